@@ -41,6 +41,16 @@ func (lp LayoutPosition) String() string {
 	}
 }
 
+// ParseLayoutPosition parses string representation of LayoutPosition.
+func ParseLayoutPosition(s string) (LayoutPosition, error) {
+	for _, lp := range []LayoutPosition{ENDNODE, STANDALONE, GATEWAY} {
+		if s == lp.String() {
+			return lp, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid layout position: %q", s)
+}
+
 // OnboardGatewayRequest for requesting Gateway Onboard.
 type OnboardGatewayRequest struct {
 	VendorThingID   string                 `json:"vendorThingID"`
@@ -251,6 +261,13 @@ type ListEndNodesResponse struct {
 	NextPaginationKey string    `json:"nextPaginationKey"`
 }
 
+// EndNodeStatus represents relationship and connection status of end-node
+type EndNodeStatus struct {
+	EndNode
+	GatewayID string
+	Online    bool
+}
+
 // ListRequest consist of parameters when request list of
 // data(like end-nodes) from Kii Cloud
 type ListRequest struct {
@@ -265,6 +282,13 @@ type CreateObjectResponse struct {
 	DataType string `json:"dataType"`
 }
 
+// ObjectBodyRange is a range of body of object which is downloaded.
+type ObjectBodyRange struct {
+	Offset    int64
+	Body      []byte
+	TotalSize int64
+}
+
 // ListObjectsResponse for receiving response of list object request
 type ListObjectsResponse struct {
 	Results           []map[string]interface{}
@@ -333,6 +357,25 @@ type QueryThingsResponse struct {
 	NextPaginationKey string        `json:"nextPaginationKey"`
 }
 
+// QueryTypedThingsResponse represents response of querying things as Thing
+type QueryTypedThingsResponse struct {
+	Results           []Thing `json:"results"`
+	NextPaginationKey string  `json:"nextPaginationKey"`
+}
+
+// ThingOwnersResponse represents owners of a thing.
+type ThingOwnersResponse struct {
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+}
+
+// ThingOwnershipRequestResponse represents response of requesting ownership
+// of a thing.  Code is PIN which should be confirmed by the requester.
+type ThingOwnershipRequestResponse struct {
+	Code      string `json:"code"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
 // Clause for query
 type Clause map[string]interface{}
 
@@ -3,12 +3,12 @@ package kii
 import (
 	"fmt"
 	"testing"
-	"time"
 
 	"github.com/koron/go-dproxy"
 )
 
 func TestAnonymousLogin(t *testing.T) {
+	defer useCassette(t)()
 
 	author, err := AnonymousLogin(testApp)
 	if err != nil {
@@ -20,6 +20,7 @@ func TestAnonymousLogin(t *testing.T) {
 }
 
 func TestGatewayOnboard(t *testing.T) {
+	defer useCassette(t)()
 	author, err := AnonymousLogin(testApp)
 	if err != nil {
 		t.Errorf("got error on anonymous login %s", err)
@@ -72,6 +73,7 @@ func TestGatewayOnboard(t *testing.T) {
 }
 
 func TestGenerateEndNodeTokenSuccess(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -94,6 +96,7 @@ func TestGenerateEndNodeTokenSuccess(t *testing.T) {
 	}
 }
 func TestGenerateEndNodeTokenFail(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -109,12 +112,13 @@ func TestGenerateEndNodeTokenFail(t *testing.T) {
 }
 
 func TestRegisterEndNodeSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author, err := AnonymousLogin(testApp)
 	if err != nil {
 		t.Errorf("anonymouseLogin fail:%s", err)
 	}
 
-	VendorThingID := fmt.Sprintf("dummyID%d", time.Now().UnixNano())
+	VendorThingID := uniqueID("dummyID")
 	type MyRegisterThingRequest struct {
 		RegisterThingRequest
 		MyCustomString string                 `json:"myCustomString"`
@@ -157,6 +161,7 @@ func TestRegisterEndNodeSuccess(t *testing.T) {
 }
 
 func TestRegisterEndNodeFail(t *testing.T) {
+	defer useCassette(t)()
 	author, err := AnonymousLogin(testApp)
 	if err != nil {
 		t.Errorf("anonymouseLogin fail:%s", err)
@@ -178,6 +183,7 @@ func TestRegisterEndNodeFail(t *testing.T) {
 }
 
 func TestAddEndNodeSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -194,6 +200,7 @@ func TestAddEndNodeSuccess(t *testing.T) {
 }
 
 func TestAddEndNodeFail(t *testing.T) {
+	defer useCassette(t)()
 
 	author, gatewayID, err := GatewayOnboard()
 	if err != nil {
@@ -206,6 +213,7 @@ func TestAddEndNodeFail(t *testing.T) {
 }
 
 func TestEndNodeStateSuccess(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -264,6 +272,7 @@ func TestEndNodeStateSuccess(t *testing.T) {
 }
 
 func TestEndNodeStateFail(t *testing.T) {
+	defer useCassette(t)()
 	endNodeAuthor := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -287,12 +296,13 @@ func TestEndNodeStateFail(t *testing.T) {
 }
 
 func TestRegisterAndLoginKiiUserSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "",
 		App:   testApp,
 	}
 
-	userName := fmt.Sprintf("user%d", time.Now().UnixNano())
+	userName := uniqueID("user")
 	requestObj := UserRegisterRequest{
 		LoginName: userName,
 		Password:  "dummyPassword",
@@ -317,6 +327,7 @@ func TestRegisterAndLoginKiiUserSuccess(t *testing.T) {
 }
 
 func TestRegisterKiiUserFail(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "",
 		App:   testApp,
@@ -335,6 +346,7 @@ func TestRegisterKiiUserFail(t *testing.T) {
 }
 
 func TestLoginAsKiiUserFail(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "",
 		App:   testApp,
@@ -357,6 +369,7 @@ func TestLoginAsKiiUserFail(t *testing.T) {
 }
 
 func TestPostCommandSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
 		t.Errorf("fail to get login user")
@@ -397,6 +410,7 @@ func TestPostCommandSuccess(t *testing.T) {
 }
 
 func TestPostCommandFail(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -425,6 +439,7 @@ func TestPostCommandFail(t *testing.T) {
 }
 
 func TestUpdateCommandResultsSuccess(t *testing.T) {
+	defer useCassette(t)()
 
 	// Post command by endnode owner
 	author, userID, err := GetLoginKiiUser()
@@ -501,6 +516,7 @@ func TestUpdateCommandResultsSuccess(t *testing.T) {
 }
 
 func TestUpdateCommandResultsFail(t *testing.T) {
+	defer useCassette(t)()
 	// endnode update Command results
 	endnodeAuthor := APIAuthor{
 		Token: "dummyToken",
@@ -523,6 +539,7 @@ func TestUpdateCommandResultsFail(t *testing.T) {
 }
 
 func TestOnboardThingByOwnerSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
 		t.Errorf("fail to get login user")
@@ -571,6 +588,7 @@ func TestOnboardThingByOwnerSuccess(t *testing.T) {
 	}
 }
 func TestOnboardThingByOwnerFail(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -591,6 +609,7 @@ func TestOnboardThingByOwnerFail(t *testing.T) {
 }
 
 func TestOnboardEndNodeWithGatewayIDSuccess(t *testing.T) {
+	defer useCassette(t)()
 	// get a login user
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
@@ -635,6 +654,7 @@ func TestOnboardEndNodeWithGatewayIDSuccess(t *testing.T) {
 }
 
 func TestOnboardEndNodeWithGatewayIDFail(t *testing.T) {
+	defer useCassette(t)()
 	// get a login user
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
@@ -661,6 +681,7 @@ func TestOnboardEndNodeWithGatewayIDFail(t *testing.T) {
 }
 
 func TestOnboardEndNodeWithGatewayVendorIDSuccess(t *testing.T) {
+	defer useCassette(t)()
 	// get a login user
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
@@ -705,6 +726,7 @@ func TestOnboardEndNodeWithGatewayVendorIDSuccess(t *testing.T) {
 }
 
 func TestListEndnodeSuccess(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -760,6 +782,7 @@ func TestListEndnodeSuccess(t *testing.T) {
 }
 
 func TestListEndnodeFail(t *testing.T) {
+	defer useCassette(t)()
 	// dummy gateway
 	gwAuthor := APIAuthor{
 		Token: "dummyToken",
@@ -776,7 +799,8 @@ func TestListEndnodeFail(t *testing.T) {
 }
 
 func TestCreateThingScopeObjectSuccess(t *testing.T) {
-	thingBucket := fmt.Sprintf("myBucket%d", time.Now().UnixNano())
+	defer useCassette(t)()
+	thingBucket := uniqueID("myBucket")
 
 	au, gwID, err := GatewayOnboard()
 	if err != nil {
@@ -841,7 +865,8 @@ func TestCreateThingScopeObjectSuccess(t *testing.T) {
 }
 
 func TestQueryObjectSuccess(t *testing.T) {
-	thingBucket := fmt.Sprintf("myBucket%d", time.Now().UnixNano())
+	defer useCassette(t)()
+	thingBucket := uniqueID("myBucket")
 
 	au, gwID, err := GatewayOnboard()
 	if err != nil {
@@ -898,6 +923,7 @@ func TestQueryObjectSuccess(t *testing.T) {
 	}
 }
 func TestCreateThingScopeObjectFail(t *testing.T) {
+	defer useCassette(t)()
 
 	// dummy gateway
 	au := APIAuthor{
@@ -920,6 +946,7 @@ func TestCreateThingScopeObjectFail(t *testing.T) {
 }
 
 func TestListAllThingScopeObjectsFail(t *testing.T) {
+	defer useCassette(t)()
 
 	// dummy gateway
 	au := APIAuthor{
@@ -938,6 +965,7 @@ func TestListAllThingScopeObjectsFail(t *testing.T) {
 }
 
 func TestDeleteThingScopeBucketFail(t *testing.T) {
+	defer useCassette(t)()
 	// dummy gateway
 	au := APIAuthor{
 		Token: "dummyToken",
@@ -960,6 +988,7 @@ func TestDeleteThingScopeBucketFail(t *testing.T) {
 }
 
 func TestQueryObjectsFail(t *testing.T) {
+	defer useCassette(t)()
 
 	// dummy gateway
 	au := APIAuthor{
@@ -991,12 +1020,13 @@ func TestQueryObjectsFail(t *testing.T) {
 }
 
 func TestUpdateVendorThingIDSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
 		t.Error("fail to get login user", err)
 	}
 
-	newVid := fmt.Sprintf("newVID%d", time.Now().UnixNano())
+	newVid := uniqueID("newVID")
 	thingID, err := RegisterAnEndNode(author)
 	if err != nil {
 		t.Error("should not fail to register thing", err)
@@ -1039,6 +1069,7 @@ func TestUpdateVendorThingIDSuccess(t *testing.T) {
 }
 
 func TestUpdateVendorThingIDFail(t *testing.T) {
+	defer useCassette(t)()
 
 	au := APIAuthor{
 		Token: "dummyToken",
@@ -1054,6 +1085,7 @@ func TestUpdateVendorThingIDFail(t *testing.T) {
 }
 
 func TestGetThingFail(t *testing.T) {
+	defer useCassette(t)()
 	au := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -1068,6 +1100,7 @@ func TestGetThingFail(t *testing.T) {
 }
 
 func TestDeleteThingFail(t *testing.T) {
+	defer useCassette(t)()
 	au := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -1078,11 +1111,12 @@ func TestDeleteThingFail(t *testing.T) {
 	}
 }
 func TestResetThingPasswordSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author, err := AdminLogin(testApp, clientID, clientSecret)
 	if err != nil {
 		t.Errorf("anonymouseLogin fail:%s", err)
 	}
-	vid := fmt.Sprintf("dummyID%d", time.Now().UnixNano())
+	vid := uniqueID("dummyID")
 	req := RegisterThingRequest{
 		VendorThingID:  vid,
 		ThingPassword:  "dummyPass",
@@ -1106,6 +1140,7 @@ func TestResetThingPasswordSuccess(t *testing.T) {
 }
 
 func TestResetThingPasswordFail(t *testing.T) {
+	defer useCassette(t)()
 	au := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -1,12 +1,14 @@
 package kii
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 
 	dproxy "github.com/koron/go-dproxy"
 )
@@ -91,6 +93,86 @@ func (a APIAuthor) AddEndNode(gatewayID string, endnodeID string) error {
 	return nil
 }
 
+// RemoveEndNode removes an end node thing from gateway.
+// Notes that the end node thing itself is not deleted.
+func (a APIAuthor) RemoveEndNode(gatewayID string, endnodeID string) error {
+	path := fmt.Sprintf("/things/%s/end-nodes/%s", gatewayID, endnodeID)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetEndNode gets relationship and connection status of an end node of
+// gateway.  When the end node doesn't belong to the gateway, CloudError with
+// HTTPStatus 404 is returned.
+func (a APIAuthor) GetEndNode(gatewayID string, endnodeID string) (*EndNodeStatus, error) {
+	path := fmt.Sprintf("/things/%s/end-nodes/%s", gatewayID, endnodeID)
+	req, err := a.newRequest("GET", a.App.CloudURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	ret := EndNodeStatus{GatewayID: gatewayID}
+	if len(bodyStr) > 0 {
+		if err := json.Unmarshal(bodyStr, &ret.EndNode); err != nil {
+			return nil, err
+		}
+	}
+	if ret.ThingID == "" {
+		ret.ThingID = endnodeID
+	}
+
+	req, err = a.newRequest("GET", a.App.ThingIFURL(path+"/connection"), nil)
+	if err != nil {
+		return nil, err
+	}
+	bodyStr, err = executeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var conn ReportEndnodeStatusRequest
+	if len(bodyStr) > 0 {
+		if err := json.Unmarshal(bodyStr, &conn); err != nil {
+			return nil, err
+		}
+	}
+	ret.Online = conn.Online
+	return &ret, nil
+}
+
+// MoveEndNode moves an end node from a gateway to another gateway.  When
+// adding to the new gateway fails, the end node is added back to the old
+// gateway.
+// Notes that the APIAuthor should be able to manage both gateways, like
+// owner of them.
+func (a APIAuthor) MoveEndNode(fromGatewayID, toGatewayID, endnodeID string) error {
+	if fromGatewayID == toGatewayID {
+		return errors.New("gateways must be different")
+	}
+	if err := a.RemoveEndNode(fromGatewayID, endnodeID); err != nil {
+		return err
+	}
+	if err := a.AddEndNode(toGatewayID, endnodeID); err != nil {
+		if rerr := a.AddEndNode(fromGatewayID, endnodeID); rerr != nil {
+			return fmt.Errorf("failed to add end node %s to %s: %s, and failed to roll back to %s: %s",
+				endnodeID, toGatewayID, err, fromGatewayID, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
 // RegisterThing registers a Thing on Kii Cloud.
 // The request must consist of the predefined fields(see RegisterThingRequest).
 // If you want to add the custom fileds, you can simply make RegisterThingRequest as anonymous field of your defined request struct, like:
@@ -98,9 +180,14 @@ func (a APIAuthor) AddEndNode(gatewayID string, endnodeID string) error {
 //    RegisterThingRequest
 //    MyField1             string
 //  }
+// Otherwise the request must supply "_vendorThingID" and "_password".  Custom
+// fields must not use reserved keys prefixed by "_", and "_layoutPosition"
+// must be one of LayoutPosition.
 // Where there is no error, RegisterThingResponse is returned
 func (a APIAuthor) RegisterThing(request interface{}) (*RegisterThingResponse, error) {
-	// TODO: should be checked that request contains RegisterThingResponse.
+	if err := validateRegisterThingRequest(request); err != nil {
+		return nil, err
+	}
 
 	url := a.App.CloudURL("/things")
 	req, err := a.App.newRequest("POST", url, request)
@@ -550,6 +637,27 @@ func (a APIAuthor) GetThing(thingID string) (interface{}, error) {
 	return obj, nil
 }
 
+// GetTypedThing gets thing info as Thing.
+func (a APIAuthor) GetTypedThing(thingID string) (*Thing, error) {
+	path := fmt.Sprintf("/things/%s", thingID)
+	url := a.App.CloudURL(path)
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret Thing
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
 // UpdateThing update thing properites.
 func (a APIAuthor) UpdateThing(thingID string, data map[string]interface{}) error {
 	path := fmt.Sprintf("/things/%s", thingID)
@@ -566,6 +674,13 @@ func (a APIAuthor) UpdateThing(thingID string, data map[string]interface{}) erro
 	return nil
 }
 
+// UpdateTypedThing updates thing properties with Thing.  Non-zero writable
+// predefined fields and Properties are updated.  Read-only fields like
+// ThingID, VendorThingID, Created or Online are ignored.
+func (a APIAuthor) UpdateTypedThing(thingID string, thing *Thing) error {
+	return a.UpdateThing(thingID, thing.fieldMap(true))
+}
+
 // DeleteThing delete an exsiting Thing
 func (a APIAuthor) DeleteThing(thingID string) error {
 	path := fmt.Sprintf("/things/%s", thingID)
@@ -639,6 +754,54 @@ func (a APIAuthor) UpdateTraitState(thingID string, alias string, request interf
 	return nil
 }
 
+// GetTraitDefinition gets definition of a trait with version.
+func (a APIAuthor) GetTraitDefinition(trait string, version int) (*TraitDefinition, error) {
+	path := fmt.Sprintf("/traits/%s/versions/%d", trait, version)
+	url := a.App.ThingIFURL(path)
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var ret TraitDefinition
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
+	if ret.Trait == "" {
+		ret.Trait = trait
+	}
+	if ret.Version == 0 {
+		ret.Version = version
+	}
+	return &ret, nil
+}
+
+// GetTraitAliases gets aliases defined for thingType and firmwareVersion.
+func (a APIAuthor) GetTraitAliases(thingType, firmwareVersion string) (map[string]TraitAlias, error) {
+	path := fmt.Sprintf("/configuration/thing-types/%s/firmware-versions/%s/aliases", thingType, firmwareVersion)
+	url := a.App.ThingIFURL(path)
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var ret struct {
+		Aliases map[string]TraitAlias `json:"aliases"`
+	}
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
+	return ret.Aliases, nil
+}
+
 //InstallMqtt a MQTT installation to the Kii cloud for current logged in user.
 func (a APIAuthor) InstallMqtt(development bool) (installationID string, err error) {
 	url := a.App.CloudURL("/installations")
@@ -743,6 +906,84 @@ func (a APIAuthor) DeleteObject(bucket Bucket, objectID string) error {
 	return nil
 }
 
+// QueryBucketObjects queries kii objects in bucket.
+func (a APIAuthor) QueryBucketObjects(bucket Bucket, request QueryObjectsRequest) (*QueryObjectResponse, error) {
+	url := a.App.CloudURL(bucket.Path() + "/query")
+	req, err := a.newRequest("POST", url, request)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kii.QueryRequest+json")
+
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret QueryObjectResponse
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// UploadObjectBody uploads body of a kii object.
+func (a APIAuthor) UploadObjectBody(bucket Bucket, objectID, contentType string, body []byte) error {
+	path := fmt.Sprintf("%s/objects/%s/body", bucket.Path(), objectID)
+	url := a.App.CloudURL(path)
+	req, err := newRawRequest("PUT", url, contentType, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	_, err = executeRequest(req)
+	return err
+}
+
+// DownloadObjectBody downloads a range of body of a kii object, which
+// starts at offset.  When length is zero or negative, the rest of body is
+// downloaded.  The download is aborted when ctx is done.
+func (a APIAuthor) DownloadObjectBody(ctx context.Context, bucket Bucket, objectID string, offset, length int64) (*ObjectBodyRange, error) {
+	path := fmt.Sprintf("%s/objects/%s/body", bucket.Path(), objectID)
+	url := a.App.CloudURL(path)
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Request = req.Request.WithContext(ctx)
+	req.Header.Set("Accept", "*/*")
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, b, err := doRequest(req, 200, 300)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ObjectBodyRange{Offset: offset, Body: b, TotalSize: int64(len(b))}
+	if resp.StatusCode != 206 {
+		// server doesn't support range, returns whole body.
+		if offset > int64(len(b)) {
+			offset = int64(len(b))
+		}
+		ret.Body = b[offset:]
+		if length > 0 && length < int64(len(ret.Body)) {
+			ret.Body = ret.Body[:length]
+		}
+		return ret, nil
+	}
+	// Content-Range: bytes 0-99/1234
+	cr := resp.Header.Get("Content-Range")
+	var first, last int64
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &first, &last, &ret.TotalSize); err != nil {
+		return nil, fmt.Errorf("unexpected Content-Range: %q", cr)
+	}
+	ret.Offset = first
+	return ret, nil
+}
+
 //DeleteBucket deletes bucket
 func (a APIAuthor) DeleteBucket(bucket Bucket) error {
 	url := a.App.CloudURL(bucket.Path())
@@ -761,6 +1002,32 @@ func (a APIAuthor) DeleteBucket(bucket Bucket) error {
 
 //QueryThings query things owned by user
 func (a APIAuthor) QueryThings(request ThingQueryRequest) (*QueryThingsResponse, error) {
+	bodyStr, err := a.queryThings(request)
+	if err != nil {
+		return nil, err
+	}
+	var ret QueryThingsResponse
+	err = json.Unmarshal(bodyStr, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// QueryTypedThings query things owned by user, results are returned as Thing.
+func (a APIAuthor) QueryTypedThings(request ThingQueryRequest) (*QueryTypedThingsResponse, error) {
+	bodyStr, err := a.queryThings(request)
+	if err != nil {
+		return nil, err
+	}
+	var ret QueryTypedThingsResponse
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (a APIAuthor) queryThings(request ThingQueryRequest) ([]byte, error) {
 	if request.OwnerID == "" {
 		return nil, errors.New("OwnerID must not be empty")
 	}
@@ -795,32 +1062,287 @@ func (a APIAuthor) QueryThings(request ThingQueryRequest) (*QueryThingsResponse,
 	}
 	req.Header.Set("Content-Type", "application/vnd.kii.ThingQueryRequest+json")
 
+	return executeRequest(req)
+}
+
+// ResetThingPassword reset password of existing thing.
+func (a APIAuthor) ResetThingPassword(thingID, newPassword string) error {
+	path := fmt.Sprintf("/things/%s/password", thingID)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("PUT", url, map[string]string{
+		"newPassword": newPassword,
+	})
+	if err != nil {
+		return err
+	}
+	// a.newRequest() don't set Content-Type for nil body. So we must set it
+	// explicitly.
+	req.Header.Set("Content-Type", "application/vnd.kii.ChangeThingPasswordRequest+json")
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkOwner checks that owner is in format of "user:<user-id>" or
+// "group:<group-id>".
+func checkOwner(owner string) error {
+	for _, prefix := range []string{"user:", "group:"} {
+		if strings.HasPrefix(owner, prefix) && len(owner) > len(prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("owner must be \"user:<user-id>\" or \"group:<group-id>\": %q", owner)
+}
+
+// AddThingOwner adds an owner to thing.
+// owner must be "user:<user-id>" or "group:<group-id>".
+func (a APIAuthor) AddThingOwner(thingID, owner string) error {
+	if err := checkOwner(owner); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/things/%s/ownership/%s", thingID, owner)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("PUT", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveThingOwner removes an owner from thing.
+// owner must be "user:<user-id>" or "group:<group-id>".
+func (a APIAuthor) RemoveThingOwner(thingID, owner string) error {
+	if err := checkOwner(owner); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/things/%s/ownership/%s", thingID, owner)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsThingOwner checks whether owner owns thing.
+// owner must be "user:<user-id>" or "group:<group-id>".
+func (a APIAuthor) IsThingOwner(thingID, owner string) (bool, error) {
+	if err := checkOwner(owner); err != nil {
+		return false, err
+	}
+	path := fmt.Sprintf("/things/%s/ownership/%s", thingID, owner)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("HEAD", url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := executeRequest(req); err != nil {
+		if ce, ok := err.(*CloudError); ok && ce.HTTPStatus == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ListThingOwners lists user and group owners of thing.
+func (a APIAuthor) ListThingOwners(thingID string) (*ThingOwnersResponse, error) {
+	path := fmt.Sprintf("/things/%s/ownership", thingID)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	bodyStr, err := executeRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	var ret QueryThingsResponse
-	err = json.Unmarshal(bodyStr, &ret)
+	var ret ThingOwnersResponse
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// RequestThingOwnership requests ownership of thing for owner.  The returned
+// PIN code should be passed to owner out of band, like displayed on the
+// device, then confirmed with ConfirmThingOwnership.
+// owner must be "user:<user-id>" or "group:<group-id>".
+func (a APIAuthor) RequestThingOwnership(thingID, owner string) (*ThingOwnershipRequestResponse, error) {
+	if err := checkOwner(owner); err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("/things/%s/ownership/request/%s", thingID, owner)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("POST", url, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kii.ThingOwnershipRequest+json")
+
+	bodyStr, err := executeRequest(req)
 	if err != nil {
 		return nil, err
 	}
+	var ret ThingOwnershipRequestResponse
+	if err := json.Unmarshal(bodyStr, &ret); err != nil {
+		return nil, err
+	}
 	return &ret, nil
 }
 
-// ResetThingPassword reset password of existing thing.
-func (a APIAuthor) ResetThingPassword(thingID, newPassword string) error {
-	path := fmt.Sprintf("/things/%s/password", thingID)
+// ConfirmThingOwnership confirms ownership request with PIN code which is
+// issued by RequestThingOwnership.  When confirmed, owner is added to owners
+// of thing.
+func (a APIAuthor) ConfirmThingOwnership(thingID, owner, code string) error {
+	if err := checkOwner(owner); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/things/%s/ownership/confirm/%s", thingID, owner)
+	url := a.App.CloudURL(path)
+
+	req, err := a.newRequest("POST", url, map[string]string{
+		"code": code,
+	})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kii.ThingOwnershipConfirmationRequest+json")
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DisableThing disables thing.  Disabled thing can't access to Kii Cloud.
+func (a APIAuthor) DisableThing(thingID string) error {
+	return a.updateThingStatus(thingID, "disable")
+}
+
+// EnableThing enables disabled thing.
+func (a APIAuthor) EnableThing(thingID string) error {
+	return a.updateThingStatus(thingID, "enable")
+}
+
+func (a APIAuthor) updateThingStatus(thingID, status string) error {
+	path := fmt.Sprintf("/things/%s/status/%s", thingID, status)
 	url := a.App.CloudURL(path)
 
+	req, err := a.newRequest("PUT", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetFirmwareVersion gets firmware version of thing through Thing-IF.
+func (a APIAuthor) GetFirmwareVersion(thingID string) (string, error) {
+	path := fmt.Sprintf("/things/%s/firmware-version", thingID)
+	url := a.App.ThingIFURL(path)
+
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var ret struct {
+		FirmwareVersion string `json:"firmwareVersion"`
+	}
+	if len(bodyStr) > 0 {
+		if err := json.Unmarshal(bodyStr, &ret); err != nil {
+			return "", err
+		}
+	}
+	return ret.FirmwareVersion, nil
+}
+
+// UpdateFirmwareVersion updates firmware version of thing through Thing-IF.
+// Traits which apply to the thing are switched to ones defined for new
+// firmware version.
+func (a APIAuthor) UpdateFirmwareVersion(thingID, firmwareVersion string) error {
+	path := fmt.Sprintf("/things/%s/firmware-version", thingID)
+	url := a.App.ThingIFURL(path)
+
 	req, err := a.newRequest("PUT", url, map[string]string{
-		"newPassword": newPassword,
+		"firmwareVersion": firmwareVersion,
 	})
 	if err != nil {
 		return err
 	}
-	// a.newRequest() don't set Content-Type for nil body. So we must set it
-	// explicitly.
-	req.Header.Set("Content-Type", "application/vnd.kii.ChangeThingPasswordRequest+json")
+	req.Header.Set("Content-Type", "application/vnd.kii.ThingFirmwareVersionUpdateRequest+json")
+
+	if _, err := executeRequest(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetThingType gets thing type of thing through Thing-IF.
+func (a APIAuthor) GetThingType(thingID string) (string, error) {
+	path := fmt.Sprintf("/things/%s/thing-type", thingID)
+	url := a.App.ThingIFURL(path)
+
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	bodyStr, err := executeRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var ret struct {
+		ThingType string `json:"thingType"`
+	}
+	if len(bodyStr) > 0 {
+		if err := json.Unmarshal(bodyStr, &ret); err != nil {
+			return "", err
+		}
+	}
+	return ret.ThingType, nil
+}
+
+// UpdateThingType updates thing type of thing through Thing-IF.
+// Traits which apply to the thing are switched to ones defined for new thing
+// type.
+func (a APIAuthor) UpdateThingType(thingID, thingType string) error {
+	path := fmt.Sprintf("/things/%s/thing-type", thingID)
+	url := a.App.ThingIFURL(path)
+
+	req, err := a.newRequest("PUT", url, map[string]string{
+		"thingType": thingType,
+	})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kii.ThingTypeUpdateRequest+json")
 
 	if _, err := executeRequest(req); err != nil {
 		return err
@@ -0,0 +1,105 @@
+package kii
+
+import (
+	"testing"
+)
+
+func TestRemoveEndNodeSuccess(t *testing.T) {
+	defer useCassette(t)()
+	author, gatewayID, err := GatewayOnboard()
+	if err != nil {
+		t.Fatalf("got error on onboard gateway %s", err)
+	}
+	endNodeID, err := RegisterAnEndNode(author)
+	if err != nil {
+		t.Fatalf("got error when register an end node %s", err)
+	}
+	if err := author.AddEndNode(*gatewayID, endNodeID); err != nil {
+		t.Fatalf("got error when add end node %s", err)
+	}
+
+	status, err := author.GetEndNode(*gatewayID, endNodeID)
+	if err != nil {
+		t.Errorf("got error when get end node %s", err)
+	} else if status.ThingID != endNodeID || status.GatewayID != *gatewayID || status.Online {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if err := author.RemoveEndNode(*gatewayID, endNodeID); err != nil {
+		t.Errorf("got error when remove end node %s", err)
+	}
+	_, err = author.GetEndNode(*gatewayID, endNodeID)
+	if ce, ok := err.(*CloudError); !ok || ce.HTTPStatus != 404 {
+		t.Errorf("removed end node should not be found: %v", err)
+	}
+}
+
+func TestMoveEndNodeSuccess(t *testing.T) {
+	defer useCassette(t)()
+	author, userID, err := GetLoginKiiUser()
+	if err != nil {
+		t.Fatalf("fail to get login user")
+	}
+	var gatewayIDs []string
+	for i := 0; i < 2; i++ {
+		_, gwid, err := OnboardAGateway(uniqueID("gwID"), "dummyPass")
+		if err != nil {
+			t.Fatalf("fail to onboard gateway:%s", err)
+		}
+		_, err = author.OnboardThingByOwner(OnboardByOwnerRequest{
+			ThingID:       *gwid,
+			Owner:         "user:" + userID,
+			ThingPassword: "dummyPass",
+		})
+		if err != nil {
+			t.Fatalf("fail to onboard gateway by login user:%s", err)
+		}
+		gatewayIDs = append(gatewayIDs, *gwid)
+	}
+	resp, err := author.OnboardEndnodeWithGatewayThingID(OnboardEndnodeWithGatewayThingIDRequest{
+		GatewayThingID: gatewayIDs[0],
+		OnboardEndnodeRequestCommon: OnboardEndnodeRequestCommon{
+			EndNodeVendorThingID: uniqueID("dummyID"),
+			EndNodePassword:      "dummyPass",
+			Owner:                "user:" + userID,
+		},
+	})
+	if err != nil {
+		t.Fatalf("onboard endnode with gateway id fail: %s ", err)
+	}
+
+	if err := author.MoveEndNode(gatewayIDs[0], gatewayIDs[1], resp.EndNodeThingID); err != nil {
+		t.Errorf("fail to move end node: %s", err)
+	}
+	if _, err := author.GetEndNode(gatewayIDs[1], resp.EndNodeThingID); err != nil {
+		t.Errorf("end node should belong to new gateway: %s", err)
+	}
+	if _, err := author.GetEndNode(gatewayIDs[0], resp.EndNodeThingID); err == nil {
+		t.Errorf("end node should not belong to old gateway")
+	}
+
+	// moving to not existing gateway is rolled back.
+	if err := author.MoveEndNode(gatewayIDs[1], "th.notexistThing", resp.EndNodeThingID); err == nil {
+		t.Errorf("should fail")
+	}
+	if _, err := author.GetEndNode(gatewayIDs[1], resp.EndNodeThingID); err != nil {
+		t.Errorf("end node should be rolled back: %s", err)
+	}
+}
+
+func TestRemoveEndNodeFail(t *testing.T) {
+	defer useCassette(t)()
+	au := APIAuthor{
+		Token: "dummyToken",
+		App:   testApp,
+	}
+	if err := au.RemoveEndNode("dummyGWID", "dummyEnID"); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := au.GetEndNode("dummyGWID", "dummyEnID"); err == nil {
+		t.Error("should fail")
+	}
+	if err := au.MoveEndNode("dummyGWID", "dummyGWID", "dummyEnID"); err == nil {
+		t.Error("should fail")
+	}
+}
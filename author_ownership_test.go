@@ -0,0 +1,77 @@
+package kii
+
+import (
+	"testing"
+)
+
+func TestThingOwnershipSuccess(t *testing.T) {
+	defer useCassette(t)()
+	author, userID, err := GetLoginKiiUser()
+	if err != nil {
+		t.Fatalf("fail to get login user: %s", err)
+	}
+
+	gwvid := uniqueID("gwID")
+	_, gwid, err := OnboardAGateway(gwvid, "dummyPass")
+	if err != nil {
+		t.Fatalf("fail to onboard gateway:%s", err)
+	}
+	oboreq := OnboardByOwnerRequest{
+		ThingID:       *gwid,
+		Owner:         "user:" + userID,
+		ThingPassword: "dummyPass",
+	}
+	if _, err := author.OnboardThingByOwner(oboreq); err != nil {
+		t.Fatalf("fail to onboard gateway by login user:%s", err)
+	}
+
+	owner := "user:" + userID
+	isOwner, err := author.IsThingOwner(*gwid, owner)
+	if err != nil || !isOwner {
+		t.Errorf("user should be owner: %v", err)
+	}
+	owners, err := author.ListThingOwners(*gwid)
+	if err != nil {
+		t.Errorf("fail to list owners: %s", err)
+	} else if len(owners.Users) != 1 || owners.Users[0] != userID {
+		t.Errorf("unexpected owners: %+v", owners)
+	}
+
+	if err := author.RemoveThingOwner(*gwid, owner); err != nil {
+		t.Errorf("fail to remove owner: %s", err)
+	}
+	isOwner, err = author.IsThingOwner(*gwid, owner)
+	if err != nil || isOwner {
+		t.Errorf("user should not be owner: %v", err)
+	}
+}
+
+func TestThingOwnershipFail(t *testing.T) {
+	defer useCassette(t)()
+	au := APIAuthor{
+		Token: "dummyToken",
+		App:   testApp,
+	}
+	if err := au.AddThingOwner("dummyThing", "user:dummyUser"); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := au.ListThingOwners("dummyThing"); err == nil {
+		t.Error("should fail")
+	}
+	if err := au.ConfirmThingOwnership("dummyThing", "user:dummyUser", "0000"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestCheckOwner(t *testing.T) {
+	for _, owner := range []string{"user:abc", "group:abc"} {
+		if err := checkOwner(owner); err != nil {
+			t.Errorf("%s should be valid: %s", owner, err)
+		}
+	}
+	for _, owner := range []string{"", "abc", "user:", "thing:abc"} {
+		if err := checkOwner(owner); err == nil {
+			t.Errorf("%s should be invalid", owner)
+		}
+	}
+}
@@ -1,19 +1,18 @@
 package kii
 
 import (
-	"fmt"
 	"testing"
-	"time"
 	// dproxy "github.com/koron/go-dproxy"
 )
 
 func TestQueryThingsSuccess(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "",
 		App:   testApp,
 	}
 
-	userName := fmt.Sprintf("user%d", time.Now().UnixNano())
+	userName := uniqueID("user")
 	requestObj := UserRegisterRequest{
 		LoginName: userName,
 		Password:  "dummyPassword",
@@ -36,7 +35,7 @@ func TestQueryThingsSuccess(t *testing.T) {
 	}
 	author.Token = loginResp.AccessToken
 
-	gwvid := fmt.Sprintf("gwID%d", time.Now().UnixNano())
+	gwvid := uniqueID("gwID")
 
 	_, gwid, err := OnboardAGateway(gwvid, "dummyPass")
 	if err != nil {
@@ -157,6 +156,7 @@ func TestQueryThingsSuccess(t *testing.T) {
 }
 
 func TestQueryThingsFail(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
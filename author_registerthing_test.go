@@ -0,0 +1,86 @@
+package kii
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRegisterThingRequestSuccess(t *testing.T) {
+	type MyRegisterThingRequest struct {
+		RegisterThingRequest
+		MyCustomString string `json:"myCustomString"`
+	}
+	type FlatRequest struct {
+		VendorThingID string `json:"_vendorThingID"`
+		Password      string `json:"_password"`
+		Color         string `json:"color"`
+	}
+	predefined := RegisterThingRequest{
+		VendorThingID:  "vid",
+		ThingPassword:  "pass",
+		LayoutPosition: ENDNODE.String(),
+	}
+	for i, req := range []interface{}{
+		predefined,
+		&predefined,
+		MyRegisterThingRequest{RegisterThingRequest: predefined, MyCustomString: "str"},
+		FlatRequest{VendorThingID: "vid", Password: "pass"},
+		map[string]interface{}{"_vendorThingID": "vid", "_password": "pass", "color": "red"},
+	} {
+		if err := validateRegisterThingRequest(req); err != nil {
+			t.Errorf("request[%d] should be valid: %s", i, err)
+		}
+	}
+}
+
+func TestValidateRegisterThingRequestFail(t *testing.T) {
+	type Typo struct {
+		VendorThingID string `json:"_vendorThingId"`
+		Password      string `json:"_password"`
+	}
+	type Collision struct {
+		RegisterThingRequest
+		Type string `json:"_thingType"`
+	}
+	type ReadOnly struct {
+		RegisterThingRequest
+		Created int64 `json:"_created"`
+	}
+	predefined := RegisterThingRequest{VendorThingID: "vid", ThingPassword: "pass"}
+	for _, c := range []struct {
+		request interface{}
+		message string
+	}{
+		{nil, "must not be nil"},
+		{(*RegisterThingRequest)(nil), "must not be nil"},
+		{"vid", "must be struct or map"},
+		{RegisterThingRequest{ThingPassword: "pass"}, "_vendorThingID"},
+		{RegisterThingRequest{VendorThingID: "vid"}, "_password"},
+		{Typo{VendorThingID: "vid", Password: "pass"}, `"_vendorThingId" is reserved`},
+		{Collision{RegisterThingRequest: predefined}, "collides"},
+		{ReadOnly{RegisterThingRequest: predefined}, `"_created" is reserved`},
+		{map[string]interface{}{"_vendorThingID": "vid", "_password": "pass", "_online": true}, "reserved"},
+		{RegisterThingRequest{VendorThingID: "vid", ThingPassword: "pass", LayoutPosition: "ENDNODE"}, "layout position"},
+	} {
+		err := validateRegisterThingRequest(c.request)
+		if err == nil {
+			t.Errorf("%#v should be invalid", c.request)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.message) {
+			t.Errorf("error for %#v should contain %q: %s", c.request, c.message, err)
+		}
+	}
+}
+
+func TestParseLayoutPosition(t *testing.T) {
+	for _, lp := range []LayoutPosition{ENDNODE, STANDALONE, GATEWAY} {
+		actual, err := ParseLayoutPosition(lp.String())
+		if err != nil || actual != lp {
+			t.Errorf("failed to parse %s: %v", lp, err)
+		}
+	}
+	if _, err := ParseLayoutPosition("UNKNOWN"); err == nil {
+		t.Error("should fail")
+	}
+}
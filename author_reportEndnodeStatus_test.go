@@ -7,6 +7,7 @@ import (
 )
 
 func TestReportEndnodeStatusSuccess(t *testing.T) {
+	defer useCassette(t)()
 	// get a login user
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
@@ -80,6 +81,7 @@ func TestReportEndnodeStatusSuccess(t *testing.T) {
 }
 
 func TestReportEndnodeStatusFail(t *testing.T) {
+	defer useCassette(t)()
 	au := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
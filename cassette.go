@@ -0,0 +1,254 @@
+package kii
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// CassetteMode is mode of Cassette.
+type CassetteMode int
+
+const (
+	// CassetteReplay serves recorded exchanges without network.
+	CassetteReplay CassetteMode = iota
+	// CassetteRecord sends requests to Kii Cloud, and records exchanges.
+	CassetteRecord
+)
+
+// Cassette is a http.RoundTripper which records exchanges with Kii Cloud
+// to a file, and replays them in tests without cloud credentials.
+//
+// Secrets are scrubbed from recorded headers and bodies as logs of
+// requests.  Requests are matched by method, path, query and normalized
+// body, so tests must send the same requests on replay, and IDs in them must
+// not depend on time.  Host and the app ID in path are not matched, so any
+// App works on replay.  Unmatched requests fail with an error, and are
+// reported by Unmatched.
+//
+//	c, err := kii.NewCassette("testdata/onboard.json", kii.CassetteReplay)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	kii.SetHTTPClient(&http.Client{Transport: c})
+//	defer kii.SetHTTPClient(nil)
+type Cassette struct {
+	Path string
+	Mode CassetteMode
+
+	// Transport sends requests in record mode.  Default is
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []*CassetteInteraction
+	used         []bool
+	unmatched    []string
+}
+
+var _ http.RoundTripper = (*Cassette)(nil)
+
+// CassetteInteraction is a recorded exchange.
+type CassetteInteraction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+// CassetteRequest is a recorded request.  Body is normalized, and the app ID
+// in Path and string values of Body is replaced with "{appID}".
+type CassetteRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+// CassetteResponse is a recorded response.  Body is encoded by base64 when
+// BodyEncoding is "base64".
+type CassetteResponse struct {
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+type cassetteFile struct {
+	Interactions []*CassetteInteraction `json:"interactions"`
+}
+
+// NewCassette creates a Cassette.  In replay mode, the file at path is
+// loaded.
+func NewCassette(path string, mode CassetteMode) (*Cassette, error) {
+	c := &Cassette{Path: path, Mode: mode}
+	if mode != CassetteReplay {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f cassetteFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("broken cassette %s: %s", path, err)
+	}
+	c.interactions = f.Interactions
+	c.used = make([]bool, len(f.Interactions))
+	return c, nil
+}
+
+var cassetteAppPath = regexp.MustCompile(`/apps/([^/]+)(/|$)`)
+
+// cassetteRequestOf returns normalized and scrubbed request.
+func cassetteRequestOf(req *http.Request, body []byte) CassetteRequest {
+	r := CassetteRequest{
+		Method: req.Method,
+		Path:   cassetteAppPath.ReplaceAllString(req.URL.Path, "/apps/{appID}$2"),
+		Query:  req.URL.Query().Encode(),
+	}
+	if len(body) > 0 {
+		b := redactBody(req.Header, body)
+		if m := cassetteAppPath.FindStringSubmatch(req.URL.Path); m != nil {
+			b = bytes.Replace(b, []byte(`"`+m[1]+`"`), []byte(`"{appID}"`), -1)
+		}
+		r.Body = string(b)
+	}
+	return r
+}
+
+// RoundTrip records or replays an exchange.
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	cr := cassetteRequestOf(req, body)
+	if c.Mode == CassetteRecord {
+		return c.record(req, cr)
+	}
+	return c.replay(req, cr)
+}
+
+func (c *Cassette) record(req *http.Request, cr CassetteRequest) (*http.Response, error) {
+	t := c.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	r := CassetteResponse{Status: resp.StatusCode, Header: redactHeader(resp.Header)}
+	if len(b) > 0 {
+		if utf8.Valid(b) {
+			r.Body = string(redactBody(resp.Header, b))
+		} else {
+			r.Body = base64.StdEncoding.EncodeToString(b)
+			r.BodyEncoding = "base64"
+		}
+	}
+	c.mu.Lock()
+	c.interactions = append(c.interactions, &CassetteInteraction{Request: cr, Response: r})
+	c.used = append(c.used, true)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// replay serves the first unused interaction which matches cr.
+func (c *Cassette) replay(req *http.Request, cr CassetteRequest) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, in := range c.interactions {
+		if c.used[i] || in.Request != cr {
+			continue
+		}
+		c.used[i] = true
+		body := []byte(in.Response.Body)
+		if in.Response.BodyEncoding == "base64" {
+			b, err := base64.StdEncoding.DecodeString(in.Response.Body)
+			if err != nil {
+				return nil, err
+			}
+			body = b
+		}
+		header := in.Response.Header
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+			StatusCode:    in.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	desc := fmt.Sprintf("%s %s", cr.Method, cr.Path)
+	if cr.Query != "" {
+		desc += "?" + cr.Query
+	}
+	if cr.Body != "" {
+		desc += " body=" + cr.Body
+	}
+	c.unmatched = append(c.unmatched, desc)
+	return nil, fmt.Errorf("cassette %s has no interaction for %s", c.Path, desc)
+}
+
+// Unmatched returns requests which are not matched on replay.
+func (c *Cassette) Unmatched() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.unmatched...)
+}
+
+// Unused returns number of interactions which are not replayed.
+func (c *Cassette) Unused() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, u := range c.used {
+		if !u {
+			n++
+		}
+	}
+	return n
+}
+
+// Save writes recorded interactions to Path.  It is used in record mode.
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	f := cassetteFile{Interactions: c.interactions}
+	b, err := json.MarshalIndent(&f, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
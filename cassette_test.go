@@ -0,0 +1,77 @@
+package kii
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "onboard.json")
+
+	// record exchanges with fake cloud.
+	c := newFakeThingCloud(t)
+	rec, err := NewCassette(path, CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Transport = c.server.Client().Transport
+	SetHTTPClient(&http.Client{Transport: rec})
+	author, err := AnonymousLogin(c.App)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := author.OnboardGateway(&OnboardGatewayRequest{VendorThingID: "gw-1", ThingPassword: "secret-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+	c.Close()
+	b, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(b), "/apps/{appID}/onboardings") {
+		t.Errorf("app ID should be normalized: %s", b)
+	}
+	for _, s := range []string{"secret-pass", "fakekey", recorded.AccessToken} {
+		if strings.Contains(string(b), s) {
+			t.Errorf("%s should be scrubbed: %s", s, b)
+		}
+	}
+
+	// replay without network.
+	play, err := NewCassette(path, CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetHTTPClient(&http.Client{Transport: play})
+	defer SetHTTPClient(nil)
+	app := App{AppID: "otherapp", AppKey: "otherkey", Location: "replay.invalid"}
+	author, err = AnonymousLogin(app)
+	if err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+	replayed, err := author.OnboardGateway(&OnboardGatewayRequest{ThingPassword: "other-pass", VendorThingID: "gw-1"})
+	if err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+	if replayed.ThingID != recorded.ThingID {
+		t.Errorf("unexpected thingID: %s", replayed.ThingID)
+	}
+	if n := play.Unused(); n != 0 {
+		t.Errorf("all interactions should be used: %d", n)
+	}
+
+	// unmatched requests fail.
+	if _, err := author.OnboardGateway(&OnboardGatewayRequest{VendorThingID: "gw-2", ThingPassword: "pass"}); err == nil || !strings.Contains(err.Error(), "no interaction") {
+		t.Errorf("unmatched request should fail: %v", err)
+	}
+	if u := play.Unmatched(); len(u) != 1 || !strings.Contains(u[0], `"vendorThingID":"gw-2"`) {
+		t.Errorf("unexpected unmatched requests: %v", u)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 type contentTyper interface {
@@ -51,30 +52,60 @@ func newRequest(method, url string, body interface{}) (*request, error) {
 	}, nil
 }
 
+// newRawRequest creates http.Request with body which isn't JSON, like body
+// of objects.  The body is not logged.
+func newRawRequest(method, url, contentType string, body []byte) (*request, error) {
+	req, err := newRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.Request.ContentLength = int64(len(body))
+	req.Request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Header.Set("Content-Type", contentType)
+	return req, nil
+}
+
 func executeRequest(req *request) ([]byte, error) {
 	return executeRequest2(req, 200, 400)
 }
 
 func executeRequest2(req *request, scMin, scMax int) ([]byte, error) {
-	client := &http.Client{}
-	resp, err := client.Do(req.Request)
+	_, b, err := doRequest(req, scMin, scMax)
+	return b, err
+}
+
+// doRequest executes req, and returns response with its body.
+func doRequest(req *request, scMin, scMax int) (*http.Response, []byte, error) {
+	requestID, _ := randomHex(8)
+	start := time.Now()
+	resp, err := httpClient.Do(req.Request)
+	wait := time.Since(start)
 	if err != nil {
-		return nil, err
+		logRequestError(req.Request, requestID, wait, err)
+		recordHAR(&harExchange{req: req.Request, reqBody: req.body, requestID: requestID, start: start, wait: wait, err: err})
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	b, err := ioutil.ReadAll(resp.Body)
+	latency := time.Since(start)
 	if err != nil {
-		return nil, err
+		logRequestError(req.Request, requestID, latency, err)
+		recordHAR(&harExchange{req: req.Request, reqBody: req.body, requestID: requestID, start: start, wait: wait, receive: latency - wait, err: err})
+		return nil, nil, err
 	}
 
-	logRequest(req.Request, req.body, resp, b)
+	logRequest(req.Request, req.body, resp, b, requestID, latency)
+	recordHAR(&harExchange{req: req.Request, reqBody: req.body, resp: resp, respBody: b, requestID: requestID, start: start, wait: wait, receive: latency - wait})
 
 	if resp.StatusCode < scMin || resp.StatusCode >= scMax {
 		ce := newCloudError(resp.StatusCode, b)
-		return nil, ce
+		return nil, nil, ce
 	}
-	return b, nil
+	return resp, b, nil
 }
 
 var defaultUserAgent = "";
@@ -85,3 +116,15 @@ var defaultUserAgent = "";
 func SetDefaultUserAgent(s string) {
 	defaultUserAgent = s
 }
+
+var httpClient = &http.Client{}
+
+// SetHTTPClient sets HTTP client which is used for all requests made by
+// kii_go.  It is useful to configure timeout, proxy or TLS, or to access a
+// local server in tests.  If c is nil, default client is restored.
+func SetHTTPClient(c *http.Client) {
+	if c == nil {
+		c = &http.Client{}
+	}
+	httpClient = c
+}
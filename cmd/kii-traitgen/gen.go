@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+
+	kii "github.com/KiiPlatform/kii_go"
+)
+
+// generator writes Go code for aliases.
+type generator struct {
+	buf bytes.Buffer
+	// types holds names of generated types to detect collisions.
+	types map[string]bool
+}
+
+// binding is a trait bound to an alias, and thing types which bind it.
+type binding struct {
+	kii.TraitAlias
+	// users are "thingType firmwareVersion" which bind the trait.
+	users []string
+}
+
+// generate returns formatted Go code for all aliases in r.  When firmware
+// versions bind an alias to different traits, types are generated for each
+// of them, and named with the trait version, like "XV2State", or with the
+// trait too, like "XFooV2State", when the traits differ by name.
+func generate(pkg string, r *kii.TraitRegistry) ([]byte, error) {
+	aliases := map[string][]*binding{}
+	for _, tt := range r.ThingTypes() {
+		for alias, ta := range tt.Aliases {
+			var b *binding
+			for _, o := range aliases[alias] {
+				if o.TraitAlias == ta {
+					b = o
+				}
+			}
+			if b == nil {
+				b = &binding{TraitAlias: ta}
+				aliases[alias] = append(aliases[alias], b)
+			}
+			b.users = append(b.users, tt.ThingType+" "+tt.FirmwareVersion)
+		}
+	}
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no aliases are defined")
+	}
+	sort.Strings(names)
+	if err := checkNames("alias", names); err != nil {
+		return nil, err
+	}
+
+	g := &generator{types: map[string]bool{}}
+	g.printf("// Code generated by kii-traitgen. DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", pkg)
+	g.printf("import kii %q\n", "github.com/KiiPlatform/kii_go")
+	for _, alias := range names {
+		bindings := aliases[alias]
+		sort.Slice(bindings, func(i, j int) bool {
+			if bindings[i].Trait != bindings[j].Trait {
+				return bindings[i].Trait < bindings[j].Trait
+			}
+			return bindings[i].TraitVersion < bindings[j].TraitVersion
+		})
+		sameTrait := true
+		for _, b := range bindings {
+			sameTrait = sameTrait && b.Trait == bindings[0].Trait
+		}
+		for _, b := range bindings {
+			def, ok := r.Trait(b.Trait, b.TraitVersion)
+			if !ok {
+				return nil, fmt.Errorf("trait %s version %d for alias %s is not defined", b.Trait, b.TraitVersion, alias)
+			}
+			prefix := exportedName(alias)
+			if len(bindings) > 1 {
+				if !sameTrait {
+					prefix += exportedName(b.Trait)
+				}
+				prefix += fmt.Sprintf("V%d", b.TraitVersion)
+				sort.Strings(b.users)
+				g.printf("\n// Types of %s are for alias %s of %s.\n", prefix, alias, strings.Join(b.users, ", "))
+			}
+			if err := g.alias(alias, prefix, def); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %s", err)
+	}
+	return b, nil
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// declare reserves a type name.
+func (g *generator) declare(name string) error {
+	if g.types[name] {
+		return fmt.Errorf("type name %s is generated twice", name)
+	}
+	g.types[name] = true
+	return nil
+}
+
+// checkNames returns an error when names are converted to the same Go
+// identifier, like "foo_bar" and "fooBar".
+func checkNames(kind string, names []string) error {
+	seen := map[string]string{}
+	for _, n := range names {
+		e := exportedName(n)
+		if o, ok := seen[e]; ok {
+			return fmt.Errorf("%s names %q and %q are both converted to %s", kind, o, n, e)
+		}
+		seen[e] = n
+	}
+	return nil
+}
+
+// dataNames returns names of entries.
+func dataNames(entries []dataEntry) []string {
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.name
+	}
+	return names
+}
+
+func (g *generator) alias(alias, prefix string, def *kii.TraitDefinition) error {
+	// state
+	stateType := prefix + "State"
+	if err := g.declare(stateType); err != nil {
+		return err
+	}
+	states := sortedData(def.States)
+	if err := checkNames("state", dataNames(states)); err != nil {
+		return fmt.Errorf("trait %s version %d: %s", def.Trait, def.Version, err)
+	}
+	var fields []field
+	for _, e := range states {
+		typ, err := g.goType(stateType+exportedName(e.name), e.def.PayloadSchema)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, field{name: e.name, typ: typ, desc: e.def.Description})
+	}
+	g.printf("\n// %s is state of alias %s (trait %s version %d).\n", stateType, alias, def.Trait, def.Version)
+	g.printStruct(stateType, fields, false)
+	g.printf("\n// Update%s updates state of alias %s.\n", stateType, alias)
+	g.printf("func Update%s(a *kii.APIAuthor, thingID string, state *%s) error {\n", stateType, stateType)
+	g.printf("return a.UpdateTraitState(thingID, %q, state)\n}\n", alias)
+
+	if len(def.Actions) == 0 {
+		return nil
+	}
+
+	// actions and results
+	actionData := sortedData(def.Actions)
+	if err := checkNames("action", dataNames(actionData)); err != nil {
+		return fmt.Errorf("trait %s version %d: %s", def.Trait, def.Version, err)
+	}
+	var actions, results []field
+	for _, e := range actionData {
+		name, ad := e.name, e.def
+		actionType := prefix + exportedName(name) + "Action"
+		if err := g.declare(actionType); err != nil {
+			return err
+		}
+		typ, err := g.goType(actionType+"Payload", ad.PayloadSchema)
+		if err != nil {
+			return err
+		}
+		g.printf("\n// %s is payload of action %s of alias %s.\n", actionType, name, alias)
+		if ad.Description != "" {
+			g.printf("// %s\n", ad.Description)
+		}
+		g.printf("type %s %s\n", actionType, typ)
+
+		resultType := prefix + exportedName(name) + "Result"
+		if err := g.declare(resultType); err != nil {
+			return err
+		}
+		resultFields := []field{
+			{name: "succeeded", typ: "bool"},
+			{name: "errorMessage", typ: "string", omitempty: true},
+		}
+		if ad.ResultSchema != nil {
+			dt, err := g.goType(resultType+"Data", ad.ResultSchema)
+			if err != nil {
+				return err
+			}
+			resultFields = append(resultFields, field{name: "data", typ: pointerOf(dt), omitempty: true})
+		}
+		g.printf("\n// %s is result of action %s of alias %s.\n", resultType, name, alias)
+		g.printStruct(resultType, resultFields, false)
+
+		actions = append(actions, field{name: name, typ: "*" + actionType})
+		results = append(results, field{name: name, typ: "*" + resultType})
+	}
+
+	actionsType := prefix + "Actions"
+	if err := g.declare(actionsType); err != nil {
+		return err
+	}
+	g.printf("\n// %s is a set of actions of alias %s.  Nil actions are not sent.\n", actionsType, alias)
+	g.printStruct(actionsType, actions, true)
+	g.printf("\n// TraitActions returns actions in trait format for kii.PostCommandRequest.\n// Nil x returns no actions.\n")
+	g.printf("func (x *%s) TraitActions() []map[string]interface{} {\n", actionsType)
+	g.printList(alias, actions)
+	g.printf("\n// Post%sCommand posts trait command with actions of alias %s.\n", prefix, alias)
+	g.printf("func Post%sCommand(a *kii.APIAuthor, thingID, issuer string, actions *%s) (*kii.PostCommandResponse, error) {\n", prefix, actionsType)
+	g.printf("return a.PostTraitCommand(thingID, kii.PostCommandRequest{Issuer: issuer, Actions: actions.TraitActions()})\n}\n")
+
+	resultsType := prefix + "ActionResults"
+	if err := g.declare(resultsType); err != nil {
+		return err
+	}
+	g.printf("\n// %s is a set of action results of alias %s.  Nil results are not sent.\n", resultsType, alias)
+	g.printStruct(resultsType, results, true)
+	g.printf("\n// TraitActionResults returns action results in trait format for\n// kii.UpdateCommandResultsRequest.  Nil x returns no results.\n")
+	g.printf("func (x *%s) TraitActionResults() []map[string]interface{} {\n", resultsType)
+	g.printList(alias, results)
+	g.printf("\n// Update%sCommandResults updates results of a trait command for alias %s.\n", prefix, alias)
+	g.printf("func Update%sCommandResults(a *kii.APIAuthor, thingID, commandID string, results *%s) error {\n", prefix, resultsType)
+	g.printf("return a.UpdateTraitCommandResults(thingID, commandID, kii.UpdateCommandResultsRequest{ActionResults: results.TraitActionResults()})\n}\n")
+	return nil
+}
+
+// dataEntry is a state field or an action of a trait.
+type dataEntry struct {
+	name string
+	def  kii.TraitDataDefinition
+}
+
+// sortedData returns entries of list sorted by name, so that output is
+// stable regardless of map iteration order.
+func sortedData(list []map[string]kii.TraitDataDefinition) []dataEntry {
+	var entries []dataEntry
+	for _, m := range list {
+		for name, d := range m {
+			entries = append(entries, dataEntry{name: name, def: d})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+type field struct {
+	name      string
+	typ       string
+	desc      string
+	omitempty bool
+}
+
+// printStruct prints a struct declaration.  When noTag is true, fields have
+// no JSON tags.
+func (g *generator) printStruct(name string, fields []field, noTag bool) {
+	g.printf("type %s struct {\n", name)
+	for _, f := range fields {
+		if f.desc != "" {
+			g.printf("// %s\n", f.desc)
+		}
+		if noTag {
+			g.printf("%s %s\n", exportedName(f.name), f.typ)
+			continue
+		}
+		tag := f.name
+		if f.omitempty {
+			tag += ",omitempty"
+		}
+		g.printf("%s %s `json:%q`\n", exportedName(f.name), f.typ, tag)
+	}
+	g.printf("}\n")
+}
+
+// printList prints body of a method which converts non-nil fields into
+// [{alias: [{name: value}, ...]}].  Nil receiver has no fields.
+func (g *generator) printList(alias string, fields []field) {
+	g.printf("var list []map[string]interface{}\n")
+	g.printf("if x != nil {\n")
+	for _, f := range fields {
+		n := exportedName(f.name)
+		g.printf("if x.%s != nil {\n", n)
+		g.printf("list = append(list, map[string]interface{}{%q: x.%s})\n}\n", f.name, n)
+	}
+	g.printf("}\n")
+	g.printf("return []map[string]interface{}{{%q: list}}\n}\n", alias)
+}
+
+// goType returns Go type for a schema.  Objects with properties are declared
+// as named struct types.
+func (g *generator) goType(name string, s *kii.JSONSchema) (string, error) {
+	if s == nil {
+		return "interface{}", nil
+	}
+	var types []string
+	nullable := false
+	for _, t := range s.Type {
+		if t == "null" {
+			nullable = true
+			continue
+		}
+		types = append(types, t)
+	}
+	if len(types) != 1 {
+		return "interface{}", nil
+	}
+	var typ string
+	switch types[0] {
+	case "boolean":
+		typ = "bool"
+	case "integer":
+		typ = "int64"
+	case "number":
+		typ = "float64"
+	case "string":
+		typ = "string"
+	case "array":
+		it, err := g.goType(name+"Item", s.Items)
+		if err != nil {
+			return "", err
+		}
+		typ = "[]" + it
+	case "object":
+		if len(s.Properties) == 0 {
+			typ = "map[string]interface{}"
+			break
+		}
+		if err := g.declare(name); err != nil {
+			return "", err
+		}
+		required := map[string]bool{}
+		for _, r := range s.Required {
+			required[r] = true
+		}
+		props := make([]string, 0, len(s.Properties))
+		for p := range s.Properties {
+			props = append(props, p)
+		}
+		sort.Strings(props)
+		if err := checkNames("property", props); err != nil {
+			return "", fmt.Errorf("%s: %s", name, err)
+		}
+		var fields []field
+		for _, p := range props {
+			pt, err := g.goType(name+exportedName(p), s.Properties[p])
+			if err != nil {
+				return "", err
+			}
+			f := field{name: p, typ: pt, desc: s.Properties[p].Description}
+			if !required[p] {
+				f.typ = pointerOf(pt)
+				f.omitempty = true
+			}
+			fields = append(fields, f)
+		}
+		// nested types are printed before the type which refers them.
+		g.printf("\n// %s is generated from schema.\n", name)
+		g.printStruct(name, fields, false)
+		typ = name
+	default:
+		return "", fmt.Errorf("unknown type %q for %s", types[0], name)
+	}
+	if nullable {
+		typ = pointerOf(typ)
+	}
+	return typ, nil
+}
+
+// pointerOf returns pointer type of typ.  Slices, maps and interfaces are
+// returned as is, because they can be nil.
+func pointerOf(typ string) string {
+	if strings.HasPrefix(typ, "[]") || strings.HasPrefix(typ, "map[") || typ == "interface{}" || strings.HasPrefix(typ, "*") {
+		return typ
+	}
+	return "*" + typ
+}
+
+// exportedName converts name to an exported Go identifier, like
+// "currentTemperature" to "CurrentTemperature".
+func exportedName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	s := b.String()
+	if s == "" || unicode.IsDigit([]rune(s)[0]) {
+		s = "X" + s
+	}
+	return s
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kii "github.com/KiiPlatform/kii_go"
+)
+
+const testDefinitions = `[
+  {
+    "trait": "AirConditioner",
+    "version": 1,
+    "states": [
+      {"power": {"payloadSchema": {"type": "boolean"}}},
+      {"currentTemperature": {"payloadSchema": {"type": "integer"}}},
+      {"mode": {"payloadSchema": {"type": "string"}}, "fanSpeed": {"payloadSchema": {"type": "integer"}}, "humidity": {"payloadSchema": {"type": "number"}}},
+      {"timer": {"payloadSchema": {
+        "type": "object",
+        "required": ["enabled"],
+        "properties": {"enabled": {"type": "boolean"}, "minutes": {"type": "integer"}}
+      }}}
+    ],
+    "actions": [
+      {"turnPower": {"payloadSchema": {"type": "boolean"}}, "setMode": {"payloadSchema": {"type": "string"}}},
+      {"setPresetTemperature": {
+        "payloadSchema": {"type": "integer"},
+        "resultSchema": {"type": "object", "properties": {"applied": {"type": "integer"}}}
+      }}
+    ]
+  },
+  {
+    "thingType": "MyAirConditioner",
+    "firmwareVersion": "v1",
+    "aliases": {"AirConditionerAlias": {"trait": "AirConditioner", "traitVersion": 1}}
+  }
+]`
+
+func loadTestRegistry(t *testing.T, definitions string) *kii.TraitRegistry {
+	dir, err := ioutil.TempDir("", "kii_traitgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traits.json")
+	if err := ioutil.WriteFile(path, []byte(definitions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := kii.NewTraitRegistry()
+	if err := r.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// compileGenerated type-checks generated code, and returns names of declared
+// types and functions.
+func compileGenerated(t *testing.T, b []byte) map[string]bool {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "gen.go", b, 0)
+	if err != nil {
+		t.Fatalf("generated code is invalid: %s\n%s", err, b)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("mydevice", fset, []*ast.File{f}, nil); err != nil {
+		t.Fatalf("generated code doesn't compile: %s\n%s", err, b)
+	}
+	decls := map[string]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch d := n.(type) {
+		case *ast.TypeSpec:
+			decls[d.Name.Name] = true
+		case *ast.FuncDecl:
+			decls[d.Name.Name] = true
+		}
+		return true
+	})
+	return decls
+}
+
+func TestGenerate(t *testing.T) {
+	b, err := generate("mydevice", loadTestRegistry(t, testDefinitions))
+	if err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+	decls := compileGenerated(t, b)
+	for i := 0; i < 10; i++ {
+		b2, err := generate("mydevice", loadTestRegistry(t, testDefinitions))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("output should be stable:\n%s\n%s", b, b2)
+		}
+	}
+	for _, name := range []string{
+		"AirConditionerAliasState",
+		"AirConditionerAliasStateTimer",
+		"AirConditionerAliasTurnPowerAction",
+		"AirConditionerAliasSetPresetTemperatureResult",
+		"AirConditionerAliasSetPresetTemperatureResultData",
+		"AirConditionerAliasActions",
+		"AirConditionerAliasActionResults",
+		"UpdateAirConditionerAliasState",
+		"PostAirConditionerAliasCommand",
+		"UpdateAirConditionerAliasCommandResults",
+		"TraitActions",
+		"TraitActionResults",
+	} {
+		if !decls[name] {
+			t.Errorf("%s is not generated", name)
+		}
+	}
+	if !bytes.Contains(b, []byte("func (x *AirConditionerAliasActions) TraitActions() []map[string]interface{} {\n\tvar list []map[string]interface{}\n\tif x != nil {")) {
+		t.Errorf("TraitActions should accept nil receiver:\n%s", b)
+	}
+}
+
+func TestGenerateAliasOfTraitVersions(t *testing.T) {
+	b, err := generate("mydevice", loadTestRegistry(t, `[
+	  {"trait": "A", "version": 1, "states": [{"power": {"payloadSchema": {"type": "boolean"}}}]},
+	  {"trait": "A", "version": 2, "states": [{"level": {"payloadSchema": {"type": "integer"}}}]},
+	  {"trait": "B", "version": 1},
+	  {"thingType": "T", "firmwareVersion": "v1", "aliases": {"x": {"trait": "A", "traitVersion": 1}, "y": {"trait": "A", "traitVersion": 1}}},
+	  {"thingType": "T", "firmwareVersion": "v2", "aliases": {"x": {"trait": "A", "traitVersion": 2}, "y": {"trait": "B", "traitVersion": 1}}},
+	  {"thingType": "T", "firmwareVersion": "v3", "aliases": {"x": {"trait": "A", "traitVersion": 2}}}
+	]`))
+	if err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+	decls := compileGenerated(t, b)
+	for _, name := range []string{"XV1State", "XV2State", "UpdateXV2State", "YAV1State", "YBV1State"} {
+		if !decls[name] {
+			t.Errorf("%s is not generated:\n%s", name, b)
+		}
+	}
+	if !bytes.Contains(b, []byte("// Types of XV2 are for alias x of T v2, T v3.")) {
+		t.Errorf("firmware versions of the trait should be documented:\n%s", b)
+	}
+}
+
+func TestGenerateNameCollision(t *testing.T) {
+	for name, definitions := range map[string]string{
+		"alias": `[
+		  {"trait": "A", "version": 1},
+		  {"thingType": "T", "firmwareVersion": "v1", "aliases": {"foo_bar": {"trait": "A", "traitVersion": 1}, "fooBar": {"trait": "A", "traitVersion": 1}}}
+		]`,
+		"state": `[
+		  {"trait": "A", "version": 1, "states": [{"foo_bar": {"payloadSchema": {"type": "boolean"}}, "fooBar": {"payloadSchema": {"type": "boolean"}}}]},
+		  {"thingType": "T", "firmwareVersion": "v1", "aliases": {"x": {"trait": "A", "traitVersion": 1}}}
+		]`,
+		"action": `[
+		  {"trait": "A", "version": 1, "actions": [{"turn-on": {"payloadSchema": {"type": "boolean"}}}, {"turnOn": {"payloadSchema": {"type": "boolean"}}}]},
+		  {"thingType": "T", "firmwareVersion": "v1", "aliases": {"x": {"trait": "A", "traitVersion": 1}}}
+		]`,
+		"property": `[
+		  {"trait": "A", "version": 1, "states": [{"timer": {"payloadSchema": {"type": "object", "properties": {"foo_bar": {"type": "integer"}, "fooBar": {"type": "integer"}}}}}]},
+		  {"thingType": "T", "firmwareVersion": "v1", "aliases": {"x": {"trait": "A", "traitVersion": 1}}}
+		]`,
+	} {
+		_, err := generate("mydevice", loadTestRegistry(t, definitions))
+		if err == nil || !strings.Contains(err.Error(), name+" names") {
+			t.Errorf("collision of %s names should be detected: %v", name, err)
+		}
+	}
+}
+
+func TestExportedName(t *testing.T) {
+	for in, expected := range map[string]string{
+		"currentTemperature": "CurrentTemperature",
+		"turn-power":         "TurnPower",
+		"set_value":          "SetValue",
+		"1st":                "X1st",
+	} {
+		if actual := exportedName(in); actual != expected {
+			t.Errorf("exportedName(%q) should be %q but %q", in, expected, actual)
+		}
+	}
+}
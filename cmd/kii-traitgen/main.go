@@ -0,0 +1,59 @@
+// Command kii-traitgen generates Go types and helpers from trait definition
+// files, which are loadable by kii.TraitRegistry.LoadFile.
+//
+// It is designed to be used with go generate:
+//
+//	//go:generate kii-traitgen -pkg mydevice -o traits_gen.go traits.json
+//
+// For each alias, it generates a state struct, action and result types, and
+// helpers which call UpdateTraitState, PostTraitCommand and
+// UpdateTraitCommandResults with the alias.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	kii "github.com/KiiPlatform/kii_go"
+)
+
+func main() {
+	var (
+		pkg    = flag.String("pkg", "", "package name of generated code (required)")
+		output = flag.String("o", "", "output file name (default stdout)")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kii-traitgen -pkg NAME [-o FILE] DEFINITION...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *pkg == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	r := kii.NewTraitRegistry()
+	for _, path := range flag.Args() {
+		if err := r.LoadFile(path); err != nil {
+			fatal(err)
+		}
+	}
+	b, err := generate(*pkg, r)
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*output, b, 0644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "kii-traitgen: %s\n", err)
+	os.Exit(1)
+}
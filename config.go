@@ -0,0 +1,357 @@
+package kii
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is configuration of an application using kii_go.  It is loaded by
+// ConfigLoader.
+type Config struct {
+	// Profile is name of the loaded profile.  It is empty when no config
+	// file is loaded.
+	Profile string
+
+	App          App
+	ClientID     string
+	ClientSecret string
+
+	// Gateway is credentials of the gateway.  It is optional.
+	Gateway GatewayCredentials
+
+	Transport TransportConfig
+}
+
+// GatewayCredentials is vendorThingID and password of a gateway.
+type GatewayCredentials struct {
+	VendorThingID string
+	Password      string
+}
+
+// TransportConfig is settings of HTTP client.
+type TransportConfig struct {
+	// Timeout is timeout of a request.  Zero means no timeout.
+	Timeout time.Duration
+	// Proxy is URL of HTTP proxy.  When empty, proxy is taken from
+	// environment variables as http.ProxyFromEnvironment.
+	Proxy string
+}
+
+// Environment variables read by ConfigLoader.  EnvApp has the format
+// {SITE}:{APP_ID}:{APP_KEY}:{CLIENT_ID}:{CLIENT_SECRET}, and the other
+// variables override its fields.
+const (
+	EnvConfig        = "KIIGO_CONFIG"
+	EnvProfile       = "KIIGO_PROFILE"
+	EnvApp           = "KIIGO_APP"
+	EnvSite          = "KIIGO_SITE"
+	EnvAppID         = "KIIGO_APP_ID"
+	EnvAppKey        = "KIIGO_APP_KEY"
+	EnvClientID      = "KIIGO_CLIENT_ID"
+	EnvClientSecret  = "KIIGO_CLIENT_SECRET"
+	EnvVendorThingID = "KIIGO_VENDOR_THING_ID"
+	EnvThingPassword = "KIIGO_THING_PASSWORD"
+	EnvTimeout       = "KIIGO_TIMEOUT"
+	EnvProxy         = "KIIGO_PROXY"
+)
+
+// defaultProfile is used when no profile is specified.
+const defaultProfile = "default"
+
+// ConfigLoader loads Config from a config file and environment variables.
+// Environment variables take precedence over the file, so a profile can be
+// overridden on each host.
+//
+// The file is JSON, or a format registered by RegisterConfigFormat, chosen
+// by extension.  Package github.com/KiiPlatform/kii_go/config registers
+// YAML and TOML.  The file has named profiles:
+//
+//	{
+//	  "defaultProfile": "production",
+//	  "profiles": {
+//	    "production": {
+//	      "site": "us",
+//	      "appID": "myapp",
+//	      "appKey": "mykey",
+//	      "clientID": "myclient",
+//	      "clientSecret": "mysecret",
+//	      "gateway": {"vendorThingID": "gw-1", "password": "gwpass"},
+//	      "transport": {"timeout": "30s", "proxy": "http://proxy:8080"}
+//	    }
+//	  }
+//	}
+//
+// The profile is Profile, EnvProfile, defaultProfile of the file, "default",
+// or the only profile of the file in this order.
+type ConfigLoader struct {
+	// Path is path of the config file.  When empty, EnvConfig is used.
+	// When both are empty, only environment variables are loaded.
+	Path string
+
+	// Profile is name of the profile to load.
+	Profile string
+
+	// IgnoreEnv disables environment variables.
+	IgnoreEnv bool
+
+	// lookupEnv is used in tests.
+	lookupEnv func(string) (string, bool)
+}
+
+// LoadConfig loads profile from the file at EnvConfig and environment
+// variables.
+func LoadConfig(profile string) (*Config, error) {
+	l := &ConfigLoader{Profile: profile}
+	return l.Load()
+}
+
+// ConfigDecoder decodes a config file to v.  Unknown keys should be errors,
+// to find typos.  Keys are the same as JSON, and fields of v have tags of
+// json, yaml and toml.
+type ConfigDecoder func(b []byte, v interface{}) error
+
+var configFormats = struct {
+	sync.RWMutex
+	m map[string]ConfigDecoder
+}{m: map[string]ConfigDecoder{".json": decodeJSONConfig}}
+
+// RegisterConfigFormat registers a decoder of config files with extension
+// ext like ".yaml".
+func RegisterConfigFormat(ext string, d ConfigDecoder) {
+	configFormats.Lock()
+	defer configFormats.Unlock()
+	configFormats.m[strings.ToLower(ext)] = d
+}
+
+func decodeJSONConfig(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+type configFile struct {
+	DefaultProfile string                    `json:"defaultProfile" yaml:"defaultProfile" toml:"defaultProfile"`
+	Profiles       map[string]*configProfile `json:"profiles" yaml:"profiles" toml:"profiles"`
+}
+
+type configProfile struct {
+	Site         string `json:"site" yaml:"site" toml:"site"`
+	AppID        string `json:"appID" yaml:"appID" toml:"appID"`
+	AppKey       string `json:"appKey" yaml:"appKey" toml:"appKey"`
+	ClientID     string `json:"clientID" yaml:"clientID" toml:"clientID"`
+	ClientSecret string `json:"clientSecret" yaml:"clientSecret" toml:"clientSecret"`
+	Gateway      struct {
+		VendorThingID string `json:"vendorThingID" yaml:"vendorThingID" toml:"vendorThingID"`
+		Password      string `json:"password" yaml:"password" toml:"password"`
+	} `json:"gateway" yaml:"gateway" toml:"gateway"`
+	Transport struct {
+		Timeout string `json:"timeout" yaml:"timeout" toml:"timeout"`
+		Proxy   string `json:"proxy" yaml:"proxy" toml:"proxy"`
+	} `json:"transport" yaml:"transport" toml:"transport"`
+}
+
+func (l *ConfigLoader) getenv(name string) string {
+	if l.IgnoreEnv {
+		return ""
+	}
+	lookup := l.lookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	v, _ := lookup(name)
+	return v
+}
+
+// Load loads Config, and validates it.
+func (l *ConfigLoader) Load() (*Config, error) {
+	path := l.Path
+	if path == "" {
+		path = l.getenv(EnvConfig)
+	}
+	var p configProfile
+	var name string
+	if path != "" {
+		f, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		name, err = l.selectProfile(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		p = *f.Profiles[name]
+	}
+	if err := l.applyEnv(&p); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	require := func(v, field, env string) {
+		if v == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (or set %s)", field, env))
+		}
+	}
+	require(p.Site, "site", EnvSite)
+	require(p.AppID, "appID", EnvAppID)
+	require(p.AppKey, "appKey", EnvAppKey)
+	if p.ClientID != "" || p.ClientSecret != "" {
+		require(p.ClientID, "clientID", EnvClientID)
+		require(p.ClientSecret, "clientSecret", EnvClientSecret)
+	}
+	if p.Gateway.VendorThingID != "" || p.Gateway.Password != "" {
+		require(p.Gateway.VendorThingID, "gateway.vendorThingID", EnvVendorThingID)
+		require(p.Gateway.Password, "gateway.password", EnvThingPassword)
+	}
+	c := &Config{
+		Profile:      name,
+		App:          App{Location: p.Site, AppID: p.AppID, AppKey: p.AppKey},
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Gateway:      GatewayCredentials{VendorThingID: p.Gateway.VendorThingID, Password: p.Gateway.Password},
+	}
+	if p.Transport.Timeout != "" {
+		d, err := time.ParseDuration(p.Transport.Timeout)
+		if err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("transport.timeout %q is not a valid duration like \"30s\"", p.Transport.Timeout))
+		}
+		c.Transport.Timeout = d
+	}
+	if p.Transport.Proxy != "" {
+		if u, err := url.Parse(p.Transport.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("transport.proxy %q is not a valid URL like \"http://proxy:8080\"", p.Transport.Proxy))
+		}
+		c.Transport.Proxy = p.Transport.Proxy
+	}
+	if len(problems) > 0 {
+		src := "environment"
+		if path != "" {
+			src = fmt.Sprintf("profile %q of %s", name, path)
+		}
+		return nil, fmt.Errorf("invalid config in %s: %s", src, strings.Join(problems, "; "))
+	}
+	return c, nil
+}
+
+// readConfigFile decodes the file by the decoder of its extension.
+func readConfigFile(path string) (*configFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	configFormats.RLock()
+	decode, ok := configFormats.m[ext]
+	exts := make([]string, 0, len(configFormats.m))
+	for e := range configFormats.m {
+		exts = append(exts, e)
+	}
+	configFormats.RUnlock()
+	if !ok {
+		sort.Strings(exts)
+		return nil, fmt.Errorf("%s: unsupported config format %q, use %s, or import github.com/KiiPlatform/kii_go/config for YAML and TOML", path, ext, strings.Join(exts, ", "))
+	}
+	var f configFile
+	if err := decode(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for name, p := range f.Profiles {
+		if p == nil {
+			f.Profiles[name] = &configProfile{}
+		}
+	}
+	return &f, nil
+}
+
+func (l *ConfigLoader) selectProfile(f *configFile) (string, error) {
+	if len(f.Profiles) == 0 {
+		return "", errors.New("no profiles")
+	}
+	name := l.Profile
+	if name == "" {
+		name = l.getenv(EnvProfile)
+	}
+	if name == "" {
+		name = f.DefaultProfile
+	}
+	if name == "" {
+		if _, ok := f.Profiles[defaultProfile]; ok || len(f.Profiles) > 1 {
+			name = defaultProfile
+		} else {
+			for n := range f.Profiles {
+				name = n
+			}
+		}
+	}
+	if _, ok := f.Profiles[name]; !ok {
+		names := make([]string, 0, len(f.Profiles))
+		for n := range f.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("profile %q is not found in %s", name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// applyEnv overrides p by environment variables.
+func (l *ConfigLoader) applyEnv(p *configProfile) error {
+	if s := l.getenv(EnvApp); s != "" {
+		ss := strings.SplitN(s, ":", 5)
+		if len(ss) != 5 {
+			return fmt.Errorf("invalid format of %s, it should be {SITE}:{APP_ID}:{APP_KEY}:{CLIENT_ID}:{CLIENT_SECRET}", EnvApp)
+		}
+		p.Site, p.AppID, p.AppKey, p.ClientID, p.ClientSecret = ss[0], ss[1], ss[2], ss[3], ss[4]
+	}
+	for _, e := range []struct {
+		name string
+		v    *string
+	}{
+		{EnvSite, &p.Site},
+		{EnvAppID, &p.AppID},
+		{EnvAppKey, &p.AppKey},
+		{EnvClientID, &p.ClientID},
+		{EnvClientSecret, &p.ClientSecret},
+		{EnvVendorThingID, &p.Gateway.VendorThingID},
+		{EnvThingPassword, &p.Gateway.Password},
+		{EnvTimeout, &p.Transport.Timeout},
+		{EnvProxy, &p.Transport.Proxy},
+	} {
+		if v := l.getenv(e.name); v != "" {
+			*e.v = v
+		}
+	}
+	return nil
+}
+
+// HTTPClient returns http.Client with Transport settings.  Set it by
+// SetHTTPClient.
+func (c *Config) HTTPClient() (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Transport.Proxy != "" {
+		u, err := url.Parse(c.Transport.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: t, Timeout: c.Transport.Timeout}, nil
+}
+
+// AdminLogin logins as admin user with ClientID and ClientSecret.
+func (c *Config) AdminLogin() (*APIAuthor, error) {
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return nil, errors.New("ClientID and ClientSecret are required")
+	}
+	return AdminLogin(c.App, c.ClientID, c.ClientSecret)
+}
@@ -0,0 +1,45 @@
+// Package config adds YAML and TOML formats of config files to
+// kii.ConfigLoader.  Import it for the side effect:
+//
+//	import _ "github.com/KiiPlatform/kii_go/config"
+//
+// Then kii.LoadConfig loads files with extensions .yaml, .yml and .toml:
+//
+//	defaultProfile: production
+//	profiles:
+//	  production:
+//	    site: us
+//	    appID: myapp
+//	    appKey: mykey
+//	    gateway:
+//	      vendorThingID: gw-1
+//	      password: gwpass
+//	    transport:
+//	      timeout: 30s
+package config
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	kii "github.com/KiiPlatform/kii_go"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	kii.RegisterConfigFormat(".yaml", yaml.UnmarshalStrict)
+	kii.RegisterConfigFormat(".yml", yaml.UnmarshalStrict)
+	kii.RegisterConfigFormat(".toml", decodeTOML)
+}
+
+// decodeTOML decodes b, and reports an unknown key as error.
+func decodeTOML(b []byte, v interface{}) error {
+	md, err := toml.Decode(string(b), v)
+	if err != nil {
+		return err
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("unknown key %s", keys[0])
+	}
+	return nil
+}
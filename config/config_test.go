@@ -0,0 +1,100 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kii "github.com/KiiPlatform/kii_go"
+)
+
+func TestFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kii_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"kii.yaml": `defaultProfile: prod
+profiles:
+  prod:
+    site: us
+    appID: app1
+    appKey: key1
+    clientID: cid1
+    clientSecret: cs1
+    gateway:
+      vendorThingID: gw-1
+      password: gwpass
+    transport:
+      timeout: 30s
+      proxy: http://proxy:8080
+  dev:
+    site: localhost:8080
+    appID: app2
+    appKey: key2
+`,
+		"kii.toml": `defaultProfile = "prod"
+[profiles.prod]
+site = "us"
+appID = "app1"
+appKey = "key1"
+clientID = "cid1"
+clientSecret = "cs1"
+[profiles.prod.gateway]
+vendorThingID = "gw-1"
+password = "gwpass"
+[profiles.prod.transport]
+timeout = "30s"
+proxy = "http://proxy:8080"
+[profiles.dev]
+site = "localhost:8080"
+appID = "app2"
+appKey = "key2"
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		l := &kii.ConfigLoader{Path: path, IgnoreEnv: true}
+		c, err := l.Load()
+		if err != nil {
+			t.Fatalf("%s: failed to load: %s", name, err)
+		}
+		expected := kii.Config{
+			Profile:      "prod",
+			App:          kii.App{Location: "us", AppID: "app1", AppKey: "key1"},
+			ClientID:     "cid1",
+			ClientSecret: "cs1",
+			Gateway:      kii.GatewayCredentials{VendorThingID: "gw-1", Password: "gwpass"},
+			Transport:    kii.TransportConfig{Timeout: 30 * time.Second, Proxy: "http://proxy:8080"},
+		}
+		if *c != expected {
+			t.Errorf("%s: unexpected config: %+v", name, *c)
+		}
+		l.Profile = "dev"
+		if c, err := l.Load(); err != nil || c.App.AppID != "app2" || c.ClientID != "" {
+			t.Errorf("%s: unexpected dev profile: %+v %v", name, c, err)
+		}
+	}
+
+	// unknown keys are errors.
+	for name, content := range map[string]string{
+		"bad.yml":  "profiles:\n  prod:\n    site: us\n    appName: x\n",
+		"bad.toml": "[profiles.prod]\nsite = \"us\"\nappName = \"x\"\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := (&kii.ConfigLoader{Path: path, IgnoreEnv: true}).Load()
+		if err == nil || !strings.Contains(err.Error(), "appName") {
+			t.Errorf("%s: unknown key should be error: %v", name, err)
+		}
+	}
+}
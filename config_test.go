@@ -0,0 +1,103 @@
+package kii
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigLoader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"kii.json": `{"defaultProfile":"prod","profiles":{
+  "prod":{"site":"us","appID":"app1","appKey":"key1","clientID":"cid1","clientSecret":"cs1",
+    "gateway":{"vendorThingID":"gw-1","password":"gwpass"},
+    "transport":{"timeout":"30s","proxy":"http://proxy:8080"}},
+  "dev":{"site":"localhost:8080","appID":"app2","appKey":"key2"}}}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		l := &ConfigLoader{Path: path, IgnoreEnv: true}
+		c, err := l.Load()
+		if err != nil {
+			t.Fatalf("%s: failed to load: %s", name, err)
+		}
+		expected := Config{
+			Profile:      "prod",
+			App:          App{Location: "us", AppID: "app1", AppKey: "key1"},
+			ClientID:     "cid1",
+			ClientSecret: "cs1",
+			Gateway:      GatewayCredentials{VendorThingID: "gw-1", Password: "gwpass"},
+			Transport:    TransportConfig{Timeout: 30 * time.Second, Proxy: "http://proxy:8080"},
+		}
+		if *c != expected {
+			t.Errorf("%s: unexpected config: %+v", name, *c)
+		}
+		l.Profile = "dev"
+		if c, err := l.Load(); err != nil || c.App.AppID != "app2" || c.ClientID != "" {
+			t.Errorf("%s: unexpected dev profile: %+v %v", name, c, err)
+		}
+	}
+
+	// environment variables override the file.
+	env := map[string]string{
+		EnvConfig:        filepath.Join(dir, "kii.json"),
+		EnvProfile:       "dev",
+		EnvApp:           "jp:app3:key3:cid3:cs3",
+		EnvAppKey:        "key4",
+		EnvTimeout:       "5s",
+		EnvThingPassword: "envpass",
+	}
+	l := &ConfigLoader{lookupEnv: func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}}
+	c, err := l.Load()
+	if err == nil || !strings.Contains(err.Error(), "gateway.vendorThingID is required (or set KIIGO_VENDOR_THING_ID)") {
+		t.Errorf("password without vendorThingID should be invalid: %v", err)
+	}
+	env[EnvVendorThingID] = "gw-2"
+	if c, err = l.Load(); err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if c.Profile != "dev" || c.App != (App{Location: "jp", AppID: "app3", AppKey: "key4"}) ||
+		c.ClientID != "cid3" || c.ClientSecret != "cs3" || c.Gateway.Password != "envpass" || c.Transport.Timeout != 5*time.Second {
+		t.Errorf("unexpected config: %+v", *c)
+	}
+
+	// errors
+	for content, msg := range map[string]string{
+		`{"profiles":{"prod":{"site":"us","appName":"x"}}}`:                                        `unknown field "appName"`,
+		`{"profiles":{"prod":{"site":"us"}}}`:                                                      `profile "prod" of`,
+		`{"profiles":{"a":{"site":"us"},"b":{"site":"jp"}}}`:                                       `profile "default" is not found in a, b`,
+		`{"profiles":{"a":{"site":"us","appID":"x","appKey":"y","transport":{"timeout":"soon"}}}}`: `transport.timeout "soon" is not a valid duration`,
+	} {
+		path := filepath.Join(dir, "bad.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := (&ConfigLoader{Path: path, IgnoreEnv: true}).Load()
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("unexpected error for %q: %v", content, err)
+		}
+	}
+	path := filepath.Join(dir, "kii.yaml")
+	if err := ioutil.WriteFile(path, []byte("profiles: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&ConfigLoader{Path: path, IgnoreEnv: true}).Load()
+	if err == nil || !strings.Contains(err.Error(), `unsupported config format ".yaml", use .json, or import github.com/KiiPlatform/kii_go/config`) {
+		t.Errorf("YAML should need the config package: %v", err)
+	}
+	_, err = (&ConfigLoader{IgnoreEnv: true}).Load()
+	if err == nil || err.Error() != "invalid config in environment: site is required (or set KIIGO_SITE); appID is required (or set KIIGO_APP_ID); appKey is required (or set KIIGO_APP_KEY)" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+package kii
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DiscoveredDevice is a device found in local network.
+type DiscoveredDevice struct {
+	// Address is address of the device in local network.
+	Address         string
+	VendorThingID   string
+	ThingType       string
+	FirmwareVersion string
+	Properties      map[string]interface{}
+	// Discoverer is name of Discoverer which found the device.  It is set
+	// by AutoOnboarder.
+	Discoverer string
+}
+
+// DiscoveryEventType is type of DiscoveryEvent.
+type DiscoveryEventType int
+
+const (
+	// DeviceAppeared represents a device is found.
+	DeviceAppeared DiscoveryEventType = iota
+	// DeviceGone represents a device is lost.
+	DeviceGone
+)
+
+// DiscoveryEvent is an event emitted by Discoverer.
+type DiscoveryEvent struct {
+	Type   DiscoveryEventType
+	Device DiscoveredDevice
+}
+
+// Discoverer finds devices in local network, like by mDNS, SSDP or scanning
+// BLE advertisements.
+type Discoverer interface {
+	// Name returns name of the discoverer.  It is used as name of adapter
+	// of end nodes onboarded by AutoOnboarder.
+	Name() string
+	// Discover sends events to events until ctx is done.
+	Discover(ctx context.Context, events chan<- DiscoveryEvent) error
+}
+
+// ApprovalDecision is decision of ApprovalPolicy.
+type ApprovalDecision int
+
+const (
+	// Rejected devices are ignored.
+	Rejected ApprovalDecision = iota
+	// Approved devices are onboarded.
+	Approved
+	// Pending devices wait for AutoOnboarder.Approve or
+	// AutoOnboarder.Reject.
+	Pending
+)
+
+// ApprovalPolicy decides whether discovered devices are onboarded.
+type ApprovalPolicy interface {
+	Decide(d *DiscoveredDevice) ApprovalDecision
+}
+
+// ApprovalPolicyFunc is a function which implements ApprovalPolicy.
+type ApprovalPolicyFunc func(d *DiscoveredDevice) ApprovalDecision
+
+// Decide calls f(d).
+func (f ApprovalPolicyFunc) Decide(d *DiscoveredDevice) ApprovalDecision {
+	return f(d)
+}
+
+// AllowlistPolicy approves devices which have one of vendorThingIDs, and
+// rejects others.
+func AllowlistPolicy(vendorThingIDs ...string) ApprovalPolicy {
+	allowed := make(map[string]bool, len(vendorThingIDs))
+	for _, id := range vendorThingIDs {
+		allowed[id] = true
+	}
+	return ApprovalPolicyFunc(func(d *DiscoveredDevice) ApprovalDecision {
+		if allowed[d.VendorThingID] {
+			return Approved
+		}
+		return Rejected
+	})
+}
+
+// PatternPolicy approves devices which vendorThingID matches pattern, and
+// rejects others.
+func PatternPolicy(pattern *regexp.Regexp) ApprovalPolicy {
+	return ApprovalPolicyFunc(func(d *DiscoveredDevice) ApprovalDecision {
+		if pattern.MatchString(d.VendorThingID) {
+			return Approved
+		}
+		return Rejected
+	})
+}
+
+// ManualPolicy lets all devices wait for manual approval.
+func ManualPolicy() ApprovalPolicy {
+	return ApprovalPolicyFunc(func(d *DiscoveredDevice) ApprovalDecision {
+		return Pending
+	})
+}
+
+// AutoOnboarder onboards devices found by discoverers as end nodes of a
+// gateway.  Approved devices are onboarded with generated passwords,
+// registered to Registry and reported online.
+//
+//	o := &kii.AutoOnboarder{
+//		Gateway:     gw,
+//		Registry:    registry,
+//		Policy:      kii.PatternPolicy(regexp.MustCompile(`^sensor-`)),
+//		Discoverers: []kii.Discoverer{mdns},
+//	}
+//	go o.Run(ctx)
+type AutoOnboarder struct {
+	Gateway     *Gateway
+	Registry    *EndNodeRegistry
+	Policy      ApprovalPolicy
+	Discoverers []Discoverer
+
+	// Liveness is fed heartbeats of appeared devices when it is not nil.
+	// Otherwise status is reported on appearance and disappearance.
+	Liveness *LivenessMonitor
+
+	// OnOnboarded is called after a device is onboarded or failed to be
+	// onboarded.  Optional.
+	OnOnboarded func(rec *EndNodeRecord, err error)
+
+	mu      sync.Mutex
+	pending map[string]DiscoveredDevice
+}
+
+// Run runs discoverers and handles their events until ctx is done.
+func (o *AutoOnboarder) Run(ctx context.Context) error {
+	if o.Gateway == nil || o.Registry == nil || o.Policy == nil {
+		return errors.New("Gateway, Registry and Policy must not be nil")
+	}
+	events := make(chan DiscoveryEvent)
+	var wg sync.WaitGroup
+	for _, d := range o.Discoverers {
+		wg.Add(1)
+		go func(d Discoverer) {
+			defer wg.Done()
+			ch := make(chan DiscoveryEvent)
+			go func() {
+				for ev := range ch {
+					ev.Device.Discoverer = d.Name()
+					select {
+					case events <- ev:
+					case <-ctx.Done():
+					}
+				}
+			}()
+			if err := d.Discover(ctx, ch); err != nil && ctx.Err() == nil {
+				gatewayLog.Error("discoverer stopped", "discoverer", d.Name(), "error", err)
+			}
+			close(ch)
+		}(d)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		case ev := <-events:
+			o.HandleEvent(ev)
+		}
+	}
+}
+
+// HandleEvent handles an event of a discoverer.
+func (o *AutoOnboarder) HandleEvent(ev DiscoveryEvent) {
+	d := ev.Device
+	switch ev.Type {
+	case DeviceAppeared:
+		if rec, ok := o.Registry.Get(d.Address); ok {
+			if rec.Pending && rec.VendorThingID == d.VendorThingID {
+				// onboarding was interrupted after approval.
+				o.onboard(d)
+				return
+			}
+			o.online(rec.VendorThingID, true)
+			return
+		}
+		switch o.Policy.Decide(&d) {
+		case Approved:
+			o.onboard(d)
+		case Pending:
+			o.mu.Lock()
+			if o.pending == nil {
+				o.pending = map[string]DiscoveredDevice{}
+			}
+			o.pending[d.Address] = d
+			o.mu.Unlock()
+		}
+	case DeviceGone:
+		o.mu.Lock()
+		delete(o.pending, d.Address)
+		o.mu.Unlock()
+		if rec, ok := o.Registry.Get(d.Address); ok {
+			o.online(rec.VendorThingID, false)
+		}
+	}
+}
+
+// Pending returns devices which wait for approval ordered by address.
+func (o *AutoOnboarder) Pending() []DiscoveredDevice {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]DiscoveredDevice, 0, len(o.pending))
+	for _, d := range o.pending {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+// Approve onboards a pending device.
+func (o *AutoOnboarder) Approve(address string) (*EndNodeRecord, error) {
+	o.mu.Lock()
+	d, ok := o.pending[address]
+	delete(o.pending, address)
+	o.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("device %s is not pending", address)
+	}
+	return o.onboard(d)
+}
+
+// Reject drops a pending device.  It is pending again when it appears
+// again.
+func (o *AutoOnboarder) Reject(address string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.pending, address)
+}
+
+func (o *AutoOnboarder) onboard(d DiscoveredDevice) (*EndNodeRecord, error) {
+	rec, err := o.doOnboard(d)
+	if err != nil {
+		gatewayLog.Error("failed to onboard", "vendorThingID", d.VendorThingID, "error", err)
+	} else {
+		o.online(rec.VendorThingID, true)
+	}
+	if o.OnOnboarded != nil {
+		o.OnOnboarded(rec, err)
+	}
+	return rec, err
+}
+
+func (o *AutoOnboarder) doOnboard(d DiscoveredDevice) (*EndNodeRecord, error) {
+	if d.Address == "" || d.VendorThingID == "" {
+		return nil, errors.New("address and vendorThingID are required")
+	}
+	// the password is saved before onboarding, and reused when onboarding
+	// is retried.
+	rec, ok := o.Registry.Get(d.Address)
+	if !ok || !rec.Pending || rec.VendorThingID != d.VendorThingID {
+		password, err := randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+		rec = &EndNodeRecord{
+			Address:         d.Address,
+			VendorThingID:   d.VendorThingID,
+			Password:        password,
+			ThingType:       d.ThingType,
+			FirmwareVersion: d.FirmwareVersion,
+			Adapter:         d.Discoverer,
+			Pending:         true,
+		}
+		if err := o.Registry.Put(*rec); err != nil {
+			return nil, err
+		}
+	}
+	en, err := o.Gateway.OnboardEndNode(EndNodeInfo{
+		VendorThingID:   d.VendorThingID,
+		Password:        rec.Password,
+		ThingType:       d.ThingType,
+		FirmwareVersion: d.FirmwareVersion,
+		Properties:      d.Properties,
+		Adapter:         d.Discoverer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rec.ThingID = en.ThingID
+	rec.Pending = false
+	if err := o.Registry.Put(*rec); err != nil {
+		return nil, err
+	}
+	rec.Password = ""
+	return rec, nil
+}
+
+func (o *AutoOnboarder) online(vendorThingID string, online bool) {
+	if o.Liveness != nil {
+		if online {
+			o.Liveness.Heartbeat(vendorThingID)
+		}
+		return
+	}
+	if err := o.Gateway.ReportEndNodeStatus(vendorThingID, online); err != nil {
+		gatewayLog.Warn("failed to report status", "vendorThingID", vendorThingID, "error", err)
+	}
+}
+
+// randomHex returns hex encoded n random bytes.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SimulatedDiscoverer is a Discoverer which emits events given by Appear and
+// Disappear.  It is useful for tests and demonstrations.
+type SimulatedDiscoverer struct {
+	name   string
+	events chan DiscoveryEvent
+}
+
+// NewSimulatedDiscoverer creates a SimulatedDiscoverer.
+func NewSimulatedDiscoverer(name string) *SimulatedDiscoverer {
+	return &SimulatedDiscoverer{name: name, events: make(chan DiscoveryEvent, 16)}
+}
+
+// Name returns name of the discoverer.
+func (s *SimulatedDiscoverer) Name() string {
+	return s.name
+}
+
+// Discover sends events given by Appear and Disappear until ctx is done.
+func (s *SimulatedDiscoverer) Discover(ctx context.Context, events chan<- DiscoveryEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-s.events:
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Appear emits DeviceAppeared event of d.
+func (s *SimulatedDiscoverer) Appear(d DiscoveredDevice) {
+	s.events <- DiscoveryEvent{Type: DeviceAppeared, Device: d}
+}
+
+// Disappear emits DeviceGone event of a device of address.
+func (s *SimulatedDiscoverer) Disappear(address string) {
+	s.events <- DiscoveryEvent{Type: DeviceGone, Device: DiscoveredDevice{Address: address}}
+}
@@ -0,0 +1,175 @@
+package kii
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func startTestGateway(t *testing.T, c *fakeThingCloud) *Gateway {
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass"}
+	if err := gw.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start gateway: %s", err)
+	}
+	return gw
+}
+
+func TestAutoOnboarderRun(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	registry, _ := OpenEndNodeRegistry(NewMemoryStore())
+
+	sim := NewSimulatedDiscoverer("sim")
+	onboarded := make(chan *EndNodeRecord, 1)
+	o := &AutoOnboarder{
+		Gateway:     gw,
+		Registry:    registry,
+		Policy:      PatternPolicy(regexp.MustCompile(`^sensor-`)),
+		Discoverers: []Discoverer{sim},
+		OnOnboarded: func(rec *EndNodeRecord, err error) {
+			if err != nil {
+				t.Errorf("failed to onboard: %s", err)
+			}
+			onboarded <- rec
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- o.Run(ctx) }()
+
+	sim.Appear(DiscoveredDevice{Address: "aa:01", VendorThingID: "unknown-1"})
+	sim.Appear(DiscoveredDevice{Address: "aa:02", VendorThingID: "sensor-1", ThingType: "thermometer", FirmwareVersion: "v1"})
+	var rec *EndNodeRecord
+	select {
+	case rec = <-onboarded:
+	case <-time.After(time.Second):
+		t.Fatalf("device should be onboarded")
+	}
+	if rec.VendorThingID != "sensor-1" || rec.ThingID == "" || rec.Password != "" || rec.Adapter != "sim" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+	if en, ok := gw.EndNode("sensor-1"); !ok || en.ThingID != rec.ThingID {
+		t.Errorf("end node should be onboarded to gateway: %+v", en)
+	}
+	if _, ok := registry.ByVendorThingID("unknown-1"); ok {
+		t.Errorf("rejected device should not be registered")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !c.isOnline(rec.ThingID) {
+		t.Errorf("device should be reported online")
+	}
+
+	o.HandleEvent(DiscoveryEvent{Type: DeviceGone, Device: DiscoveredDevice{Address: "aa:02"}})
+	if c.isOnline(rec.ThingID) {
+		t.Errorf("gone device should be reported offline")
+	}
+	o.HandleEvent(DiscoveryEvent{Type: DeviceAppeared, Device: DiscoveredDevice{Address: "aa:02", VendorThingID: "sensor-1"}})
+	if !c.isOnline(rec.ThingID) {
+		t.Errorf("device should be reported online again")
+	}
+	if n := len(c.requestsTo("POST", "thing-if:/onboardings")); n != 2 {
+		t.Errorf("device should be onboarded once: %d onboardings", n)
+	}
+}
+
+func TestAutoOnboarderManualApproval(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	registry, _ := OpenEndNodeRegistry(NewMemoryStore())
+	liveness := &LivenessMonitor{}
+	o := &AutoOnboarder{
+		Gateway:  gw,
+		Registry: registry,
+		Policy:   ManualPolicy(),
+		Liveness: liveness,
+	}
+
+	o.HandleEvent(DiscoveryEvent{Type: DeviceAppeared, Device: DiscoveredDevice{Address: "b", VendorThingID: "vid-b"}})
+	o.HandleEvent(DiscoveryEvent{Type: DeviceAppeared, Device: DiscoveredDevice{Address: "a", VendorThingID: "vid-a"}})
+	o.HandleEvent(DiscoveryEvent{Type: DeviceAppeared, Device: DiscoveredDevice{Address: "c", VendorThingID: "vid-c"}})
+	o.HandleEvent(DiscoveryEvent{Type: DeviceGone, Device: DiscoveredDevice{Address: "c"}})
+	if p := o.Pending(); len(p) != 2 || p[0].Address != "a" || p[1].Address != "b" {
+		t.Errorf("unexpected pending devices: %+v", p)
+	}
+
+	rec, err := o.Approve("a")
+	if err != nil {
+		t.Fatalf("failed to approve: %s", err)
+	}
+	if r, ok := registry.Get("a"); !ok || r.ThingID != rec.ThingID {
+		t.Errorf("approved device should be registered: %+v", r)
+	}
+	if online, _ := liveness.Status("vid-a"); !online {
+		t.Errorf("approved device should be online")
+	}
+	o.Reject("b")
+	if p := o.Pending(); len(p) != 0 {
+		t.Errorf("no device should be pending: %+v", p)
+	}
+	if _, err := o.Approve("b"); err == nil {
+		t.Errorf("rejected device should not be approved")
+	}
+
+	if d := AllowlistPolicy("vid-a").Decide(&DiscoveredDevice{VendorThingID: "vid-b"}); d != Rejected {
+		t.Errorf("not allowed device should be rejected: %v", d)
+	}
+}
+
+func TestAutoOnboarderResumesPendingOnboarding(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	store := NewMemoryStore()
+	registry, _ := OpenEndNodeRegistry(store)
+	o := &AutoOnboarder{
+		Gateway:  gw,
+		Registry: registry,
+		Policy:   AllowlistPolicy("sensor-1"),
+		Liveness: &LivenessMonitor{},
+	}
+
+	fail := true
+	c.handle("POST", "thing-if:/onboardings", func(req *fakeRequest, m []string) (int, interface{}) {
+		if fail {
+			return 503, nil
+		}
+		return c.onboard(req, m)
+	})
+	d := DiscoveredDevice{Address: "aa:01", VendorThingID: "sensor-1"}
+	o.HandleEvent(DiscoveryEvent{Type: DeviceAppeared, Device: d})
+	rec, ok := registry.Get("aa:01")
+	if !ok || !rec.Pending || rec.Password == "" || rec.ThingID != "" {
+		t.Fatalf("pending record should be saved before onboarding: %+v", rec)
+	}
+
+	// the registry is reopened as after a crash.
+	registry, _ = OpenEndNodeRegistry(store)
+	o.Registry = registry
+	fail = false
+	o.HandleEvent(DiscoveryEvent{Type: DeviceAppeared, Device: d})
+	done, ok := registry.Get("aa:01")
+	if !ok || done.Pending || done.ThingID == "" || done.Password != "" {
+		t.Errorf("onboarding should be completed and the password should be dropped: %+v", done)
+	}
+	var saved map[string]interface{}
+	getJSON(store, endNodeRecordKeyPrefix+"aa:01", &saved)
+	if _, ok := saved["password"]; ok {
+		t.Errorf("password should not be persisted after onboarding: %v", saved)
+	}
+	reqs := c.requestsTo("POST", "thing-if:/onboardings")
+	var r OnboardEndnodeWithGatewayThingIDRequest
+	reqs[len(reqs)-1].decode(&r)
+	if r.EndNodePassword != rec.Password {
+		t.Errorf("saved password should be sent: %q", r.EndNodePassword)
+	}
+}
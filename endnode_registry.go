@@ -0,0 +1,365 @@
+package kii
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const endNodeRecordKeyPrefix = "registry/"
+
+// EndNodeRecord maps a local device to an end node on Kii Cloud.  Tokens of
+// end nodes are kept by Gateway, not by the record.
+type EndNodeRecord struct {
+	// Address is address of the device in local network, like MAC address
+	// or Zigbee short address.
+	Address       string `json:"address"`
+	VendorThingID string `json:"vendorThingID"`
+	ThingID       string `json:"thingID,omitempty"`
+	// Password is used to onboard the end node.  It is kept only while
+	// Pending, and dropped when the record is put after onboarding.
+	Password        string `json:"password,omitempty"`
+	ThingType       string `json:"thingType,omitempty"`
+	FirmwareVersion string `json:"firmwareVersion,omitempty"`
+	Adapter         string `json:"adapter,omitempty"`
+	// Pending is true while the end node is being onboarded.  The record
+	// is saved with Password before onboarding, so the password is not lost
+	// when onboarding is interrupted.
+	Pending   bool      `json:"pending,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// legacyEndNodeRecord is EndNodeRecord saved by older versions, which
+// persisted the token and the password of onboarded end nodes.
+type legacyEndNodeRecord struct {
+	EndNodeRecord
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+// EndNodeRegistry persists EndNodeRecord in Store, indexed by address,
+// vendorThingID and thingID.  Gateway keeps its own identities of end nodes,
+// so set ReconcileOptions.Gateway to repair both of them.
+type EndNodeRegistry struct {
+	store Store
+
+	mu      sync.RWMutex
+	records map[string]*EndNodeRecord
+}
+
+// OpenEndNodeRegistry loads records from store.  Credentials saved by older
+// versions in records of onboarded end nodes are erased from store.
+func OpenEndNodeRegistry(store Store) (*EndNodeRegistry, error) {
+	keys, err := store.Keys(endNodeRecordKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	r := &EndNodeRegistry{store: store, records: make(map[string]*EndNodeRecord, len(keys))}
+	for _, k := range keys {
+		var legacy legacyEndNodeRecord
+		if err := getJSON(store, k, &legacy); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %s", k, err)
+		}
+		rec := legacy.EndNodeRecord
+		if legacy.AccessToken != "" || (!rec.Pending && rec.Password != "") {
+			rec.Password = rec.passwordToKeep()
+			if err := putJSON(store, k, &rec); err != nil {
+				return nil, fmt.Errorf("failed to erase credentials of %s: %s", k, err)
+			}
+		}
+		r.records[rec.Address] = &rec
+	}
+	return r, nil
+}
+
+// passwordToKeep returns Password while rec is pending, and "" otherwise.
+func (rec *EndNodeRecord) passwordToKeep() string {
+	if rec.Pending {
+		return rec.Password
+	}
+	return ""
+}
+
+// Put adds or replaces record of rec.Address.  VendorThingID and ThingID
+// must be unique in the registry.  Password is not saved unless Pending is
+// true.
+func (r *EndNodeRegistry) Put(rec EndNodeRecord) error {
+	if rec.Address == "" || rec.VendorThingID == "" {
+		return errors.New("address and vendorThingID are required")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, o := range r.records {
+		if addr == rec.Address {
+			continue
+		}
+		if o.VendorThingID == rec.VendorThingID {
+			return fmt.Errorf("vendorThingID %s is already used by %s", rec.VendorThingID, addr)
+		}
+		if rec.ThingID != "" && o.ThingID == rec.ThingID {
+			return fmt.Errorf("thingID %s is already used by %s", rec.ThingID, addr)
+		}
+	}
+	rec.Password = rec.passwordToKeep()
+	rec.UpdatedAt = time.Now()
+	if err := putJSON(r.store, endNodeRecordKeyPrefix+rec.Address, &rec); err != nil {
+		return err
+	}
+	r.records[rec.Address] = &rec
+	return nil
+}
+
+// Delete deletes record of address.
+func (r *EndNodeRegistry) Delete(address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.store.Delete(endNodeRecordKeyPrefix + address); err != nil {
+		return err
+	}
+	delete(r.records, address)
+	return nil
+}
+
+// Get returns record of address.
+func (r *EndNodeRegistry) Get(address string) (*EndNodeRecord, bool) {
+	return r.find(func(rec *EndNodeRecord) bool { return rec.Address == address })
+}
+
+// ByVendorThingID returns record of vendorThingID.
+func (r *EndNodeRegistry) ByVendorThingID(vendorThingID string) (*EndNodeRecord, bool) {
+	return r.find(func(rec *EndNodeRecord) bool { return rec.VendorThingID == vendorThingID })
+}
+
+// ByThingID returns record of thingID.
+func (r *EndNodeRegistry) ByThingID(thingID string) (*EndNodeRecord, bool) {
+	return r.find(func(rec *EndNodeRecord) bool { return rec.ThingID == thingID })
+}
+
+func (r *EndNodeRegistry) find(match func(rec *EndNodeRecord) bool) (*EndNodeRecord, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rec := range r.records {
+		if match(rec) {
+			c := *rec
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// List returns all records ordered by address.
+func (r *EndNodeRegistry) List() []EndNodeRecord {
+	r.mu.RLock()
+	list := make([]EndNodeRecord, 0, len(r.records))
+	for _, rec := range r.records {
+		list = append(list, *rec)
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+// ReconcileOptions is options of EndNodeRegistry.Reconcile.
+type ReconcileOptions struct {
+	// Repair lets Reconcile fix differences.  Local only end nodes are
+	// onboarded with their passwords, which only pending records have,
+	// cloud only end nodes are detached from the gateway, and mismatched
+	// records are updated with IDs on the cloud.
+	Repair bool
+
+	// Owner is owner of end nodes onboarded by repair.
+	Owner string
+
+	// PageSize is bestEffortLimit of ListEndNodes.  When zero, default of
+	// the cloud is used.
+	PageSize int
+
+	// Gateway is the gateway of end nodes.  When it is set, repair also
+	// updates identities of end nodes in the Gateway, so that it uses the
+	// repaired thingIDs and new tokens.
+	Gateway *Gateway
+}
+
+// EndNodeMismatch is a pair of records which have the same thingID or
+// vendorThingID but differ in the other.
+type EndNodeMismatch struct {
+	Local EndNodeRecord
+	Cloud EndNode
+}
+
+// ReconcileFailure is a failure to repair an end node.
+type ReconcileFailure struct {
+	VendorThingID string
+	Err           error
+}
+
+// ReconcileReport is result of EndNodeRegistry.Reconcile.
+type ReconcileReport struct {
+	LocalOnly  []EndNodeRecord
+	CloudOnly  []EndNode
+	Mismatched []EndNodeMismatch
+	// Repaired is vendorThingIDs of repaired end nodes.
+	Repaired []string
+	Failures []ReconcileFailure
+}
+
+// InSync returns true when the registry and the cloud have the same end
+// nodes.
+func (rep *ReconcileReport) InSync() bool {
+	return len(rep.LocalOnly) == 0 && len(rep.CloudOnly) == 0 && len(rep.Mismatched) == 0
+}
+
+// Reconcile compares records with end nodes of the gateway on the cloud,
+// which are listed by ListEndNodes.  a must be APIAuthor of the gateway or
+// its owner.  When opts.Repair is true, it also fixes differences, and
+// failures of repair are reported in ReconcileReport.Failures.
+func (r *EndNodeRegistry) Reconcile(a *APIAuthor, gatewayID string, opts ReconcileOptions) (*ReconcileReport, error) {
+	var cloud []EndNode
+	list := ListRequest{BestEffortLimit: opts.PageSize}
+	for {
+		resp, err := a.ListEndNodes(gatewayID, list)
+		if err != nil {
+			return nil, err
+		}
+		cloud = append(cloud, resp.Results...)
+		if resp.NextPaginationKey == "" {
+			break
+		}
+		list.NextPaginationKey = resp.NextPaginationKey
+	}
+
+	byThingID := make(map[string]EndNode, len(cloud))
+	byVendorThingID := make(map[string]EndNode, len(cloud))
+	for _, en := range cloud {
+		byThingID[en.ThingID] = en
+		byVendorThingID[en.VendorThingID] = en
+	}
+	matched := map[string]bool{}
+	rep := &ReconcileReport{}
+	for _, rec := range r.List() {
+		if en, ok := byThingID[rec.ThingID]; ok && rec.ThingID != "" {
+			matched[en.ThingID] = true
+			if en.VendorThingID != rec.VendorThingID {
+				rep.Mismatched = append(rep.Mismatched, EndNodeMismatch{Local: rec, Cloud: en})
+			}
+		} else if en, ok := byVendorThingID[rec.VendorThingID]; ok {
+			matched[en.ThingID] = true
+			rep.Mismatched = append(rep.Mismatched, EndNodeMismatch{Local: rec, Cloud: en})
+		} else {
+			rep.LocalOnly = append(rep.LocalOnly, rec)
+		}
+	}
+	for _, en := range cloud {
+		if !matched[en.ThingID] {
+			rep.CloudOnly = append(rep.CloudOnly, en)
+		}
+	}
+
+	if opts.Repair {
+		r.repair(a, gatewayID, opts, rep)
+	}
+	return rep, nil
+}
+
+func (r *EndNodeRegistry) repair(a *APIAuthor, gatewayID string, opts ReconcileOptions, rep *ReconcileReport) {
+	done := func(vendorThingID string, err error) {
+		if err != nil {
+			rep.Failures = append(rep.Failures, ReconcileFailure{VendorThingID: vendorThingID, Err: err})
+		} else {
+			rep.Repaired = append(rep.Repaired, vendorThingID)
+		}
+	}
+
+	for _, rec := range rep.LocalOnly {
+		if !rec.Pending || rec.Password == "" {
+			done(rec.VendorThingID, errors.New("password is required to onboard"))
+			continue
+		}
+		resp, err := a.OnboardEndnodeWithGatewayThingID(OnboardEndnodeWithGatewayThingIDRequest{
+			GatewayThingID: gatewayID,
+			OnboardEndnodeRequestCommon: OnboardEndnodeRequestCommon{
+				EndNodeVendorThingID:   rec.VendorThingID,
+				EndNodePassword:        rec.Password,
+				Owner:                  opts.Owner,
+				EndNodeThingType:       rec.ThingType,
+				EndNodeFirmwareVersion: rec.FirmwareVersion,
+			},
+		})
+		if err == nil {
+			// the gateway must know the password before it is dropped
+			// from the record.
+			rec.ThingID = resp.EndNodeThingID
+			err = syncGatewayEndNode(opts.Gateway, rec.VendorThingID, &rec, resp.AccessToken)
+		}
+		if err == nil {
+			rec.Pending = false
+			err = r.Put(rec)
+		}
+		done(rec.VendorThingID, err)
+	}
+
+	for _, en := range rep.CloudOnly {
+		err := a.RemoveEndNode(gatewayID, en.ThingID)
+		if err == nil {
+			err = syncGatewayEndNode(opts.Gateway, en.VendorThingID, nil, "")
+		}
+		done(en.VendorThingID, err)
+	}
+
+	for _, m := range rep.Mismatched {
+		rec := m.Local
+		rec.VendorThingID = m.Cloud.VendorThingID
+		rec.ThingID = m.Cloud.ThingID
+		var err error
+		if opts.Gateway != nil {
+			var token *EndNodeTokenResponse
+			token, err = a.GenerateEndNodeToken(gatewayID, m.Cloud.ThingID, &EndNodeTokenRequest{})
+			if err == nil {
+				err = syncGatewayEndNode(opts.Gateway, m.Local.VendorThingID, &rec, token.AccessToken)
+			}
+		}
+		if err == nil {
+			err = r.Put(rec)
+		}
+		done(m.Local.VendorThingID, err)
+	}
+}
+
+// syncGatewayEndNode replaces identity of vendorThingID in gw with rec and
+// token.  When rec is nil, the identity is removed.
+func syncGatewayEndNode(gw *Gateway, vendorThingID string, rec *EndNodeRecord, token string) error {
+	if gw == nil {
+		return nil
+	}
+	en, ok := gw.EndNode(vendorThingID)
+	if ok && (rec == nil || rec.VendorThingID != vendorThingID) {
+		if err := gw.ForgetEndNode(vendorThingID); err != nil {
+			return err
+		}
+	}
+	if rec == nil {
+		return nil
+	}
+	if !ok {
+		en = &EndNodeIdentity{}
+	}
+	en.VendorThingID = rec.VendorThingID
+	en.ThingID = rec.ThingID
+	en.AccessToken = token
+	if rec.ThingType != "" {
+		en.ThingType = rec.ThingType
+	}
+	if rec.FirmwareVersion != "" {
+		en.FirmwareVersion = rec.FirmwareVersion
+	}
+	if rec.Adapter != "" {
+		en.Adapter = rec.Adapter
+	}
+	if rec.Password != "" && !en.checkPassword(rec.Password) {
+		if err := en.setPassword(rec.Password); err != nil {
+			return err
+		}
+	}
+	return gw.saveEndNode(en)
+}
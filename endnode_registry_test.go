@@ -0,0 +1,167 @@
+package kii
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestEndNodeRegistryPersistence(t *testing.T) {
+	store := NewMemoryStore()
+	r, err := OpenEndNodeRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put(EndNodeRecord{Address: "00:01", VendorThingID: "en-1", ThingID: "th.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put(EndNodeRecord{Address: "00:02", VendorThingID: "en-1"}); err == nil {
+		t.Errorf("duplicated vendorThingID should be rejected")
+	}
+	if err := r.Put(EndNodeRecord{Address: "00:02", VendorThingID: "en-2", ThingID: "th.1"}); err == nil {
+		t.Errorf("duplicated thingID should be rejected")
+	}
+	if err := r.Put(EndNodeRecord{Address: "00:02", VendorThingID: "en-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = OpenEndNodeRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, ok := r.ByThingID("th.1"); !ok || rec.Address != "00:01" {
+		t.Errorf("record should be found by thingID: %+v", rec)
+	}
+	if rec, ok := r.ByVendorThingID("en-2"); !ok || rec.Address != "00:02" {
+		t.Errorf("record should be found by vendorThingID: %+v", rec)
+	}
+	if err := r.Delete("00:01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get("00:01"); ok {
+		t.Errorf("deleted record should not be found")
+	}
+	if list := r.List(); len(list) != 1 || list[0].VendorThingID != "en-2" {
+		t.Errorf("unexpected records: %+v", list)
+	}
+}
+
+func TestEndNodeRegistryErasesCredentials(t *testing.T) {
+	store := NewMemoryStore()
+	putJSON(store, endNodeRecordKeyPrefix+"1", map[string]interface{}{
+		"address": "1", "vendorThingID": "en-1", "thingID": "th.1", "accessToken": "token", "password": "pass",
+	})
+	putJSON(store, endNodeRecordKeyPrefix+"2", map[string]interface{}{
+		"address": "2", "vendorThingID": "en-2", "password": "pass", "pending": true,
+	})
+	r, err := OpenEndNodeRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]interface{}
+	getJSON(store, endNodeRecordKeyPrefix+"1", &saved)
+	if _, ok := saved["accessToken"]; ok {
+		t.Errorf("token should be erased: %v", saved)
+	}
+	if _, ok := saved["password"]; ok {
+		t.Errorf("password of onboarded end node should be erased: %v", saved)
+	}
+	if rec, _ := r.Get("2"); rec.Password != "pass" {
+		t.Errorf("password of pending end node should be kept: %+v", rec)
+	}
+
+	r.Put(EndNodeRecord{Address: "3", VendorThingID: "en-3", ThingID: "th.3", Password: "pass"})
+	if rec, _ := r.Get("3"); rec.Password != "" {
+		t.Errorf("password should not be kept after onboarding: %+v", rec)
+	}
+}
+
+func TestEndNodeRegistryReconcile(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass"}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(ctx)
+	gatewayID := gw.ThingID()
+
+	idA := c.addEndNode(gatewayID, "en-a")
+	idB := c.addEndNode(gatewayID, "en-b")
+	idC := c.addEndNode(gatewayID, "en-c")
+
+	r, _ := OpenEndNodeRegistry(NewMemoryStore())
+	for _, rec := range []EndNodeRecord{
+		{Address: "1", VendorThingID: "en-a", ThingID: idA},
+		{Address: "2", VendorThingID: "en-c", ThingID: "th.old"},
+		{Address: "3", VendorThingID: "en-d", Password: "pass", Pending: true},
+		{Address: "4", VendorThingID: "en-e"},
+	} {
+		if err := r.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := ReconcileOptions{PageSize: 1}
+	rep, err := r.Reconcile(gw.Author(), gatewayID, opts)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %s", err)
+	}
+	if n := len(c.requestsTo("GET", "thing-if:/things/[^/]+/end-nodes")); n != 3 {
+		t.Errorf("all pages should be listed: %d requests", n)
+	}
+	if len(rep.LocalOnly) != 2 || rep.LocalOnly[0].VendorThingID != "en-d" || rep.LocalOnly[1].VendorThingID != "en-e" {
+		t.Errorf("unexpected local only: %+v", rep.LocalOnly)
+	}
+	if !reflect.DeepEqual(rep.CloudOnly, []EndNode{{ThingID: idB, VendorThingID: "en-b"}}) {
+		t.Errorf("unexpected cloud only: %+v", rep.CloudOnly)
+	}
+	if len(rep.Mismatched) != 1 || rep.Mismatched[0].Cloud.ThingID != idC {
+		t.Errorf("unexpected mismatched: %+v", rep.Mismatched)
+	}
+	if rep.InSync() || len(rep.Repaired) != 0 {
+		t.Errorf("should not be repaired: %+v", rep)
+	}
+
+	// the gateway has stale identities.
+	gw.saveEndNode(&EndNodeIdentity{VendorThingID: "en-c", ThingID: "th.old", AccessToken: "stale"})
+	gw.saveEndNode(&EndNodeIdentity{VendorThingID: "en-b", ThingID: idB, AccessToken: "token-b"})
+
+	opts.Repair = true
+	opts.Gateway = gw
+	rep, err = r.Reconcile(gw.Author(), gatewayID, opts)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %s", err)
+	}
+	if !reflect.DeepEqual(rep.Repaired, []string{"en-d", "en-b", "en-c"}) {
+		t.Errorf("unexpected repaired: %v", rep.Repaired)
+	}
+	if len(rep.Failures) != 1 || rep.Failures[0].VendorThingID != "en-e" {
+		t.Errorf("end node without password should fail: %+v", rep.Failures)
+	}
+	if c.hasEndNode(gatewayID, idB) {
+		t.Errorf("cloud only end node should be detached")
+	}
+	if rec, _ := r.Get("2"); rec.ThingID != idC {
+		t.Errorf("mismatched record should be updated: %+v", rec)
+	}
+	if rec, _ := r.Get("3"); rec.ThingID == "" || rec.Pending || rec.Password != "" || !c.hasEndNode(gatewayID, rec.ThingID) {
+		t.Errorf("local only end node should be onboarded: %+v", rec)
+	}
+	if en, ok := gw.EndNode("en-c"); !ok || en.ThingID != idC || en.AccessToken == "stale" || en.AccessToken == "" {
+		t.Errorf("gateway should use repaired identity: %+v", en)
+	}
+	if en, ok := gw.EndNode("en-d"); !ok || en.AccessToken == "" || !en.checkPassword("pass") {
+		t.Errorf("onboarded end node should be added to gateway: %+v", en)
+	}
+	if _, ok := gw.EndNode("en-b"); ok {
+		t.Errorf("detached end node should be removed from gateway")
+	}
+
+	r.Delete("4")
+	rep, err = r.Reconcile(gw.Author(), gatewayID, ReconcileOptions{})
+	if err != nil || !rep.InSync() {
+		t.Errorf("should be in sync: %+v, %v", rep, err)
+	}
+}
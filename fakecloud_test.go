@@ -0,0 +1,457 @@
+package kii
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloud is a local HTTPS server which pretends Kii Cloud in offline
+// tests.  Requests are routed by method and a regexp of path, which is
+// relative to "/api/apps/<appID>" or "/thing-if/apps/<appID>", and prefixed
+// by "api:" or "thing-if:".
+type fakeCloud struct {
+	t      *testing.T
+	server *httptest.Server
+	App    App
+
+	mu       sync.Mutex
+	routes   []fakeRoute
+	requests []fakeRequest
+}
+
+type fakeRoute struct {
+	method  string
+	pattern *regexp.Regexp
+	handler fakeHandler
+}
+
+// fakeRequest is a request received by fakeCloud.
+type fakeRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// fakeHandler handles a request.  m is submatches of the route pattern.  It
+// returns status code and body, which is encoded to JSON unless it is nil,
+// []byte or *fakeResponse.
+type fakeHandler func(req *fakeRequest, m []string) (int, interface{})
+
+// fakeResponse is a response body with headers.
+type fakeResponse struct {
+	Header http.Header
+	Body   []byte
+}
+
+// newFakeCloud starts fakeCloud and makes kii_go use it.  Close must be
+// called at the end of the test.
+func newFakeCloud(t *testing.T) *fakeCloud {
+	c := &fakeCloud{t: t}
+	c.server = httptest.NewTLSServer(http.HandlerFunc(c.serveHTTP))
+	c.App = App{
+		AppID:    "fakeapp",
+		AppKey:   "fakekey",
+		Location: strings.TrimPrefix(c.server.URL, "https://"),
+	}
+	SetHTTPClient(c.server.Client())
+	return c
+}
+
+// Close stops the server and restores default HTTP client.
+func (c *fakeCloud) Close() {
+	SetHTTPClient(nil)
+	c.server.Close()
+}
+
+// handle adds a route.  Routes added later take priority.
+func (c *fakeCloud) handle(method, pattern string, h fakeHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = append(c.routes, fakeRoute{
+		method:  method,
+		pattern: regexp.MustCompile("^" + pattern + "$"),
+		handler: h,
+	})
+}
+
+// requestsTo returns received requests which match method and pattern.
+func (c *fakeCloud) requestsTo(method, pattern string) []fakeRequest {
+	re := regexp.MustCompile("^" + pattern + "$")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []fakeRequest
+	for _, r := range c.requests {
+		if r.Method == method && re.MatchString(r.Path) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func (c *fakeCloud) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	path := r.URL.Path
+	for _, p := range []string{"api", "thing-if"} {
+		prefix := "/" + p + "/apps/" + c.App.AppID
+		if strings.HasPrefix(path, prefix) {
+			path = p + ":" + strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+	req := fakeRequest{Method: r.Method, Path: path, Query: r.URL.Query(), Header: r.Header, Body: body}
+
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	var (
+		h fakeHandler
+		m []string
+	)
+	for i := len(c.routes) - 1; i >= 0; i-- {
+		rt := c.routes[i]
+		if rt.method != r.Method {
+			continue
+		}
+		if m = rt.pattern.FindStringSubmatch(path); m != nil {
+			h = rt.handler
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if h == nil {
+		c.t.Logf("fakeCloud: no route for %s %s", r.Method, path)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errorCode":"NOT_FOUND"}`)
+		return
+	}
+	status, v := h(&req, m)
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+	case []byte:
+		b = v
+	case *fakeResponse:
+		for k, vv := range v.Header {
+			w.Header()[k] = vv
+		}
+		b = v.Body
+	default:
+		b, _ = json.Marshal(v)
+	}
+	if b != nil && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// decode decodes body of the request into v.
+func (r *fakeRequest) decode(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// token returns bearer token of the request.
+func (r *fakeRequest) token() string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// fakeThingCloud holds things, end nodes and commands on fakeCloud, and
+// serves APIs used by Gateway.
+type fakeThingCloud struct {
+	*fakeCloud
+
+	mu       sync.Mutex
+	seq      int
+	things   map[string]string                 // thingID -> vendorThingID
+	tokens   map[string]string                 // token -> thingID
+	endNodes map[string]map[string]bool        // gatewayID -> endnodeIDs
+	online   map[string]bool                   // endnodeID -> online
+	states   map[string]map[string]interface{} // thingID -> alias -> state
+	commands map[string]*GetCommandResponse    // commandID -> command
+	firmware map[string]string                 // thingID -> firmware version
+}
+
+func newFakeThingCloud(t *testing.T) *fakeThingCloud {
+	c := &fakeThingCloud{
+		fakeCloud: newFakeCloud(t),
+		things:    map[string]string{},
+		tokens:    map[string]string{},
+		endNodes:  map[string]map[string]bool{},
+		online:    map[string]bool{},
+		states:    map[string]map[string]interface{}{},
+		commands:  map[string]*GetCommandResponse{},
+		firmware:  map[string]string{},
+	}
+	c.handle("POST", "api:/oauth2/token", func(req *fakeRequest, m []string) (int, interface{}) {
+		return 200, map[string]interface{}{"id": "anonymous", "access_token": "anonymous-token"}
+	})
+	c.handle("POST", "thing-if:/onboardings", c.onboard)
+	c.handle("POST", "api:/things/([^/]+)/end-nodes/([^/]+)/token", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		token := c.newToken(m[2])
+		return 200, map[string]interface{}{"id": m[2], "access_token": token}
+	}))
+	c.handle("PUT", "thing-if:/things/([^/]+)/end-nodes/([^/]+)/connection", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var r ReportEndnodeStatusRequest
+		req.decode(&r)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.endNodes[m[1]][m[2]] {
+			return 404, nil
+		}
+		c.online[m[2]] = r.Online
+		return 204, nil
+	}))
+	c.handle("PUT", "thing-if:/targets/thing:([^/]+)/states/aliases/([^/]+)", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var s interface{}
+		req.decode(&s)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.states[m[1]] == nil {
+			c.states[m[1]] = map[string]interface{}{}
+		}
+		c.states[m[1]][m[2]] = s
+		return 204, nil
+	}))
+	c.handle("PUT", "thing-if:/targets/thing:([^/]+)/states", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var s map[string]interface{}
+		req.decode(&s)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.states[m[1]] == nil {
+			c.states[m[1]] = map[string]interface{}{}
+		}
+		for k, v := range s {
+			c.states[m[1]][k] = v
+		}
+		return 204, nil
+	}))
+	c.handle("PUT", "thing-if:/things/([^/]+)/firmware-version", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var r struct {
+			FirmwareVersion string `json:"firmwareVersion"`
+		}
+		req.decode(&r)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.firmware[m[1]] = r.FirmwareVersion
+		return 204, nil
+	}))
+	c.handle("PATCH", "api:/things/([^/]+)", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		return 200, map[string]interface{}{}
+	}))
+	c.handle("GET", "thing-if:/targets/thing:([^/]+)/commands/([^/]+)", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		cmd, ok := c.commands[m[2]]
+		if !ok || cmd.Target != "thing:"+m[1] {
+			return 404, nil
+		}
+		return 200, cmd
+	}))
+	c.handle("PUT", "thing-if:/targets/thing:([^/]+)/commands/([^/]+)/action-results", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var r UpdateCommandResultsRequest
+		req.decode(&r)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		cmd, ok := c.commands[m[2]]
+		if !ok {
+			return 404, nil
+		}
+		cmd.ActionResults = r.ActionResults
+		cmd.CommandState = "DONE"
+		return 204, nil
+	}))
+	c.handle("GET", "thing-if:/things/([^/]+)/end-nodes", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		results := []EndNode{}
+		for _, id := range sortedKeys(toInterfaceMap(c.endNodes[m[1]])) {
+			results = append(results, EndNode{ThingID: id, VendorThingID: c.things[id]})
+		}
+		start, _ := strconv.Atoi(req.Query.Get("paginationKey"))
+		results = results[start:]
+		next := ""
+		if limit, _ := strconv.Atoi(req.Query.Get("bestEffortLimit")); limit > 0 && limit < len(results) {
+			results = results[:limit]
+			next = strconv.Itoa(start + limit)
+		}
+		return 200, ListEndNodesResponse{Results: results, NextPaginationKey: next}
+	}))
+	c.handle("PUT", "api:/things/([^/]+)/end-nodes/([^/]+)", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.things[m[1]]; !ok {
+			return 404, nil
+		}
+		if _, ok := c.things[m[2]]; !ok {
+			return 404, nil
+		}
+		if c.endNodes[m[1]] == nil {
+			c.endNodes[m[1]] = map[string]bool{}
+		}
+		c.endNodes[m[1]][m[2]] = true
+		return 204, nil
+	}))
+	c.handle("DELETE", "api:/things/([^/]+)/end-nodes/([^/]+)", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.endNodes[m[1]][m[2]] {
+			return 404, nil
+		}
+		delete(c.endNodes[m[1]], m[2])
+		return 204, nil
+	}))
+	return c
+}
+
+func toInterfaceMap(m map[string]bool) map[string]interface{} {
+	r := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		r[k] = v
+	}
+	return r
+}
+
+// auth wraps h to reject requests with unknown tokens.
+func (c *fakeThingCloud) auth(h fakeHandler) fakeHandler {
+	return func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		_, ok := c.tokens[req.token()]
+		c.mu.Unlock()
+		if !ok {
+			return 401, map[string]interface{}{"errorCode": "WRONG_TOKEN"}
+		}
+		return h(req, m)
+	}
+}
+
+// newToken issues a token for thingID.  c.mu must be held.
+func (c *fakeThingCloud) newToken(thingID string) string {
+	c.seq++
+	token := fmt.Sprintf("token-%s-%d", thingID, c.seq)
+	c.tokens[token] = thingID
+	return token
+}
+
+// thingID returns thingID of vendorThingID, registering it if needed.
+// c.mu must be held.
+func (c *fakeThingCloud) thingID(vendorThingID string) string {
+	for id, vid := range c.things {
+		if vid == vendorThingID {
+			return id
+		}
+	}
+	c.seq++
+	id := fmt.Sprintf("th.%d", c.seq)
+	c.things[id] = vendorThingID
+	return id
+}
+
+func (c *fakeThingCloud) onboard(req *fakeRequest, m []string) (int, interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if strings.Contains(req.Header.Get("Content-Type"), "OnboardingEndNode") {
+		if _, ok := c.tokens[req.token()]; !ok {
+			return 401, nil
+		}
+		var r OnboardEndnodeWithGatewayThingIDRequest
+		req.decode(&r)
+		if _, ok := c.things[r.GatewayThingID]; !ok {
+			return 404, nil
+		}
+		id := c.thingID(r.EndNodeVendorThingID)
+		if c.endNodes[r.GatewayThingID] == nil {
+			c.endNodes[r.GatewayThingID] = map[string]bool{}
+		}
+		c.endNodes[r.GatewayThingID][id] = true
+		return 200, OnboardEndnodeResponse{EndNodeThingID: id, AccessToken: c.newToken(id)}
+	}
+	var r OnboardGatewayRequest
+	req.decode(&r)
+	id := c.thingID(r.VendorThingID)
+	return 200, OnboardGatewayResponse{
+		ThingID:      id,
+		AccessToken:  c.newToken(id),
+		MqttEndpoint: MqttEndpoint{InstallationID: "inst", MqttTopic: "topic-" + id},
+	}
+}
+
+// addEndNode registers an end node of gatewayID, and returns its thingID.
+func (c *fakeThingCloud) addEndNode(gatewayID, vendorThingID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.thingID(vendorThingID)
+	if c.endNodes[gatewayID] == nil {
+		c.endNodes[gatewayID] = map[string]bool{}
+	}
+	c.endNodes[gatewayID][id] = true
+	return id
+}
+
+// hasEndNode returns true when thingID is an end node of gatewayID.
+func (c *fakeThingCloud) hasEndNode(gatewayID, thingID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endNodes[gatewayID][thingID]
+}
+
+// addCommand adds a command for thingID.
+func (c *fakeThingCloud) addCommand(thingID, commandID string, actions []map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands[commandID] = &GetCommandResponse{
+		CommandID:    commandID,
+		Target:       "thing:" + thingID,
+		Actions:      actions,
+		CommandState: "SENDING",
+	}
+}
+
+// command returns a copy of command.
+func (c *fakeThingCloud) command(commandID string) GetCommandResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.commands[commandID]
+}
+
+// revokeTokens revokes all tokens of thingID.
+func (c *fakeThingCloud) revokeTokens(thingID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for token, id := range c.tokens {
+		if id == thingID {
+			delete(c.tokens, token)
+		}
+	}
+}
+
+func (c *fakeThingCloud) state(thingID, alias string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.states[thingID][alias]
+}
+
+// firmwareVersion returns firmware version of thingID.
+func (c *fakeThingCloud) firmwareVersion(thingID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.firmware[thingID]
+}
+
+func (c *fakeThingCloud) isOnline(thingID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.online[thingID]
+}
@@ -0,0 +1,833 @@
+package kii
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	gatewayIdentityKey = "gateway"
+	endNodeKeyPrefix   = "endnode/"
+)
+
+// ErrWrongPassword is returned by Gateway.OnboardEndNode when the password
+// doesn't match with the onboarded end node.
+var ErrWrongPassword = errors.New("password doesn't match")
+
+// ErrNotRunning is returned by requests of Gateway before Start or after
+// Stop, so a stopped instance doesn't act as the gateway.
+var ErrNotRunning = errors.New("gateway is not running")
+
+// GatewayIdentity is identity of an onboarded gateway.  It is persisted in
+// Store of Gateway.
+type GatewayIdentity struct {
+	VendorThingID string       `json:"vendorThingID"`
+	ThingID       string       `json:"thingID"`
+	AccessToken   string       `json:"accessToken"`
+	MqttEndpoint  MqttEndpoint `json:"mqttEndpoint"`
+}
+
+// EndNodeIdentity is identity of an onboarded end node.  It is persisted in
+// Store of Gateway.
+type EndNodeIdentity struct {
+	VendorThingID   string `json:"vendorThingID"`
+	ThingID         string `json:"thingID"`
+	AccessToken     string `json:"accessToken"`
+	ThingType       string `json:"thingType,omitempty"`
+	FirmwareVersion string `json:"firmwareVersion,omitempty"`
+	// Adapter is name of EndNodeAdapter which manages the end node.
+	Adapter string `json:"adapter,omitempty"`
+	// PasswordSalt and PasswordHash verify password of the end node when it
+	// is onboarded again.
+	PasswordSalt string `json:"passwordSalt,omitempty"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+}
+
+// setPassword saves salted hash of password.
+func (en *EndNodeIdentity) setPassword(password string) error {
+	salt, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	en.PasswordSalt = salt
+	en.PasswordHash = hashPassword(salt, password)
+	return nil
+}
+
+// checkPassword returns true when password matches with the saved hash.
+// Identities without hash never match.
+func (en *EndNodeIdentity) checkPassword(password string) bool {
+	if en.PasswordHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPassword(en.PasswordSalt, password)), []byte(en.PasswordHash)) == 1
+}
+
+func hashPassword(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// EndNodeInfo is parameters to onboard an end node.
+type EndNodeInfo struct {
+	VendorThingID   string
+	Password        string
+	ThingType       string
+	FirmwareVersion string
+	Properties      map[string]interface{}
+	// Adapter is name of EndNodeAdapter which manages the end node.
+	Adapter string
+}
+
+// MQTTConnector connects to MQTT endpoint of Kii Cloud.  kii_go doesn't
+// include MQTT client, so implement it with a MQTT client library.
+type MQTTConnector interface {
+	// Connect connects to endpoint and subscribes endpoint.MqttTopic.
+	// handler must be called with payload of each received message.
+	Connect(ctx context.Context, endpoint MqttEndpoint, handler func(payload []byte)) error
+	// Disconnect disconnects from the endpoint.
+	Disconnect() error
+}
+
+// MQTTReconnector is implemented by MQTTConnector which reconnects by itself
+// when the connection is lost.  Gateway sets handler before Connect, and the
+// connector must call it after each reconnection.
+type MQTTReconnector interface {
+	SetReconnectHandler(handler func())
+}
+
+// EndNodeAdapter bridges local devices and Gateway.
+type EndNodeAdapter interface {
+	// Name returns name of the adapter, which is used to route commands to
+	// end nodes.
+	Name() string
+	// Run runs the adapter until ctx is done.  Adapter onboards end nodes
+	// and reports their status and states through gw.
+	Run(ctx context.Context, gw *Gateway) error
+	// HandleCommand executes a command for an end node, and returns action
+	// results.  When results are nil, they are not updated, and the adapter
+	// should call Gateway.UpdateEndNodeCommandResults later.
+	HandleCommand(ctx context.Context, endNode *EndNodeIdentity, cmd *GetCommandResponse) ([]map[string]interface{}, error)
+}
+
+// GatewayCommandHandler handles commands for gateway itself, and returns
+// action results.
+type GatewayCommandHandler func(ctx context.Context, cmd *GetCommandResponse) ([]map[string]interface{}, error)
+
+// Gateway is a runtime of gateway.  It onboards the gateway, persists
+// identities, connects MQTT, onboards end nodes, routes commands to adapters
+// and reports status and states of end nodes.
+//
+//	gw := &kii.Gateway{
+//		App:           app,
+//		VendorThingID: "gateway-001",
+//		Password:      "password",
+//		Store:         store,
+//		MQTT:          connector,
+//		Adapters:      []kii.EndNodeAdapter{adapter},
+//	}
+//	if err := gw.Start(ctx); err != nil {
+//		...
+//	}
+//	defer gw.Stop(ctx)
+type Gateway struct {
+	App             App
+	VendorThingID   string
+	Password        string
+	ThingType       string
+	FirmwareVersion string
+	Properties      map[string]interface{}
+
+	// Owner is owner of end nodes, like "user:<user-id>".  Optional.
+	Owner string
+
+	// Store persists identities.  Default is a MemoryStore.
+	Store Store
+
+	// MQTT is used to receive commands.  When nil, commands should be
+	// passed to HandleCommand by the caller.
+	MQTT MQTTConnector
+
+	// Adapters are run while the gateway is running.
+	Adapters []EndNodeAdapter
+
+	// CommandHandler handles commands for gateway itself.  Optional.
+	CommandHandler GatewayCommandHandler
+
+	mu       sync.RWMutex
+	identity *GatewayIdentity
+	endNodes map[string]*EndNodeIdentity
+	running  bool
+	runCtx   context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	// onboarding is closed when the running re-onboarding finishes.
+	onboarding chan struct{}
+
+	// reconnectHooks are called by Reconnected.
+	reconnectHooks map[int]func()
+	reconnectSeq   int
+
+	// fence and dedup are set by HAGateway.  fence fails when this
+	// instance must not act as the gateway, and dedup calls fn to upload
+	// state unless it is a duplicate.
+	fence func() error
+	dedup func(key string, state interface{}, fn func() error) error
+}
+
+// setHA sets hooks of HAGateway.
+func (g *Gateway) setHA(fence func() error, dedup func(key string, state interface{}, fn func() error) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.fence = fence
+	g.dedup = dedup
+}
+
+// checkFence returns an error when this instance must not send requests as
+// the gateway.
+func (g *Gateway) checkFence() error {
+	g.mu.RLock()
+	running, fence := g.running, g.fence
+	g.mu.RUnlock()
+	if !running {
+		return ErrNotRunning
+	}
+	if fence != nil {
+		return fence()
+	}
+	return nil
+}
+
+// uploadState uploads state of key by fn, through dedup of HAGateway.
+func (g *Gateway) uploadState(key string, state interface{}, fn func() error) error {
+	if err := g.checkFence(); err != nil {
+		return err
+	}
+	g.mu.RLock()
+	dedup := g.dedup
+	g.mu.RUnlock()
+	if dedup == nil {
+		return fn()
+	}
+	return dedup(key, state, fn)
+}
+
+// Start onboards the gateway if it is not onboarded yet, loads end nodes
+// from Store, connects MQTT and runs adapters.  ctx is used for the start up,
+// and adapters run until Stop is called.
+func (g *Gateway) Start(ctx context.Context) error {
+	g.mu.Lock()
+	if g.running {
+		g.mu.Unlock()
+		return errors.New("gateway is already running")
+	}
+	g.running = true
+	if g.Store == nil {
+		g.Store = NewMemoryStore()
+	}
+	g.mu.Unlock()
+
+	if err := g.start(ctx); err != nil {
+		g.mu.Lock()
+		g.running = false
+		g.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (g *Gateway) start(ctx context.Context) error {
+	if err := g.loadEndNodes(); err != nil {
+		return err
+	}
+	id, err := g.loadIdentity()
+	if err != nil {
+		return err
+	}
+	if id == nil {
+		if id, err = g.onboard(); err != nil {
+			return err
+		}
+	}
+	g.mu.Lock()
+	g.identity = id
+	g.mu.Unlock()
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	g.mu.Lock()
+	g.runCtx = runCtx
+	g.cancel = cancel
+	g.mu.Unlock()
+
+	if g.MQTT != nil {
+		if r, ok := g.MQTT.(MQTTReconnector); ok {
+			r.SetReconnectHandler(g.Reconnected)
+		}
+		if err := g.MQTT.Connect(ctx, id.MqttEndpoint, g.handleMQTTMessage); err != nil {
+			cancel()
+			return err
+		}
+	}
+
+	for _, a := range g.Adapters {
+		g.wg.Add(1)
+		go func(a EndNodeAdapter) {
+			defer g.wg.Done()
+			if err := a.Run(runCtx, g); err != nil && runCtx.Err() == nil {
+				gatewayLog.Error("adapter stopped", "adapter", a.Name(), "error", err)
+			}
+		}(a)
+	}
+	return nil
+}
+
+// Stop stops adapters and disconnects MQTT.  It waits adapters to return
+// until ctx is done.
+func (g *Gateway) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	if !g.running {
+		g.mu.Unlock()
+		return nil
+	}
+	g.running = false
+	cancel := g.cancel
+	g.cancel = nil
+	g.runCtx = nil
+	g.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if g.MQTT != nil {
+		if derr := g.MQTT.Disconnect(); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// ThingID returns thingID of the gateway.  It is empty before Start.
+func (g *Gateway) ThingID() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.identity == nil {
+		return ""
+	}
+	return g.identity.ThingID
+}
+
+// Author returns APIAuthor of the gateway.  It is nil before Start and
+// after Stop, so a stopped instance doesn't use the token of the gateway.
+func (g *Gateway) Author() *APIAuthor {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.identity == nil || !g.running {
+		return nil
+	}
+	return &APIAuthor{Token: g.identity.AccessToken, App: g.App}
+}
+
+func (g *Gateway) loadIdentity() (*GatewayIdentity, error) {
+	var id GatewayIdentity
+	err := getJSON(g.Store, gatewayIdentityKey, &id)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if id.VendorThingID != g.VendorThingID {
+		return nil, fmt.Errorf("stored gateway %s doesn't match with %s", id.VendorThingID, g.VendorThingID)
+	}
+	return &id, nil
+}
+
+// onboard onboards the gateway and persists its identity.
+func (g *Gateway) onboard() (*GatewayIdentity, error) {
+	author, err := AnonymousLogin(g.App)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := author.OnboardGateway(&OnboardGatewayRequest{
+		VendorThingID:   g.VendorThingID,
+		ThingPassword:   g.Password,
+		ThingType:       g.ThingType,
+		LayoutPosition:  GATEWAY.String(),
+		ThingProperties: g.Properties,
+		FirmwareVersion: g.FirmwareVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	id := &GatewayIdentity{
+		VendorThingID: g.VendorThingID,
+		ThingID:       resp.ThingID,
+		AccessToken:   resp.AccessToken,
+		MqttEndpoint:  resp.MqttEndpoint,
+	}
+	if err := putJSON(g.Store, gatewayIdentityKey, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (g *Gateway) loadEndNodes() error {
+	keys, err := g.Store.Keys(endNodeKeyPrefix)
+	if err != nil {
+		return err
+	}
+	endNodes := make(map[string]*EndNodeIdentity, len(keys))
+	for _, k := range keys {
+		var en EndNodeIdentity
+		if err := getJSON(g.Store, k, &en); err != nil {
+			return fmt.Errorf("failed to load %s: %s", k, err)
+		}
+		endNodes[en.VendorThingID] = &en
+	}
+	g.mu.Lock()
+	g.endNodes = endNodes
+	g.mu.Unlock()
+	return nil
+}
+
+// withGateway calls fn with APIAuthor of the gateway.  When the token is
+// rejected, the gateway is onboarded again and fn is retried.
+func (g *Gateway) withGateway(fn func(a *APIAuthor) error) error {
+	if err := g.checkFence(); err != nil {
+		return err
+	}
+	a := g.Author()
+	if a == nil {
+		return ErrNotRunning
+	}
+	err := fn(a)
+	if !isAuthError(err) {
+		return err
+	}
+	na, oerr := g.reonboard(a.Token)
+	if oerr == ErrNotRunning {
+		return oerr
+	} else if oerr != nil {
+		return err
+	}
+	return fn(na)
+}
+
+// reonboard onboards the gateway again because token is rejected, and
+// returns APIAuthor with the new token.  Only one onboarding runs at a
+// time, and callers which failed with the same token share its result.
+func (g *Gateway) reonboard(token string) (*APIAuthor, error) {
+	g.mu.Lock()
+	for {
+		if !g.running || g.identity == nil {
+			g.mu.Unlock()
+			return nil, ErrNotRunning
+		}
+		if g.identity.AccessToken != token {
+			// onboarded by another caller.
+			a := &APIAuthor{Token: g.identity.AccessToken, App: g.App}
+			g.mu.Unlock()
+			return a, nil
+		}
+		if g.onboarding == nil {
+			break
+		}
+		done := g.onboarding
+		g.mu.Unlock()
+		<-done
+		g.mu.Lock()
+	}
+	done := make(chan struct{})
+	g.onboarding = done
+	g.mu.Unlock()
+
+	id, err := g.onboard()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onboarding = nil
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	if !g.running {
+		// stopped while onboarding.
+		return nil, ErrNotRunning
+	}
+	g.identity = id
+	return &APIAuthor{Token: id.AccessToken, App: g.App}, nil
+}
+
+// OnboardEndNode onboards an end node to the gateway, and persists its
+// identity with hash of the password.  If the end node is already onboarded,
+// stored identity is returned when the password matches, and
+// ErrWrongPassword is returned otherwise.
+func (g *Gateway) OnboardEndNode(info EndNodeInfo) (*EndNodeIdentity, error) {
+	if en, ok := g.EndNode(info.VendorThingID); ok {
+		if !en.checkPassword(info.Password) {
+			return nil, ErrWrongPassword
+		}
+		return en, nil
+	}
+	gatewayID := g.ThingID()
+	var en *EndNodeIdentity
+	err := g.withGateway(func(a *APIAuthor) error {
+		resp, err := a.OnboardEndnodeWithGatewayThingID(OnboardEndnodeWithGatewayThingIDRequest{
+			GatewayThingID: gatewayID,
+			OnboardEndnodeRequestCommon: OnboardEndnodeRequestCommon{
+				EndNodeVendorThingID:   info.VendorThingID,
+				EndNodePassword:        info.Password,
+				Owner:                  g.Owner,
+				EndNodeThingType:       info.ThingType,
+				EndNodeFirmwareVersion: info.FirmwareVersion,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(info.Properties) > 0 {
+			ea := APIAuthor{Token: resp.AccessToken, App: g.App}
+			if err := ea.UpdateThing(resp.EndNodeThingID, info.Properties); err != nil {
+				return err
+			}
+		}
+		en = &EndNodeIdentity{
+			VendorThingID:   info.VendorThingID,
+			ThingID:         resp.EndNodeThingID,
+			AccessToken:     resp.AccessToken,
+			ThingType:       info.ThingType,
+			FirmwareVersion: info.FirmwareVersion,
+			Adapter:         info.Adapter,
+		}
+		return en.setPassword(info.Password)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := g.saveEndNode(en); err != nil {
+		return nil, err
+	}
+	c := *en
+	return &c, nil
+}
+
+// ForgetEndNode removes identity of an end node from the gateway.  It
+// doesn't change the end node on the cloud.
+func (g *Gateway) ForgetEndNode(vendorThingID string) error {
+	if err := g.Store.Delete(endNodeKeyPrefix + vendorThingID); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	delete(g.endNodes, vendorThingID)
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *Gateway) saveEndNode(en *EndNodeIdentity) error {
+	if err := putJSON(g.Store, endNodeKeyPrefix+en.VendorThingID, en); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	if g.endNodes == nil {
+		g.endNodes = map[string]*EndNodeIdentity{}
+	}
+	g.endNodes[en.VendorThingID] = en
+	g.mu.Unlock()
+	return nil
+}
+
+// EndNode returns identity of an onboarded end node.
+func (g *Gateway) EndNode(vendorThingID string) (*EndNodeIdentity, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	en, ok := g.endNodes[vendorThingID]
+	if !ok {
+		return nil, false
+	}
+	c := *en
+	return &c, true
+}
+
+// EndNodes returns identities of all onboarded end nodes ordered by
+// vendorThingID.
+func (g *Gateway) EndNodes() []*EndNodeIdentity {
+	g.mu.RLock()
+	list := make([]*EndNodeIdentity, 0, len(g.endNodes))
+	for _, en := range g.endNodes {
+		c := *en
+		list = append(list, &c)
+	}
+	g.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].VendorThingID < list[j].VendorThingID })
+	return list
+}
+
+func (g *Gateway) endNodeByThingID(thingID string) (*EndNodeIdentity, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, en := range g.endNodes {
+		if en.ThingID == thingID {
+			c := *en
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// withEndNode calls fn with APIAuthor of an end node.  When the token is
+// rejected, new token is generated and fn is retried.
+func (g *Gateway) withEndNode(vendorThingID string, fn func(a *APIAuthor, en *EndNodeIdentity) error) error {
+	if err := g.checkFence(); err != nil {
+		return err
+	}
+	en, ok := g.EndNode(vendorThingID)
+	if !ok {
+		return fmt.Errorf("end node %s is not onboarded", vendorThingID)
+	}
+	err := fn(&APIAuthor{Token: en.AccessToken, App: g.App}, en)
+	if !isAuthError(err) {
+		return err
+	}
+	gatewayID := g.ThingID()
+	var token *EndNodeTokenResponse
+	if terr := g.withGateway(func(a *APIAuthor) error {
+		var err error
+		token, err = a.GenerateEndNodeToken(gatewayID, en.ThingID, &EndNodeTokenRequest{})
+		return err
+	}); terr != nil {
+		return err
+	}
+	en.AccessToken = token.AccessToken
+	if err := g.saveEndNode(en); err != nil {
+		return err
+	}
+	return fn(&APIAuthor{Token: en.AccessToken, App: g.App}, en)
+}
+
+// EndNodeAuthor returns APIAuthor of an end node.
+func (g *Gateway) EndNodeAuthor(vendorThingID string) (*APIAuthor, error) {
+	en, ok := g.EndNode(vendorThingID)
+	if !ok {
+		return nil, fmt.Errorf("end node %s is not onboarded", vendorThingID)
+	}
+	return &APIAuthor{Token: en.AccessToken, App: g.App}, nil
+}
+
+// ReportEndNodeStatus reports online status of an end node.
+func (g *Gateway) ReportEndNodeStatus(vendorThingID string, online bool) error {
+	en, ok := g.EndNode(vendorThingID)
+	if !ok {
+		return fmt.Errorf("end node %s is not onboarded", vendorThingID)
+	}
+	gatewayID := g.ThingID()
+	return g.withGateway(func(a *APIAuthor) error {
+		return a.ReportEndnodeStatus(gatewayID, en.ThingID, ReportEndnodeStatusRequest{Online: online})
+	})
+}
+
+// UpdateEndNodeTraitState updates state of an alias of an end node.
+func (g *Gateway) UpdateEndNodeTraitState(vendorThingID, alias string, state interface{}) error {
+	return g.uploadState("endnode/"+vendorThingID+"/"+alias, state, func() error {
+		return g.withEndNode(vendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+			return a.UpdateTraitState(en.ThingID, alias, state)
+		})
+	})
+}
+
+// UpdateEndNodeMultipleTraitState updates states of aliases of an end node.
+func (g *Gateway) UpdateEndNodeMultipleTraitState(vendorThingID string, states interface{}) error {
+	return g.uploadState("endnode/"+vendorThingID, states, func() error {
+		return g.withEndNode(vendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+			return a.UpdateMultipleTraitState(en.ThingID, states)
+		})
+	})
+}
+
+// UpdateTraitState updates state of an alias of the gateway itself.
+func (g *Gateway) UpdateTraitState(alias string, state interface{}) error {
+	thingID := g.ThingID()
+	return g.uploadState("gateway/"+alias, state, func() error {
+		return g.withGateway(func(a *APIAuthor) error {
+			return a.UpdateTraitState(thingID, alias, state)
+		})
+	})
+}
+
+// OnReconnect adds fn which is called after MQTT reconnects, and returns a
+// function to remove it.
+func (g *Gateway) OnReconnect(fn func()) (remove func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reconnectHooks == nil {
+		g.reconnectHooks = map[int]func(){}
+	}
+	g.reconnectSeq++
+	id := g.reconnectSeq
+	g.reconnectHooks[id] = fn
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.reconnectHooks, id)
+	}
+}
+
+// Reconnected calls functions added by OnReconnect.  It is called by
+// MQTTConnector which implements MQTTReconnector.  Call it after other
+// connectors reconnect.
+func (g *Gateway) Reconnected() {
+	g.mu.RLock()
+	hooks := make([]func(), 0, len(g.reconnectHooks))
+	for _, fn := range g.reconnectHooks {
+		hooks = append(hooks, fn)
+	}
+	g.mu.RUnlock()
+	mqttLog.Debug("reconnected", "hooks", len(hooks))
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// commandNotification is payload of MQTT message which notifies a command.
+type commandNotification struct {
+	CommandID string `json:"commandID"`
+	Target    string `json:"target"`
+}
+
+func (g *Gateway) handleMQTTMessage(payload []byte) {
+	var n commandNotification
+	if err := json.Unmarshal(payload, &n); err != nil || n.CommandID == "" {
+		mqttLog.Debug("ignore MQTT message", "payload", string(payload))
+		return
+	}
+	thingID := n.Target
+	if i := strings.Index(thingID, ":"); i >= 0 {
+		thingID = thingID[i+1:]
+	}
+	if thingID == "" {
+		thingID = g.ThingID()
+	}
+	g.mu.Lock()
+	if !g.running || g.runCtx == nil {
+		g.mu.Unlock()
+		mqttLog.Debug("ignore command while not running", "commandID", n.CommandID)
+		return
+	}
+	ctx := g.runCtx
+	g.wg.Add(1)
+	g.mu.Unlock()
+	go func() {
+		defer g.wg.Done()
+		if err := g.HandleCommand(ctx, thingID, n.CommandID); err != nil && ctx.Err() == nil {
+			gatewayLog.Error("failed to handle command", "commandID", n.CommandID, "thingID", thingID, "error", err)
+		}
+	}()
+}
+
+// HandleCommand gets a command, executes it by CommandHandler or the
+// adapter of the end node, and updates action results.
+func (g *Gateway) HandleCommand(ctx context.Context, thingID, commandID string) error {
+	if thingID == g.ThingID() {
+		if g.CommandHandler == nil {
+			return errors.New("CommandHandler is not set")
+		}
+		var cmd *GetCommandResponse
+		if err := g.withGateway(func(a *APIAuthor) error {
+			var err error
+			cmd, err = a.GetCommand(thingID, commandID)
+			return err
+		}); err != nil {
+			return err
+		}
+		results, err := g.CommandHandler(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		return g.withGateway(func(a *APIAuthor) error {
+			return a.UpdateTraitCommandResults(thingID, commandID, UpdateCommandResultsRequest{ActionResults: results})
+		})
+	}
+
+	en, ok := g.endNodeByThingID(thingID)
+	if !ok {
+		return fmt.Errorf("thing %s is neither the gateway nor its end node", thingID)
+	}
+	adapter, err := g.adapterOf(en)
+	if err != nil {
+		return err
+	}
+	var cmd *GetCommandResponse
+	if err := g.withEndNode(en.VendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+		var err error
+		cmd, err = a.GetCommand(thingID, commandID)
+		return err
+	}); err != nil {
+		return err
+	}
+	results, err := adapter.HandleCommand(ctx, en, cmd)
+	if err != nil || results == nil {
+		return err
+	}
+	return g.UpdateEndNodeCommandResults(en.VendorThingID, commandID, results)
+}
+
+// UpdateEndNodeCommandResults updates action results of a command of an end
+// node.  Adapters which execute commands asynchronously return nil results
+// from HandleCommand, and call it when results are available.
+func (g *Gateway) UpdateEndNodeCommandResults(vendorThingID, commandID string, results []map[string]interface{}) error {
+	return g.withEndNode(vendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+		return a.UpdateTraitCommandResults(en.ThingID, commandID, UpdateCommandResultsRequest{ActionResults: results})
+	})
+}
+
+// UpdateEndNodeFirmwareVersion updates firmware version of an end node in
+// Kii Cloud and in the stored identity.
+func (g *Gateway) UpdateEndNodeFirmwareVersion(vendorThingID, firmwareVersion string) error {
+	return g.withEndNode(vendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+		if err := a.UpdateFirmwareVersion(en.ThingID, firmwareVersion); err != nil {
+			return err
+		}
+		en.FirmwareVersion = firmwareVersion
+		return g.saveEndNode(en)
+	})
+}
+
+// adapterOf returns adapter of an end node.  When the end node has no
+// adapter name and only one adapter is registered, it is returned.
+func (g *Gateway) adapterOf(en *EndNodeIdentity) (EndNodeAdapter, error) {
+	if en.Adapter == "" && len(g.Adapters) == 1 {
+		return g.Adapters[0], nil
+	}
+	for _, a := range g.Adapters {
+		if a.Name() == en.Adapter {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no adapter for end node %s", en.VendorThingID)
+}
+
+// isAuthError returns true when err shows that the token is rejected.  403
+// means the token is valid but not permitted, so it is not included.
+func isAuthError(err error) bool {
+	ce, ok := err.(*CloudError)
+	return ok && ce.HTTPStatus == 401
+}
@@ -0,0 +1,317 @@
+package kii
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// GatewayMigration moves all end nodes of a gateway to another one, like
+// when hardware of the gateway is replaced.  Progress is written to a
+// journal, so an interrupted migration can be resumed by Run or rolled back
+// by Rollback.
+//
+//	m := &kii.GatewayMigration{
+//		Author:        &ownerAuthor,
+//		FromGatewayID: oldID,
+//		ToGatewayID:   newID,
+//		JournalPath:   "migration.journal",
+//	}
+//	result, err := m.Run()
+type GatewayMigration struct {
+	// Author is used to call APIs.  It should be the owner of gateways.
+	Author *APIAuthor
+
+	FromGatewayID string
+	ToGatewayID   string
+
+	// JournalPath is path of the journal file.  It is required.
+	JournalPath string
+
+	// PageSize is bestEffortLimit of ListEndNodes.  Optional.
+	PageSize int
+
+	// OnToken is called with a new token of an end node which is moved.
+	// The token is of ToGatewayID in Run, and of FromGatewayID in Rollback.
+	// Tokens are not written to the journal.  Optional.
+	OnToken func(endNodeID string, token *EndNodeTokenResponse)
+}
+
+// MigrationFailure is a failure to migrate an end node.
+type MigrationFailure struct {
+	EndNodeID string
+	Err       error
+}
+
+// MigrationResult is result of GatewayMigration.
+type MigrationResult struct {
+	// EndNodes is thingIDs of all end nodes in the migration.
+	EndNodes []string
+	// Done is thingIDs of end nodes which are moved, or moved back by
+	// Rollback, including ones done in previous runs.
+	Done     []string
+	Failures []MigrationFailure
+}
+
+// Completed returns true when all end nodes are done.
+func (r *MigrationResult) Completed() bool {
+	return len(r.Done) == len(r.EndNodes)
+}
+
+const (
+	journalPlan       = "plan"
+	journalMoving     = "moving"
+	journalMoved      = "moved"
+	journalTokenDone  = "token"
+	journalRollback   = "rollback"
+	journalMovingBack = "movingBack"
+	journalMovedBack  = "movedBack"
+	journalTokenBack  = "tokenBack"
+)
+
+// journalEntry is a line of migration journal.
+type journalEntry struct {
+	Type      string    `json:"type"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	EndNodes  []string  `json:"endNodes,omitempty"`
+	EndNodeID string    `json:"endNodeID,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// migrationState is state of migration restored from journal.
+type migrationState struct {
+	planned    bool
+	endNodes   []string
+	status     map[string]string
+	rolledBack bool
+}
+
+// Run migrates end nodes.  On the first run, end nodes of FromGatewayID are
+// listed and recorded to the journal.  Later runs continue the recorded
+// migration.  Failures of end nodes are reported in MigrationResult, and
+// they are retried by the next run.
+func (m *GatewayMigration) Run() (*MigrationResult, error) {
+	st, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	if st.rolledBack {
+		return nil, errors.New("migration is rolled back")
+	}
+	f, err := m.openJournal()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !st.planned {
+		endNodes, err := m.listEndNodes()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeJournal(f, &journalEntry{Type: journalPlan, From: m.FromGatewayID, To: m.ToGatewayID, EndNodes: endNodes}); err != nil {
+			return nil, err
+		}
+		st.endNodes = endNodes
+	}
+
+	result := &MigrationResult{EndNodes: st.endNodes}
+	for _, id := range st.endNodes {
+		status := st.status[id]
+		if status == journalTokenDone {
+			result.Done = append(result.Done, id)
+			continue
+		}
+		if err := m.migrate(f, id, status); err != nil {
+			result.Failures = append(result.Failures, MigrationFailure{EndNodeID: id, Err: err})
+			continue
+		}
+		result.Done = append(result.Done, id)
+	}
+	return result, nil
+}
+
+// migrate moves an end node and regenerates its token.
+func (m *GatewayMigration) migrate(f *os.File, id, status string) error {
+	if status != journalMoved {
+		if err := writeJournal(f, &journalEntry{Type: journalMoving, EndNodeID: id}); err != nil {
+			return err
+		}
+		if err := m.move(m.FromGatewayID, m.ToGatewayID, id); err != nil {
+			return err
+		}
+		if err := writeJournal(f, &journalEntry{Type: journalMoved, EndNodeID: id}); err != nil {
+			return err
+		}
+	}
+	token, err := m.Author.GenerateEndNodeToken(m.ToGatewayID, id, &EndNodeTokenRequest{})
+	if err != nil {
+		return err
+	}
+	if m.OnToken != nil {
+		m.OnToken(id, token)
+	}
+	return writeJournal(f, &journalEntry{Type: journalTokenDone, EndNodeID: id})
+}
+
+// Rollback moves end nodes which have been moved back to FromGatewayID, and
+// regenerates their tokens for FromGatewayID.  After rollback, the migration
+// can't be resumed.
+func (m *GatewayMigration) Rollback() (*MigrationResult, error) {
+	st, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	if !st.planned {
+		return nil, errors.New("migration is not started")
+	}
+	f, err := m.openJournal()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !st.rolledBack {
+		if err := writeJournal(f, &journalEntry{Type: journalRollback}); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &MigrationResult{}
+	for i := len(st.endNodes) - 1; i >= 0; i-- {
+		id := st.endNodes[i]
+		status, ok := st.status[id]
+		if !ok {
+			continue
+		}
+		result.EndNodes = append(result.EndNodes, id)
+		if status == journalTokenBack {
+			result.Done = append(result.Done, id)
+			continue
+		}
+		if err := m.rollback(f, id, status); err != nil {
+			result.Failures = append(result.Failures, MigrationFailure{EndNodeID: id, Err: err})
+			continue
+		}
+		result.Done = append(result.Done, id)
+	}
+	return result, nil
+}
+
+// rollback moves an end node back and regenerates its token.
+func (m *GatewayMigration) rollback(f *os.File, id, status string) error {
+	if status != journalMovedBack {
+		if err := writeJournal(f, &journalEntry{Type: journalMovingBack, EndNodeID: id}); err != nil {
+			return err
+		}
+		if err := m.move(m.ToGatewayID, m.FromGatewayID, id); err != nil {
+			return err
+		}
+		if err := writeJournal(f, &journalEntry{Type: journalMovedBack, EndNodeID: id}); err != nil {
+			return err
+		}
+	}
+	token, err := m.Author.GenerateEndNodeToken(m.FromGatewayID, id, &EndNodeTokenRequest{})
+	if err != nil {
+		return err
+	}
+	if m.OnToken != nil {
+		m.OnToken(id, token)
+	}
+	return writeJournal(f, &journalEntry{Type: journalTokenBack, EndNodeID: id})
+}
+
+// move adds an end node to a gateway and detaches it from another.  The end
+// node is added first, so that it is never left without gateway.  Unlike
+// MoveEndNode, an end node which has been already detached is accepted, so
+// that a move interrupted by crash can be retried.
+func (m *GatewayMigration) move(from, to, id string) error {
+	if err := m.Author.AddEndNode(to, id); err != nil {
+		return err
+	}
+	if err := m.Author.RemoveEndNode(from, id); err != nil && !isNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func isNotFoundError(err error) bool {
+	ce, ok := err.(*CloudError)
+	return ok && ce.HTTPStatus == 404
+}
+
+func (m *GatewayMigration) listEndNodes() ([]string, error) {
+	var ids []string
+	list := ListRequest{BestEffortLimit: m.PageSize}
+	for {
+		resp, err := m.Author.ListEndNodes(m.FromGatewayID, list)
+		if err != nil {
+			return nil, err
+		}
+		for _, en := range resp.Results {
+			ids = append(ids, en.ThingID)
+		}
+		if resp.NextPaginationKey == "" {
+			return ids, nil
+		}
+		list.NextPaginationKey = resp.NextPaginationKey
+	}
+}
+
+// load restores state of the migration from the journal.
+func (m *GatewayMigration) load() (*migrationState, error) {
+	if m.Author == nil || m.JournalPath == "" || m.FromGatewayID == "" || m.ToGatewayID == "" {
+		return nil, errors.New("Author, JournalPath, FromGatewayID and ToGatewayID are required")
+	}
+	st := &migrationState{status: map[string]string{}}
+	f, err := os.Open(m.JournalPath)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		var e journalEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// the last line may be broken by crash.
+			gatewayLog.Warn("skip broken journal line", "line", line, "path", m.JournalPath, "error", err)
+			continue
+		}
+		switch e.Type {
+		case journalPlan:
+			if e.From != m.FromGatewayID || e.To != m.ToGatewayID {
+				return nil, fmt.Errorf("journal %s is migration from %s to %s", m.JournalPath, e.From, e.To)
+			}
+			st.planned = true
+			st.endNodes = e.EndNodes
+		case journalRollback:
+			st.rolledBack = true
+		default:
+			st.status[e.EndNodeID] = e.Type
+		}
+	}
+	return st, s.Err()
+}
+
+func (m *GatewayMigration) openJournal() (*os.File, error) {
+	return os.OpenFile(m.JournalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+func writeJournal(f *os.File, e *journalEntry) error {
+	e.Time = time.Now()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,200 @@
+package kii
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func startMigrationGateways(t *testing.T, c *fakeThingCloud) (*Gateway, *Gateway) {
+	from := startTestGateway(t, c)
+	to := &Gateway{App: c.App, VendorThingID: "gw-2", Password: "pass"}
+	if err := to.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start gateway: %s", err)
+	}
+	return from, to
+}
+
+func TestGatewayMigration(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	from, to := startMigrationGateways(t, c)
+	defer from.Stop(context.Background())
+	defer to.Stop(context.Background())
+	en1 := c.addEndNode(from.ThingID(), "en-1")
+	en2 := c.addEndNode(from.ThingID(), "en-2")
+	en3 := c.addEndNode(from.ThingID(), "en-3")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tokens := map[string]string{}
+	m := &GatewayMigration{
+		Author:        from.Author(),
+		FromGatewayID: from.ThingID(),
+		ToGatewayID:   to.ThingID(),
+		JournalPath:   filepath.Join(dir, "migration.journal"),
+		PageSize:      2,
+		OnToken: func(id string, token *EndNodeTokenResponse) {
+			tokens[id] = token.AccessToken
+		},
+	}
+
+	// adding en-2 fails in the first run.
+	c.handle("PUT", "api:/things/"+to.ThingID()+"/end-nodes/"+en2, func(req *fakeRequest, m []string) (int, interface{}) {
+		return 500, map[string]interface{}{"errorCode": "UNEXPECTED_ERROR"}
+	})
+	result, err := m.Run()
+	if err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	if result.Completed() || len(result.Failures) != 1 || result.Failures[0].EndNodeID != en2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if !reflect.DeepEqual(result.EndNodes, []string{en1, en2, en3}) {
+		t.Errorf("unexpected end nodes: %v", result.EndNodes)
+	}
+	if !c.hasEndNode(to.ThingID(), en1) || !c.hasEndNode(to.ThingID(), en3) {
+		t.Errorf("end nodes should be moved")
+	}
+	if !c.hasEndNode(from.ThingID(), en2) {
+		t.Errorf("end node failed to move should be kept")
+	}
+	if n := len(c.requestsTo("DELETE", "api:/things/"+from.ThingID()+"/end-nodes/"+en2)); n != 0 {
+		t.Errorf("end node should not be detached before it is added: %d", n)
+	}
+	if len(tokens) != 2 || tokens[en1] == "" || tokens[en3] == "" {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+
+	// resume: only en-2 is moved.
+	c.handle("PUT", "api:/things/("+to.ThingID()+")/end-nodes/"+en2, func(req *fakeRequest, m []string) (int, interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.endNodes[m[1]][en2] = true
+		return 204, nil
+	})
+	lists := len(c.requestsTo("GET", "thing-if:/things/[^/]+/end-nodes"))
+	moves := len(c.requestsTo("DELETE", "api:/things/[^/]+/end-nodes/[^/]+"))
+	result, err = m.Run()
+	if err != nil {
+		t.Fatalf("failed to resume: %s", err)
+	}
+	if !result.Completed() || len(result.Failures) != 0 {
+		t.Fatalf("migration should be completed: %+v", result)
+	}
+	if !c.hasEndNode(to.ThingID(), en2) || c.hasEndNode(from.ThingID(), en2) {
+		t.Errorf("en-2 should be moved")
+	}
+	if n := len(c.requestsTo("GET", "thing-if:/things/[^/]+/end-nodes")); n != lists {
+		t.Errorf("end nodes should not be listed again: %d", n-lists)
+	}
+	if n := len(c.requestsTo("DELETE", "api:/things/[^/]+/end-nodes/[^/]+")); n != moves+1 {
+		t.Errorf("only en-2 should be moved: %d", n-moves)
+	}
+
+	// rollback moves all end nodes back with new tokens.
+	moved := map[string]string{}
+	for k, v := range tokens {
+		moved[k] = v
+	}
+	result, err = m.Rollback()
+	if err != nil {
+		t.Fatalf("failed to rollback: %s", err)
+	}
+	if !result.Completed() || !reflect.DeepEqual(result.EndNodes, []string{en3, en2, en1}) {
+		t.Errorf("unexpected rollback result: %+v", result)
+	}
+	for _, id := range []string{en1, en2, en3} {
+		if !c.hasEndNode(from.ThingID(), id) || c.hasEndNode(to.ThingID(), id) {
+			t.Errorf("%s should be moved back", id)
+		}
+		if tokens[id] == "" || tokens[id] == moved[id] {
+			t.Errorf("token of %s should be regenerated: %v", id, tokens)
+		}
+	}
+	if n := len(c.requestsTo("POST", "api:/things/"+from.ThingID()+"/end-nodes/[^/]+/token")); n != 3 {
+		t.Errorf("tokens should be generated for the original gateway: %d", n)
+	}
+	if _, err := m.Run(); err == nil {
+		t.Errorf("rolled back migration should not be resumed")
+	}
+}
+
+func TestGatewayMigrationJournalMismatch(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	from, to := startMigrationGateways(t, c)
+	defer from.Stop(context.Background())
+	defer to.Stop(context.Background())
+	c.addEndNode(from.ThingID(), "en-1")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	m := &GatewayMigration{
+		Author:        from.Author(),
+		FromGatewayID: from.ThingID(),
+		ToGatewayID:   to.ThingID(),
+		JournalPath:   filepath.Join(dir, "migration.journal"),
+	}
+	if _, err := m.Rollback(); err == nil {
+		t.Errorf("migration not started should not be rolled back")
+	}
+	if _, err := m.Run(); err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	m.FromGatewayID, m.ToGatewayID = m.ToGatewayID, m.FromGatewayID
+	if _, err := m.Run(); err == nil {
+		t.Errorf("journal of other migration should be rejected")
+	}
+}
+
+func TestGatewayMigrationResumeMoving(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	from, to := startMigrationGateways(t, c)
+	defer from.Stop(context.Background())
+	defer to.Stop(context.Background())
+	en1 := c.addEndNode(from.ThingID(), "en-1")
+	en2 := c.addEndNode(from.ThingID(), "en-2")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "migration.journal")
+	tokens := map[string]string{}
+	m := &GatewayMigration{
+		Author:        from.Author(),
+		FromGatewayID: from.ThingID(),
+		ToGatewayID:   to.ThingID(),
+		JournalPath:   path,
+		OnToken: func(id string, token *EndNodeTokenResponse) {
+			tokens[id] = token.AccessToken
+		},
+	}
+
+	// crashed after en-1 is detached from the original gateway.
+	f, err := m.openJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJournal(f, &journalEntry{Type: journalPlan, From: m.FromGatewayID, To: m.ToGatewayID, EndNodes: []string{en1, en2}})
+	writeJournal(f, &journalEntry{Type: journalMoving, EndNodeID: en1})
+	f.Close()
+	c.mu.Lock()
+	delete(c.endNodes[from.ThingID()], en1)
+	c.mu.Unlock()
+
+	result, err := m.Run()
+	if err != nil {
+		t.Fatalf("failed to resume: %s", err)
+	}
+	if !result.Completed() || len(result.Failures) != 0 {
+		t.Fatalf("migration should be completed: %+v", result)
+	}
+	for _, id := range []string{en1, en2} {
+		if !c.hasEndNode(to.ThingID(), id) || c.hasEndNode(from.ThingID(), id) || tokens[id] == "" {
+			t.Errorf("%s should be moved with new token", id)
+		}
+	}
+}
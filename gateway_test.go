@@ -0,0 +1,422 @@
+package kii
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMQTT struct {
+	mu          sync.Mutex
+	endpoint    MqttEndpoint
+	handler     func(payload []byte)
+	onReconnect func()
+	connected   bool
+}
+
+func (m *fakeMQTT) SetReconnectHandler(handler func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onReconnect = handler
+}
+
+func (m *fakeMQTT) Connect(ctx context.Context, endpoint MqttEndpoint, handler func(payload []byte)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoint = endpoint
+	m.handler = handler
+	m.connected = true
+	return nil
+}
+
+func (m *fakeMQTT) Disconnect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected = false
+	return nil
+}
+
+func (m *fakeMQTT) reconnect() {
+	m.mu.Lock()
+	h := m.onReconnect
+	m.mu.Unlock()
+	h()
+}
+
+func (m *fakeMQTT) deliver(payload string) {
+	m.mu.Lock()
+	h := m.handler
+	m.mu.Unlock()
+	h([]byte(payload))
+}
+
+type fakeAdapter struct {
+	name     string
+	started  chan struct{}
+	stopped  chan struct{}
+	commands chan *GetCommandResponse
+}
+
+func newFakeAdapter(name string) *fakeAdapter {
+	return &fakeAdapter{
+		name:     name,
+		started:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		commands: make(chan *GetCommandResponse, 10),
+	}
+}
+
+func (a *fakeAdapter) Name() string { return a.name }
+
+func (a *fakeAdapter) Run(ctx context.Context, gw *Gateway) error {
+	close(a.started)
+	<-ctx.Done()
+	close(a.stopped)
+	return ctx.Err()
+}
+
+func (a *fakeAdapter) HandleCommand(ctx context.Context, en *EndNodeIdentity, cmd *GetCommandResponse) ([]map[string]interface{}, error) {
+	a.commands <- cmd
+	return []map[string]interface{}{
+		{"light": []interface{}{map[string]interface{}{"turnPower": map[string]interface{}{"succeeded": true}}}},
+	}, nil
+}
+
+func waitCommandDone(t *testing.T, c *fakeThingCloud, commandID string) GetCommandResponse {
+	for i := 0; i < 100; i++ {
+		if cmd := c.command(commandID); cmd.CommandState == "DONE" {
+			return cmd
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("command %s is not done", commandID)
+	return GetCommandResponse{}
+}
+
+func TestGatewayStartAndRestart(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gateway.json")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mqtt := &fakeMQTT{}
+	adapter := newFakeAdapter("zigbee")
+	gw := &Gateway{
+		App:           c.App,
+		VendorThingID: "gw-1",
+		Password:      "pass",
+		Store:         store,
+		MQTT:          mqtt,
+		Adapters:      []EndNodeAdapter{adapter},
+	}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	<-adapter.started
+	if gw.ThingID() == "" || !mqtt.connected || mqtt.endpoint.MqttTopic != "topic-"+gw.ThingID() {
+		t.Errorf("gateway should be onboarded and connected: %s %+v", gw.ThingID(), mqtt.endpoint)
+	}
+	if err := gw.Start(ctx); err == nil {
+		t.Errorf("second start should fail")
+	}
+
+	en, err := gw.OnboardEndNode(EndNodeInfo{
+		VendorThingID: "en-1",
+		Password:      "pass",
+		Properties:    map[string]interface{}{"color": "red"},
+		Adapter:       "zigbee",
+	})
+	if err != nil {
+		t.Fatalf("failed to onboard end node: %s", err)
+	}
+	if err := gw.ReportEndNodeStatus("en-1", true); err != nil {
+		t.Errorf("failed to report status: %s", err)
+	}
+	if !c.isOnline(en.ThingID) {
+		t.Errorf("end node should be online")
+	}
+	if err := gw.UpdateEndNodeTraitState("en-1", "light", map[string]interface{}{"power": true}); err != nil {
+		t.Errorf("failed to update state: %s", err)
+	}
+	if s := c.state(en.ThingID, "light"); !reflect.DeepEqual(s, map[string]interface{}{"power": true}) {
+		t.Errorf("unexpected state: %v", s)
+	}
+	if err := gw.ReportEndNodeStatus("unknown", true); err == nil {
+		t.Errorf("unknown end node should fail")
+	}
+
+	if err := gw.Stop(ctx); err != nil {
+		t.Errorf("failed to stop: %s", err)
+	}
+	<-adapter.stopped
+	if mqtt.connected {
+		t.Errorf("MQTT should be disconnected")
+	}
+
+	// restart with persisted identities.
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw2 := &Gateway{
+		App:           c.App,
+		VendorThingID: "gw-1",
+		Password:      "pass",
+		Store:         store,
+	}
+	if err := gw2.Start(ctx); err != nil {
+		t.Fatalf("failed to restart: %s", err)
+	}
+	defer gw2.Stop(ctx)
+	if gw2.ThingID() != gw.ThingID() {
+		t.Errorf("identity should be restored: %s != %s", gw2.ThingID(), gw.ThingID())
+	}
+	if n := len(c.requestsTo("POST", "thing-if:/onboardings")); n != 2 {
+		t.Errorf("gateway should not onboard again: %d onboardings", n)
+	}
+	if list := gw2.EndNodes(); len(list) != 1 || *list[0] != *en {
+		t.Errorf("end nodes should be restored: %+v", list)
+	}
+	if got, err := gw2.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass"}); err != nil || *got != *en {
+		t.Errorf("onboarded end node should be reused: %+v, %v", got, err)
+	}
+	if _, err := gw2.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "wrong"}); err != ErrWrongPassword {
+		t.Errorf("wrong password should be rejected: %v", err)
+	}
+}
+
+func TestGatewayCommandRouting(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	mqtt := &fakeMQTT{}
+	adapter := newFakeAdapter("ble")
+	gwCommands := make(chan *GetCommandResponse, 1)
+	gw := &Gateway{
+		App:           c.App,
+		VendorThingID: "gw-1",
+		Password:      "pass",
+		MQTT:          mqtt,
+		Adapters:      []EndNodeAdapter{adapter},
+		CommandHandler: func(ctx context.Context, cmd *GetCommandResponse) ([]map[string]interface{}, error) {
+			gwCommands <- cmd
+			return []map[string]interface{}{}, nil
+		},
+	}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(ctx)
+	en, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass"})
+	if err != nil {
+		t.Fatalf("failed to onboard end node: %s", err)
+	}
+
+	actions := []map[string]interface{}{
+		{"light": []interface{}{map[string]interface{}{"turnPower": true}}},
+	}
+	c.addCommand(en.ThingID, "cmd-1", actions)
+	mqtt.deliver(`{"commandID":"cmd-1","target":"thing:` + en.ThingID + `"}`)
+	select {
+	case cmd := <-adapter.commands:
+		if cmd.CommandID != "cmd-1" || len(cmd.Actions) != 1 {
+			t.Errorf("unexpected command: %+v", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("command should be routed to adapter")
+	}
+	if cmd := waitCommandDone(t, c, "cmd-1"); len(cmd.ActionResults) != 1 {
+		t.Errorf("action results should be updated: %+v", cmd)
+	}
+
+	c.addCommand(gw.ThingID(), "cmd-2", actions)
+	mqtt.deliver(`{"commandID":"cmd-2","target":"THING:` + gw.ThingID() + `"}`)
+	select {
+	case cmd := <-gwCommands:
+		if cmd.CommandID != "cmd-2" {
+			t.Errorf("unexpected command: %+v", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("command should be routed to gateway")
+	}
+	waitCommandDone(t, c, "cmd-2")
+
+	if err := gw.HandleCommand(ctx, "th.unknown", "cmd-3"); err == nil {
+		t.Errorf("command for unknown thing should fail")
+	}
+}
+
+func TestGatewayTokenRefresh(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass"}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(ctx)
+	en, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass"})
+	if err != nil {
+		t.Fatalf("failed to onboard end node: %s", err)
+	}
+
+	c.revokeTokens(en.ThingID)
+	if err := gw.UpdateEndNodeTraitState("en-1", "light", map[string]interface{}{"power": false}); err != nil {
+		t.Errorf("token of end node should be regenerated: %s", err)
+	}
+	if n := len(c.requestsTo("POST", "api:/things/[^/]+/end-nodes/[^/]+/token")); n != 1 {
+		t.Errorf("token should be generated once: %d", n)
+	}
+	if got, _ := gw.EndNode("en-1"); got.AccessToken == en.AccessToken {
+		t.Errorf("new token should be saved")
+	}
+
+	c.revokeTokens(gw.ThingID())
+	onboardings := len(c.requestsTo("POST", "thing-if:/onboardings"))
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := gw.ReportEndNodeStatus("en-1", true); err != nil {
+				t.Errorf("gateway should be onboarded again: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(c.requestsTo("POST", "thing-if:/onboardings")) - onboardings; n != 1 {
+		t.Errorf("gateway should be onboarded once: %d", n)
+	}
+
+	c.handle("PUT", "thing-if:/things/[^/]+/end-nodes/[^/]+/connection", func(req *fakeRequest, m []string) (int, interface{}) {
+		return 403, map[string]interface{}{"errorCode": "THING_ACCESS_FORBIDDEN"}
+	})
+	onboardings = len(c.requestsTo("POST", "thing-if:/onboardings"))
+	if err := gw.ReportEndNodeStatus("en-1", false); err == nil {
+		t.Errorf("403 should be returned")
+	}
+	if n := len(c.requestsTo("POST", "thing-if:/onboardings")) - onboardings; n != 0 {
+		t.Errorf("gateway should not be onboarded on 403: %d", n)
+	}
+}
+
+func TestGatewayStopCancelsCommands(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	mqtt := &fakeMQTT{}
+	handling := make(chan struct{})
+	canceled := make(chan struct{})
+	gw := &Gateway{
+		App:           c.App,
+		VendorThingID: "gw-1",
+		Password:      "pass",
+		MQTT:          mqtt,
+		CommandHandler: func(ctx context.Context, cmd *GetCommandResponse) ([]map[string]interface{}, error) {
+			close(handling)
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		},
+	}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	c.addCommand(gw.ThingID(), "cmd-1", []map[string]interface{}{})
+	mqtt.deliver(`{"commandID":"cmd-1","target":"thing:` + gw.ThingID() + `"}`)
+	select {
+	case <-handling:
+	case <-time.After(time.Second):
+		t.Fatalf("command should be handled")
+	}
+	stopCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := gw.Stop(stopCtx); err != nil {
+		t.Errorf("Stop should wait the command: %s", err)
+	}
+	select {
+	case <-canceled:
+	default:
+		t.Errorf("context of the command should be canceled by Stop")
+	}
+}
+
+func TestGatewayStartFail(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	c.handle("POST", "thing-if:/onboardings", func(req *fakeRequest, m []string) (int, interface{}) {
+		return 403, map[string]interface{}{"errorCode": "WRONG_PASSWORD"}
+	})
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "wrong"}
+	err := gw.Start(context.Background())
+	if ce, ok := err.(*CloudError); !ok || ce.HTTPStatus != 403 {
+		t.Errorf("start should fail with 403: %v", err)
+	}
+	if _, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1"}); err == nil {
+		t.Errorf("not started gateway should fail")
+	}
+
+	store := NewMemoryStore()
+	putJSON(store, gatewayIdentityKey, &GatewayIdentity{VendorThingID: "gw-other"})
+	gw = &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Store: store}
+	if err := gw.Start(context.Background()); err == nil {
+		t.Errorf("identity of other gateway should be rejected")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Errorf("should be ErrNotFound: %v", err)
+	}
+	if err := s.Put("a", []byte("not json")); err == nil {
+		t.Errorf("invalid JSON should be rejected")
+	}
+	for _, k := range []string{"p/2", "p/1", "q/1"} {
+		if err := s.Put(k, []byte(`{"k":"`+k+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("q/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := s.Keys("p/")
+	if !reflect.DeepEqual(keys, []string{"p/1", "p/2"}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	var v map[string]string
+	if err := getJSON(s, "p/2", &v); err != nil || v["k"] != "p/2" {
+		t.Errorf("unexpected value: %v, %v", v, err)
+	}
+	if _, err := s.Get("q/1"); err != ErrNotFound {
+		t.Errorf("deleted key should not be found: %v", err)
+	}
+	if err := s.Delete("q/1"); err != nil {
+		t.Errorf("deleting not existing key should succeed: %v", err)
+	}
+	if _, err := OpenFileStore(dir); err == nil {
+		t.Errorf("directory should not be opened")
+	}
+}
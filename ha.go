@@ -0,0 +1,296 @@
+package kii
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStandby is returned by HAGateway when the instance is not the leader.
+var ErrStandby = errors.New("gateway is standby")
+
+// LeaseBackend elects the leader of gateway instances.
+type LeaseBackend interface {
+	// Acquire acquires the lease for holder, or renews it when holder
+	// already has it.  It returns false when another holder has the
+	// lease.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// Release releases the lease of holder.
+	Release(holder string) error
+}
+
+// HAGateway runs Gateway in active/standby mode.  Instances share the same
+// gateway identity, and only the leader elected by Lease runs Gateway.
+//
+// Standby instances must have replicated Store of the gateway, so that the
+// leader can take over the identity, end nodes and credentials without
+// onboarding again.  Use FileStore on shared storage with FileLease, or
+// give the store to PeerLease.
+//
+// The lease is renewed on every LeaseTTL/3.  When the leader can't renew
+// the lease until it expires, it stops Gateway, so a standby takes over
+// within LeaseTTL and LeaseTTL/3.  Requests of Gateway, including those of
+// adapters and agents given the Gateway, fail with ErrStandby as soon as
+// the lease expires, and states uploaded by Gateway are deduplicated after
+// taking over.
+//
+//	ha := &kii.HAGateway{
+//		Gateway: gw,
+//		Lease:   &kii.FileLease{Path: "/mnt/shared/gateway.lease"},
+//		Holder:  hostname,
+//	}
+//	go ha.Run(ctx)
+type HAGateway struct {
+	Gateway *Gateway
+	Lease   LeaseBackend
+
+	// Holder is unique name of this instance.
+	Holder string
+
+	// LeaseTTL is time to live of the lease.  Default is 15 seconds.
+	LeaseTTL time.Duration
+
+	// DedupWindow is duration after taking over the lease, while states
+	// which are the same as the last uploaded ones are skipped.  Default
+	// is LeaseTTL.
+	DedupWindow time.Duration
+
+	// OnChange is called when this instance becomes the leader or
+	// standby.  Optional.
+	OnChange func(leader bool)
+
+	mu      sync.Mutex
+	leader  bool
+	expires time.Time
+	// since is when this instance started to become the leader.
+	since time.Time
+	// uploadLocks serialize uploads of each key to suppress duplicates.
+	uploadLocks map[string]*sync.Mutex
+}
+
+const haUploadedKeyPrefix = "ha/uploaded/"
+
+func (h *HAGateway) dedupWindow() time.Duration {
+	if h.DedupWindow > 0 {
+		return h.DedupWindow
+	}
+	return h.leaseTTL()
+}
+
+func (h *HAGateway) leaseTTL() time.Duration {
+	if h.LeaseTTL > 0 {
+		return h.LeaseTTL
+	}
+	return 15 * time.Second
+}
+
+// IsLeader returns true when this instance is the leader and its lease is
+// valid.
+func (h *HAGateway) IsLeader() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.leader && time.Now().Before(h.expires)
+}
+
+// checkLease is the fence of Gateway.  It fails when the lease isn't
+// valid.
+func (h *HAGateway) checkLease() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !time.Now().Before(h.expires) {
+		return ErrStandby
+	}
+	return nil
+}
+
+// Run takes part in the election until ctx is done.  Gateway is started
+// when this instance becomes the leader, and stopped when it loses the
+// lease.  The lease is released at the end.
+func (h *HAGateway) Run(ctx context.Context) error {
+	if h.Gateway == nil || h.Lease == nil || h.Holder == "" {
+		return errors.New("Gateway, Lease and Holder are required")
+	}
+	h.Gateway.setHA(h.checkLease, h.upload)
+	ttl := h.leaseTTL()
+	t := time.NewTicker(ttl / 3)
+	defer t.Stop()
+	expiry := time.NewTimer(ttl)
+	defer expiry.Stop()
+	for {
+		h.elect(ctx, ttl)
+		if !expiry.Stop() {
+			select {
+			case <-expiry.C:
+			default:
+			}
+		}
+		expiry.Reset(h.untilExpiry(ttl))
+		select {
+		case <-ctx.Done():
+			h.stepDown()
+			if err := h.Lease.Release(h.Holder); err != nil {
+				gatewayLog.Warn("failed to release lease", "holder", h.Holder, "error", err)
+			}
+			return ctx.Err()
+		case <-t.C:
+		case <-expiry.C:
+			// the lease couldn't be renewed in time.
+			if h.checkLease() != nil {
+				h.stepDown()
+			}
+		}
+	}
+}
+
+// untilExpiry returns duration until the lease expires, or ttl when this
+// instance isn't the leader.
+func (h *HAGateway) untilExpiry(ttl time.Duration) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.leader {
+		return ttl
+	}
+	return time.Until(h.expires)
+}
+
+// elect acquires or renews the lease, and starts or stops Gateway.
+func (h *HAGateway) elect(ctx context.Context, ttl time.Duration) {
+	start := time.Now()
+	ok, err := h.Lease.Acquire(ctx, h.Holder, ttl)
+	if err != nil {
+		gatewayLog.Warn("failed to acquire lease", "holder", h.Holder, "error", err)
+	}
+	h.mu.Lock()
+	leader := h.leader
+	if ok {
+		// expiry is counted from the request, not the response.
+		h.expires = start.Add(ttl)
+	}
+	valid := time.Now().Before(h.expires)
+	h.mu.Unlock()
+
+	switch {
+	case ok && !leader:
+		// adapters may upload states in Start.
+		h.mu.Lock()
+		h.since = time.Now()
+		h.mu.Unlock()
+		if err := h.Gateway.Start(ctx); err != nil {
+			gatewayLog.Error("failed to start gateway as leader", "holder", h.Holder, "error", err)
+			if rerr := h.Lease.Release(h.Holder); rerr != nil {
+				gatewayLog.Warn("failed to release lease", "holder", h.Holder, "error", rerr)
+			}
+			return
+		}
+		h.setLeader(true)
+	case !ok && leader && (err == nil || !valid):
+		// lease is taken by other, or can't be renewed until it expires.
+		h.stepDown()
+	}
+}
+
+func (h *HAGateway) setLeader(leader bool) {
+	h.mu.Lock()
+	changed := h.leader != leader
+	h.leader = leader
+	if !leader {
+		h.expires = time.Time{}
+	}
+	h.mu.Unlock()
+	if changed {
+		gatewayLog.Debug("leadership changed", "holder", h.Holder, "leader", leader)
+		if h.OnChange != nil {
+			h.OnChange(leader)
+		}
+	}
+}
+
+func (h *HAGateway) stepDown() {
+	h.mu.Lock()
+	leader := h.leader
+	h.mu.Unlock()
+	if !leader {
+		return
+	}
+	h.setLeader(false)
+	ctx, cancel := context.WithTimeout(context.Background(), h.leaseTTL())
+	defer cancel()
+	if err := h.Gateway.Stop(ctx); err != nil {
+		gatewayLog.Warn("failed to stop gateway", "holder", h.Holder, "error", err)
+	}
+}
+
+// UpdateTraitState updates state of the gateway like
+// Gateway.UpdateTraitState.  It returns ErrStandby on standby instances.
+// Within DedupWindow after taking over, Gateway skips the state which is
+// the same as the last uploaded one, which may be uploaded by the previous
+// leader.
+func (h *HAGateway) UpdateTraitState(alias string, state interface{}) error {
+	if !h.IsLeader() {
+		return ErrStandby
+	}
+	return h.Gateway.UpdateTraitState(alias, state)
+}
+
+// UpdateEndNodeTraitState updates state of an end node like
+// Gateway.UpdateEndNodeTraitState, suppressing duplicates.
+func (h *HAGateway) UpdateEndNodeTraitState(vendorThingID, alias string, state interface{}) error {
+	if !h.IsLeader() {
+		return ErrStandby
+	}
+	return h.Gateway.UpdateEndNodeTraitState(vendorThingID, alias, state)
+}
+
+// UpdateEndNodeMultipleTraitState updates states of an end node like
+// Gateway.UpdateEndNodeMultipleTraitState, suppressing duplicates.
+func (h *HAGateway) UpdateEndNodeMultipleTraitState(vendorThingID string, states interface{}) error {
+	if !h.IsLeader() {
+		return ErrStandby
+	}
+	return h.Gateway.UpdateEndNodeMultipleTraitState(vendorThingID, states)
+}
+
+// upload is called by Gateway for each state upload.  It calls fn unless
+// state is the same as the last uploaded state of key within DedupWindow
+// after taking over.  Digests of uploaded states are saved to Store of
+// Gateway, so they are replicated with the store.
+func (h *HAGateway) upload(key string, state interface{}, fn func() error) error {
+	b, err := json.Marshal(normalizeJSON(state))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	digest := hex.EncodeToString(sum[:])
+
+	h.mu.Lock()
+	dedup := time.Since(h.since) < h.dedupWindow()
+	if h.uploadLocks == nil {
+		h.uploadLocks = map[string]*sync.Mutex{}
+	}
+	mu, ok := h.uploadLocks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		h.uploadLocks[key] = mu
+	}
+	h.mu.Unlock()
+
+	// uploads of other keys run in parallel.
+	mu.Lock()
+	defer mu.Unlock()
+	var last string
+	if err := getJSON(h.Gateway.Store, haUploadedKeyPrefix+key, &last); err != nil && err != ErrNotFound {
+		return err
+	}
+	if dedup && last == digest {
+		gatewayLog.Debug("skip duplicated upload", "key", key)
+		return nil
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return putJSON(h.Gateway.Store, haUploadedKeyPrefix+key, digest)
+}
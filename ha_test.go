@@ -0,0 +1,259 @@
+package kii
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestFileLease(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l := &FileLease{Path: filepath.Join(dir, "gateway.lease")}
+	ctx := context.Background()
+	ttl := 200 * time.Millisecond
+
+	if ok, err := l.Acquire(ctx, "a", ttl); !ok || err != nil {
+		t.Fatalf("a should acquire: %t %v", ok, err)
+	}
+	if ok, err := l.Acquire(ctx, "b", ttl); ok || err != nil {
+		t.Errorf("b should not acquire: %t %v", ok, err)
+	}
+	if ok, _ := l.Acquire(ctx, "a", ttl); !ok {
+		t.Errorf("a should renew")
+	}
+	if err := l.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Acquire(ctx, "b", ttl); ok {
+		t.Errorf("release by other holder should be ignored")
+	}
+	if err := l.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Acquire(ctx, "b", ttl); !ok {
+		t.Errorf("b should acquire released lease")
+	}
+	time.Sleep(ttl)
+	if ok, _ := l.Acquire(ctx, "a", ttl); !ok {
+		t.Errorf("a should acquire expired lease")
+	}
+}
+
+func newPeerLeases(t *testing.T, s1, s2 Store) (*PeerLease, *PeerLease) {
+	l1 := &PeerLease{ListenAddr: "127.0.0.1:0", Secret: "secret", Store: s1, Timeout: 200 * time.Millisecond}
+	l2 := &PeerLease{ListenAddr: "127.0.0.1:0", Secret: "secret", Store: s2, Timeout: 200 * time.Millisecond}
+	if err := l1.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l2.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	l1.PeerAddr = l2.Addr().String()
+	l2.PeerAddr = l1.Addr().String()
+	return l1, l2
+}
+
+func TestPeerLease(t *testing.T) {
+	s1 := NewMemoryStore()
+	s1.Put("gateway", []byte(`{"thingID":"th.1"}`))
+	s2 := NewMemoryStore()
+	s2.Put("stale", []byte(`true`))
+	l1, l2 := newPeerLeases(t, s1, s2)
+	defer l2.Close()
+	ctx := context.Background()
+	ttl := 300 * time.Millisecond
+
+	if ok, err := l1.Acquire(ctx, "a", ttl); !ok || err != nil {
+		t.Fatalf("a should acquire: %t %v", ok, err)
+	}
+	if ok, err := l2.Acquire(ctx, "b", ttl); ok || err != nil {
+		t.Errorf("b should not acquire: %t %v", ok, err)
+	}
+	if b, err := s2.Get("gateway"); err != nil || string(b) != `{"thingID":"th.1"}` {
+		t.Errorf("store should be replicated: %s %v", b, err)
+	}
+	if _, err := s2.Get("stale"); err != ErrNotFound {
+		t.Errorf("key which leader doesn't have should be deleted: %v", err)
+	}
+
+	// peer without the secret can't take the lease nor read the store.
+	s3 := NewMemoryStore()
+	l3 := &PeerLease{PeerAddr: l1.Addr().String(), Secret: "wrong", Store: s3, Timeout: 200 * time.Millisecond}
+	if err := l3.Replicate(ctx); err == nil || err.Error() != "authentication failed" {
+		t.Errorf("snapshot should be refused: %v", err)
+	}
+	if keys, _ := s3.Keys(""); len(keys) != 0 {
+		t.Errorf("store should not be leaked: %v", keys)
+	}
+	if ok, _ := l3.Acquire(ctx, "c", ttl); ok {
+		t.Errorf("c should not acquire without the secret")
+	}
+	if ok, _ := l1.Acquire(ctx, "a", ttl); !ok {
+		t.Errorf("a should keep the lease")
+	}
+	if err := (&PeerLease{ListenAddr: "127.0.0.1:0"}).Listen(); err == nil {
+		t.Errorf("Listen without Secret should fail")
+	}
+
+	// leader crashes: standby acquires after the lease expires.
+	l1.Close()
+	if ok, _ := l2.Acquire(ctx, "b", ttl); ok {
+		t.Errorf("lease of crashed leader is still valid")
+	}
+	time.Sleep(ttl)
+	if ok, err := l2.Acquire(ctx, "b", ttl); !ok || err != nil {
+		t.Errorf("b should acquire after the lease expires: %t %v", ok, err)
+	}
+}
+
+func TestHAGateway(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw1 := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Store: NewMemoryStore()}
+	gw2 := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Store: NewMemoryStore()}
+	l1, l2 := newPeerLeases(t, gw1.Store, gw2.Store)
+	defer l1.Close()
+	defer l2.Close()
+	ttl := 300 * time.Millisecond
+	ha1 := &HAGateway{Gateway: gw1, Lease: l1, Holder: "a", LeaseTTL: ttl}
+	ha2 := &HAGateway{Gateway: gw2, Lease: l2, Holder: "b", LeaseTTL: ttl, DedupWindow: time.Second}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done1 := make(chan struct{})
+	go func() {
+		ha1.Run(ctx1)
+		close(done1)
+	}()
+	if !waitUntil(t, time.Second, ha1.IsLeader) {
+		t.Fatalf("a should be leader")
+	}
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	go ha2.Run(ctx2)
+
+	state := map[string]interface{}{"power": true}
+	if err := ha1.UpdateTraitState("light", state); err != nil {
+		t.Fatalf("failed to update state: %s", err)
+	}
+	if err := ha2.UpdateTraitState("light", state); err != ErrStandby {
+		t.Errorf("standby should not upload: %v", err)
+	}
+	if !waitUntil(t, time.Second, func() bool {
+		_, err := gw2.Store.Get(haUploadedKeyPrefix + "gateway/light")
+		return err == nil
+	}) {
+		t.Fatalf("uploads should be replicated")
+	}
+
+	// handover
+	cancel1()
+	<-done1
+	if !waitUntil(t, 2*ttl, ha2.IsLeader) {
+		t.Fatalf("b should take over within bounded time")
+	}
+	if n := len(c.requestsTo("POST", "thing-if:/onboardings")); n != 1 {
+		t.Errorf("standby should take over identity without onboarding: %d", n)
+	}
+	if gw2.ThingID() != gw1.ThingID() {
+		t.Errorf("unexpected thingID: %s", gw2.ThingID())
+	}
+	// adapters upload by Gateway, which is deduplicated too.
+	states := "thing-if:/targets/thing:[^/]+/states/aliases/light"
+	if err := gw2.UpdateTraitState("light", state); err != nil {
+		t.Fatalf("failed to update state: %s", err)
+	}
+	if n := len(c.requestsTo("PUT", states)); n != 1 {
+		t.Errorf("duplicated upload should be suppressed: %d", n)
+	}
+	if err := ha2.UpdateTraitState("light", map[string]interface{}{"power": false}); err != nil {
+		t.Fatalf("failed to update state: %s", err)
+	}
+	if n := len(c.requestsTo("PUT", states)); n != 2 {
+		t.Errorf("new state should be uploaded: %d", n)
+	}
+	if err := ha1.UpdateTraitState("light", state); err != ErrStandby {
+		t.Errorf("previous leader should not upload: %v", err)
+	}
+	if err := gw1.UpdateTraitState("light", state); err != ErrNotRunning {
+		t.Errorf("stopped gateway should not upload: %v", err)
+	}
+
+	// repeated states are uploaded after the window.
+	time.Sleep(time.Second)
+	if err := ha2.UpdateTraitState("light", state); err != nil {
+		t.Fatalf("failed to update state: %s", err)
+	}
+	if err := ha2.UpdateTraitState("light", state); err != nil {
+		t.Fatalf("failed to update state: %s", err)
+	}
+	if n := len(c.requestsTo("PUT", states)); n != 4 {
+		t.Errorf("state should be uploaded after the window: %d", n)
+	}
+}
+
+// failingLease grants the lease once, and then fails to renew it.
+type failingLease struct {
+	mu      sync.Mutex
+	granted bool
+}
+
+func (l *failingLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.granted {
+		return false, errors.New("unreachable")
+	}
+	l.granted = true
+	return true, nil
+}
+
+func (l *failingLease) Release(holder string) error {
+	return nil
+}
+
+func TestHAGatewayLeaseExpiry(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Store: NewMemoryStore()}
+	ttl := 300 * time.Millisecond
+	ha := &HAGateway{Gateway: gw, Lease: &failingLease{}, Holder: "a", LeaseTTL: ttl}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ha.Run(ctx)
+	if !waitUntil(t, time.Second, ha.IsLeader) {
+		t.Fatalf("a should be leader")
+	}
+	state := map[string]interface{}{"power": true}
+	if err := gw.UpdateTraitState("light", state); err != nil {
+		t.Fatalf("failed to update state: %s", err)
+	}
+
+	// the lease can't be renewed: requests of Gateway are fenced as soon
+	// as it expires, and the gateway is stopped.
+	ha.mu.Lock()
+	expires := ha.expires
+	ha.mu.Unlock()
+	time.Sleep(time.Until(expires))
+	if err := gw.UpdateTraitState("light", map[string]interface{}{"power": false}); err != ErrStandby && err != ErrNotRunning {
+		t.Errorf("expired leader should not upload: %v", err)
+	}
+	if !waitUntil(t, ttl/3, func() bool { return gw.Author() == nil }) {
+		t.Errorf("gateway should be stopped when the lease expires")
+	}
+}
@@ -0,0 +1,341 @@
+package kii
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HARRecorder writes HTTP exchanges of kii_go to HAR 1.2 files, which can
+// be loaded by HAR viewers like developer tools of browsers.  Credentials
+// are redacted as logs of requests.  The file is kept valid after each
+// exchange, and rotated when it exceeds MaxSize.
+//
+//	r := kii.NewHARRecorder("/var/log/gateway/kii.har")
+//	kii.SetHARRecorder(r)
+//	defer r.Close()
+type HARRecorder struct {
+	// Path is path of the current file.  Rotated files have suffixes
+	// ".1", ".2" and so on, and ".1" is the newest.  An existing file is
+	// rotated when recording starts.
+	Path string
+
+	// MaxSize is the maximum size of a file.  Default is 10 MiB.
+	MaxSize int64
+
+	// MaxFiles is the maximum number of files including the current
+	// one.  Default is 3.
+	MaxFiles int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	entries int
+}
+
+// NewHARRecorder creates a HARRecorder.  The file is created on the first
+// exchange.
+func NewHARRecorder(path string) *HARRecorder {
+	return &HARRecorder{Path: path}
+}
+
+var (
+	harMu       sync.RWMutex
+	harRecorder *HARRecorder
+)
+
+// SetHARRecorder sets recorder of all requests made by kii_go.  If r is
+// nil, recording is stopped.
+func SetHARRecorder(r *HARRecorder) {
+	harMu.Lock()
+	defer harMu.Unlock()
+	harRecorder = r
+}
+
+func currentHARRecorder() *HARRecorder {
+	harMu.RLock()
+	defer harMu.RUnlock()
+	return harRecorder
+}
+
+const (
+	harHeader = `{"log":{"version":"1.2","creator":{"name":"kii_go","version":"1"},"pages":[],"entries":[`
+	harFooter = "]}}\n"
+)
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	RequestID       string      `json:"_requestID,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+// harExchange is an exchange to record.  resp is nil when the request
+// failed.
+type harExchange struct {
+	req       *http.Request
+	reqBody   []byte
+	resp      *http.Response
+	respBody  []byte
+	requestID string
+	start     time.Time
+	wait      time.Duration
+	receive   time.Duration
+	err       error
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	h = redactHeader(h)
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := []harNameValue{}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			list = append(list, harNameValue{Name: k, Value: v})
+		}
+	}
+	return list
+}
+
+func harMimeType(h http.Header) string {
+	t := h.Get("Content-Type")
+	if t == "" {
+		return "application/octet-stream"
+	}
+	if mt, _, err := mime.ParseMediaType(t); err == nil {
+		return mt
+	}
+	return t
+}
+
+func newHAREntry(x *harExchange) *harEntry {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	e := &harEntry{
+		StartedDateTime: x.start.Format(time.RFC3339Nano),
+		Time:            ms(x.wait + x.receive),
+		Timings:         harTimings{Wait: ms(x.wait), Receive: ms(x.receive)},
+		RequestID:       x.requestID,
+	}
+	e.Request = harRequest{
+		Method:      x.req.Method,
+		URL:         x.req.URL.String(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(x.req.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(x.reqBody),
+	}
+	for k, vv := range x.req.URL.Query() {
+		for _, v := range vv {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	if len(x.reqBody) > 0 {
+		e.Request.PostData = &harPostData{
+			MimeType: harMimeType(x.req.Header),
+			Text:     string(redactBody(x.req.Header, x.reqBody)),
+		}
+	}
+	if x.resp == nil {
+		// HAR viewers show status 0 as failed requests.
+		e.Response = harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			Content:     harContent{MimeType: "x-unknown"},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		if x.err != nil {
+			e.Error = x.err.Error()
+		}
+		return e
+	}
+	e.Response = harResponse{
+		Status:      x.resp.StatusCode,
+		StatusText:  http.StatusText(x.resp.StatusCode),
+		HTTPVersion: x.resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(x.resp.Header),
+		Content:     harContent{Size: len(x.respBody), MimeType: harMimeType(x.resp.Header)},
+		HeadersSize: -1,
+		BodySize:    len(x.respBody),
+	}
+	if e.Response.HTTPVersion == "" {
+		e.Response.HTTPVersion = "HTTP/1.1"
+	}
+	if len(x.respBody) > 0 {
+		if utf8.Valid(x.respBody) {
+			e.Response.Content.Text = string(redactBody(x.resp.Header, x.respBody))
+		} else {
+			e.Response.Content.Text = base64.StdEncoding.EncodeToString(x.respBody)
+			e.Response.Content.Encoding = "base64"
+		}
+	}
+	return e
+}
+
+// record appends an exchange to the file.
+func (r *HARRecorder) record(x *harExchange) error {
+	b, err := json.Marshal(newHAREntry(x))
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	maxSize := r.MaxSize
+	if maxSize <= 0 {
+		maxSize = 10 * 1024 * 1024
+	}
+	if r.f != nil && r.entries > 0 && r.size+int64(len(b))+1 > maxSize {
+		if err := r.f.Close(); err != nil {
+			return err
+		}
+		r.f = nil
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	// overwrite the footer.
+	off := r.size - int64(len(harFooter))
+	if r.entries > 0 {
+		b = append([]byte{','}, b...)
+	}
+	b = append(b, harFooter...)
+	if _, err := r.f.WriteAt(b, off); err != nil {
+		return err
+	}
+	r.size = off + int64(len(b))
+	r.entries++
+	return nil
+}
+
+// open starts a new file.  The existing file is rotated.
+func (r *HARRecorder) open() error {
+	if r.Path == "" {
+		return errors.New("Path is required")
+	}
+	if fi, err := os.Stat(r.Path); err == nil && fi.Size() > 0 {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(r.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(harHeader + harFooter); err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = int64(len(harHeader) + len(harFooter))
+	r.entries = 0
+	return nil
+}
+
+// rotate shifts the current file and rotated files.  The oldest file is
+// removed.
+func (r *HARRecorder) rotate() error {
+	maxFiles := r.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = 3
+	}
+	if maxFiles == 1 {
+		return os.Remove(r.Path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.Path, maxFiles-1))
+	for i := maxFiles - 2; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.Path, r.Path+".1")
+}
+
+// Close closes the current file.
+func (r *HARRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// recordHAR records an exchange when a recorder is set.
+func recordHAR(x *harExchange) {
+	r := currentHARRecorder()
+	if r == nil {
+		return
+	}
+	if err := r.record(x); err != nil {
+		transportLog.Warn("failed to record HAR", "path", r.Path, "error", err)
+	}
+}
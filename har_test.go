@@ -0,0 +1,98 @@
+package kii
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type harFile struct {
+	Log struct {
+		Version string     `json:"version"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+func readHAR(t *testing.T, path string) *harFile {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h harFile
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatalf("invalid HAR %s: %s", path, err)
+	}
+	return &h
+}
+
+func TestHARRecorder(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kii.har")
+	r := NewHARRecorder(path)
+	SetHARRecorder(r)
+	defer SetHARRecorder(nil)
+	defer r.Close()
+
+	author, err := AnonymousLogin(c.App)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = author.OnboardGateway(&OnboardGatewayRequest{VendorThingID: "gw-1", ThingPassword: "secret-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := readHAR(t, path)
+	if h.Log.Version != "1.2" || len(h.Log.Entries) != 2 {
+		t.Fatalf("unexpected HAR: %+v", h)
+	}
+	e := h.Log.Entries[1]
+	if e.Request.Method != "POST" || !strings.HasSuffix(e.Request.URL, "/thing-if/apps/fakeapp/onboardings") || e.Response.Status != 200 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if e.StartedDateTime == "" || e.Time < 0 || e.RequestID == "" {
+		t.Errorf("unexpected timings: %+v", e)
+	}
+	b, _ := ioutil.ReadFile(path)
+	for _, s := range []string{"secret-pass", "fakekey", "anonymous-token"} {
+		if strings.Contains(string(b), s) {
+			t.Errorf("%s should be redacted", s)
+		}
+	}
+	if e.Request.PostData == nil || !strings.Contains(e.Request.PostData.Text, `"vendorThingID":"gw-1"`) {
+		t.Errorf("request body should be recorded: %+v", e.Request.PostData)
+	}
+
+	// failed request
+	SetHTTPClient(&http.Client{Transport: offlineTransport{}})
+	AnonymousLogin(c.App)
+	SetHTTPClient(c.server.Client())
+	h = readHAR(t, path)
+	if e := h.Log.Entries[2]; e.Response.Status != 0 || e.Error == "" {
+		t.Errorf("failed request should be recorded: %+v", e)
+	}
+
+	// rotation
+	r.MaxSize = 2000
+	r.MaxFiles = 2
+	for i := 0; i < 10; i++ {
+		AnonymousLogin(c.App)
+	}
+	for _, p := range []string{path, path + ".1"} {
+		if h := readHAR(t, p); len(h.Log.Entries) == 0 {
+			t.Errorf("%s should have entries", p)
+		}
+		if fi, _ := os.Stat(p); fi.Size() > r.MaxSize {
+			t.Errorf("%s is too large: %d", p, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("old files should be removed: %v", err)
+	}
+}
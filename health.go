@@ -0,0 +1,281 @@
+package kii
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayHealth is health of a gateway reported as its trait state.
+type GatewayHealth struct {
+	CPUPercent      float64 `json:"cpuPercent"`
+	MemoryPercent   float64 `json:"memoryPercent"`
+	DiskPercent     float64 `json:"diskPercent"`
+	UplinkLatencyMs int64   `json:"uplinkLatencyMs"`
+	QueueBacklog    int     `json:"queueBacklog"`
+	EndNodes        int     `json:"endNodes"`
+	OnlineEndNodes  int     `json:"onlineEndNodes"`
+	// Alert is true when any metric crosses its threshold.  Alerts is
+	// names of the metrics.
+	Alert  bool     `json:"alert"`
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+// HealthThresholds are thresholds to set alert of GatewayHealth.  Zero
+// values disable the thresholds.
+type HealthThresholds struct {
+	CPUPercent    float64
+	MemoryPercent float64
+	DiskPercent   float64
+	UplinkLatency time.Duration
+	QueueBacklog  int
+}
+
+// HealthReporter periodically collects health of the gateway, and uploads
+// it by UpdateTraitState.  CPU and memory are read from /proc, so they are
+// available only on Linux.  Metrics which can't be collected are reported
+// as zero.
+//
+//	r := &kii.HealthReporter{
+//		Gateway:    gw,
+//		LocalAPI:   api,
+//		Thresholds: kii.HealthThresholds{CPUPercent: 90, DiskPercent: 95},
+//	}
+//	go r.Run(ctx)
+type HealthReporter struct {
+	Gateway *Gateway
+
+	// Alias is alias of the trait state.  Default is "health".
+	Alias string
+
+	// Interval is interval of reports.  Default is 1 minute.
+	Interval time.Duration
+
+	// DiskPath is path of the file system to report usage.  Default is
+	// "/".
+	DiskPath string
+
+	Thresholds HealthThresholds
+
+	// LocalAPI is used to report queue backlog.  Optional.
+	LocalAPI *LocalAPI
+
+	// Liveness is used to report number of online end nodes.  Optional.
+	Liveness *LivenessMonitor
+
+	// procPath and diskUsage are used to replace the system in tests.
+	procPath  string
+	diskUsage func(path string) (float64, error)
+
+	mu      sync.Mutex
+	lastCPU *cpuSample
+	latency time.Duration
+}
+
+type cpuSample struct {
+	idle, total uint64
+}
+
+func (r *HealthReporter) alias() string {
+	if r.Alias != "" {
+		return r.Alias
+	}
+	return "health"
+}
+
+// Collect collects health of the gateway.  CPU usage is average since the
+// previous call, and uplink latency is round trip time of the previous
+// report.
+func (r *HealthReporter) Collect() *GatewayHealth {
+	h := &GatewayHealth{}
+	var err error
+	if h.CPUPercent, err = r.cpuPercent(); err != nil {
+		gatewayLog.Debug("failed to collect CPU usage", "error", err)
+	}
+	if h.MemoryPercent, err = r.memoryPercent(); err != nil {
+		gatewayLog.Debug("failed to collect memory usage", "error", err)
+	}
+	diskPath := r.DiskPath
+	if diskPath == "" {
+		diskPath = "/"
+	}
+	usage := r.diskUsage
+	if usage == nil {
+		usage = diskUsage
+	}
+	if h.DiskPercent, err = usage(diskPath); err != nil {
+		gatewayLog.Debug("failed to collect disk usage", "error", err)
+	}
+	r.mu.Lock()
+	h.UplinkLatencyMs = int64(r.latency / time.Millisecond)
+	r.mu.Unlock()
+	if r.LocalAPI != nil {
+		h.QueueBacklog = r.LocalAPI.Queued()
+	}
+	if r.Gateway != nil {
+		for _, en := range r.Gateway.EndNodes() {
+			h.EndNodes++
+			if r.Liveness != nil {
+				if online, ok := r.Liveness.Status(en.VendorThingID); ok && online {
+					h.OnlineEndNodes++
+				}
+			}
+		}
+	}
+
+	t := r.Thresholds
+	if t.CPUPercent > 0 && h.CPUPercent >= t.CPUPercent {
+		h.Alerts = append(h.Alerts, "cpuPercent")
+	}
+	if t.MemoryPercent > 0 && h.MemoryPercent >= t.MemoryPercent {
+		h.Alerts = append(h.Alerts, "memoryPercent")
+	}
+	if t.DiskPercent > 0 && h.DiskPercent >= t.DiskPercent {
+		h.Alerts = append(h.Alerts, "diskPercent")
+	}
+	if t.UplinkLatency > 0 && time.Duration(h.UplinkLatencyMs)*time.Millisecond >= t.UplinkLatency {
+		h.Alerts = append(h.Alerts, "uplinkLatencyMs")
+	}
+	if t.QueueBacklog > 0 && h.QueueBacklog >= t.QueueBacklog {
+		h.Alerts = append(h.Alerts, "queueBacklog")
+	}
+	h.Alert = len(h.Alerts) > 0
+	return h
+}
+
+// Report collects health and uploads it.
+func (r *HealthReporter) Report() (*GatewayHealth, error) {
+	if r.Gateway == nil {
+		return nil, errors.New("Gateway must not be nil")
+	}
+	h := r.Collect()
+	start := time.Now()
+	if err := r.Gateway.UpdateTraitState(r.alias(), h); err != nil {
+		return h, err
+	}
+	r.mu.Lock()
+	r.latency = time.Since(start)
+	r.mu.Unlock()
+	if h.Alert {
+		gatewayLog.Warn("gateway health alert", "alerts", strings.Join(h.Alerts, ", "))
+	}
+	return h, nil
+}
+
+// Run reports health on every Interval until ctx is done.  Failures are
+// logged and retried on the next interval.
+func (r *HealthReporter) Run(ctx context.Context) error {
+	if r.Gateway == nil {
+		return errors.New("Gateway must not be nil")
+	}
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := r.Report(); err != nil {
+			gatewayLog.Warn("failed to report gateway health", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (r *HealthReporter) proc(name string) string {
+	dir := r.procPath
+	if dir == "" {
+		dir = "/proc"
+	}
+	return filepath.Join(dir, name)
+}
+
+// cpuPercent returns CPU usage since the previous call from /proc/stat.
+func (r *HealthReporter) cpuPercent() (float64, error) {
+	f, err := os.Open(r.proc("stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return 0, errors.New("empty stat")
+	}
+	fields := strings.Fields(s.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("unexpected stat: %s", s.Text())
+	}
+	cur := &cpuSample{}
+	for i, v := range fields[1:] {
+		// guest and guest_nice are included in user and nice.
+		if i >= 8 {
+			break
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		cur.total += n
+		// idle and iowait
+		if i == 3 || i == 4 {
+			cur.idle += n
+		}
+	}
+	r.mu.Lock()
+	prev := r.lastCPU
+	r.lastCPU = cur
+	r.mu.Unlock()
+	total, idle := cur.total, cur.idle
+	if prev != nil && cur.total > prev.total {
+		total, idle = cur.total-prev.total, cur.idle-prev.idle
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(total-idle) * 100 / float64(total), nil
+}
+
+// memoryPercent returns usage of memory from /proc/meminfo.
+func (r *HealthReporter) memoryPercent() (float64, error) {
+	f, err := os.Open(r.proc("meminfo"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	values := map[string]uint64{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = n
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	total := values["MemTotal"]
+	available, ok := values["MemAvailable"]
+	if !ok {
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if total == 0 || available > total {
+		return 0, errors.New("unexpected meminfo")
+	}
+	return float64(total-available) * 100 / float64(total), nil
+}
@@ -0,0 +1,17 @@
+package kii
+
+import "syscall"
+
+// diskUsage returns usage of the file system which path is in.
+func diskUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	total := st.Blocks * uint64(st.Bsize)
+	if total == 0 {
+		return 0, nil
+	}
+	avail := st.Bavail * uint64(st.Bsize)
+	return float64(total-avail) * 100 / float64(total), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package kii
+
+import "errors"
+
+// diskUsage is not supported except Linux.
+func diskUsage(path string) (float64, error) {
+	return 0, errors.New("disk usage is not supported")
+}
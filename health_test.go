@@ -0,0 +1,77 @@
+package kii
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeProc(t *testing.T, dir, stat, meminfo string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "meminfo"), []byte(meminfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthReporter(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	if _, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-2", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	liveness := &LivenessMonitor{Gateway: gw}
+	liveness.Heartbeat("en-1")
+	liveness.check(liveness.clock())
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	meminfo := "MemTotal: 1000 kB\nMemFree: 100 kB\nMemAvailable: 250 kB\n"
+	writeProc(t, dir, "cpu  100 0 100 800 0 0 0 0 50 10\ncpu0 100 0 100 800 0 0 0 0 0 0\n", meminfo)
+	r := &HealthReporter{
+		Gateway:    gw,
+		Alias:      "gatewayHealth",
+		Liveness:   liveness,
+		Thresholds: HealthThresholds{CPUPercent: 90, MemoryPercent: 70},
+		procPath:   dir,
+		diskUsage:  func(path string) (float64, error) { return 40, nil },
+	}
+	h, err := r.Report()
+	if err != nil {
+		t.Fatalf("failed to report: %s", err)
+	}
+	if h.CPUPercent != 20 || h.MemoryPercent != 75 || h.DiskPercent != 40 {
+		t.Errorf("unexpected usage: %+v", h)
+	}
+	if h.EndNodes != 2 || h.OnlineEndNodes != 1 {
+		t.Errorf("unexpected end nodes: %+v", h)
+	}
+	if !h.Alert || !reflect.DeepEqual(h.Alerts, []string{"memoryPercent"}) {
+		t.Errorf("memory alert should be set: %+v", h)
+	}
+	s, ok := c.state(gw.ThingID(), "gatewayHealth").(map[string]interface{})
+	if !ok || s["memoryPercent"] != 75.0 || s["alert"] != true {
+		t.Errorf("unexpected state: %v", c.state(gw.ThingID(), "gatewayHealth"))
+	}
+
+	// CPU usage is since the previous report, and guest time which is
+	// included in user time is not counted twice.
+	writeProc(t, dir, "cpu  1050 0 100 850 0 0 0 0 500 10\n", meminfo)
+	r.Thresholds.MemoryPercent = 0
+	h, err = r.Report()
+	if err != nil {
+		t.Fatalf("failed to report: %s", err)
+	}
+	if h.CPUPercent != 95 || !reflect.DeepEqual(h.Alerts, []string{"cpuPercent"}) {
+		t.Errorf("unexpected CPU usage: %+v", h)
+	}
+}
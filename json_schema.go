@@ -0,0 +1,288 @@
+package kii
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// JSONSchema represents a JSON Schema (draft-04) which is used as payload
+// schema of traits.  Only a subset of keywords is supported: type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength,
+// maxLength, pattern and anyOf.
+type JSONSchema struct {
+	Type                 JSONSchemaTypes                 `json:"type,omitempty"`
+	Description          string                          `json:"description,omitempty"`
+	Enum                 []interface{}                   `json:"enum,omitempty"`
+	Properties           map[string]*JSONSchema          `json:"properties,omitempty"`
+	Required             []string                        `json:"required,omitempty"`
+	AdditionalProperties *JSONSchemaAdditionalProperties `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema                     `json:"items,omitempty"`
+	MinItems             *int                            `json:"minItems,omitempty"`
+	MaxItems             *int                            `json:"maxItems,omitempty"`
+	Minimum              *float64                        `json:"minimum,omitempty"`
+	Maximum              *float64                        `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool                            `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     bool                            `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int                            `json:"minLength,omitempty"`
+	MaxLength            *int                            `json:"maxLength,omitempty"`
+	Pattern              string                          `json:"pattern,omitempty"`
+	AnyOf                []*JSONSchema                   `json:"anyOf,omitempty"`
+}
+
+// JSONSchemaTypes is value of "type" keyword, which is a string or an array
+// of strings.
+type JSONSchemaTypes []string
+
+func (st JSONSchemaTypes) MarshalJSON() ([]byte, error) {
+	if len(st) == 1 {
+		return json.Marshal(st[0])
+	}
+	return json.Marshal([]string(st))
+}
+
+func (st *JSONSchemaTypes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*st = JSONSchemaTypes{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings: %s", b)
+	}
+	*st = ss
+	return nil
+}
+
+// JSONSchemaAdditionalProperties is value of "additionalProperties" keyword,
+// which is a boolean or a schema.
+type JSONSchemaAdditionalProperties struct {
+	Allowed bool
+	Schema  *JSONSchema
+}
+
+func (ap JSONSchemaAdditionalProperties) MarshalJSON() ([]byte, error) {
+	if ap.Schema != nil {
+		return json.Marshal(ap.Schema)
+	}
+	return json.Marshal(ap.Allowed)
+}
+
+func (ap *JSONSchemaAdditionalProperties) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &ap.Allowed); err == nil {
+		return nil
+	}
+	ap.Allowed = true
+	return json.Unmarshal(b, &ap.Schema)
+}
+
+// ValidationError represents a violation of a schema.
+type ValidationError struct {
+	// Path is location of the violating value, like
+	// "AirConditionerAlias.currentTemperature" or "actions[0].alias[1]".
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors is a list of ValidationError.
+type ValidationErrors []*ValidationError
+
+func (es ValidationErrors) Error() string {
+	ss := make([]string, len(es))
+	for i, e := range es {
+		ss[i] = e.Error()
+	}
+	return strings.Join(ss, "; ")
+}
+
+// err returns es as error.  It returns nil when es is empty.
+func (es ValidationErrors) err() error {
+	if len(es) == 0 {
+		return nil
+	}
+	return es
+}
+
+// Validate validates v against the schema.  v is normalized to JSON
+// representation before validation, so structs are also acceptable.  When
+// v violates the schema, ValidationErrors is returned.
+func (s *JSONSchema) Validate(v interface{}) error {
+	return s.validate("", normalizeJSON(v)).err()
+}
+
+func (s *JSONSchema) validate(path string, v interface{}) ValidationErrors {
+	if s == nil {
+		return nil
+	}
+	var errs ValidationErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(s.Type) > 0 && !s.matchType(v) {
+		fail("must be %s but %s", strings.Join(s.Type, " or "), jsonTypeOf(v))
+		return errs
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(normalizeJSON(e), v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", s.Enum)
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			if len(sub.validate(path, v)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match any of schemas")
+		}
+	}
+
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := tv[name]; !ok {
+				errs = append(errs, &ValidationError{
+					Path:    joinPath(path, name),
+					Message: "is required",
+				})
+			}
+		}
+		for _, k := range sortedKeys(tv) {
+			if ps, ok := s.Properties[k]; ok {
+				errs = append(errs, ps.validate(joinPath(path, k), tv[k])...)
+				continue
+			}
+			if s.AdditionalProperties == nil {
+				continue
+			}
+			if !s.AdditionalProperties.Allowed {
+				errs = append(errs, &ValidationError{
+					Path:    joinPath(path, k),
+					Message: "is not allowed",
+				})
+				continue
+			}
+			errs = append(errs, s.AdditionalProperties.Schema.validate(joinPath(path, k), tv[k])...)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(tv) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(tv) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range tv {
+			errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	case float64:
+		if s.Minimum != nil {
+			if s.ExclusiveMinimum && tv <= *s.Minimum {
+				fail("must be greater than %v", *s.Minimum)
+			} else if tv < *s.Minimum {
+				fail("must be greater than or equal to %v", *s.Minimum)
+			}
+		}
+		if s.Maximum != nil {
+			if s.ExclusiveMaximum && tv >= *s.Maximum {
+				fail("must be less than %v", *s.Maximum)
+			} else if tv > *s.Maximum {
+				fail("must be less than or equal to %v", *s.Maximum)
+			}
+		}
+	case string:
+		n := len([]rune(tv))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				fail("invalid pattern %q in schema: %s", s.Pattern, err)
+			} else if !re.MatchString(tv) {
+				fail("must match pattern %q", s.Pattern)
+			}
+		}
+	}
+	return errs
+}
+
+func (s *JSONSchema) matchType(v interface{}) bool {
+	actual := jsonTypeOf(v)
+	for _, t := range s.Type {
+		if t == actual {
+			return true
+		}
+		if t == "integer" && actual == "number" {
+			if f := v.(float64); f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonTypeOf returns JSON Schema type name of normalized value.
+func jsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
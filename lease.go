@@ -0,0 +1,488 @@
+package kii
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaseRecord is content of a lease.
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// FileLease is a LeaseBackend which records the lease to a file on storage
+// shared by gateway instances.  Updates of the file are guarded by a lock
+// file, which is created exclusively next to it.  Clocks of instances must
+// be synchronized.
+type FileLease struct {
+	Path string
+}
+
+var _ LeaseBackend = (*FileLease)(nil)
+
+// Acquire acquires or renews the lease.
+func (l *FileLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := l.withLock(ctx, ttl, func() error {
+		rec, err := l.read()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if rec.Holder != "" && rec.Holder != holder && now.Before(rec.Expires) {
+			return nil
+		}
+		acquired = true
+		return l.write(&leaseRecord{Holder: holder, Expires: now.Add(ttl)})
+	})
+	if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+// Release releases the lease when holder has it.
+func (l *FileLease) Release(holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return l.withLock(ctx, 10*time.Second, func() error {
+		rec, err := l.read()
+		if err != nil || rec.Holder != holder {
+			return err
+		}
+		return l.write(&leaseRecord{})
+	})
+}
+
+// withLock calls fn while holding the lock file.  A lock file older than
+// stale is left by a crashed instance, and is removed.
+func (l *FileLease) withLock(ctx context.Context, stale time.Duration, fn func() error) error {
+	if l.Path == "" {
+		return errors.New("Path is required")
+	}
+	lock := l.Path + ".lock"
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > stale {
+			gatewayLog.Warn("remove stale lock file", "path", lock)
+			os.Remove(lock)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer os.Remove(lock)
+	return fn()
+}
+
+func (l *FileLease) read() (*leaseRecord, error) {
+	var rec leaseRecord
+	b, err := ioutil.ReadFile(l.Path)
+	if os.IsNotExist(err) || len(b) == 0 {
+		return &rec, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (l *FileLease) write(rec *leaseRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp := l.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.Path)
+}
+
+// PeerLease is a LeaseBackend for a pair of gateway instances, which talk
+// with each other by a simple TCP protocol.  An instance acquires the lease
+// when the peer grants it or the peer is unreachable, so both instances may
+// become leaders while the network between them is partitioned.
+//
+// When Store is given, the standby instance replicates it from the leader
+// on every Acquire.
+//
+// Messages are authenticated by HMAC with Secret shared by the instances,
+// and a nonce of each connection, so only the peer can take the lease or
+// read Store.  Messages are not encrypted, and replicated Store has
+// credentials of the gateway, so ListenAddr must be a private address which
+// is reachable only from the peer, not all interfaces.
+//
+//	lease := &kii.PeerLease{
+//		ListenAddr: "192.168.0.2:7070",
+//		PeerAddr:   "192.168.0.3:7070",
+//		Secret:     os.Getenv("PEER_SECRET"),
+//		Store:      store,
+//	}
+//	if err := lease.Listen(); err != nil {
+//		...
+//	}
+//	defer lease.Close()
+type PeerLease struct {
+	ListenAddr string
+	PeerAddr   string
+
+	// Secret is shared by the instances to authenticate messages.
+	// Required.
+	Secret string
+
+	// Store is replicated from the leader to the standby.  Optional.
+	Store Store
+
+	// Timeout is timeout to talk with the peer.  Default is 2 seconds.
+	Timeout time.Duration
+
+	mu          sync.Mutex
+	ln          net.Listener
+	holder      string
+	holding     bool
+	expires     time.Time
+	candidate   bool
+	peerHolder  string
+	peerExpires time.Time
+}
+
+var _ LeaseBackend = (*PeerLease)(nil)
+
+// peerMessage is a request or a response of PeerLease protocol.  Messages
+// are JSON terminated by a newline.  On a connection, the server sends a
+// nonce first, and then the request and the response are sent in
+// peerEnvelope signed with the nonce.
+type peerMessage struct {
+	Nonce   string                     `json:"nonce,omitempty"`
+	Op      string                     `json:"op,omitempty"`
+	Holder  string                     `json:"holder,omitempty"`
+	TTL     time.Duration              `json:"ttl,omitempty"`
+	Granted bool                       `json:"granted,omitempty"`
+	Values  map[string]json.RawMessage `json:"values,omitempty"`
+	Error   string                     `json:"error,omitempty"`
+}
+
+// peerEnvelope is a signed peerMessage.
+type peerEnvelope struct {
+	Body json.RawMessage `json:"body"`
+	MAC  string          `json:"mac"`
+}
+
+var errPeerAuth = errors.New("authentication failed")
+
+// mac returns HMAC of body.  dir distinguishes requests from responses, so
+// a response can't be replayed as a request.
+func (l *PeerLease) mac(dir, nonce string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(l.Secret))
+	fmt.Fprintf(h, "%s\n%s\n", dir, nonce)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (l *PeerLease) seal(dir, nonce string, m *peerMessage) (*peerEnvelope, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &peerEnvelope{Body: b, MAC: l.mac(dir, nonce, b)}, nil
+}
+
+func (l *PeerLease) open(dir, nonce string, e *peerEnvelope) (*peerMessage, error) {
+	if !hmac.Equal([]byte(e.MAC), []byte(l.mac(dir, nonce, e.Body))) {
+		return nil, errPeerAuth
+	}
+	var m peerMessage
+	if err := json.Unmarshal(e.Body, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (l *PeerLease) timeout() time.Duration {
+	if l.Timeout > 0 {
+		return l.Timeout
+	}
+	return 2 * time.Second
+}
+
+// Listen starts to accept requests from the peer.
+func (l *PeerLease) Listen() error {
+	if l.Secret == "" {
+		return errors.New("Secret is required")
+	}
+	ln, err := net.Listen("tcp", l.ListenAddr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.ln = ln
+	l.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go l.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns address which PeerLease listens.
+func (l *PeerLease) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln == nil {
+		return nil
+	}
+	return l.ln.Addr()
+}
+
+// Close stops listening.
+func (l *PeerLease) Close() error {
+	l.mu.Lock()
+	ln := l.ln
+	l.ln = nil
+	l.mu.Unlock()
+	if ln == nil {
+		return nil
+	}
+	return ln.Close()
+}
+
+func (l *PeerLease) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(l.timeout()))
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	nonce := hex.EncodeToString(b)
+	enc := json.NewEncoder(conn)
+	if err := enc.Encode(&peerMessage{Nonce: nonce}); err != nil {
+		return
+	}
+	var e peerEnvelope
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&e); err != nil {
+		return
+	}
+	req, err := l.open("request", nonce, &e)
+	if err != nil {
+		gatewayLog.Warn("rejected lease request", "remote", conn.RemoteAddr().String(), "error", err)
+		enc.Encode(&peerEnvelope{Body: json.RawMessage(`{"error":"authentication failed"}`)})
+		return
+	}
+	resp, err := l.seal("response", nonce, l.handle(req))
+	if err != nil {
+		return
+	}
+	enc.Encode(resp)
+}
+
+func (l *PeerLease) handle(req *peerMessage) *peerMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	switch req.Op {
+	case "acquire":
+		if l.holding && now.Before(l.expires) {
+			return &peerMessage{Granted: false}
+		}
+		// both are trying: the smaller holder wins.
+		if l.candidate && l.holder < req.Holder {
+			return &peerMessage{Granted: false}
+		}
+		l.holding = false
+		l.peerHolder = req.Holder
+		l.peerExpires = now.Add(req.TTL)
+		return &peerMessage{Granted: true}
+	case "release":
+		if l.peerHolder == req.Holder {
+			l.peerExpires = time.Time{}
+		}
+		return &peerMessage{}
+	case "snapshot":
+		if l.Store == nil {
+			return &peerMessage{Error: "store is not replicated"}
+		}
+		keys, err := l.Store.Keys("")
+		if err != nil {
+			return &peerMessage{Error: err.Error()}
+		}
+		values := make(map[string]json.RawMessage, len(keys))
+		for _, k := range keys {
+			v, err := l.Store.Get(k)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return &peerMessage{Error: err.Error()}
+			}
+			values[k] = v
+		}
+		return &peerMessage{Values: values}
+	}
+	return &peerMessage{Error: fmt.Sprintf("unknown op: %s", req.Op)}
+}
+
+// call sends a request to the peer, and verifies the response.
+func (l *PeerLease) call(ctx context.Context, req *peerMessage) (*peerMessage, error) {
+	if l.Secret == "" {
+		return nil, errors.New("Secret is required")
+	}
+	d := net.Dialer{Timeout: l.timeout()}
+	conn, err := d.DialContext(ctx, "tcp", l.PeerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(l.timeout()))
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	var hello peerMessage
+	if err := dec.Decode(&hello); err != nil {
+		return nil, err
+	}
+	if hello.Nonce == "" {
+		return nil, errors.New("no nonce from peer")
+	}
+	e, err := l.seal("request", hello.Nonce, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(conn).Encode(e); err != nil {
+		return nil, err
+	}
+	var re peerEnvelope
+	if err := dec.Decode(&re); err != nil {
+		return nil, err
+	}
+	resp, err := l.open("response", hello.Nonce, &re)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Acquire acquires or renews the lease.  The lease is acquired when the
+// peer grants it, or when the peer is unreachable and its lease has
+// expired.  It isn't acquired when the peer fails authentication.
+func (l *PeerLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	l.holder = holder
+	if time.Now().Before(l.peerExpires) {
+		l.mu.Unlock()
+		l.replicate(ctx)
+		return false, nil
+	}
+	l.candidate = true
+	l.mu.Unlock()
+
+	start := time.Now()
+	resp, err := l.call(ctx, &peerMessage{Op: "acquire", Holder: holder, TTL: ttl})
+
+	// a peer which fails authentication is reachable, so it may hold the
+	// lease.
+	if err == errPeerAuth {
+		gatewayLog.Warn("failed to authenticate peer, check Secret", "peer", l.PeerAddr)
+	} else if err != nil {
+		gatewayLog.Debug("peer is unreachable", "peer", l.PeerAddr, "error", err)
+	}
+	granted := err != errPeerAuth && (err != nil || resp.Granted)
+	l.mu.Lock()
+	l.candidate = false
+	l.holding = granted
+	if granted {
+		l.expires = start.Add(ttl)
+	}
+	l.mu.Unlock()
+	if !granted {
+		l.replicate(ctx)
+	}
+	return granted, nil
+}
+
+// Release releases the lease and tells it to the peer.
+func (l *PeerLease) Release(holder string) error {
+	l.mu.Lock()
+	if l.holder == holder {
+		l.holding = false
+		l.expires = time.Time{}
+	}
+	l.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout())
+	defer cancel()
+	if _, err := l.call(ctx, &peerMessage{Op: "release", Holder: holder}); err != nil {
+		gatewayLog.Debug("failed to tell release to peer", "peer", l.PeerAddr, "error", err)
+	}
+	return nil
+}
+
+// replicate copies Store of the peer, which is the leader.
+func (l *PeerLease) replicate(ctx context.Context) {
+	if l.Store == nil {
+		return
+	}
+	if err := l.Replicate(ctx); err != nil {
+		gatewayLog.Warn("failed to replicate store from peer", "peer", l.PeerAddr, "error", err)
+	}
+}
+
+// Replicate copies Store of the peer.  Keys which the peer doesn't have are
+// deleted.
+func (l *PeerLease) Replicate(ctx context.Context) error {
+	if l.Store == nil {
+		return errors.New("Store is required")
+	}
+	resp, err := l.call(ctx, &peerMessage{Op: "snapshot"})
+	if err != nil {
+		return err
+	}
+	keys, err := l.Store.Keys("")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, ok := resp.Values[k]; !ok {
+			if err := l.Store.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range resp.Values {
+		if err := l.Store.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package kii
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LivenessMonitor decides online status of end nodes from heartbeats sent
+// by adapters, and reports changes by ReportEndnodeStatus.
+//
+// An end node becomes online after OnlineHeartbeats consecutive heartbeats,
+// and offline when no heartbeat is received for OfflineTimeout.  A change
+// is reported only when it lasts for Debounce, so flapping end nodes don't
+// flood the cloud.  Reports are sent in batches on every CheckInterval and
+// limited by RequestsPerSecond.
+//
+//	m := &kii.LivenessMonitor{Gateway: gw, OfflineTimeout: time.Minute}
+//	go m.Run(ctx)
+//	...
+//	m.Heartbeat("end-node-001")
+type LivenessMonitor struct {
+	// Gateway is used to report status.
+	Gateway *Gateway
+
+	// OfflineTimeout is duration without heartbeat to decide an end node
+	// is offline.  Default is 1 minute.
+	OfflineTimeout time.Duration
+
+	// OnlineHeartbeats is number of consecutive heartbeats to decide an
+	// end node is online.  Heartbeats are consecutive when intervals of
+	// them are shorter than OfflineTimeout.  Default is 1.
+	OnlineHeartbeats int
+
+	// Debounce is duration which a change of status must last before it is
+	// reported.  Default is zero.
+	Debounce time.Duration
+
+	// CheckInterval is interval to check timeouts and send reports.
+	// Default is 1 second.
+	CheckInterval time.Duration
+
+	// RequestsPerSecond limits rate of reports.  When zero, the rate is
+	// not limited.
+	RequestsPerSecond float64
+
+	// report and now are used to replace reporting and clock in tests.
+	report func(vendorThingID string, online bool) error
+	now    func() time.Time
+
+	mu        sync.Mutex
+	nodes     map[string]*livenessNode
+	allowance float64
+	lastTick  time.Time
+}
+
+type livenessNode struct {
+	lastSeen  time.Time
+	streak    int
+	online    bool
+	changedAt time.Time
+	reported  bool
+	// known is true when status has been reported.
+	known bool
+	// force is true when status must be reported even if it is not
+	// changed.
+	force bool
+	// queuedAt is when the node started to wait for a report.  Reports are
+	// sent in this order, so that rate limit doesn't starve any node.
+	queuedAt time.Time
+}
+
+func (m *LivenessMonitor) offlineTimeout() time.Duration {
+	if m.OfflineTimeout > 0 {
+		return m.OfflineTimeout
+	}
+	return time.Minute
+}
+
+func (m *LivenessMonitor) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// Heartbeat records a heartbeat of an end node at now.
+func (m *LivenessMonitor) Heartbeat(vendorThingID string) {
+	m.Seen(vendorThingID, m.clock())
+}
+
+// Seen records that an end node was seen at t.  It is useful for adapters
+// which know last seen timestamps of devices.  t older than the last one
+// is ignored.
+func (m *LivenessMonitor) Seen(vendorThingID string, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.node(vendorThingID)
+	if t.Before(n.lastSeen) {
+		return
+	}
+	if n.lastSeen.IsZero() || t.Sub(n.lastSeen) > m.offlineTimeout() {
+		n.streak = 1
+	} else {
+		n.streak++
+	}
+	n.lastSeen = t
+	need := m.OnlineHeartbeats
+	if need < 1 {
+		need = 1
+	}
+	if !n.online && n.streak >= need {
+		n.online = true
+		n.changedAt = t
+	}
+}
+
+// node returns state of an end node.  m.mu must be held.
+func (m *LivenessMonitor) node(vendorThingID string) *livenessNode {
+	if m.nodes == nil {
+		m.nodes = map[string]*livenessNode{}
+	}
+	n, ok := m.nodes[vendorThingID]
+	if !ok {
+		n = &livenessNode{}
+		m.nodes[vendorThingID] = n
+	}
+	return n
+}
+
+// Status returns decided online status of an end node.  ok is false when
+// the end node is unknown.
+func (m *LivenessMonitor) Status(vendorThingID string) (online, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[vendorThingID]
+	if !ok {
+		return false, false
+	}
+	return n.online, true
+}
+
+// Forget stops monitoring an end node.
+func (m *LivenessMonitor) Forget(vendorThingID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.nodes, vendorThingID)
+}
+
+// Reassert lets the monitor report status of all end nodes again on the next
+// check, because status may be changed by the cloud while the gateway is
+// disconnected.  Run calls it when Gateway reconnects.
+func (m *LivenessMonitor) Reassert() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range m.nodes {
+		n.force = true
+	}
+}
+
+// Run checks status and sends reports on every CheckInterval until ctx is
+// done.  Status is reasserted while it runs when Gateway reconnects.
+func (m *LivenessMonitor) Run(ctx context.Context) error {
+	if m.Gateway == nil && m.report == nil {
+		return errors.New("Gateway must not be nil")
+	}
+	interval := m.CheckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if m.Gateway != nil {
+		defer m.Gateway.OnReconnect(m.Reassert)()
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			m.check(m.clock())
+		}
+	}
+}
+
+// check decides offline end nodes, and reports changes which last for
+// Debounce within the rate limit.  Reports are sent in order of waiting
+// time.  Failed reports are retried on the next check.
+func (m *LivenessMonitor) check(now time.Time) {
+	m.mu.Lock()
+	var pending []string
+	for id, n := range m.nodes {
+		if n.online && now.Sub(n.lastSeen) > m.offlineTimeout() {
+			n.online = false
+			n.streak = 0
+			n.changedAt = now
+		}
+		if now.Sub(n.changedAt) < m.Debounce || (n.known && n.reported == n.online && !n.force) {
+			n.queuedAt = time.Time{}
+			continue
+		}
+		if n.queuedAt.IsZero() {
+			n.queuedAt = now
+		}
+		pending = append(pending, id)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		a, b := m.nodes[pending[i]], m.nodes[pending[j]]
+		if !a.queuedAt.Equal(b.queuedAt) {
+			return a.queuedAt.Before(b.queuedAt)
+		}
+		return pending[i] < pending[j]
+	})
+	if m.RequestsPerSecond > 0 {
+		burst := m.RequestsPerSecond
+		if burst < 1 {
+			burst = 1
+		}
+		if m.lastTick.IsZero() {
+			m.allowance = burst
+		} else {
+			m.allowance += now.Sub(m.lastTick).Seconds() * m.RequestsPerSecond
+			if m.allowance > burst {
+				m.allowance = burst
+			}
+		}
+		m.lastTick = now
+		if n := int(m.allowance); n < len(pending) {
+			pending = pending[:n]
+		}
+		m.allowance -= float64(len(pending))
+	}
+	reports := make(map[string]bool, len(pending))
+	for _, id := range pending {
+		reports[id] = m.nodes[id].online
+	}
+	m.mu.Unlock()
+
+	for _, id := range pending {
+		online := reports[id]
+		if err := m.doReport(id, online); err != nil {
+			gatewayLog.Warn("failed to report status", "vendorThingID", id, "error", err)
+			continue
+		}
+		m.mu.Lock()
+		if n, ok := m.nodes[id]; ok {
+			n.known = true
+			n.reported = online
+			n.force = false
+			n.queuedAt = time.Time{}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *LivenessMonitor) doReport(vendorThingID string, online bool) error {
+	if m.report != nil {
+		return m.report(vendorThingID, online)
+	}
+	return m.Gateway.ReportEndNodeStatus(vendorThingID, online)
+}
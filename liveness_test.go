@@ -0,0 +1,206 @@
+package kii
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type livenessRecorder struct {
+	mu      sync.Mutex
+	reports []string
+	fail    bool
+}
+
+func (r *livenessRecorder) report(vendorThingID string, online bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail {
+		return errors.New("temporary error")
+	}
+	s := "offline"
+	if online {
+		s = "online"
+	}
+	r.reports = append(r.reports, vendorThingID+":"+s)
+	return nil
+}
+
+func (r *livenessRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := r.reports
+	r.reports = nil
+	return list
+}
+
+func TestLivenessMonitorHysteresisAndDebounce(t *testing.T) {
+	rec := &livenessRecorder{}
+	base := time.Unix(1000, 0)
+	at := func(sec float64) time.Time { return base.Add(time.Duration(sec * float64(time.Second))) }
+	m := &LivenessMonitor{
+		OfflineTimeout:   10 * time.Second,
+		OnlineHeartbeats: 2,
+		Debounce:         5 * time.Second,
+		report:           rec.report,
+	}
+
+	m.Seen("a", at(0))
+	if online, ok := m.Status("a"); !ok || online {
+		t.Errorf("one heartbeat should not be online")
+	}
+	m.Seen("a", at(1))
+	if online, _ := m.Status("a"); !online {
+		t.Errorf("two heartbeats should be online")
+	}
+	m.check(at(2))
+	if got := rec.take(); len(got) != 0 {
+		t.Errorf("change should be debounced: %v", got)
+	}
+	m.check(at(6))
+	if got := rec.take(); !reflect.DeepEqual(got, []string{"a:online"}) {
+		t.Errorf("unexpected reports: %v", got)
+	}
+
+	// flapping: offline for a moment and back online is not reported.
+	m.check(at(12))
+	if online, _ := m.Status("a"); online {
+		t.Errorf("should be offline after timeout")
+	}
+	m.Seen("a", at(13))
+	m.Seen("a", at(14))
+	m.check(at(15))
+	if got := rec.take(); len(got) != 0 {
+		t.Errorf("flapping should not be reported: %v", got)
+	}
+
+	// old timestamp is ignored.
+	m.Seen("a", at(3))
+	m.check(at(25))
+	if got := rec.take(); len(got) != 0 {
+		t.Errorf("offline should be debounced: %v", got)
+	}
+	m.check(at(30))
+	if got := rec.take(); !reflect.DeepEqual(got, []string{"a:offline"}) {
+		t.Errorf("unexpected reports: %v", got)
+	}
+	m.check(at(31))
+	if got := rec.take(); len(got) != 0 {
+		t.Errorf("unchanged status should not be reported: %v", got)
+	}
+
+	m.Reassert()
+	m.check(at(32))
+	if got := rec.take(); !reflect.DeepEqual(got, []string{"a:offline"}) {
+		t.Errorf("status should be reasserted: %v", got)
+	}
+}
+
+func TestLivenessMonitorRateLimitAndRetry(t *testing.T) {
+	rec := &livenessRecorder{}
+	base := time.Unix(1000, 0)
+	m := &LivenessMonitor{
+		OfflineTimeout:    time.Minute,
+		RequestsPerSecond: 2,
+		report:            rec.report,
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		m.Seen(id, base)
+	}
+	m.check(base)
+	if got := rec.take(); !reflect.DeepEqual(got, []string{"a:online", "b:online"}) {
+		t.Errorf("reports should be limited: %v", got)
+	}
+	m.check(base.Add(500 * time.Millisecond))
+	if got := rec.take(); !reflect.DeepEqual(got, []string{"c:online"}) {
+		t.Errorf("reports should be limited: %v", got)
+	}
+
+	rec.fail = true
+	m.check(base.Add(1500 * time.Millisecond))
+	rec.fail = false
+	m.check(base.Add(2500 * time.Millisecond))
+	if got := rec.take(); !reflect.DeepEqual(got, []string{"d:online", "e:online"}) {
+		t.Errorf("failed reports should be retried: %v", got)
+	}
+
+	m.Forget("a")
+	if _, ok := m.Status("a"); ok {
+		t.Errorf("forgotten end node should be unknown")
+	}
+}
+
+func TestLivenessMonitorRateLimitFairness(t *testing.T) {
+	rec := &livenessRecorder{}
+	base := time.Unix(1000, 0)
+	m := &LivenessMonitor{
+		OfflineTimeout:    time.Hour,
+		RequestsPerSecond: 1,
+		report:            rec.report,
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		m.Seen(id, base)
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		// "a" needs a report on every check, but shouldn't starve others.
+		m.mu.Lock()
+		m.nodes["a"].force = true
+		m.mu.Unlock()
+		m.check(base.Add(time.Duration(i) * time.Second))
+		got = append(got, rec.take()...)
+	}
+	if expected := []string{"a:online", "b:online", "c:online", "a:online"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("reports should be sent in order of waiting time: %v", got)
+	}
+}
+
+func TestLivenessMonitorReassertOnReconnect(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	mqtt := &fakeMQTT{}
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", MQTT: mqtt}
+	if err := gw.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(context.Background())
+	rec := &livenessRecorder{}
+	m := &LivenessMonitor{
+		Gateway:        gw,
+		OfflineTimeout: time.Hour,
+		CheckInterval:  10 * time.Millisecond,
+		report:         rec.report,
+	}
+	m.Heartbeat("a")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	var reports []string
+	if !waitUntil(t, time.Second, func() bool {
+		reports = append(reports, rec.take()...)
+		return len(reports) == 1
+	}) {
+		t.Fatalf("status should be reported: %v", reports)
+	}
+	mqtt.reconnect()
+	reports = nil
+	if !waitUntil(t, time.Second, func() bool {
+		reports = append(reports, rec.take()...)
+		return len(reports) == 1
+	}) || reports[0] != "a:online" {
+		t.Errorf("status should be reasserted after reconnection: %v", reports)
+	}
+
+	cancel()
+	<-done
+	gw.mu.RLock()
+	n := len(gw.reconnectHooks)
+	gw.mu.RUnlock()
+	if n != 0 {
+		t.Errorf("hook should be removed when Run returns: %d", n)
+	}
+}
@@ -0,0 +1,622 @@
+package kii
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localNodeKeyPrefix    = "localapi/node/"
+	localStateKeyPrefix   = "localapi/state/"
+	localCommandKeyPrefix = "localapi/command/"
+	localQueueKeyPrefix   = "localapi/queue/"
+	localDeadKeyPrefix    = "localapi/dead/"
+)
+
+// LocalAPI is a HTTP API of gateway for end nodes in local network which
+// can't reach Kii Cloud.  It serves a subset of Thing-IF API with the same
+// paths, so end nodes can use it by replacing host of Kii Cloud with
+// address of the gateway.
+//
+//	POST /thing-if/apps/{appID}/onboardings
+//	PUT  /thing-if/apps/{appID}/targets/thing:{thingID}/states
+//	GET  /thing-if/apps/{appID}/targets/thing:{thingID}/states
+//	PUT  /thing-if/apps/{appID}/targets/thing:{thingID}/states/aliases/{alias}
+//	GET  /thing-if/apps/{appID}/targets/thing:{thingID}/commands/{commandID}
+//	PUT  /thing-if/apps/{appID}/targets/thing:{thingID}/commands/{commandID}/action-results
+//
+// End nodes onboard with vendorThingID and password, and the gateway
+// onboards them to Kii Cloud as its end nodes.  Returned access tokens are
+// local ones, and requests are proxied to Kii Cloud with tokens managed by
+// the gateway.  When Kii Cloud is unreachable, updates are queued and
+// retried in order by Run, and states and commands are served from local
+// cache.  Updates which fail by errors of Kii Cloud, like 5xx and 429, are
+// also queued and retried with backoff, up to MaxAttempts.  Cached states
+// of a thing are dropped when Kii Cloud rejects its update.
+type LocalAPI struct {
+	gw    *Gateway
+	store Store
+
+	// RetryInterval is interval to retry queued updates in Run.  Default is
+	// 10 seconds.
+	RetryInterval time.Duration
+
+	// MaxRetryInterval is the maximum interval of retry, which is doubled
+	// on each failure.  Default is 5 minutes.
+	MaxRetryInterval time.Duration
+
+	// MaxAttempts is the maximum number of attempts of a queued update
+	// which fails by errors of Kii Cloud.  Then the update is moved to
+	// dead letters, so it doesn't block the queue.  Attempts while Kii
+	// Cloud is unreachable aren't counted.  Default is 10.
+	MaxAttempts int
+
+	// MaxBodySize is the maximum size of a request body.  Default is
+	// 1 MiB.
+	MaxBodySize int64
+
+	mu      sync.Mutex
+	nodes   map[string]*localNode // local token -> node
+	seq     int64
+	flushMu sync.Mutex
+	kick    chan struct{}
+}
+
+var _ http.Handler = (*LocalAPI)(nil)
+
+// localNode is credential of an end node of LocalAPI.
+type localNode struct {
+	VendorThingID string `json:"vendorThingID"`
+	ThingID       string `json:"thingID"`
+	Salt          string `json:"salt"`
+	PasswordHash  string `json:"passwordHash"`
+	Token         string `json:"token"`
+}
+
+// localOp is an update queued while Kii Cloud is unreachable.
+type localOp struct {
+	Kind          string          `json:"kind"`
+	VendorThingID string          `json:"vendorThingID"`
+	ThingID       string          `json:"thingID"`
+	Alias         string          `json:"alias,omitempty"`
+	CommandID     string          `json:"commandID,omitempty"`
+	Body          json.RawMessage `json:"body"`
+	Attempts      int             `json:"attempts,omitempty"`
+}
+
+const (
+	opState              = "state"
+	opTraitState         = "traitState"
+	opMultipleTraitState = "multipleTraitState"
+	opActionResults      = "actionResults"
+	opTraitActionResults = "traitActionResults"
+)
+
+// NewLocalAPI creates LocalAPI of gw.  Credentials, cache and queue are
+// persisted in Store of gw, so gw must be started.
+func NewLocalAPI(gw *Gateway) (*LocalAPI, error) {
+	if gw.Store == nil {
+		return nil, fmt.Errorf("gateway is not started")
+	}
+	api := &LocalAPI{gw: gw, store: gw.Store, nodes: map[string]*localNode{}, kick: make(chan struct{}, 1)}
+	keys, err := api.store.Keys(localNodeKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		var n localNode
+		if err := getJSON(api.store, k, &n); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %s", k, err)
+		}
+		api.nodes[n.Token] = &n
+	}
+	keys, err = api.store.Keys(localQueueKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		api.seq, _ = strconv.ParseInt(strings.TrimPrefix(keys[len(keys)-1], localQueueKeyPrefix), 10, 64)
+	}
+	return api, nil
+}
+
+var (
+	localAPIPrefix    = regexp.MustCompile(`^/thing-if/apps/[^/]+`)
+	localStatesPath   = regexp.MustCompile(`^/targets/thing:([^/]+)/states$`)
+	localAliasPath    = regexp.MustCompile(`^/targets/thing:([^/]+)/states/aliases/([^/]+)$`)
+	localCommandPath  = regexp.MustCompile(`^/targets/thing:([^/]+)/commands/([^/]+)$`)
+	localResultsPath  = regexp.MustCompile(`^/targets/thing:([^/]+)/commands/([^/]+)/action-results$`)
+	errLocalNoRoute   = &localError{http.StatusNotFound, "NOT_FOUND", "no such API"}
+	errLocalForbidden = &localError{http.StatusForbidden, "WRONG_TOKEN", "token doesn't match with the thing"}
+)
+
+type localError struct {
+	status  int
+	code    string
+	message string
+}
+
+// ServeHTTP serves the API.
+func (api *LocalAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	loc := localAPIPrefix.FindString(r.URL.Path)
+	if loc == "" {
+		api.writeError(w, errLocalNoRoute)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, loc)
+	maxSize := api.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = 1024 * 1024
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		api.writeError(w, &localError{http.StatusRequestEntityTooLarge, "REQUEST_ENTITY_TOO_LARGE", err.Error()})
+		return
+	}
+	if err != nil {
+		api.writeError(w, &localError{http.StatusBadRequest, "INVALID_INPUT_DATA", err.Error()})
+		return
+	}
+	if path == "/onboardings" && r.Method == "POST" {
+		api.onboard(w, body)
+		return
+	}
+
+	var m []string
+	route := func(method string, re *regexp.Regexp) bool {
+		if r.Method != method {
+			return false
+		}
+		m = re.FindStringSubmatch(path)
+		return m != nil
+	}
+	var op *localOp
+	switch {
+	case route("PUT", localStatesPath):
+		op = &localOp{Kind: opState}
+		if strings.Contains(r.Header.Get("Content-Type"), "MultipleTraitState") {
+			op.Kind = opMultipleTraitState
+		}
+	case route("PUT", localAliasPath):
+		op = &localOp{Kind: opTraitState, Alias: m[2]}
+	case route("PUT", localResultsPath):
+		op = &localOp{Kind: opActionResults, CommandID: m[2]}
+		if strings.Contains(r.Header.Get("Content-Type"), "CommandResultsUpdateRequest") {
+			op.Kind = opTraitActionResults
+		}
+	case route("GET", localStatesPath), route("GET", localCommandPath):
+	default:
+		api.writeError(w, errLocalNoRoute)
+		return
+	}
+
+	node, ok := api.authenticate(r)
+	if !ok || node.ThingID != m[1] {
+		api.writeError(w, errLocalForbidden)
+		return
+	}
+	if op != nil {
+		if !json.Valid(body) {
+			api.writeError(w, &localError{http.StatusBadRequest, "INVALID_INPUT_DATA", "body must be JSON"})
+			return
+		}
+		op.VendorThingID = node.VendorThingID
+		op.ThingID = node.ThingID
+		op.Body = body
+		api.update(w, op)
+	} else if len(m) == 2 {
+		api.getStates(w, node)
+	} else {
+		api.getCommand(w, node, m[2])
+	}
+}
+
+func (api *LocalAPI) authenticate(r *http.Request) (*localNode, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, false
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	n, ok := api.nodes[strings.TrimPrefix(auth, "Bearer ")]
+	return n, ok
+}
+
+func (api *LocalAPI) onboard(w http.ResponseWriter, body []byte) {
+	var req OnboardGatewayRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.VendorThingID == "" || req.ThingPassword == "" {
+		api.writeError(w, &localError{http.StatusBadRequest, "INVALID_INPUT_DATA", "vendorThingID and thingPassword are required"})
+		return
+	}
+
+	api.mu.Lock()
+	var node *localNode
+	for _, n := range api.nodes {
+		if n.VendorThingID == req.VendorThingID {
+			node = n
+			break
+		}
+	}
+	api.mu.Unlock()
+	if node != nil {
+		if !node.checkPassword(req.ThingPassword) {
+			api.writeError(w, &localError{http.StatusForbidden, "WRONG_PASSWORD", "password doesn't match"})
+			return
+		}
+		api.writeJSON(w, http.StatusOK, &OnboardGatewayResponse{ThingID: node.ThingID, AccessToken: node.Token})
+		return
+	}
+
+	en, err := api.gw.OnboardEndNode(EndNodeInfo{
+		VendorThingID:   req.VendorThingID,
+		Password:        req.ThingPassword,
+		ThingType:       req.ThingType,
+		FirmwareVersion: req.FirmwareVersion,
+		Properties:      req.ThingProperties,
+	})
+	if err == ErrWrongPassword {
+		api.writeError(w, &localError{http.StatusForbidden, "WRONG_PASSWORD", "password doesn't match"})
+		return
+	}
+	if err != nil {
+		api.writeCloudError(w, err)
+		return
+	}
+	salt, err := randomHex(16)
+	if err == nil {
+		node = &localNode{VendorThingID: en.VendorThingID, ThingID: en.ThingID, Salt: salt}
+		node.PasswordHash = node.hash(req.ThingPassword)
+		node.Token, err = randomHex(32)
+	}
+	if err == nil {
+		err = putJSON(api.store, localNodeKeyPrefix+node.VendorThingID, node)
+	}
+	if err != nil {
+		api.writeError(w, &localError{http.StatusInternalServerError, "INTERNAL_ERROR", err.Error()})
+		return
+	}
+	api.mu.Lock()
+	api.nodes[node.Token] = node
+	api.mu.Unlock()
+	api.writeJSON(w, http.StatusOK, &OnboardGatewayResponse{ThingID: node.ThingID, AccessToken: node.Token})
+}
+
+func (n *localNode) hash(password string) string {
+	return hashPassword(n.Salt, password)
+}
+
+func (n *localNode) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(n.hash(password)), []byte(n.PasswordHash)) == 1
+}
+
+// update caches states and sends op to Kii Cloud.  If other updates are
+// queued, op is queued after them and Run is kicked to flush the queue.  If
+// op fails with a retryable error, op is queued.
+func (api *LocalAPI) update(w http.ResponseWriter, op *localOp) {
+	if err := api.cacheState(op); err != nil {
+		api.writeError(w, &localError{http.StatusInternalServerError, "INTERNAL_ERROR", err.Error()})
+		return
+	}
+	if api.Queued() == 0 {
+		err := api.execute(op)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !isRetryableError(err) {
+			api.dropCachedState(op)
+			api.writeCloudError(w, err)
+			return
+		}
+	} else {
+		defer api.kickFlush()
+	}
+	if err := api.enqueue(op); err != nil {
+		api.writeError(w, &localError{http.StatusInternalServerError, "INTERNAL_ERROR", err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// kickFlush lets Run flush the queue unless it is backing off.
+func (api *LocalAPI) kickFlush() {
+	select {
+	case api.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (api *LocalAPI) execute(op *localOp) error {
+	var body interface{}
+	if err := json.Unmarshal(op.Body, &body); err != nil {
+		return err
+	}
+	return api.gw.withEndNode(op.VendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+		switch op.Kind {
+		case opState:
+			return a.UpdateState(op.ThingID, body)
+		case opTraitState:
+			return a.UpdateTraitState(op.ThingID, op.Alias, body)
+		case opMultipleTraitState:
+			return a.UpdateMultipleTraitState(op.ThingID, body)
+		}
+		var req UpdateCommandResultsRequest
+		if err := json.Unmarshal(op.Body, &req); err != nil {
+			return err
+		}
+		if op.Kind == opTraitActionResults {
+			return a.UpdateTraitCommandResults(op.ThingID, op.CommandID, req)
+		}
+		return a.UpdateCommandResults(op.ThingID, op.CommandID, req)
+	})
+}
+
+func (api *LocalAPI) enqueue(op *localOp) error {
+	api.mu.Lock()
+	api.seq++
+	key := fmt.Sprintf("%s%020d", localQueueKeyPrefix, api.seq)
+	api.mu.Unlock()
+	return putJSON(api.store, key, op)
+}
+
+// Queued returns number of queued updates.
+func (api *LocalAPI) Queued() int {
+	keys, _ := api.store.Keys(localQueueKeyPrefix)
+	return len(keys)
+}
+
+// DeadLetters returns number of updates which are given up after
+// MaxAttempts.  They are kept in Store of the gateway.
+func (api *LocalAPI) DeadLetters() int {
+	keys, _ := api.store.Keys(localDeadKeyPrefix)
+	return len(keys)
+}
+
+func (api *LocalAPI) maxAttempts() int {
+	if api.MaxAttempts > 0 {
+		return api.MaxAttempts
+	}
+	return 10
+}
+
+// Flush sends queued updates to Kii Cloud in order.  It stops at the first
+// update which fails with a retryable error, like Kii Cloud is unreachable
+// or returns 5xx, and returns the error.  An update which fails by errors
+// of Kii Cloud MaxAttempts times is moved to dead letters, and updates
+// rejected by Kii Cloud with other 4xx are dropped.
+func (api *LocalAPI) Flush() error {
+	api.flushMu.Lock()
+	defer api.flushMu.Unlock()
+	keys, err := api.store.Keys(localQueueKeyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		var op localOp
+		if err := getJSON(api.store, k, &op); err != nil {
+			gatewayLog.Error("drop broken queued update", "key", k, "error", err)
+		} else if err := api.execute(&op); isRetryableError(err) {
+			if isOfflineError(err) {
+				return err
+			}
+			op.Attempts++
+			if op.Attempts < api.maxAttempts() {
+				if perr := putJSON(api.store, k, &op); perr != nil {
+					return perr
+				}
+				return err
+			}
+			gatewayLog.Error("give up queued update", "kind", op.Kind, "vendorThingID", op.VendorThingID, "attempts", op.Attempts, "error", err)
+			if perr := putJSON(api.store, localDeadKeyPrefix+strings.TrimPrefix(k, localQueueKeyPrefix), &op); perr != nil {
+				return perr
+			}
+			api.dropCachedState(&op)
+		} else if err != nil {
+			gatewayLog.Error("drop queued update", "kind", op.Kind, "vendorThingID", op.VendorThingID, "error", err)
+			api.dropCachedState(&op)
+		}
+		if err := api.store.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run flushes queued updates on every RetryInterval until ctx is done.
+// When flush fails, the interval is doubled up to MaxRetryInterval.  Updates
+// queued by requests kick the flush unless Run is backing off.
+func (api *LocalAPI) Run(ctx context.Context) error {
+	interval := api.RetryInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	maxInterval := api.MaxRetryInterval
+	if maxInterval <= 0 {
+		maxInterval = 5 * time.Minute
+	}
+	delay := interval
+	var retryAt time.Time
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-api.kick:
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+		}
+		if err := api.Flush(); err != nil {
+			gatewayLog.Debug("failed to flush queued updates", "error", err)
+			delay *= 2
+			if delay > maxInterval {
+				delay = maxInterval
+			}
+			retryAt = time.Now().Add(delay)
+		} else {
+			delay = interval
+			retryAt = time.Time{}
+		}
+		t.Reset(delay)
+	}
+}
+
+// cacheState caches states of state updates.  Cached states are
+// map[string]interface{}, and trait states are keyed by alias.
+func (api *LocalAPI) cacheState(op *localOp) error {
+	var update map[string]interface{}
+	switch op.Kind {
+	case opState, opMultipleTraitState:
+		if err := json.Unmarshal(op.Body, &update); err != nil {
+			return err
+		}
+	case opTraitState:
+		var s interface{}
+		if err := json.Unmarshal(op.Body, &s); err != nil {
+			return err
+		}
+		update = map[string]interface{}{op.Alias: s}
+	default:
+		return nil
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	key := localStateKeyPrefix + op.ThingID
+	state := map[string]interface{}{}
+	if err := getJSON(api.store, key, &state); err != nil && err != ErrNotFound {
+		return err
+	}
+	if op.Kind == opState {
+		state = update
+	} else {
+		for k, v := range update {
+			state[k] = v
+		}
+	}
+	return putJSON(api.store, key, state)
+}
+
+// dropCachedState drops cached states of the thing of op which is rejected
+// by Kii Cloud, so states which Kii Cloud doesn't have aren't served.
+func (api *LocalAPI) dropCachedState(op *localOp) {
+	switch op.Kind {
+	case opState, opTraitState, opMultipleTraitState:
+	default:
+		return
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if err := api.store.Delete(localStateKeyPrefix + op.ThingID); err != nil {
+		gatewayLog.Warn("failed to drop cached state", "vendorThingID", op.VendorThingID, "error", err)
+	}
+}
+
+func (api *LocalAPI) getStates(w http.ResponseWriter, node *localNode) {
+	b, err := api.store.Get(localStateKeyPrefix + node.ThingID)
+	if err == ErrNotFound {
+		api.writeError(w, &localError{http.StatusNotFound, "STATE_NOT_FOUND", "no state is cached"})
+		return
+	}
+	if err != nil {
+		api.writeError(w, &localError{http.StatusInternalServerError, "INTERNAL_ERROR", err.Error()})
+		return
+	}
+	api.writeJSON(w, http.StatusOK, json.RawMessage(b))
+}
+
+// getCommand gets a command from Kii Cloud and caches it.  When Kii Cloud is
+// unreachable, cached command is served.
+func (api *LocalAPI) getCommand(w http.ResponseWriter, node *localNode, commandID string) {
+	key := localCommandKeyPrefix + node.ThingID + "/" + commandID
+	var cmd *GetCommandResponse
+	err := api.gw.withEndNode(node.VendorThingID, func(a *APIAuthor, en *EndNodeIdentity) error {
+		var err error
+		cmd, err = a.GetCommand(node.ThingID, commandID)
+		return err
+	})
+	if err == nil {
+		if err := putJSON(api.store, key, cmd); err != nil {
+			gatewayLog.Warn("failed to cache command", "commandID", commandID, "error", err)
+		}
+		api.writeJSON(w, http.StatusOK, cmd)
+		return
+	}
+	if !isOfflineError(err) {
+		api.writeCloudError(w, err)
+		return
+	}
+	b, gerr := api.store.Get(key)
+	if gerr != nil {
+		api.writeError(w, &localError{http.StatusServiceUnavailable, "CLOUD_UNREACHABLE", err.Error()})
+		return
+	}
+	api.writeJSON(w, http.StatusOK, json.RawMessage(b))
+}
+
+func (api *LocalAPI) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b = []byte(`{"errorCode":"INTERNAL_ERROR"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (api *LocalAPI) writeError(w http.ResponseWriter, e *localError) {
+	api.writeJSON(w, e.status, map[string]string{"errorCode": e.code, "message": e.message})
+}
+
+// writeCloudError relays an error of Kii Cloud to the client.
+func (api *LocalAPI) writeCloudError(w http.ResponseWriter, err error) {
+	if ce, ok := err.(*CloudError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(ce.HTTPStatus)
+		w.Write([]byte(ce.RawResponse))
+		return
+	}
+	if isOfflineError(err) {
+		api.writeError(w, &localError{http.StatusServiceUnavailable, "CLOUD_UNREACHABLE", err.Error()})
+		return
+	}
+	api.writeError(w, &localError{http.StatusInternalServerError, "INTERNAL_ERROR", err.Error()})
+}
+
+// isRetryableError returns true when an update which failed with err may
+// succeed later.
+func isRetryableError(err error) bool {
+	if isOfflineError(err) {
+		return true
+	}
+	ce, ok := err.(*CloudError)
+	if !ok {
+		return false
+	}
+	switch ce.HTTPStatus {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return ce.HTTPStatus >= 500
+}
+
+// isOfflineError returns true when err shows that Kii Cloud is unreachable.
+func isOfflineError(err error) bool {
+	_, ok := err.(*url.Error)
+	return ok
+}
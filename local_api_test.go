@@ -0,0 +1,267 @@
+package kii
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("network is unreachable")
+}
+
+type localClient struct {
+	t     *testing.T
+	base  string
+	token string
+}
+
+func (c *localClient) do(method, path, contentType string, body interface{}, out interface{}) int {
+	var r bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&r).Encode(body)
+	}
+	req, _ := http.NewRequest(method, c.base+"/thing-if/apps/fakeapp"+path, &r)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func TestLocalAPI(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	api, err := NewLocalAPI(gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := &localClient{t: t, base: server.URL}
+
+	var onboarded OnboardGatewayResponse
+	req := map[string]interface{}{"vendorThingID": "en-1", "thingPassword": "pass"}
+	if sc := client.do("POST", "/onboardings", "", req, &onboarded); sc != 200 || onboarded.ThingID == "" {
+		t.Fatalf("failed to onboard: %d %+v", sc, onboarded)
+	}
+	en, _ := gw.EndNode("en-1")
+	if en.ThingID != onboarded.ThingID || en.AccessToken == onboarded.AccessToken {
+		t.Errorf("local token should be issued for end node: %+v", onboarded)
+	}
+	req["thingPassword"] = "wrong"
+	if sc := client.do("POST", "/onboardings", "", req, nil); sc != 403 {
+		t.Errorf("wrong password should be rejected: %d", sc)
+	}
+
+	states := "/targets/thing:" + en.ThingID + "/states"
+	if sc := client.do("PUT", states+"/aliases/light", "", map[string]interface{}{"power": true}, nil); sc != 403 {
+		t.Errorf("request without token should be rejected: %d", sc)
+	}
+	client.token = onboarded.AccessToken
+	if sc := client.do("PUT", "/targets/thing:th.other/states/aliases/light", "", map[string]interface{}{}, nil); sc != 403 {
+		t.Errorf("request for other thing should be rejected: %d", sc)
+	}
+	if sc := client.do("PUT", states+"/aliases/light", "application/vnd.kii.TraitState+json", map[string]interface{}{"power": true}, nil); sc != 204 {
+		t.Errorf("failed to update state: %d", sc)
+	}
+	if s := c.state(en.ThingID, "light"); !reflect.DeepEqual(s, map[string]interface{}{"power": true}) {
+		t.Errorf("state should be proxied: %v", s)
+	}
+
+	c.addCommand(en.ThingID, "cmd-1", []map[string]interface{}{{"light": []interface{}{map[string]interface{}{"turnPower": false}}}})
+	var cmd GetCommandResponse
+	if sc := client.do("GET", "/targets/thing:"+en.ThingID+"/commands/cmd-1", "", nil, &cmd); sc != 200 || cmd.CommandID != "cmd-1" {
+		t.Errorf("failed to get command: %d %+v", sc, cmd)
+	}
+
+	// offline: updates are queued and cache is served.
+	SetHTTPClient(&http.Client{Transport: offlineTransport{}})
+	if sc := client.do("PUT", states, "application/vnd.kii.MultipleTraitState+json", map[string]interface{}{"light": map[string]interface{}{"power": false}}, nil); sc != 202 {
+		t.Errorf("update should be queued: %d", sc)
+	}
+	results := map[string]interface{}{"actionResults": []interface{}{map[string]interface{}{"light": []interface{}{map[string]interface{}{"turnPower": map[string]interface{}{"succeeded": true}}}}}}
+	if sc := client.do("PUT", "/targets/thing:"+en.ThingID+"/commands/cmd-1/action-results", "application/vnd.kii.CommandResultsUpdateRequest+json", results, nil); sc != 202 {
+		t.Errorf("action results should be queued: %d", sc)
+	}
+	if n := api.Queued(); n != 2 {
+		t.Errorf("2 updates should be queued: %d", n)
+	}
+	cmd = GetCommandResponse{}
+	if sc := client.do("GET", "/targets/thing:"+en.ThingID+"/commands/cmd-1", "", nil, &cmd); sc != 200 || cmd.CommandID != "cmd-1" {
+		t.Errorf("command should be served from cache: %d %+v", sc, cmd)
+	}
+	if sc := client.do("GET", "/targets/thing:"+en.ThingID+"/commands/cmd-2", "", nil, nil); sc != 503 {
+		t.Errorf("not cached command should be unavailable: %d", sc)
+	}
+	var cached map[string]interface{}
+	if sc := client.do("GET", states, "", nil, &cached); sc != 200 || !reflect.DeepEqual(cached["light"], map[string]interface{}{"power": false}) {
+		t.Errorf("state should be served from cache: %d %v", sc, cached)
+	}
+
+	// online again: queue is flushed in order.
+	SetHTTPClient(c.server.Client())
+	if err := api.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if n := api.Queued(); n != 0 {
+		t.Errorf("queue should be empty: %d", n)
+	}
+	if s := c.state(en.ThingID, "light"); !reflect.DeepEqual(s, map[string]interface{}{"power": false}) {
+		t.Errorf("queued state should be sent: %v", s)
+	}
+	if cmd := c.command("cmd-1"); cmd.CommandState != "DONE" {
+		t.Errorf("queued action results should be sent: %+v", cmd)
+	}
+
+	// credentials are persisted.
+	api2, err := NewLocalAPI(gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server2 := httptest.NewServer(api2)
+	defer server2.Close()
+	client.base = server2.URL
+	if sc := client.do("GET", states, "", nil, nil); sc != 200 {
+		t.Errorf("token should be restored: %d", sc)
+	}
+}
+
+func TestLocalAPIOnboardKnownEndNode(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	if _, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	api, err := NewLocalAPI(gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := &localClient{t: t, base: server.URL}
+
+	req := map[string]interface{}{"vendorThingID": "en-1", "thingPassword": "attacker"}
+	var onboarded OnboardGatewayResponse
+	if sc := client.do("POST", "/onboardings", "", req, &onboarded); sc != 403 || onboarded.AccessToken != "" {
+		t.Errorf("wrong password should be rejected: %d %+v", sc, onboarded)
+	}
+	req["thingPassword"] = "pass"
+	if sc := client.do("POST", "/onboardings", "", req, &onboarded); sc != 200 || onboarded.AccessToken == "" {
+		t.Errorf("end node should be onboarded with its password: %d %+v", sc, onboarded)
+	}
+}
+
+func TestLocalAPIRetryableErrors(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	gw := startTestGateway(t, c)
+	defer gw.Stop(context.Background())
+	api, err := NewLocalAPI(gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.RetryInterval = time.Hour
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := &localClient{t: t, base: server.URL}
+	var onboarded OnboardGatewayResponse
+	client.do("POST", "/onboardings", "", map[string]interface{}{"vendorThingID": "en-1", "thingPassword": "pass"}, &onboarded)
+	client.token = onboarded.AccessToken
+	path := "/targets/thing:" + onboarded.ThingID + "/states/aliases/light"
+
+	var (
+		mu     sync.Mutex
+		status = 503
+	)
+	setStatus := func(s int) {
+		mu.Lock()
+		defer mu.Unlock()
+		status = s
+	}
+	c.handle("PUT", "thing-if:/targets/thing:([^/]+)/states/aliases/([^/]+)", func(req *fakeRequest, m []string) (int, interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		return status, nil
+	})
+
+	// 5xx is retried.
+	if sc := client.do("PUT", path, "", map[string]interface{}{"power": true}, nil); sc != 202 {
+		t.Errorf("update should be queued on 5xx: %d", sc)
+	}
+	if err := api.Flush(); err == nil || api.Queued() != 1 {
+		t.Errorf("update should be kept on 5xx: %v, %d", err, api.Queued())
+	}
+	setStatus(429)
+	if err := api.Flush(); err == nil || api.Queued() != 1 {
+		t.Errorf("update should be kept on 429: %v, %d", err, api.Queued())
+	}
+
+	// other 4xx is dropped with the cached state.
+	setStatus(400)
+	if err := api.Flush(); err != nil || api.Queued() != 0 {
+		t.Errorf("rejected update should be dropped: %v, %d", err, api.Queued())
+	}
+	states := "/targets/thing:" + onboarded.ThingID + "/states"
+	if sc := client.do("GET", states, "", nil, nil); sc != 404 {
+		t.Errorf("rejected state should not be served: %d", sc)
+	}
+
+	// update which keeps failing is moved to dead letters.
+	api.MaxAttempts = 2
+	setStatus(500)
+	client.do("PUT", path, "", map[string]interface{}{"power": true}, nil)
+	if err := api.Flush(); err == nil || api.Queued() != 1 {
+		t.Errorf("update should be kept until MaxAttempts: %v, %d", err, api.Queued())
+	}
+	if err := api.Flush(); err != nil || api.Queued() != 0 || api.DeadLetters() != 1 {
+		t.Errorf("update should be moved to dead letters: %v, %d, %d", err, api.Queued(), api.DeadLetters())
+	}
+
+	// large body is rejected.
+	api.MaxBodySize = 64
+	if sc := client.do("PUT", path, "", map[string]interface{}{"data": string(make([]byte, 100))}, nil); sc != 413 {
+		t.Errorf("large body should be rejected: %d", sc)
+	}
+	api.MaxBodySize = 0
+
+	// updates queued behind others kick Run.
+	setStatus(503)
+	client.do("PUT", path, "", map[string]interface{}{"power": true}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go api.Run(ctx)
+	setStatus(204)
+	if sc := client.do("PUT", path, "", map[string]interface{}{"power": false}, nil); sc != 202 {
+		t.Errorf("update should be queued behind others: %d", sc)
+	}
+	if !waitUntil(t, time.Second, func() bool { return api.Queued() == 0 }) {
+		t.Errorf("queue should be flushed by kick: %d", api.Queued())
+	}
+	if n := len(c.requestsTo("PUT", "thing-if:/targets/thing:[^/]+/states/aliases/light")); n != 10 {
+		t.Errorf("unexpected number of updates: %d", n)
+	}
+}
@@ -2,10 +2,160 @@ package kii
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
+// redactedValue replaces sensitive values in logs.
+const redactedValue = "[REDACTED]"
+
+var (
+	redactMu sync.RWMutex
+	// redactedHeaders is canonical names of headers which are redacted.
+	redactedHeaders = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"X-Kii-Appkey":        true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}
+	// redactedFields is lower case names of JSON fields and form
+	// parameters which are redacted.
+	redactedFields = map[string]bool{
+		"password":        true,
+		"_password":       true,
+		"thingpassword":   true,
+		"newpassword":     true,
+		"endnodepassword": true,
+		"code":            true,
+		"client_secret":   true,
+		"clientsecret":    true,
+		"access_token":    true,
+		"accesstoken":     true,
+		"refresh_token":   true,
+		"refreshtoken":    true,
+	}
+)
+
+// AddRedactedHeaders adds names of headers whose values are redacted in
+// logs of requests.  Authorization and X-Kii-AppKey are redacted by
+// default.
+func AddRedactedHeaders(names ...string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	for _, n := range names {
+		redactedHeaders[http.CanonicalHeaderKey(n)] = true
+	}
+}
+
+// AddRedactedFields adds names of JSON fields and form parameters whose
+// values are redacted in logs of request and response bodies.  Names are
+// case insensitive.  Passwords, client secrets, tokens and PIN codes of
+// ownership requests are redacted by default.
+func AddRedactedFields(names ...string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	for _, n := range names {
+		redactedFields[strings.ToLower(n)] = true
+	}
+}
+
+func isRedactedHeader(name string) bool {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	return redactedHeaders[http.CanonicalHeaderKey(name)]
+}
+
+func isRedactedField(name string) bool {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	return redactedFields[strings.ToLower(name)]
+}
+
+// redactHeader returns a copy of h whose sensitive values are redacted.
+// The scheme of Authorization is kept.
+func redactHeader(h http.Header) http.Header {
+	r := make(http.Header, len(h))
+	for k, v := range h {
+		if !isRedactedHeader(k) {
+			r[k] = v
+			continue
+		}
+		vv := make([]string, len(v))
+		for i, s := range v {
+			if n := strings.IndexByte(s, ' '); n > 0 && strings.HasSuffix(k, "Authorization") {
+				vv[i] = s[:n+1] + redactedValue
+			} else {
+				vv[i] = redactedValue
+			}
+		}
+		r[k] = vv
+	}
+	return r
+}
+
+// redactBody returns body whose sensitive fields are redacted.  JSON and
+// form bodies are supported, and others are returned as is.
+func redactBody(h http.Header, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if mt == "application/x-www-form-urlencoded" {
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		for k := range q {
+			if isRedactedField(k) {
+				q[k] = []string{redactedValue}
+			}
+		}
+		return []byte(q.Encode())
+	}
+	if b := bytes.TrimSpace(body); len(b) == 0 || (b[0] != '{' && b[0] != '[') {
+		return body
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return body
+	}
+	b, err := json.Marshal(redactJSON(v))
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if isRedactedField(k) {
+				v[k] = redactedValue
+			} else {
+				v[k] = redactJSON(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	}
+	return v
+}
+
 func headerToString(h http.Header) string {
 	var (
 		b        = new(bytes.Buffer)
@@ -32,28 +182,57 @@ func headerToString(h http.Header) string {
 	return b.String()
 }
 
-// logRequest logs request and response.
-func logRequest(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+var thingIDPattern = regexp.MustCompile(`/(?:things/|targets/thing:)([^/]+)`)
+
+// thingIDOf returns thingID in path of APIs.
+func thingIDOf(path string) string {
+	if m := thingIDPattern.FindStringSubmatch(path); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// logRequest logs request and response to the transport logger.  Sensitive
+// headers and fields are redacted.  Responses of server errors are logged
+// as warnings.
+func logRequest(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, requestID string, latency time.Duration) {
+	level := slog.LevelDebug
+	if resp.StatusCode >= 500 {
+		level = slog.LevelWarn
+	}
+	ctx := context.Background()
+	if !transportLog.Enabled(ctx, level) {
+		return
+	}
 	var s1, s2 string
 	if len(reqBody) > 0 {
-		s1 = string(reqBody)
+		s1 = string(redactBody(req.Header, reqBody))
 	}
 	if len(respBody) > 0 {
-		s2 = string(respBody)
-	}
-	Logger.Debugf(`access to Kii:
-  url=%s
-  method=%s
-  header=%s
-  body=%q
-  status_code=%d
-  response_header=%s
-  response_body=%q`,
-		req.URL,
-		req.Method,
-		headerToString(req.Header),
-		s1,
-		resp.StatusCode,
-		headerToString(resp.Header),
-		s2)
+		s2 = string(redactBody(resp.Header, respBody))
+	}
+	transportLog.Log(ctx, level, "access to Kii",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"path", req.URL.Path,
+		"status", resp.StatusCode,
+		"latency", latency,
+		"thingID", thingIDOf(req.URL.Path),
+		"requestID", requestID,
+		"header", headerToString(redactHeader(req.Header)),
+		"body", s1,
+		"response_header", headerToString(redactHeader(resp.Header)),
+		"response_body", s2)
+}
+
+// logRequestError logs request which failed without response.
+func logRequestError(req *http.Request, requestID string, latency time.Duration, err error) {
+	transportLog.Warn("access to Kii failed",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"path", req.URL.Path,
+		"latency", latency,
+		"thingID", thingIDOf(req.URL.Path),
+		"requestID", requestID,
+		"error", err)
 }
@@ -0,0 +1,104 @@
+package kii
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t *testing.T, fn func()) string {
+	var buf bytes.Buffer
+	orig := Logger
+	Logger = &DefaultLogger{Logger: log.New(&buf, "", 0)}
+	defer func() { Logger = orig }()
+	fn()
+	return buf.String()
+}
+
+func TestLogRequestRedaction(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://api.kii.com/thing-if/apps/app/onboardings", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Kii-AppKey", "secret-appkey")
+	req.Header.Set("X-Kii-AppID", "app")
+	req.Header.Set("X-Custom-Secret", "secret-custom")
+	reqBody := []byte(`{"vendorThingID":"vid","thingPassword":"secret-pass","thingProperties":{"password":"secret-nested","apiKey":"secret-apikey"}}`)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+	resp.Header.Set("Content-Type", "application/json")
+	respBody := []byte(`{"thingID":"th.1","accessToken":"secret-at","refresh_token":"secret-rt","list":[{"client_secret":"secret-cs"}]}`)
+
+	out := captureLog(t, func() {
+		logRequest(req, reqBody, resp, respBody, "req-1", time.Millisecond)
+	})
+	for _, s := range []string{"secret-token", "secret-appkey", "secret-pass", "secret-nested", "secret-at", "secret-rt", "secret-cs"} {
+		if strings.Contains(out, s) {
+			t.Errorf("%s should be redacted: %s", s, out)
+		}
+	}
+	for _, s := range []string{"Bearer [REDACTED]", `\"vendorThingID\":\"vid\"`, `\"thingID\":\"th.1\"`, "secret-custom", "secret-apikey"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%s should be logged: %s", s, out)
+		}
+	}
+
+	AddRedactedHeaders("x-custom-secret")
+	AddRedactedFields("APIKEY")
+	defer func() {
+		delete(redactedHeaders, "X-Custom-Secret")
+		delete(redactedFields, "apikey")
+	}()
+	out = captureLog(t, func() {
+		logRequest(req, reqBody, resp, respBody, "req-1", time.Millisecond)
+	})
+	if strings.Contains(out, "secret-custom") || strings.Contains(out, "secret-apikey") {
+		t.Errorf("configured names should be redacted: %s", out)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	if b := redactBody(form, []byte("grant_type=client_credentials&client_secret=s")); string(b) != "client_secret=%5BREDACTED%5D&grant_type=client_credentials" {
+		t.Errorf("unexpected form: %s", b)
+	}
+	if b := redactBody(http.Header{}, []byte("password=plain text")); string(b) != "password=plain text" {
+		t.Errorf("unknown body should not be changed: %s", b)
+	}
+	if b := redactBody(http.Header{}, []byte(`{"size":12345678901234567890}`)); string(b) != `{"size":12345678901234567890}` {
+		t.Errorf("numbers should be kept: %s", b)
+	}
+}
+
+// TestRedactCredentials checks that credentials in requests and responses
+// of the library are redacted.
+func TestRedactCredentials(t *testing.T) {
+	common := OnboardEndnodeRequestCommon{EndNodeVendorThingID: "vid", EndNodePassword: "SECRET"}
+	for _, v := range []interface{}{
+		&OnboardGatewayRequest{VendorThingID: "vid", ThingPassword: "SECRET"},
+		&OnboardGatewayResponse{ThingID: "th.1", AccessToken: "SECRET", MqttEndpoint: MqttEndpoint{Password: "SECRET"}},
+		&RegisterThingRequest{VendorThingID: "vid", ThingPassword: "SECRET"},
+		&EndNodeTokenResponse{AccessToken: "SECRET", RefreshToken: "SECRET"},
+		&UserRegisterRequest{LoginName: "user", Password: "SECRET"},
+		&UserLoginRequest{UserName: "user", Password: "SECRET", RefreshToken: "SECRET"},
+		&UserLoginResponse{ID: "user", AccessToken: "SECRET", RefreshToken: "SECRET"},
+		&OnboardByOwnerRequest{ThingID: "th.1", ThingPassword: "SECRET"},
+		&OnboardEndnodeWithGatewayThingIDRequest{GatewayThingID: "th.1", OnboardEndnodeRequestCommon: common},
+		&OnboardEndnodeWithGatewayVendorThingIDRequest{GatewayVendorThingID: "vid", OnboardEndnodeRequestCommon: common},
+		&OnboardEndnodeResponse{AccessToken: "SECRET", EndNodeThingID: "th.2"},
+		&UpdateVendorThingIDRequest{VendorThingID: "vid", Password: "SECRET"},
+		&ThingOwnershipRequestResponse{Code: "SECRET"},
+		map[string]string{"newPassword": "SECRET"},
+		map[string]string{"code": "SECRET"},
+		map[string]string{"client_id": "app", "client_secret": "SECRET"},
+	} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := redactBody(http.Header{}, b); strings.Contains(string(r), "SECRET") {
+			t.Errorf("credential of %T should be redacted: %s", v, r)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package kii
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// LocalBroker is a MQTT broker in local network.  kii_go doesn't include MQTT
+// client nor server, so devices in local network need an external broker,
+// like Mosquitto, and LocalBroker must be implemented with a MQTT client
+// library to attach to it.  MemoryBroker is only for devices simulated in
+// the gateway process and tests.
+//
+// Handlers may be called on goroutines of the client library, so they must
+// not block.  MQTTBridge queues messages and sends them to the cloud on its
+// own goroutine.
+type LocalBroker interface {
+	// Subscribe subscribes topics which match pattern, which may contain
+	// "+" and "#" wildcards.  It returns a function to unsubscribe.
+	Subscribe(pattern string, handler func(topic string, payload []byte)) (func(), error)
+	// Publish publishes payload to topic.
+	Publish(topic string, payload []byte) error
+}
+
+// MQTTStateRoute maps a topic pattern to state updates.  The first "+"
+// wildcard of Pattern matches ID of end node.
+type MQTTStateRoute struct {
+	Pattern string
+	// Alias is alias of trait state in payload.  When empty, payload is
+	// states of multiple aliases.
+	Alias string
+}
+
+// MQTTCommandMessage is payload of command topics.
+type MQTTCommandMessage struct {
+	CommandID string                   `json:"commandID"`
+	Actions   []map[string]interface{} `json:"actions"`
+}
+
+// MQTTResultMessage is payload of result topics.
+type MQTTResultMessage struct {
+	CommandID     string                   `json:"commandID"`
+	ActionResults []map[string]interface{} `json:"actionResults"`
+}
+
+// MQTTBridge is an EndNodeAdapter which bridges end nodes publishing MQTT in
+// local network and Kii Cloud.
+//
+// ID of end node in topics is address in Registry if Registry is given,
+// otherwise vendorThingID.
+//
+//	bridge := &kii.MQTTBridge{
+//		Broker:       broker,
+//		StateRoutes:  []kii.MQTTStateRoute{{Pattern: "site/+/state"}},
+//		CommandTopic: "site/{id}/command",
+//		ResultTopic:  "site/+/result",
+//	}
+//	gw.Adapters = append(gw.Adapters, bridge)
+type MQTTBridge struct {
+	Broker LocalBroker
+
+	// AdapterName is name of the adapter.  Default is "mqtt".
+	AdapterName string
+
+	// Registry resolves addresses in topics to end nodes.  Optional.
+	Registry *EndNodeRegistry
+
+	// StateRoutes are topics which end nodes publish states to.
+	StateRoutes []MQTTStateRoute
+
+	// CommandTopic is topic to publish commands to end nodes.  "{id}" is
+	// replaced with ID of end node.  Payload is MQTTCommandMessage.
+	CommandTopic string
+
+	// ResultTopic is pattern of topics which end nodes publish
+	// MQTTResultMessage to.  The first "+" wildcard matches ID of end node.
+	ResultTopic string
+
+	// QueueSize is number of received messages which wait to be sent to
+	// the cloud.  Messages received while the queue is full are dropped.
+	// Default is 100.
+	QueueSize int
+
+	mu sync.RWMutex
+	gw *Gateway
+}
+
+var _ EndNodeAdapter = (*MQTTBridge)(nil)
+
+// bridgeMessage is a received message which waits to be handled.
+type bridgeMessage struct {
+	topic   string
+	payload []byte
+	handle  func(topic string, payload []byte) error
+	what    string
+}
+
+// Name returns AdapterName.
+func (b *MQTTBridge) Name() string {
+	if b.AdapterName != "" {
+		return b.AdapterName
+	}
+	return "mqtt"
+}
+
+// Run subscribes state and result topics, and sends received messages to
+// the cloud in order until ctx is done.
+func (b *MQTTBridge) Run(ctx context.Context, gw *Gateway) error {
+	if b.Broker == nil {
+		return errors.New("Broker must not be nil")
+	}
+	size := b.QueueSize
+	if size <= 0 {
+		size = 100
+	}
+	queue := make(chan bridgeMessage, size)
+	// enqueue is called by the broker, so it must not block.
+	enqueue := func(what string, handle func(string, []byte) error) func(string, []byte) {
+		return func(topic string, payload []byte) {
+			m := bridgeMessage{topic: topic, payload: append([]byte(nil), payload...), handle: handle, what: what}
+			select {
+			case queue <- m:
+			default:
+				mqttLog.Warn("drop message because queue is full", "topic", topic)
+			}
+		}
+	}
+	var unsubscribes []func()
+	defer func() {
+		b.mu.Lock()
+		b.gw = nil
+		b.mu.Unlock()
+		for _, u := range unsubscribes {
+			u()
+		}
+	}()
+	for _, r := range b.StateRoutes {
+		r := r
+		u, err := b.Broker.Subscribe(r.Pattern, enqueue("state", func(topic string, payload []byte) error {
+			return b.handleState(r, topic, payload)
+		}))
+		if err != nil {
+			return err
+		}
+		unsubscribes = append(unsubscribes, u)
+	}
+	if b.ResultTopic != "" {
+		u, err := b.Broker.Subscribe(b.ResultTopic, enqueue("action results", b.handleResult))
+		if err != nil {
+			return err
+		}
+		unsubscribes = append(unsubscribes, u)
+	}
+	b.mu.Lock()
+	b.gw = gw
+	b.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-queue:
+			if err := m.handle(m.topic, m.payload); err != nil {
+				mqttLog.Warn("failed to bridge "+m.what, "topic", m.topic, "error", err)
+			}
+		}
+	}
+}
+
+func (b *MQTTBridge) gateway() (*Gateway, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.gw == nil {
+		return nil, errors.New("bridge is not running")
+	}
+	return b.gw, nil
+}
+
+// vendorThingID resolves ID in topic to vendorThingID.
+func (b *MQTTBridge) vendorThingID(pattern, topic string) (string, error) {
+	m, ok := matchTopic(pattern, topic)
+	if !ok || len(m) == 0 {
+		return "", fmt.Errorf("topic %s doesn't have ID of end node", topic)
+	}
+	if b.Registry != nil {
+		rec, ok := b.Registry.Get(m[0])
+		if !ok {
+			return "", fmt.Errorf("address %s is not registered", m[0])
+		}
+		return rec.VendorThingID, nil
+	}
+	return m[0], nil
+}
+
+func (b *MQTTBridge) handleState(r MQTTStateRoute, topic string, payload []byte) error {
+	gw, err := b.gateway()
+	if err != nil {
+		return err
+	}
+	vendorThingID, err := b.vendorThingID(r.Pattern, topic)
+	if err != nil {
+		return err
+	}
+	var state interface{}
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return err
+	}
+	if r.Alias != "" {
+		return gw.UpdateEndNodeTraitState(vendorThingID, r.Alias, state)
+	}
+	return gw.UpdateEndNodeMultipleTraitState(vendorThingID, state)
+}
+
+func (b *MQTTBridge) handleResult(topic string, payload []byte) error {
+	gw, err := b.gateway()
+	if err != nil {
+		return err
+	}
+	vendorThingID, err := b.vendorThingID(b.ResultTopic, topic)
+	if err != nil {
+		return err
+	}
+	var msg MQTTResultMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	if msg.CommandID == "" {
+		return errors.New("commandID is required")
+	}
+	return gw.UpdateEndNodeCommandResults(vendorThingID, msg.CommandID, msg.ActionResults)
+}
+
+// HandleCommand publishes cmd to the command topic of the end node.  Action
+// results are updated when the end node publishes them to the result
+// topic.
+func (b *MQTTBridge) HandleCommand(ctx context.Context, en *EndNodeIdentity, cmd *GetCommandResponse) ([]map[string]interface{}, error) {
+	if b.CommandTopic == "" {
+		return nil, errors.New("CommandTopic is not set")
+	}
+	id := en.VendorThingID
+	if b.Registry != nil {
+		rec, ok := b.Registry.ByVendorThingID(en.VendorThingID)
+		if !ok {
+			return nil, fmt.Errorf("end node %s is not registered", en.VendorThingID)
+		}
+		id = rec.Address
+	}
+	payload, err := json.Marshal(&MQTTCommandMessage{CommandID: cmd.CommandID, Actions: cmd.Actions})
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.Replace(b.CommandTopic, "{id}", id, -1)
+	return nil, b.Broker.Publish(topic, payload)
+}
+
+// matchTopic matches topic with MQTT topic filter pattern, and returns
+// levels matched by "+" wildcards.
+func matchTopic(pattern, topic string) ([]string, bool) {
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+	var m []string
+	for i, level := range p {
+		if level == "#" {
+			return m, true
+		}
+		if i >= len(t) {
+			return nil, false
+		}
+		if level == "+" {
+			m = append(m, t[i])
+		} else if level != t[i] {
+			return nil, false
+		}
+	}
+	if len(p) != len(t) {
+		return nil, false
+	}
+	return m, true
+}
+
+// MemoryBroker is a LocalBroker which delivers messages in the process.  It
+// doesn't listen on network, so devices in local network can't connect to
+// it.  Handlers are called synchronously in Publish.
+type MemoryBroker struct {
+	mu   sync.RWMutex
+	seq  int
+	subs map[int]memorySubscription
+}
+
+var _ LocalBroker = (*MemoryBroker)(nil)
+
+type memorySubscription struct {
+	pattern string
+	handler func(topic string, payload []byte)
+}
+
+// NewMemoryBroker creates a MemoryBroker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: map[int]memorySubscription{}}
+}
+
+// Subscribe subscribes topics which match pattern.
+func (b *MemoryBroker) Subscribe(pattern string, handler func(topic string, payload []byte)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	id := b.seq
+	b.subs[id] = memorySubscription{pattern: pattern, handler: handler}
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}, nil
+}
+
+// Publish delivers payload to subscribers of topic.
+func (b *MemoryBroker) Publish(topic string, payload []byte) error {
+	b.mu.RLock()
+	var handlers []func(string, []byte)
+	for _, s := range b.subs {
+		if _, ok := matchTopic(s.pattern, topic); ok {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		h(topic, payload)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package kii
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		m              []string
+		ok             bool
+	}{
+		{"site/+/state", "site/en-1/state", []string{"en-1"}, true},
+		{"site/+/state", "site/en-1/result", nil, false},
+		{"site/+/state", "site/en-1/state/x", nil, false},
+		{"site/+/+", "site/a/b", []string{"a", "b"}, true},
+		{"site/#", "site", nil, true},
+		{"site/+/#", "site/a/b/c", []string{"a"}, true},
+		{"site/a", "site", nil, false},
+	}
+	for _, c := range cases {
+		m, ok := matchTopic(c.pattern, c.topic)
+		if ok != c.ok || (ok && !reflect.DeepEqual(m, c.m)) {
+			t.Errorf("matchTopic(%q, %q) = %v, %v", c.pattern, c.topic, m, ok)
+		}
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	broker := NewMemoryBroker()
+	registry, _ := OpenEndNodeRegistry(NewMemoryStore())
+	bridge := &MQTTBridge{
+		Broker:   broker,
+		Registry: registry,
+		StateRoutes: []MQTTStateRoute{
+			{Pattern: "site/+/state"},
+			{Pattern: "site/+/light", Alias: "light"},
+		},
+		CommandTopic: "site/{id}/command",
+		ResultTopic:  "site/+/result",
+	}
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Adapters: []EndNodeAdapter{bridge}}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(ctx)
+	en, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass", Adapter: "mqtt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Put(EndNodeRecord{Address: "dev1", VendorThingID: "en-1", ThingID: en.ThingID})
+
+	// end node answers commands.
+	commands := make(chan MQTTCommandMessage, 1)
+	broker.Subscribe("site/dev1/command", func(topic string, payload []byte) {
+		var msg MQTTCommandMessage
+		json.Unmarshal(payload, &msg)
+		commands <- msg
+	})
+
+	// wait until the bridge subscribes topics.
+	for i := 0; i < 100; i++ {
+		if _, err := bridge.gateway(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	broker.Publish("site/dev1/state", []byte(`{"light":{"power":true},"sensor":{"temp":20}}`))
+	broker.Publish("site/dev1/light", []byte(`{"power":false}`))
+	broker.Publish("site/unknown/light", []byte(`{"power":false}`))
+	waitUntil(t, time.Second, func() bool {
+		return len(c.requestsTo("PUT", "thing-if:/targets/thing:[^/]+/states.*")) == 2
+	})
+	if s := c.state(en.ThingID, "sensor"); !reflect.DeepEqual(s, map[string]interface{}{"temp": 20.0}) {
+		t.Errorf("unexpected state: %v", s)
+	}
+	if s := c.state(en.ThingID, "light"); !reflect.DeepEqual(s, map[string]interface{}{"power": false}) {
+		t.Errorf("unexpected state: %v", s)
+	}
+
+	actions := []map[string]interface{}{{"light": []interface{}{map[string]interface{}{"turnPower": true}}}}
+	c.addCommand(en.ThingID, "cmd-1", actions)
+	if err := gw.HandleCommand(ctx, en.ThingID, "cmd-1"); err != nil {
+		t.Fatalf("failed to handle command: %s", err)
+	}
+	msg := <-commands
+	if msg.CommandID != "cmd-1" || !reflect.DeepEqual(msg.Actions, actions) {
+		t.Errorf("unexpected command message: %+v", msg)
+	}
+	if cmd := c.command("cmd-1"); cmd.CommandState == "DONE" {
+		t.Errorf("results should not be updated before end node answers")
+	}
+	broker.Publish("site/dev1/result", []byte(`{"commandID":"cmd-1","actionResults":[{"light":[{"turnPower":{"succeeded":true}}]}]}`))
+	waitUntil(t, time.Second, func() bool { return c.command("cmd-1").CommandState == "DONE" })
+	if cmd := c.command("cmd-1"); cmd.CommandState != "DONE" || len(cmd.ActionResults) != 1 {
+		t.Errorf("action results should be updated: %+v", cmd)
+	}
+
+	gw.Stop(ctx)
+	if sc := len(c.requestsTo("PUT", "thing-if:/targets/thing:[^/]+/states.*")); sc != 2 {
+		t.Errorf("unexpected number of state updates: %d", sc)
+	}
+	broker.Publish("site/dev1/light", []byte(`{"power":true}`))
+	if sc := len(c.requestsTo("PUT", "thing-if:/targets/thing:[^/]+/states.*")); sc != 2 {
+		t.Errorf("stopped bridge should unsubscribe: %d", sc)
+	}
+}
+
+func TestMQTTBridgeQueue(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	broker := NewMemoryBroker()
+	bridge := &MQTTBridge{
+		Broker:      broker,
+		StateRoutes: []MQTTStateRoute{{Pattern: "site/+/light", Alias: "light"}},
+		QueueSize:   1,
+	}
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Adapters: []EndNodeAdapter{bridge}}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(ctx)
+	if _, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass", Adapter: "mqtt"}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, time.Second, func() bool {
+		_, err := bridge.gateway()
+		return err == nil
+	})
+
+	// the cloud blocks the first upload.
+	uploading := make(chan struct{}, 3)
+	release := make(chan struct{})
+	c.handle("PUT", "thing-if:/targets/thing:[^/]+/states/aliases/light", func(req *fakeRequest, m []string) (int, interface{}) {
+		uploading <- struct{}{}
+		<-release
+		return 204, nil
+	})
+	broker.Publish("site/en-1/light", []byte(`{"power":true}`))
+	select {
+	case <-uploading:
+	case <-time.After(time.Second):
+		t.Fatalf("state should be uploaded")
+	}
+	done := make(chan struct{})
+	go func() {
+		broker.Publish("site/en-1/light", []byte(`{"power":false}`))
+		broker.Publish("site/en-1/light", []byte(`{"power":true}`))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("broker should not be blocked by uploads")
+	}
+	close(release)
+	waitUntil(t, time.Second, func() bool { return len(uploading) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(uploading); n != 1 {
+		t.Errorf("message over QueueSize should be dropped: %d uploads", n+1)
+	}
+}
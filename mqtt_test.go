@@ -5,6 +5,7 @@ import (
 )
 
 func TestGetMqttEndpoint(t *testing.T) {
+	defer useCassette(t)()
 	// get a login user
 	author, _, err := GetLoginKiiUser()
 	if err != nil {
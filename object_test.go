@@ -1,21 +1,20 @@
 package kii
 
 import (
-	"fmt"
 	"testing"
-	"time"
 
 	dproxy "github.com/koron/go-dproxy"
 )
 
 func TestAppScopeObjectSuccess(t *testing.T) {
+	defer useCassette(t)()
 
 	author, _, err := GetLoginKiiUser()
 	if err != nil {
 		t.Error("fail to get login user", err)
 	}
 
-	bn := fmt.Sprintf("myBucket%d", time.Now().UnixNano())
+	bn := uniqueID("myBucket")
 
 	data := map[string]interface{}{
 		"key1": "value1",
@@ -52,13 +51,14 @@ func TestAppScopeObjectSuccess(t *testing.T) {
 }
 
 func TestUserScopeObjectSuccess(t *testing.T) {
+	defer useCassette(t)()
 
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
 		t.Error("fail to get login user", err)
 	}
 
-	bn := fmt.Sprintf("myBucket%d", time.Now().UnixNano())
+	bn := uniqueID("myBucket")
 
 	data := map[string]interface{}{
 		"key1": "value1",
@@ -97,7 +97,8 @@ func TestUserScopeObjectSuccess(t *testing.T) {
 }
 
 func TestThingScopeObjectSuccess(t *testing.T) {
-	thingBucket := fmt.Sprintf("myBucket%d", time.Now().UnixNano())
+	defer useCassette(t)()
+	thingBucket := uniqueID("myBucket")
 
 	au, gwID, err := GatewayOnboard()
 	if err != nil {
@@ -0,0 +1,429 @@
+package kii
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FirmwareImage is metadata of a firmware image.  It is stored as a kii
+// object, and the image is stored as its body.
+type FirmwareImage struct {
+	ObjectID        string `json:"_id,omitempty"`
+	ThingType       string `json:"thingType"`
+	FirmwareVersion string `json:"firmwareVersion"`
+	// Checksum is hex encoded SHA-256 of the image.
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+}
+
+// PublishFirmware stores a firmware image for thingType to bucket.  When the
+// image fails to be uploaded, its metadata is deleted, so agents don't find
+// an image without body.
+func (a APIAuthor) PublishFirmware(bucket Bucket, thingType, firmwareVersion string, image []byte) (*FirmwareImage, error) {
+	if thingType == "" || firmwareVersion == "" {
+		return nil, errors.New("thingType and firmwareVersion are required")
+	}
+	sum := sha256.Sum256(image)
+	img := &FirmwareImage{
+		ThingType:       thingType,
+		FirmwareVersion: firmwareVersion,
+		Checksum:        hex.EncodeToString(sum[:]),
+		Size:            int64(len(image)),
+	}
+	resp, err := a.PostObject(bucket, map[string]interface{}{
+		"thingType":       img.ThingType,
+		"firmwareVersion": img.FirmwareVersion,
+		"checksum":        img.Checksum,
+		"size":            img.Size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	img.ObjectID = resp.ObjectID
+	if err := a.UploadObjectBody(bucket, img.ObjectID, "application/octet-stream", image); err != nil {
+		if derr := a.DeleteObject(bucket, img.ObjectID); derr != nil {
+			gatewayLog.Warn("failed to delete firmware without body", "objectID", img.ObjectID, "error", derr)
+		}
+		return nil, err
+	}
+	return img, nil
+}
+
+// ListFirmware lists firmware images for thingType in bucket, ordered by
+// version.
+func (a APIAuthor) ListFirmware(bucket Bucket, thingType string) ([]*FirmwareImage, error) {
+	var images []*FirmwareImage
+	request := QueryObjectsRequest{
+		BucketQuery: BucketQuery{Clause: EqualsClause("thingType", thingType)},
+	}
+	for {
+		resp, err := a.QueryBucketObjects(bucket, request)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Results {
+			b, err := json.Marshal(r)
+			if err != nil {
+				return nil, err
+			}
+			var img FirmwareImage
+			if err := json.Unmarshal(b, &img); err != nil {
+				return nil, err
+			}
+			images = append(images, &img)
+		}
+		if resp.NextPaginationKey == "" {
+			break
+		}
+		request.PaginationKey = resp.NextPaginationKey
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return compareVersions(images[i].FirmwareVersion, images[j].FirmwareVersion) < 0
+	})
+	return images, nil
+}
+
+// compareVersions compares versions like "1.10.2" by each numeric part.
+// Parts which are not numeric are compared as strings.
+func compareVersions(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var sa, sb string
+		if i < len(pa) {
+			sa = pa[i]
+		}
+		if i < len(pb) {
+			sb = pb[i]
+		}
+		na, erra := strconv.ParseUint(sa, 10, 64)
+		nb, errb := strconv.ParseUint(sb, 10, 64)
+		switch {
+		case erra == nil && errb == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case sa != sb:
+			if sa < sb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// FirmwareStager is implemented by EndNodeAdapter which can install
+// firmware to end nodes.
+type FirmwareStager interface {
+	// StageFirmware installs a downloaded firmware image at path to an end
+	// node.  It returns after the end node runs the new firmware.
+	StageFirmware(ctx context.Context, en *EndNodeIdentity, image *FirmwareImage, path string) error
+}
+
+// FirmwareUpdate is an update of an end node.
+type FirmwareUpdate struct {
+	VendorThingID string
+	Image         *FirmwareImage
+}
+
+// FirmwareUpdateState is progress of an update reported as trait state of
+// an end node.
+type FirmwareUpdateState struct {
+	// State is one of "downloading", "staging", "done" and "failed".
+	State           string `json:"state"`
+	FirmwareVersion string `json:"firmwareVersion"`
+	Progress        int    `json:"progress"`
+	Error           string `json:"error,omitempty"`
+}
+
+// OTAAgent distributes firmware images in Bucket to end nodes of Gateway.
+// Images are downloaded to Dir in chunks, so interrupted downloads are
+// resumed, and verified by checksum.  Then they are staged by the adapter
+// of end nodes, which must implement FirmwareStager.  Progress is reported
+// as trait state of end nodes, and firmware version is updated when done.
+//
+//	agent := &kii.OTAAgent{
+//		Gateway: gw,
+//		Bucket:  kii.AppBucket{BucketName: "firmware"},
+//		Dir:     "/var/lib/gateway/firmware",
+//	}
+//	go agent.Run(ctx)
+type OTAAgent struct {
+	Gateway *Gateway
+	Bucket  Bucket
+
+	// Dir is directory to store downloaded images.
+	Dir string
+
+	// ChunkSize is size of a download request.  Default is 1 MiB.
+	ChunkSize int64
+
+	// Interval is interval to check updates in Run.  Default is 1 hour.
+	Interval time.Duration
+
+	// Alias is alias of trait state to report progress.  Default is
+	// "firmwareUpdate".
+	Alias string
+}
+
+func (o *OTAAgent) alias() string {
+	if o.Alias != "" {
+		return o.Alias
+	}
+	return "firmwareUpdate"
+}
+
+// CheckUpdates returns the latest firmware for end nodes which run older
+// versions.
+func (o *OTAAgent) CheckUpdates() ([]FirmwareUpdate, error) {
+	if o.Gateway == nil || o.Bucket == nil {
+		return nil, errors.New("Gateway and Bucket are required")
+	}
+	latest := map[string]*FirmwareImage{}
+	var updates []FirmwareUpdate
+	for _, en := range o.Gateway.EndNodes() {
+		if en.ThingType == "" {
+			continue
+		}
+		img, ok := latest[en.ThingType]
+		if !ok {
+			var images []*FirmwareImage
+			if err := o.Gateway.withGateway(func(a *APIAuthor) error {
+				var err error
+				images, err = a.ListFirmware(o.Bucket, en.ThingType)
+				return err
+			}); err != nil {
+				return nil, err
+			}
+			if len(images) > 0 {
+				img = images[len(images)-1]
+			}
+			latest[en.ThingType] = img
+		}
+		if img != nil && compareVersions(en.FirmwareVersion, img.FirmwareVersion) < 0 {
+			updates = append(updates, FirmwareUpdate{VendorThingID: en.VendorThingID, Image: img})
+		}
+	}
+	return updates, nil
+}
+
+// Download downloads an image to Dir, and returns its path.  A partially
+// downloaded image is resumed, and a downloaded image is reused when its
+// size and checksum match, or downloaded again.  progress
+// is called with downloaded size after each chunk when it isn't nil.  The
+// download stops when ctx is done, and is resumed by the next call.
+func (o *OTAAgent) Download(ctx context.Context, img *FirmwareImage, progress func(downloaded int64)) (string, error) {
+	if o.Dir == "" {
+		return "", errors.New("Dir is required")
+	}
+	path := filepath.Join(o.Dir, img.ObjectID+".bin")
+	if ok, err := verifyImage(path, img); err != nil {
+		return "", err
+	} else if ok {
+		return path, nil
+	}
+	part := path + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	if offset > img.Size {
+		// broken partial image.
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		h.Reset()
+		offset = 0
+	}
+	chunkSize := o.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 1024 * 1024
+	}
+	for offset < img.Size {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		var r *ObjectBodyRange
+		if err := o.Gateway.withGateway(func(a *APIAuthor) error {
+			var err error
+			r, err = a.DownloadObjectBody(ctx, o.Bucket, img.ObjectID, offset, chunkSize)
+			return err
+		}); err != nil {
+			return "", err
+		}
+		if r.Offset != offset || len(r.Body) == 0 {
+			return "", fmt.Errorf("unexpected range of %s: offset=%d size=%d", img.ObjectID, r.Offset, len(r.Body))
+		}
+		if err := appendChunk(f, h, r.Body); err != nil {
+			return "", err
+		}
+		offset += int64(len(r.Body))
+		if progress != nil {
+			progress(offset)
+		}
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); offset != img.Size || !strings.EqualFold(sum, img.Checksum) {
+		// download from the beginning next time.
+		f.Close()
+		os.Remove(part)
+		return "", fmt.Errorf("checksum of %s mismatch: %s", img.ObjectID, sum)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(part, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// verifyImage reports whether the image at path matches img.  A broken image
+// is removed.
+func verifyImage(path string, img *FirmwareImage) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	if n == img.Size && strings.EqualFold(hex.EncodeToString(h.Sum(nil)), img.Checksum) {
+		return true, nil
+	}
+	gatewayLog.Warn("downloaded firmware is broken, download again", "objectID", img.ObjectID)
+	return false, os.Remove(path)
+}
+
+func appendChunk(f *os.File, h hash.Hash, b []byte) error {
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	h.Write(b)
+	return f.Sync()
+}
+
+// Apply downloads and stages an update, and reports progress.
+func (o *OTAAgent) Apply(ctx context.Context, u FirmwareUpdate) error {
+	en, ok := o.Gateway.EndNode(u.VendorThingID)
+	if !ok {
+		return fmt.Errorf("end node %s is not onboarded", u.VendorThingID)
+	}
+	adapter, err := o.Gateway.adapterOf(en)
+	if err != nil {
+		return err
+	}
+	stager, ok := adapter.(FirmwareStager)
+	if !ok {
+		return fmt.Errorf("adapter %s doesn't support firmware update", adapter.Name())
+	}
+	err = o.apply(ctx, en, stager, u.Image)
+	if err != nil {
+		o.report(en.VendorThingID, &FirmwareUpdateState{State: "failed", FirmwareVersion: u.Image.FirmwareVersion, Error: err.Error()})
+	}
+	return err
+}
+
+func (o *OTAAgent) apply(ctx context.Context, en *EndNodeIdentity, stager FirmwareStager, img *FirmwareImage) error {
+	st := &FirmwareUpdateState{State: "downloading", FirmwareVersion: img.FirmwareVersion}
+	o.report(en.VendorThingID, st)
+	path, err := o.Download(ctx, img, func(downloaded int64) {
+		if p := int(downloaded * 100 / img.Size); p != st.Progress {
+			st.Progress = p
+			o.report(en.VendorThingID, st)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	o.report(en.VendorThingID, &FirmwareUpdateState{State: "staging", FirmwareVersion: img.FirmwareVersion, Progress: 100})
+	if err := stager.StageFirmware(ctx, en, img, path); err != nil {
+		return err
+	}
+	if err := o.Gateway.UpdateEndNodeFirmwareVersion(en.VendorThingID, img.FirmwareVersion); err != nil {
+		return err
+	}
+	if !o.needed(img) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			gatewayLog.Warn("failed to delete firmware", "path", path, "error", err)
+		}
+	}
+	o.report(en.VendorThingID, &FirmwareUpdateState{State: "done", FirmwareVersion: img.FirmwareVersion, Progress: 100})
+	return nil
+}
+
+// needed returns true when an end node still runs older firmware than img,
+// so that the image is kept for it.
+func (o *OTAAgent) needed(img *FirmwareImage) bool {
+	for _, en := range o.Gateway.EndNodes() {
+		if en.ThingType == img.ThingType && compareVersions(en.FirmwareVersion, img.FirmwareVersion) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// report reports progress.  Failures are logged, and don't stop updates.
+func (o *OTAAgent) report(vendorThingID string, st *FirmwareUpdateState) {
+	if err := o.Gateway.UpdateEndNodeTraitState(vendorThingID, o.alias(), st); err != nil {
+		gatewayLog.Warn("failed to report firmware update", "vendorThingID", vendorThingID, "error", err)
+	}
+}
+
+// Run checks and applies updates on every Interval until ctx is done.
+// Failed updates are retried on the next interval.
+func (o *OTAAgent) Run(ctx context.Context) error {
+	interval := o.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		updates, err := o.CheckUpdates()
+		if err != nil {
+			gatewayLog.Warn("failed to check firmware updates", "error", err)
+		}
+		for _, u := range updates {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := o.Apply(ctx, u); err != nil {
+				gatewayLog.Error("failed to update firmware", "vendorThingID", u.VendorThingID, "firmwareVersion", u.Image.FirmwareVersion, "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package kii
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeObjects serves objects and their bodies of a bucket in fakeThingCloud.
+type fakeObjects struct {
+	mu      sync.Mutex
+	seq     int
+	objects map[string]map[string]interface{}
+	bodies  map[string][]byte
+	// failAfter makes body downloads fail after this number of requests
+	// when it is positive.
+	failAfter int
+}
+
+func handleObjects(c *fakeThingCloud, bucketPath string) *fakeObjects {
+	o := &fakeObjects{objects: map[string]map[string]interface{}{}, bodies: map[string][]byte{}}
+	// PostObject requests with a doubled slash.
+	c.handle("POST", "api:/?"+bucketPath+"/objects", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var obj map[string]interface{}
+		req.decode(&obj)
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.seq++
+		id := fmt.Sprintf("obj-%d", o.seq)
+		obj["_id"] = id
+		o.objects[id] = obj
+		return 201, map[string]interface{}{"objectID": id}
+	}))
+	c.handle("POST", "api:"+bucketPath+"/query", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		var q QueryObjectsRequest
+		req.decode(&q)
+		eq := q.BucketQuery.Clause
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		results := []map[string]interface{}{}
+		for i := 1; i <= o.seq; i++ {
+			obj, ok := o.objects[fmt.Sprintf("obj-%d", i)]
+			if ok && obj[eq["field"].(string)] == eq["value"] {
+				results = append(results, obj)
+			}
+		}
+		return 200, map[string]interface{}{"results": results}
+	}))
+	// DeleteObject requests with a doubled slash.
+	c.handle("DELETE", "api:/?"+bucketPath+"/objects/([^/]+)", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if _, ok := o.objects[m[1]]; !ok {
+			return 404, nil
+		}
+		delete(o.objects, m[1])
+		delete(o.bodies, m[1])
+		return 204, nil
+	}))
+	c.handle("PUT", "api:"+bucketPath+"/objects/([^/]+)/body", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.bodies[m[1]] = req.Body
+		return 200, map[string]interface{}{}
+	}))
+	c.handle("GET", "api:"+bucketPath+"/objects/([^/]+)/body", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		b, ok := o.bodies[m[1]]
+		if !ok {
+			return 404, nil
+		}
+		if o.failAfter > 0 {
+			o.failAfter--
+			if o.failAfter == 0 {
+				return 503, map[string]interface{}{"errorCode": "UNAVAILABLE"}
+			}
+		}
+		var first, last int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil {
+			return 200, &fakeResponse{Body: b}
+		}
+		if last >= len(b) {
+			last = len(b) - 1
+		}
+		h := http.Header{}
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(b)))
+		return 206, &fakeResponse{Header: h, Body: b[first : last+1]}
+	}))
+	return o
+}
+
+// stagerAdapter is an adapter which records staged firmware.
+type stagerAdapter struct {
+	*fakeAdapter
+	mu     sync.Mutex
+	staged map[string][]byte
+}
+
+func (a *stagerAdapter) StageFirmware(ctx context.Context, en *EndNodeIdentity, image *FirmwareImage, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.staged[en.VendorThingID] = b
+	return nil
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		r    int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0", "1.9.9", 1},
+		{"1.0", "1.0.1", -1},
+		{"", "1.0", -1},
+		{"1.0-beta", "1.0-rc", -1},
+	}
+	for _, c := range cases {
+		if r := compareVersions(c.a, c.b); r != c.r {
+			t.Errorf("compareVersions(%q, %q) = %d", c.a, c.b, r)
+		}
+	}
+}
+
+func TestOTAAgent(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	bucket := AppBucket{BucketName: "firmware"}
+	objects := handleObjects(c, bucket.Path())
+	adapter := &stagerAdapter{fakeAdapter: newFakeAdapter("ble"), staged: map[string][]byte{}}
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Adapters: []EndNodeAdapter{adapter}}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Stop(ctx)
+	en, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-1", Password: "pass", ThingType: "lamp", FirmwareVersion: "1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "en-2", Password: "pass", ThingType: "sensor", FirmwareVersion: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := gw.Author()
+	image := bytes.Repeat([]byte("0123456789"), 10)
+	if _, err := a.PublishFirmware(bucket, "lamp", "1.2.0", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	img, err := a.PublishFirmware(bucket, "lamp", "1.10.0", image)
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+	if !bytes.Equal(objects.bodies[img.ObjectID], image) {
+		t.Errorf("body should be uploaded")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	agent := &OTAAgent{Gateway: gw, Bucket: bucket, Dir: dir, ChunkSize: 30}
+	updates, err := agent.CheckUpdates()
+	if err != nil {
+		t.Fatalf("failed to check updates: %s", err)
+	}
+	if len(updates) != 1 || updates[0].VendorThingID != "en-1" || !reflect.DeepEqual(updates[0].Image, img) {
+		t.Fatalf("unexpected updates: %+v", updates)
+	}
+
+	// download is interrupted after the second chunk.
+	objects.failAfter = 3
+	var downloaded int64
+	if _, err := agent.Download(ctx, img, func(n int64) { downloaded = n }); err == nil || downloaded != 60 {
+		t.Fatalf("download should fail after the second chunk: %v %d", err, downloaded)
+	}
+	body := "api:" + bucket.Path() + "/objects/" + img.ObjectID + "/body"
+	resumed := len(c.requestsTo("GET", body))
+	if err := agent.Apply(ctx, updates[0]); err != nil {
+		t.Fatalf("failed to apply: %s", err)
+	}
+	if !bytes.Equal(adapter.staged["en-1"], image) {
+		t.Errorf("image should be staged: %q", adapter.staged["en-1"])
+	}
+	gets := c.requestsTo("GET", body)[resumed:]
+	if n := len(gets); n != 2 || gets[0].Header.Get("Range") != "bytes=60-89" {
+		t.Errorf("download should be resumed: %d %q", n, gets[0].Header.Get("Range"))
+	}
+	if v := c.firmwareVersion(en.ThingID); v != "1.10.0" {
+		t.Errorf("firmware version should be updated: %q", v)
+	}
+	if got, _ := gw.EndNode("en-1"); got.FirmwareVersion != "1.10.0" {
+		t.Errorf("stored firmware version should be updated: %q", got.FirmwareVersion)
+	}
+	st := c.state(en.ThingID, "firmwareUpdate")
+	if !reflect.DeepEqual(st, map[string]interface{}{"state": "done", "firmwareVersion": "1.10.0", "progress": 100.0}) {
+		t.Errorf("unexpected state: %v", st)
+	}
+	if updates, _ := agent.CheckUpdates(); len(updates) != 0 {
+		t.Errorf("no updates should remain: %+v", updates)
+	}
+	path := filepath.Join(dir, img.ObjectID+".bin")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("applied image should be deleted: %v", err)
+	}
+
+	// canceled download doesn't request.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	requested := len(c.requestsTo("GET", body))
+	if _, err := agent.Download(canceled, img, nil); err != context.Canceled {
+		t.Errorf("download should be canceled: %v", err)
+	}
+	if n := len(c.requestsTo("GET", body)) - requested; n != 0 {
+		t.Errorf("canceled download should not request: %d", n)
+	}
+
+	// broken downloaded image is downloaded again.
+	if err := ioutil.WriteFile(path, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.Download(ctx, img, nil); err != nil {
+		t.Fatalf("failed to download again: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, image) {
+		t.Errorf("broken image should be replaced: %q", b)
+	}
+
+	// image without body isn't published.
+	c.handle("PUT", "api:"+bucket.Path()+"/objects/([^/]+)/body", c.auth(func(req *fakeRequest, m []string) (int, interface{}) {
+		return 503, map[string]interface{}{"errorCode": "UNAVAILABLE"}
+	}))
+	if _, err := a.PublishFirmware(bucket, "lamp", "2.0.0", image); err == nil {
+		t.Errorf("publish should fail")
+	}
+	if images, err := a.ListFirmware(bucket, "lamp"); err != nil || len(images) != 2 {
+		t.Errorf("failed image should be deleted: %v %v", images, err)
+	}
+
+	// corrupted image is rejected.
+	img.Checksum = "00"
+	os.Remove(filepath.Join(dir, img.ObjectID+".bin"))
+	if err := agent.Apply(ctx, FirmwareUpdate{VendorThingID: "en-1", Image: img}); err == nil {
+		t.Errorf("checksum mismatch should fail")
+	}
+	if st := c.state(en.ThingID, "firmwareUpdate").(map[string]interface{}); st["state"] != "failed" {
+		t.Errorf("failure should be reported: %v", st)
+	}
+}
@@ -0,0 +1,495 @@
+package kii
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProtocolAdapter reads and writes data points of devices by a local
+// protocol, like Modbus registers or BLE GATT characteristics.
+type ProtocolAdapter interface {
+	// ReadPoints reads points of a device of address.  Values of the
+	// returned map are numbers, booleans or strings.
+	ReadPoints(ctx context.Context, address string, points []string) (map[string]interface{}, error)
+	// WritePoint writes value to a point of a device of address.
+	WritePoint(ctx context.Context, address, point string, value interface{}) error
+}
+
+// StateMapping maps a point of device to a field of trait state.
+//
+// Numeric values are converted by value*Scale+Offset.  Scale defaults to 1.
+type StateMapping struct {
+	Point  string  `json:"point"`
+	Alias  string  `json:"alias"`
+	Field  string  `json:"field"`
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+	// Unit is unit of the field.  It is informational.
+	Unit string `json:"unit,omitempty"`
+}
+
+// ActionMapping maps an action of trait to a point of device.
+//
+// When Field is empty, the action value is written, otherwise the field of
+// the action value, which must be an object, is written.  Numeric values
+// are converted by (value-Offset)/Scale, which is the inverse of
+// StateMapping.
+//
+// Type is Go type of the point, like "int16" or "uint16".  Numeric values
+// are rounded to the nearest integer when Type is an integer type, and
+// written as float64 when Type is empty.
+type ActionMapping struct {
+	Alias  string  `json:"alias"`
+	Action string  `json:"action"`
+	Field  string  `json:"field,omitempty"`
+	Point  string  `json:"point"`
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+	Type   string  `json:"type,omitempty"`
+	Unit   string  `json:"unit,omitempty"`
+}
+
+// DeviceMapping is declarative mappings between points of a thing type and
+// its traits.
+//
+//	{
+//	  "thingType": "thermostat",
+//	  "states": [
+//	    {"point": "40001", "alias": "thermo", "field": "temperature", "scale": 0.1, "unit": "celsius"}
+//	  ],
+//	  "actions": [
+//	    {"alias": "thermo", "action": "setTarget", "point": "40010", "scale": 0.1, "type": "int16"}
+//	  ]
+//	}
+type DeviceMapping struct {
+	ThingType string          `json:"thingType"`
+	States    []StateMapping  `json:"states"`
+	Actions   []ActionMapping `json:"actions"`
+}
+
+// Points returns points of States without duplication.
+func (m *DeviceMapping) Points() []string {
+	seen := map[string]bool{}
+	var points []string
+	for _, s := range m.States {
+		if !seen[s.Point] {
+			seen[s.Point] = true
+			points = append(points, s.Point)
+		}
+	}
+	return points
+}
+
+// ToState converts readings of points to trait states, which can be passed
+// to UpdateMultipleTraitState.  Points which are not in readings are
+// skipped.
+func (m *DeviceMapping) ToState(readings map[string]interface{}) (map[string]map[string]interface{}, error) {
+	states := map[string]map[string]interface{}{}
+	for _, s := range m.States {
+		v, ok := readings[s.Point]
+		if !ok {
+			continue
+		}
+		v, err := scaleValue(v, s.Scale, s.Offset, false)
+		if err != nil {
+			return nil, fmt.Errorf("point %s: %s", s.Point, err)
+		}
+		if states[s.Alias] == nil {
+			states[s.Alias] = map[string]interface{}{}
+		}
+		states[s.Alias][s.Field] = v
+	}
+	return states, nil
+}
+
+// action returns mapping of an action.
+func (m *DeviceMapping) action(alias, action string) (*ActionMapping, bool) {
+	for i := range m.Actions {
+		if a := &m.Actions[i]; a.Alias == alias && a.Action == action {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// scaleValue converts a numeric value by v*scale+offset, or the inverse.
+// Non numeric values are returned as is unless conversion is required.
+func scaleValue(v interface{}, scale, offset float64, inverse bool) (interface{}, error) {
+	if scale == 0 {
+		scale = 1
+	}
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case float32:
+		f = float64(n)
+	case int:
+		f = float64(n)
+	case int8:
+		f = float64(n)
+	case int16:
+		f = float64(n)
+	case int32:
+		f = float64(n)
+	case int64:
+		f = float64(n)
+	case uint:
+		f = float64(n)
+	case uint8:
+		f = float64(n)
+	case uint16:
+		f = float64(n)
+	case uint32:
+		f = float64(n)
+	case uint64:
+		f = float64(n)
+	case json.Number:
+		var err error
+		if f, err = n.Float64(); err != nil {
+			return nil, err
+		}
+	default:
+		if scale != 1 || offset != 0 {
+			return nil, fmt.Errorf("%v can't be scaled", v)
+		}
+		return v, nil
+	}
+	if scale == 1 && offset == 0 {
+		return f, nil
+	}
+	if inverse {
+		return (f - offset) / scale, nil
+	}
+	return f*scale + offset, nil
+}
+
+// pointTypes are integer types of points, with their ranges and conversions.
+var pointTypes = map[string]struct {
+	min, max float64 // max is exclusive.
+	convert  func(r float64) interface{}
+}{
+	"int":    {-(1 << 63), 1 << 63, func(r float64) interface{} { return int(r) }},
+	"int8":   {math.MinInt8, math.MaxInt8 + 1, func(r float64) interface{} { return int8(r) }},
+	"int16":  {math.MinInt16, math.MaxInt16 + 1, func(r float64) interface{} { return int16(r) }},
+	"int32":  {math.MinInt32, math.MaxInt32 + 1, func(r float64) interface{} { return int32(r) }},
+	"int64":  {-(1 << 63), 1 << 63, func(r float64) interface{} { return int64(r) }},
+	"uint":   {0, 1 << 64, func(r float64) interface{} { return uint(r) }},
+	"uint8":  {0, math.MaxUint8 + 1, func(r float64) interface{} { return uint8(r) }},
+	"uint16": {0, math.MaxUint16 + 1, func(r float64) interface{} { return uint16(r) }},
+	"uint32": {0, math.MaxUint32 + 1, func(r float64) interface{} { return uint32(r) }},
+	"uint64": {0, 1 << 64, func(r float64) interface{} { return uint64(r) }},
+}
+
+// toPointType converts a scaled value to typ.  Values of integer types are
+// rounded, so that 19.7/0.1 is 197, not 196.
+func toPointType(v interface{}, typ string) (interface{}, error) {
+	f, ok := v.(float64)
+	if !ok || typ == "" || typ == "float64" {
+		return v, nil
+	}
+	if typ == "float32" {
+		return float32(f), nil
+	}
+	t, ok := pointTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+	r := math.Round(f)
+	if math.IsNaN(r) || r < t.min || r >= t.max {
+		return nil, fmt.Errorf("%v is out of range of %s", f, typ)
+	}
+	return t.convert(r), nil
+}
+
+// ProtocolBridge is an EndNodeAdapter which bridges devices and traits by
+// ProtocolAdapter and DeviceMapping registered for each thing type.  It
+// polls states of end nodes in Registry, and translates command actions to
+// writes to devices.
+//
+//	bridge := &kii.ProtocolBridge{Registry: registry, PollInterval: 10 * time.Second}
+//	bridge.Register(modbus, &thermostatMapping)
+//	gw.Adapters = append(gw.Adapters, bridge)
+type ProtocolBridge struct {
+	// AdapterName is name of the adapter, which must be equal to Adapter
+	// of end nodes.  Default is "protocol".
+	AdapterName string
+
+	// Registry is used to look up address and thing type of end nodes.
+	Registry *EndNodeRegistry
+
+	// PollInterval is interval to read states of end nodes.  When zero,
+	// states are not polled and should be passed to Report.
+	PollInterval time.Duration
+
+	// Reporter is used to upload states when it is not nil.  Otherwise
+	// states are uploaded by Gateway.UpdateEndNodeMultipleTraitState.
+	Reporter *StateReporter
+
+	mu      sync.RWMutex
+	entries map[string]protocolEntry
+	gw      *Gateway
+}
+
+var _ EndNodeAdapter = (*ProtocolBridge)(nil)
+
+type protocolEntry struct {
+	adapter ProtocolAdapter
+	mapping *DeviceMapping
+}
+
+// Register registers adapter and mapping for mapping.ThingType.
+func (b *ProtocolBridge) Register(adapter ProtocolAdapter, mapping *DeviceMapping) error {
+	if mapping.ThingType == "" {
+		return errors.New("thingType of mapping is required")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.entries == nil {
+		b.entries = map[string]protocolEntry{}
+	}
+	if _, ok := b.entries[mapping.ThingType]; ok {
+		return fmt.Errorf("thingType %s is already registered", mapping.ThingType)
+	}
+	for _, a := range mapping.Actions {
+		if _, ok := pointTypes[a.Type]; !ok && a.Type != "" && a.Type != "float64" && a.Type != "float32" {
+			return fmt.Errorf("unknown type %s of action %s", a.Type, a.Action)
+		}
+	}
+	b.entries[mapping.ThingType] = protocolEntry{adapter: adapter, mapping: mapping}
+	return nil
+}
+
+// Name returns AdapterName.
+func (b *ProtocolBridge) Name() string {
+	if b.AdapterName != "" {
+		return b.AdapterName
+	}
+	return "protocol"
+}
+
+// Run polls states of end nodes on every PollInterval until ctx is done.
+func (b *ProtocolBridge) Run(ctx context.Context, gw *Gateway) error {
+	b.mu.Lock()
+	b.gw = gw
+	b.mu.Unlock()
+	if b.PollInterval <= 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	t := time.NewTicker(b.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			b.Poll(ctx)
+		}
+	}
+}
+
+// Poll reads and uploads states of all end nodes of registered thing
+// types.  Failures are logged, and other end nodes are processed.
+func (b *ProtocolBridge) Poll(ctx context.Context) {
+	for _, rec := range b.Registry.List() {
+		entry, ok := b.entry(rec.ThingType)
+		if !ok || (rec.Adapter != "" && rec.Adapter != b.Name()) {
+			continue
+		}
+		readings, err := entry.adapter.ReadPoints(ctx, rec.Address, entry.mapping.Points())
+		if err == nil {
+			err = b.Report(rec.VendorThingID, readings)
+		}
+		if err != nil {
+			gatewayLog.Warn("failed to poll", "vendorThingID", rec.VendorThingID, "error", err)
+		}
+	}
+}
+
+// Report converts readings of an end node to trait states and uploads
+// them.
+func (b *ProtocolBridge) Report(vendorThingID string, readings map[string]interface{}) error {
+	rec, ok := b.Registry.ByVendorThingID(vendorThingID)
+	if !ok {
+		return fmt.Errorf("end node %s is not registered", vendorThingID)
+	}
+	entry, ok := b.entry(rec.ThingType)
+	if !ok {
+		return fmt.Errorf("thingType %s is not registered", rec.ThingType)
+	}
+	b.mu.RLock()
+	gw := b.gw
+	b.mu.RUnlock()
+	if b.Reporter == nil && gw == nil {
+		return errors.New("bridge is not running")
+	}
+	states, err := entry.mapping.ToState(readings)
+	if err != nil || len(states) == 0 {
+		return err
+	}
+	if b.Reporter != nil {
+		for _, alias := range sortedStateAliases(states) {
+			if err := b.Reporter.Report(rec.ThingID, alias, states[alias]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return gw.UpdateEndNodeMultipleTraitState(vendorThingID, states)
+}
+
+func sortedStateAliases(states map[string]map[string]interface{}) []string {
+	aliases := make([]string, 0, len(states))
+	for a := range states {
+		aliases = append(aliases, a)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+func (b *ProtocolBridge) entry(thingType string) (protocolEntry, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.entries[thingType]
+	return e, ok
+}
+
+// HandleCommand writes actions of cmd to the device, and returns action
+// results.  Each action succeeds when its write succeeds.
+func (b *ProtocolBridge) HandleCommand(ctx context.Context, en *EndNodeIdentity, cmd *GetCommandResponse) ([]map[string]interface{}, error) {
+	rec, ok := b.Registry.ByVendorThingID(en.VendorThingID)
+	if !ok {
+		return nil, fmt.Errorf("end node %s is not registered", en.VendorThingID)
+	}
+	entry, ok := b.entry(rec.ThingType)
+	if !ok {
+		return nil, fmt.Errorf("thingType %s is not registered", rec.ThingType)
+	}
+	results := make([]map[string]interface{}, 0, len(cmd.Actions))
+	for _, aliasActions := range cmd.Actions {
+		for alias, list := range aliasActions {
+			actions, _ := list.([]interface{})
+			var aliasResults []interface{}
+			for _, a := range actions {
+				action, _ := a.(map[string]interface{})
+				for name, value := range action {
+					err := b.writeAction(ctx, entry, rec.Address, alias, name, value)
+					result := map[string]interface{}{"succeeded": err == nil}
+					if err != nil {
+						result["errorMessage"] = err.Error()
+					}
+					aliasResults = append(aliasResults, map[string]interface{}{name: result})
+				}
+			}
+			results = append(results, map[string]interface{}{alias: aliasResults})
+		}
+	}
+	return results, nil
+}
+
+func (b *ProtocolBridge) writeAction(ctx context.Context, entry protocolEntry, address, alias, action string, value interface{}) error {
+	m, ok := entry.mapping.action(alias, action)
+	if !ok {
+		return fmt.Errorf("action %s of %s is not supported", action, alias)
+	}
+	if m.Field != "" {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("value of %s must be an object", action)
+		}
+		if value, ok = obj[m.Field]; !ok {
+			return fmt.Errorf("%s is required", m.Field)
+		}
+	}
+	v, err := scaleValue(value, m.Scale, m.Offset, true)
+	if err != nil {
+		return err
+	}
+	if v, err = toPointType(v, m.Type); err != nil {
+		return err
+	}
+	return entry.adapter.WritePoint(ctx, address, m.Point, v)
+}
+
+// MockProtocolAdapter is a ProtocolAdapter which holds points in memory.  It
+// is useful for tests.
+type MockProtocolAdapter struct {
+	mu       sync.Mutex
+	points   map[string]map[string]interface{}
+	failures map[string]error
+}
+
+var _ ProtocolAdapter = (*MockProtocolAdapter)(nil)
+
+// NewMockProtocolAdapter creates an empty MockProtocolAdapter.
+func NewMockProtocolAdapter() *MockProtocolAdapter {
+	return &MockProtocolAdapter{
+		points:   map[string]map[string]interface{}{},
+		failures: map[string]error{},
+	}
+}
+
+// Set sets value of a point of a device.
+func (m *MockProtocolAdapter) Set(address, point string, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.points[address] == nil {
+		m.points[address] = map[string]interface{}{}
+	}
+	m.points[address][point] = value
+}
+
+// Get returns value of a point of a device.
+func (m *MockProtocolAdapter) Get(address, point string) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.points[address][point]
+	return v, ok
+}
+
+// Fail lets reads and writes of a device fail with err.  When err is nil,
+// the device works again.
+func (m *MockProtocolAdapter) Fail(address string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		delete(m.failures, address)
+	} else {
+		m.failures[address] = err
+	}
+}
+
+// ReadPoints returns values of points which are set.
+func (m *MockProtocolAdapter) ReadPoints(ctx context.Context, address string, points []string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failures[address]; err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	for _, p := range points {
+		if v, ok := m.points[address][p]; ok {
+			values[p] = v
+		}
+	}
+	return values, nil
+}
+
+// WritePoint sets value of a point.
+func (m *MockProtocolAdapter) WritePoint(ctx context.Context, address, point string, value interface{}) error {
+	m.mu.Lock()
+	err := m.failures[address]
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	m.Set(address, point, value)
+	return nil
+}
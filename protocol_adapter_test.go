@@ -0,0 +1,158 @@
+package kii
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testThermostatMapping = `{
+  "thingType": "thermostat",
+  "states": [
+    {"point": "40001", "alias": "thermo", "field": "temperature", "scale": 0.1, "unit": "celsius"},
+    {"point": "40002", "alias": "thermo", "field": "humidity"},
+    {"point": "power", "alias": "switch", "field": "power"}
+  ],
+  "actions": [
+    {"alias": "thermo", "action": "setTarget", "field": "temperature", "point": "40010", "scale": 0.1, "type": "int16"},
+    {"alias": "switch", "action": "turnPower", "point": "power"}
+  ]
+}`
+
+func TestDeviceMappingToState(t *testing.T) {
+	var m DeviceMapping
+	if err := json.Unmarshal([]byte(testThermostatMapping), &m); err != nil {
+		t.Fatal(err)
+	}
+	states, err := m.ToState(map[string]interface{}{"40001": 215, "40002": uint16(40), "power": true})
+	if err != nil {
+		t.Fatalf("failed to convert: %s", err)
+	}
+	expected := map[string]map[string]interface{}{
+		"thermo": {"temperature": 21.5, "humidity": 40.0},
+		"switch": {"power": true},
+	}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("unexpected states: %v", states)
+	}
+	if _, err := m.ToState(map[string]interface{}{"40001": "hot"}); err == nil {
+		t.Errorf("string should not be scaled")
+	}
+	if p := m.Points(); !reflect.DeepEqual(p, []string{"40001", "40002", "power"}) {
+		t.Errorf("unexpected points: %v", p)
+	}
+}
+
+func TestScaleValueToPointType(t *testing.T) {
+	for _, c := range []struct {
+		value    interface{}
+		typ      string
+		expected interface{}
+	}{
+		{19.7, "int16", int16(197)},
+		{0.3, "uint16", uint16(3)},
+		{int8(-5), "int8", int8(-50)},
+		{uint8(25), "uint8", uint8(250)},
+		{uint(7), "uint", uint(70)},
+		{uint64(9), "uint64", uint64(90)},
+		{19.7, "", 196.99999999999997},
+	} {
+		v, err := scaleValue(c.value, 0.1, 0, true)
+		if err == nil {
+			v, err = toPointType(v, c.typ)
+		}
+		if err != nil || v != c.expected {
+			t.Errorf("%v/0.1 as %q should be %v (%T): %v (%T), %v", c.value, c.typ, c.expected, c.expected, v, v, err)
+		}
+	}
+	if v, err := scaleValue(uint8(200), 2, 1, false); err != nil || v != 401.0 {
+		t.Errorf("uint8 should be scaled: %v, %v", v, err)
+	}
+	if _, err := toPointType(25.6, "uint8"); err != nil {
+		t.Errorf("25.6 should fit in uint8: %v", err)
+	}
+	if _, err := toPointType(255.6, "uint8"); err == nil {
+		t.Errorf("256 should be out of range of uint8")
+	}
+	if _, err := toPointType(-0.6, "uint16"); err == nil {
+		t.Errorf("-1 should be out of range of uint16")
+	}
+	if _, err := toPointType(1.0, "int12"); err == nil {
+		t.Errorf("unknown type should be rejected")
+	}
+}
+
+func TestProtocolBridge(t *testing.T) {
+	c := newFakeThingCloud(t)
+	defer c.Close()
+	registry, _ := OpenEndNodeRegistry(NewMemoryStore())
+	mock := NewMockProtocolAdapter()
+	var mapping DeviceMapping
+	json.Unmarshal([]byte(testThermostatMapping), &mapping)
+	bridge := &ProtocolBridge{Registry: registry}
+	if err := bridge.Register(mock, &mapping); err != nil {
+		t.Fatal(err)
+	}
+	if err := bridge.Register(mock, &mapping); err == nil {
+		t.Errorf("thingType should not be registered twice")
+	}
+
+	gw := &Gateway{App: c.App, VendorThingID: "gw-1", Password: "pass", Adapters: []EndNodeAdapter{bridge}}
+	ctx := context.Background()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer gw.Stop(ctx)
+	en, err := gw.OnboardEndNode(EndNodeInfo{VendorThingID: "th-1", Password: "pass", ThingType: "thermostat", Adapter: "protocol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Put(EndNodeRecord{Address: "unit-1", VendorThingID: "th-1", ThingID: en.ThingID, ThingType: "thermostat"})
+	registry.Put(EndNodeRecord{Address: "unit-2", VendorThingID: "th-2", ThingType: "thermostat"})
+
+	mock.Set("unit-1", "40001", 200)
+	mock.Set("unit-1", "power", false)
+	mock.Fail("unit-2", errors.New("timeout"))
+	for i := 0; i < 100 && bridge.Report("th-1", nil) != nil; i++ {
+		// wait until the bridge runs.
+		time.Sleep(10 * time.Millisecond)
+	}
+	bridge.Poll(ctx)
+	if s := c.state(en.ThingID, "thermo"); !reflect.DeepEqual(s, map[string]interface{}{"temperature": 20.0}) {
+		t.Errorf("unexpected state: %v", s)
+	}
+	if s := c.state(en.ThingID, "switch"); !reflect.DeepEqual(s, map[string]interface{}{"power": false}) {
+		t.Errorf("unexpected state: %v", s)
+	}
+
+	c.addCommand(en.ThingID, "cmd-1", []map[string]interface{}{
+		{"thermo": []interface{}{
+			map[string]interface{}{"setTarget": map[string]interface{}{"temperature": 23.5}},
+			map[string]interface{}{"setMode": "cool"},
+		}},
+		{"switch": []interface{}{map[string]interface{}{"turnPower": true}}},
+	})
+	if err := gw.HandleCommand(ctx, en.ThingID, "cmd-1"); err != nil {
+		t.Fatalf("failed to handle command: %s", err)
+	}
+	if v, _ := mock.Get("unit-1", "40010"); v != int16(235) {
+		t.Errorf("target should be written: %v", v)
+	}
+	if v, _ := mock.Get("unit-1", "power"); v != true {
+		t.Errorf("power should be written: %v", v)
+	}
+	results := c.command("cmd-1").ActionResults
+	expected := []map[string]interface{}{
+		{"thermo": []interface{}{
+			map[string]interface{}{"setTarget": map[string]interface{}{"succeeded": true}},
+			map[string]interface{}{"setMode": map[string]interface{}{"succeeded": false, "errorMessage": "action setMode of thermo is not supported"}},
+		}},
+		{"switch": []interface{}{map[string]interface{}{"turnPower": map[string]interface{}{"succeeded": true}}}},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("unexpected action results: %v", results)
+	}
+}
@@ -0,0 +1,465 @@
+package kii
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProvisionRecord represents a row of provisioning manifest.
+//
+// When Gateway is empty, the thing is registered by RegisterThing and
+// onboarded by OnboardThingByOwner if Owner is given.  Otherwise the thing
+// is onboarded as an end node of the gateway, which is specified by
+// vendorThingID, by OnboardEndnodeWithGatewayVendorThingID.
+type ProvisionRecord struct {
+	VendorThingID   string                 `json:"vendorThingID"`
+	Password        string                 `json:"password"`
+	ThingType       string                 `json:"thingType,omitempty"`
+	FirmwareVersion string                 `json:"firmwareVersion,omitempty"`
+	Properties      map[string]interface{} `json:"properties,omitempty"`
+	Owner           string                 `json:"owner,omitempty"`
+	Gateway         string                 `json:"gateway,omitempty"`
+}
+
+// ProvisionResult represents result of provisioning a row.
+type ProvisionResult struct {
+	// Row is 0-origin index of the record in manifest.
+	Row           int    `json:"row"`
+	VendorThingID string `json:"vendorThingID"`
+	ThingID       string `json:"thingID,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Succeeded returns true when the row is provisioned.
+func (r *ProvisionResult) Succeeded() bool {
+	return r.Error == ""
+}
+
+// ReadProvisionManifest reads manifest from a file.  Files which have ".csv"
+// extension are read as CSV with header row, and others are read as JSON
+// Lines of ProvisionRecord.  CSV columns are vendorThingID, password,
+// thingType, firmwareVersion, properties, owner and gateway, and properties
+// is a JSON object.
+func ReadProvisionManifest(path string) ([]ProvisionRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return readProvisionCSV(f)
+	}
+	return readProvisionJSONL(f)
+}
+
+func readProvisionCSV(r io.Reader) ([]ProvisionRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %s", err)
+	}
+	index := map[string]int{}
+	for i, h := range header {
+		index[strings.TrimSpace(h)] = i
+	}
+	for _, c := range []string{"vendorThingID", "password"} {
+		if _, ok := index[c]; !ok {
+			return nil, fmt.Errorf("column %s is required", c)
+		}
+	}
+	var records []ProvisionRecord
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(c string) string {
+			if i, ok := index[c]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec := ProvisionRecord{
+			VendorThingID:   get("vendorThingID"),
+			Password:        get("password"),
+			ThingType:       get("thingType"),
+			FirmwareVersion: get("firmwareVersion"),
+			Owner:           get("owner"),
+			Gateway:         get("gateway"),
+		}
+		if p := get("properties"); p != "" {
+			if err := json.Unmarshal([]byte(p), &rec.Properties); err != nil {
+				return nil, fmt.Errorf("line %d: invalid properties: %s", line, err)
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func readProvisionJSONL(r io.Reader) ([]ProvisionRecord, error) {
+	var records []ProvisionRecord
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		b := strings.TrimSpace(s.Text())
+		if b == "" {
+			continue
+		}
+		var rec ProvisionRecord
+		if err := json.Unmarshal([]byte(b), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Provisioner registers and onboards things in manifest.
+//
+//	p := &Provisioner{
+//		Author:            &ownerAuthor,
+//		Concurrency:       8,
+//		RequestsPerSecond: 20,
+//		CheckpointPath:    "provision.checkpoint",
+//	}
+//	results, err := p.Run(ctx, records)
+type Provisioner struct {
+	// Author is used to call APIs.  It should be the owner of things, when
+	// Owner of records is given.
+	Author *APIAuthor
+
+	// Concurrency is number of rows processed at the same time.  Default
+	// is 1.
+	Concurrency int
+
+	// RequestsPerSecond limits rate to start processing rows.  When zero,
+	// the rate is not limited.
+	RequestsPerSecond float64
+
+	// CheckpointPath is path of file to record results.  When the file
+	// exists, rows which have succeeded are skipped, so that interrupted
+	// provisioning can be resumed.  ThingID is recorded as soon as the thing
+	// is registered, so a resumed row doesn't register the thing again.
+	// When the record is lost, the registered thing is looked up by
+	// vendorThingID.  When empty, no checkpoint is used.
+	CheckpointPath string
+
+	// provision is used to replace API calls in tests.
+	provision func(rec *ProvisionRecord) (string, error)
+}
+
+// Run provisions records.  It returns results of all records ordered by
+// row, including ones which succeeded in previous runs.  Failure of rows is
+// reported in results, and error is returned only when the run itself
+// fails, like ctx is canceled or checkpoint can't be written.
+func (p *Provisioner) Run(ctx context.Context, records []ProvisionRecord) ([]ProvisionResult, error) {
+	results := make([]ProvisionResult, len(records))
+	done := make([]bool, len(records))
+	for i := range records {
+		results[i] = ProvisionResult{
+			Row:           i,
+			VendorThingID: records[i].VendorThingID,
+			Error:         "not processed",
+		}
+	}
+
+	var checkpoint *os.File
+	if p.CheckpointPath != "" {
+		prev, err := readProvisionCheckpoint(p.CheckpointPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range prev {
+			if r.Row < 0 || r.Row >= len(records) || records[r.Row].VendorThingID != r.VendorThingID {
+				return nil, fmt.Errorf("checkpoint %s doesn't match with manifest at row %d", p.CheckpointPath, r.Row)
+			}
+			results[r.Row] = r
+			done[r.Row] = r.Succeeded()
+		}
+		checkpoint, err = os.OpenFile(p.CheckpointPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer checkpoint.Close()
+	}
+
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var tick <-chan time.Time
+	if p.RequestsPerSecond > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / p.RequestsPerSecond))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	var (
+		mu       sync.Mutex
+		writeErr error
+		wg       sync.WaitGroup
+		rows     = make(chan int)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range rows {
+				r := ProvisionResult{Row: row, VendorThingID: records[row].VendorThingID}
+				mu.Lock()
+				prevID := results[row].ThingID
+				mu.Unlock()
+				// journal records the registered thing before the next
+				// step.
+				journal := func(thingID string) error {
+					mu.Lock()
+					defer mu.Unlock()
+					if checkpoint == nil {
+						return nil
+					}
+					j := r
+					j.ThingID = thingID
+					j.Error = provisionIncomplete
+					return writeProvisionCheckpoint(checkpoint, &j)
+				}
+				thingID, err := p.provisionOne(&records[row], prevID, journal)
+				r.ThingID = thingID
+				if err != nil {
+					r.Error = err.Error()
+				}
+				mu.Lock()
+				results[row] = r
+				if checkpoint != nil && writeErr == nil {
+					writeErr = writeProvisionCheckpoint(checkpoint, &r)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var runErr error
+feed:
+	for row := range records {
+		if done[row] {
+			continue
+		}
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				runErr = ctx.Err()
+				break feed
+			}
+		}
+		select {
+		case rows <- row:
+		case <-ctx.Done():
+			runErr = ctx.Err()
+			break feed
+		}
+		mu.Lock()
+		err := writeErr
+		mu.Unlock()
+		if err != nil {
+			runErr = err
+			break
+		}
+	}
+	close(rows)
+	wg.Wait()
+	if runErr == nil {
+		runErr = writeErr
+	}
+	return results, runErr
+}
+
+// provisionIncomplete is error of a row whose thing is registered but not
+// provisioned yet.
+const provisionIncomplete = "incomplete"
+
+// provisionOne provisions a record and returns thingID.  When thingID is
+// given, the thing has been registered in a previous run, and registration
+// is skipped.  journal is called with thingID when the thing is registered.
+func (p *Provisioner) provisionOne(rec *ProvisionRecord, thingID string, journal func(thingID string) error) (string, error) {
+	if rec.VendorThingID == "" || rec.Password == "" {
+		return "", errors.New("vendorThingID and password are required")
+	}
+	if p.provision != nil {
+		return p.provision(rec)
+	}
+	if p.Author == nil {
+		return "", errors.New("Author must not be nil")
+	}
+	if rec.Gateway != "" {
+		return p.onboardEndnode(rec, thingID, journal)
+	}
+	if thingID == "" {
+		id, err := p.registerThing(rec)
+		if isConflictError(err) {
+			// registered by a run which crashed before journal.
+			var thing *Thing
+			if thing, err = p.Author.GetTypedThing("VENDOR_THING_ID:" + rec.VendorThingID); err == nil {
+				id = thing.ThingID
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := journal(id); err != nil {
+			return id, err
+		}
+		thingID = id
+	}
+	if rec.Owner != "" {
+		_, err := p.Author.OnboardThingByOwner(OnboardByOwnerRequest{
+			ThingID:       thingID,
+			ThingPassword: rec.Password,
+			Owner:         rec.Owner,
+		})
+		if err != nil {
+			return thingID, err
+		}
+	}
+	return thingID, nil
+}
+
+func (p *Provisioner) registerThing(rec *ProvisionRecord) (string, error) {
+	req := map[string]interface{}{}
+	for k, v := range rec.Properties {
+		req[k] = v
+	}
+	req["_vendorThingID"] = rec.VendorThingID
+	req["_password"] = rec.Password
+	if rec.ThingType != "" {
+		req["_thingType"] = rec.ThingType
+	}
+	if rec.FirmwareVersion != "" {
+		req["_firmwareVersion"] = rec.FirmwareVersion
+	}
+	resp, err := p.Author.RegisterThing(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.ThingID, nil
+}
+
+func (p *Provisioner) onboardEndnode(rec *ProvisionRecord, thingID string, journal func(thingID string) error) (string, error) {
+	if thingID == "" {
+		id, err := p.onboardEndnodeWithGateway(rec)
+		if err != nil {
+			return "", err
+		}
+		if err := journal(id); err != nil {
+			return id, err
+		}
+		thingID = id
+	}
+	if len(rec.Properties) > 0 {
+		if err := p.Author.UpdateThing(thingID, rec.Properties); err != nil {
+			return thingID, err
+		}
+	}
+	return thingID, nil
+}
+
+func (p *Provisioner) onboardEndnodeWithGateway(rec *ProvisionRecord) (string, error) {
+	resp, err := p.Author.OnboardEndnodeWithGatewayVendorThingID(OnboardEndnodeWithGatewayVendorThingIDRequest{
+		GatewayVendorThingID: rec.Gateway,
+		OnboardEndnodeRequestCommon: OnboardEndnodeRequestCommon{
+			EndNodeVendorThingID:   rec.VendorThingID,
+			EndNodePassword:        rec.Password,
+			Owner:                  rec.Owner,
+			EndNodeThingType:       rec.ThingType,
+			EndNodeFirmwareVersion: rec.FirmwareVersion,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.EndNodeThingID, nil
+}
+
+func isConflictError(err error) bool {
+	ce, ok := err.(*CloudError)
+	return ok && ce.HTTPStatus == 409
+}
+
+// readProvisionCheckpoint reads results from checkpoint file.  Later results
+// of a row override earlier ones.
+func readProvisionCheckpoint(path string) ([]ProvisionResult, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	latest := map[int]ProvisionResult{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r ProvisionResult
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			// the last line may be broken by crash.
+			gatewayLog.Warn("skip broken checkpoint line", "path", path, "error", err)
+			continue
+		}
+		latest[r.Row] = r
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]ProvisionResult, 0, len(latest))
+	for _, r := range latest {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Row < results[j].Row })
+	return results, nil
+}
+
+func writeProvisionCheckpoint(f *os.File, r *ProvisionResult) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// WriteProvisionReport writes results as CSV with columns row,
+// vendorThingID, thingID and error.
+func WriteProvisionReport(w io.Writer, results []ProvisionResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"row", "vendorThingID", "thingID", "error"}); err != nil {
+		return err
+	}
+	for _, r := range results {
+		err := cw.Write([]string{strconv.Itoa(r.Row), r.VendorThingID, r.ThingID, r.Error})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
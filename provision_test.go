@@ -0,0 +1,323 @@
+package kii
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kii_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReadProvisionManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	csvPath := filepath.Join(dir, "manifest.csv")
+	ioutil.WriteFile(csvPath, []byte(`vendorThingID,password,thingType,properties,owner,gateway
+vid1,pass1,sensor,"{""color"":""red""}",user:u1,
+vid2,pass2,sensor,,,gw1
+`), 0644)
+	jsonlPath := filepath.Join(dir, "manifest.jsonl")
+	ioutil.WriteFile(jsonlPath, []byte(`{"vendorThingID":"vid1","password":"pass1","thingType":"sensor","properties":{"color":"red"},"owner":"user:u1"}
+
+{"vendorThingID":"vid2","password":"pass2","thingType":"sensor","gateway":"gw1"}
+`), 0644)
+
+	for _, path := range []string{csvPath, jsonlPath} {
+		records, err := ReadProvisionManifest(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("%s should have 2 records: %+v", path, records)
+		}
+		if r := records[0]; r.VendorThingID != "vid1" || r.Password != "pass1" || r.ThingType != "sensor" ||
+			r.Properties["color"] != "red" || r.Owner != "user:u1" || r.Gateway != "" {
+			t.Errorf("%s: unexpected record: %+v", path, r)
+		}
+		if r := records[1]; r.VendorThingID != "vid2" || r.Gateway != "gw1" || r.Properties != nil {
+			t.Errorf("%s: unexpected record: %+v", path, r)
+		}
+	}
+}
+
+func TestProvisionerRunAndResume(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var records []ProvisionRecord
+	for i := 0; i < 20; i++ {
+		records = append(records, ProvisionRecord{
+			VendorThingID: fmt.Sprintf("vid%d", i),
+			Password:      "pass",
+		})
+	}
+	records[3].Password = ""
+
+	var (
+		mu    sync.Mutex
+		calls = map[string]int{}
+		fail  = true
+	)
+	p := &Provisioner{
+		Concurrency:    4,
+		CheckpointPath: filepath.Join(dir, "checkpoint"),
+		provision: func(rec *ProvisionRecord) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[rec.VendorThingID]++
+			if rec.VendorThingID == "vid7" && fail {
+				return "", errors.New("temporary error")
+			}
+			return "th." + rec.VendorThingID, nil
+		},
+	}
+	results, err := p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	for i, r := range results {
+		failed := i == 3 || i == 7
+		if r.Row != i || r.Succeeded() == failed {
+			t.Errorf("unexpected result: %+v", r)
+		}
+	}
+
+	// resume: only failed rows are processed again.
+	fail = false
+	results, err = p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("resume failed: %s", err)
+	}
+	if !results[7].Succeeded() || results[7].ThingID != "th.vid7" {
+		t.Errorf("failed row should be retried: %+v", results[7])
+	}
+	if results[3].Succeeded() {
+		t.Errorf("invalid row should fail again: %+v", results[3])
+	}
+	if calls["vid0"] != 1 || calls["vid7"] != 2 {
+		t.Errorf("succeeded rows should be skipped: %v", calls)
+	}
+
+	var report bytes.Buffer
+	if err := WriteProvisionReport(&report, results); err != nil {
+		t.Fatalf("failed to write report: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 21 || lines[1] != "0,vid0,th.vid0," {
+		t.Errorf("unexpected report: %s", report.String())
+	}
+}
+
+func TestProvisionerRateLimitAndCancel(t *testing.T) {
+	records := make([]ProvisionRecord, 100)
+	for i := range records {
+		records[i] = ProvisionRecord{VendorThingID: fmt.Sprintf("vid%d", i), Password: "pass"}
+	}
+	p := &Provisioner{
+		Concurrency:       10,
+		RequestsPerSecond: 50,
+		provision: func(rec *ProvisionRecord) (string, error) {
+			return "th." + rec.VendorThingID, nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results, err := p.Run(ctx, records)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("run should be canceled: %v", err)
+	}
+	n := 0
+	for _, r := range results {
+		if r.Succeeded() {
+			n++
+		}
+	}
+	if n == 0 || n > 15 {
+		t.Errorf("rate should be limited: %d rows processed", n)
+	}
+}
+
+func TestProvisionerResumeRegisteredThing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newFakeThingCloud(t)
+	defer c.Close()
+
+	var (
+		mu         sync.Mutex
+		registered = map[string]string{}
+		owners     = map[string]string{}
+		failOwner  = true
+	)
+	c.handle("POST", "api:/things", func(req *fakeRequest, m []string) (int, interface{}) {
+		var r map[string]interface{}
+		req.decode(&r)
+		vid := r["_vendorThingID"].(string)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := registered[vid]; ok {
+			return 409, map[string]interface{}{"errorCode": "THING_ALREADY_EXISTS"}
+		}
+		registered[vid] = "th." + vid
+		return 201, RegisterThingResponse{ThingID: registered[vid], VendorThingID: vid}
+	})
+	c.handle("POST", "thing-if:/onboardings", func(req *fakeRequest, m []string) (int, interface{}) {
+		var r OnboardByOwnerRequest
+		req.decode(&r)
+		mu.Lock()
+		defer mu.Unlock()
+		if failOwner {
+			return 503, nil
+		}
+		owners[r.ThingID] = r.Owner
+		return 200, OnboardGatewayResponse{ThingID: r.ThingID, AccessToken: "token"}
+	})
+
+	records := []ProvisionRecord{{VendorThingID: "vid1", Password: "pass", Owner: "user:u1"}}
+	p := &Provisioner{
+		Author:         &APIAuthor{Token: "owner-token", App: c.App},
+		CheckpointPath: filepath.Join(dir, "checkpoint"),
+	}
+	results, err := p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	if results[0].Succeeded() || results[0].ThingID != "th.vid1" {
+		t.Fatalf("onboarding should fail after registration: %+v", results[0])
+	}
+
+	// resume: registration is skipped, and onboarding is retried.
+	mu.Lock()
+	failOwner = false
+	mu.Unlock()
+	results, err = p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("resume failed: %s", err)
+	}
+	if !results[0].Succeeded() || results[0].ThingID != "th.vid1" {
+		t.Errorf("resumed row should succeed: %+v", results[0])
+	}
+	if n := len(c.requestsTo("POST", "api:/things")); n != 1 {
+		t.Errorf("thing should be registered once: %d", n)
+	}
+	if owners["th.vid1"] != "user:u1" {
+		t.Errorf("thing should be onboarded by owner: %v", owners)
+	}
+}
+
+func TestProvisionerRegisteredBeforeCrash(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newFakeThingCloud(t)
+	defer c.Close()
+
+	// vid1 was registered by a run which crashed before the checkpoint was
+	// written.
+	var owners sync.Map
+	c.handle("POST", "api:/things", func(req *fakeRequest, m []string) (int, interface{}) {
+		return 409, map[string]interface{}{"errorCode": "THING_ALREADY_EXISTS"}
+	})
+	c.handle("GET", "api:/things/VENDOR_THING_ID:([^/]+)", func(req *fakeRequest, m []string) (int, interface{}) {
+		return 200, map[string]interface{}{"_thingID": "th." + m[1], "_vendorThingID": m[1]}
+	})
+	c.handle("POST", "thing-if:/onboardings", func(req *fakeRequest, m []string) (int, interface{}) {
+		var r OnboardByOwnerRequest
+		req.decode(&r)
+		owners.Store(r.ThingID, r.Owner)
+		return 200, OnboardGatewayResponse{ThingID: r.ThingID, AccessToken: "token"}
+	})
+
+	records := []ProvisionRecord{{VendorThingID: "vid1", Password: "pass", Owner: "user:u1"}}
+	p := &Provisioner{
+		Author:         &APIAuthor{Token: "owner-token", App: c.App},
+		CheckpointPath: filepath.Join(dir, "checkpoint"),
+	}
+	results, err := p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	if !results[0].Succeeded() || results[0].ThingID != "th.vid1" {
+		t.Errorf("registered thing should be looked up and provisioned: %+v", results[0])
+	}
+	if owner, _ := owners.Load("th.vid1"); owner != "user:u1" {
+		t.Errorf("thing should be onboarded by owner: %v", owner)
+	}
+}
+
+func TestProvisionerResumeOnboardedEndNode(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newFakeThingCloud(t)
+	defer c.Close()
+
+	var (
+		mu         sync.Mutex
+		failUpdate = true
+	)
+	c.handle("POST", "thing-if:/onboardings", func(req *fakeRequest, m []string) (int, interface{}) {
+		var r OnboardEndnodeWithGatewayVendorThingIDRequest
+		req.decode(&r)
+		if r.GatewayVendorThingID != "gw-1" {
+			return 404, nil
+		}
+		return 200, OnboardEndnodeResponse{EndNodeThingID: "th." + r.EndNodeVendorThingID, AccessToken: "token"}
+	})
+	c.handle("PATCH", "api:/things/([^/]+)", func(req *fakeRequest, m []string) (int, interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failUpdate {
+			return 503, nil
+		}
+		return 204, nil
+	})
+
+	records := []ProvisionRecord{{VendorThingID: "en1", Password: "pass", Gateway: "gw-1", Properties: map[string]interface{}{"_stringField1": "room"}}}
+	p := &Provisioner{
+		Author:         &APIAuthor{Token: "owner-token", App: c.App},
+		CheckpointPath: filepath.Join(dir, "checkpoint"),
+	}
+	results, err := p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	if results[0].Succeeded() || results[0].ThingID != "th.en1" {
+		t.Fatalf("update should fail after onboarding: %+v", results[0])
+	}
+
+	// resume with a new Provisioner as after a crash.
+	mu.Lock()
+	failUpdate = false
+	mu.Unlock()
+	p = &Provisioner{
+		Author:         &APIAuthor{Token: "owner-token", App: c.App},
+		CheckpointPath: filepath.Join(dir, "checkpoint"),
+	}
+	results, err = p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("resume failed: %s", err)
+	}
+	if !results[0].Succeeded() || results[0].ThingID != "th.en1" {
+		t.Errorf("resumed row should succeed: %+v", results[0])
+	}
+	if n := len(c.requestsTo("POST", "thing-if:/onboardings")); n != 1 {
+		t.Errorf("end node should be onboarded once: %d", n)
+	}
+	if n := len(c.requestsTo("PATCH", "api:/things/th.en1")); n != 2 {
+		t.Errorf("update should be retried: %d", n)
+	}
+}
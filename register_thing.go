@@ -0,0 +1,143 @@
+package kii
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var registerThingRequestType = reflect.TypeOf(RegisterThingRequest{})
+
+// registerThingKeys is set of predefined keys which can be sent by
+// RegisterThing.
+var registerThingKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < registerThingRequestType.NumField(); i++ {
+		name, _ := jsonFieldName(registerThingRequestType.Field(i))
+		keys[name] = true
+	}
+	return keys
+}()
+
+// validateRegisterThingRequest checks that request supplies _vendorThingID
+// and _password, that custom fields don't use reserved "_" prefixed keys,
+// and that _layoutPosition is valid.
+func validateRegisterThingRequest(request interface{}) error {
+	if request == nil {
+		return errors.New("request must not be nil")
+	}
+	v := reflect.ValueOf(request)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return errors.New("request must not be nil")
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if err := checkRegisterThingFields(v.Type(), map[string]string{}, ""); err != nil {
+			return err
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New("keys of request must be string")
+		}
+		for _, k := range v.MapKeys() {
+			if err := checkRegisterThingKey(k.String()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("request must be struct or map: %s", v.Type())
+	}
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for _, k := range []string{"_vendorThingID", "_password"} {
+		if s, ok := m[k].(string); !ok || s == "" {
+			return fmt.Errorf("%s must be supplied as a non-empty string", k)
+		}
+	}
+	if lp, ok := m["_layoutPosition"]; ok {
+		s, _ := lp.(string)
+		if _, err := ParseLayoutPosition(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRegisterThingFields checks JSON keys of struct fields.  seen holds
+// keys and field names which are already found.  inPredefined is name of
+// embedded RegisterThingRequest if t is in it.
+func checkRegisterThingFields(t reflect.Type, seen map[string]string, inPredefined string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := jsonFieldName(f)
+		if !ok {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && !hasJSONName(f) {
+			embedded := inPredefined
+			if ft == registerThingRequestType {
+				embedded = f.Name
+			}
+			if err := checkRegisterThingFields(ft, seen, embedded); err != nil {
+				return err
+			}
+			continue
+		}
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("field %s collides with %s on key %q", f.Name, prev, name)
+		}
+		seen[name] = f.Name
+		if inPredefined != "" {
+			continue
+		}
+		if err := checkRegisterThingKey(name); err != nil {
+			return fmt.Errorf("field %s: %s", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkRegisterThingKey checks that key of custom field is not a reserved
+// key.
+func checkRegisterThingKey(key string) error {
+	if strings.HasPrefix(key, "_") && !registerThingKeys[key] {
+		return fmt.Errorf("key %q is reserved", key)
+	}
+	return nil
+}
+
+// jsonFieldName returns JSON key of a struct field as encoding/json does.
+// It returns false when the field is not encoded.
+func jsonFieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" && !f.Anonymous {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
+
+func hasJSONName(f reflect.StructField) bool {
+	return strings.Split(f.Tag.Get("json"), ",")[0] != ""
+}
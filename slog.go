@@ -0,0 +1,252 @@
+package kii
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of subsystems which have their own loggers and levels.
+const (
+	LogTransport = "transport"
+	LogMQTT      = "mqtt"
+	LogGateway   = "gateway"
+)
+
+var (
+	slogMu     sync.RWMutex
+	slogLogger *slog.Logger
+	slogLevels = map[string]slog.Level{}
+	// slogLevel is the default level.  Debug keeps behavior of Logger,
+	// which has no level.
+	slogLevel = slog.LevelDebug
+)
+
+var (
+	transportLog = SubLogger(LogTransport)
+	mqttLog      = SubLogger(LogMQTT)
+	gatewayLog   = SubLogger(LogGateway)
+)
+
+// SetSlogLogger sets logger which structured logs are written to.  If l is
+// nil, they are written to Logger by the handler of NewKiiLoggerHandler.
+func SetSlogLogger(l *slog.Logger) {
+	slogMu.Lock()
+	defer slogMu.Unlock()
+	slogLogger = l
+}
+
+// SetLogLevel sets the minimum level of structured logs of a subsystem.  If
+// subsystem is empty, it sets the default level of subsystems which have no
+// level.
+func SetLogLevel(subsystem string, level slog.Level) {
+	slogMu.Lock()
+	defer slogMu.Unlock()
+	if subsystem == "" {
+		slogLevel = level
+		return
+	}
+	slogLevels[subsystem] = level
+}
+
+func logLevelOf(subsystem string) slog.Level {
+	slogMu.RLock()
+	defer slogMu.RUnlock()
+	if l, ok := slogLevels[subsystem]; ok {
+		return l
+	}
+	return slogLevel
+}
+
+func baseLogHandler() slog.Handler {
+	slogMu.RLock()
+	defer slogMu.RUnlock()
+	if slogLogger != nil {
+		return slogLogger.Handler()
+	}
+	return &kiiLoggerHandler{}
+}
+
+// SubLogger returns logger of a subsystem.  Its records have "subsystem"
+// attribute, and are filtered by the level of the subsystem.  Changes by
+// SetSlogLogger and SetLogLevel are applied to loggers which have been
+// returned.
+func SubLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{name: subsystem})
+}
+
+// subsystemHandler resolves the base handler on each record, so that the
+// base can be changed after loggers are created.
+type subsystemHandler struct {
+	name string
+	// ops are WithAttrs and WithGroup applied to the base.
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) handler() slog.Handler {
+	base := baseLogHandler().WithAttrs([]slog.Attr{slog.String("subsystem", h.name)})
+	for _, op := range h.ops {
+		base = op(base)
+	}
+	return base
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevelOf(h.name) && baseLogHandler().Enabled(ctx, level)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) *subsystemHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &subsystemHandler{name: h.name, ops: append(ops, op)}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithGroup(name) })
+}
+
+// NewKiiLoggerHandler returns slog.Handler which writes records to l as
+// "message key=value ...".  If l is nil, records are written to Logger.
+func NewKiiLoggerHandler(l KiiLogger) slog.Handler {
+	return &kiiLoggerHandler{logger: l}
+}
+
+type kiiLoggerHandler struct {
+	logger KiiLogger
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *kiiLoggerHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *kiiLoggerHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	b.WriteString(r.Message)
+	for _, a := range h.attrs {
+		appendLogAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendLogAttr(&b, h.group, a)
+		return true
+	})
+	l := h.logger
+	if l == nil {
+		l = Logger
+	}
+	switch {
+	case r.Level >= slog.LevelError:
+		l.Errorf("%s", b.String())
+	case r.Level >= slog.LevelWarn:
+		l.Warnf("%s", b.String())
+	case r.Level >= slog.LevelInfo:
+		l.Infof("%s", b.String())
+	default:
+		l.Debugf("%s", b.String())
+	}
+	return nil
+}
+
+func (h *kiiLoggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	c.attrs = append(c.attrs, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		c.attrs = append(c.attrs, a)
+	}
+	return &c
+}
+
+func (h *kiiLoggerHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	if c.group != "" {
+		c.group += "." + name
+	} else {
+		c.group = name
+	}
+	return &c
+}
+
+func appendLogAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	key := a.Key
+	if prefix != "" {
+		key = prefix + "." + key
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			appendLogAttr(b, key, ga)
+		}
+		return
+	}
+	var s string
+	switch a.Value.Kind() {
+	case slog.KindDuration:
+		s = a.Value.Duration().String()
+	case slog.KindTime:
+		s = a.Value.Time().Format(time.RFC3339Nano)
+	default:
+		s = a.Value.String()
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = strconv.Quote(s)
+	}
+	fmt.Fprintf(b, " %s=%s", key, s)
+}
+
+// NewSlogKiiLogger returns KiiLogger which writes messages to l.  It is
+// used to set Logger to send printf-style logs to slog.
+func NewSlogKiiLogger(l *slog.Logger) KiiLogger {
+	return &slogKiiLogger{logger: l}
+}
+
+type slogKiiLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogKiiLogger) Debug(message string) { l.logger.Debug(message) }
+
+func (l *slogKiiLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l *slogKiiLogger) Info(message string) { l.logger.Info(message) }
+
+func (l *slogKiiLogger) Infof(format string, args ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, args...))
+}
+
+func (l *slogKiiLogger) Warn(message string) { l.logger.Warn(message) }
+
+func (l *slogKiiLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l *slogKiiLogger) Error(message string) { l.logger.Error(message) }
+
+func (l *slogKiiLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,80 @@
+package kii
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer SetSlogLogger(nil)
+	defer func() {
+		SetLogLevel("", slog.LevelDebug)
+		delete(slogLevels, LogMQTT)
+	}()
+
+	req, _ := http.NewRequest("PUT", "https://api.kii.com/thing-if/apps/app/targets/thing:th.1/states", nil)
+	resp := &http.Response{StatusCode: 204, Header: http.Header{}}
+	logRequest(req, nil, resp, nil, "req-1", 15*time.Millisecond)
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("failed to decode log: %s %q", err, buf.String())
+	}
+	for k, v := range map[string]interface{}{
+		"level":     "DEBUG",
+		"subsystem": LogTransport,
+		"method":    "PUT",
+		"path":      "/thing-if/apps/app/targets/thing:th.1/states",
+		"status":    204.0,
+		"latency":   float64(15 * time.Millisecond),
+		"thingID":   "th.1",
+		"requestID": "req-1",
+	} {
+		if rec[k] != v {
+			t.Errorf("unexpected %s: %v", k, rec[k])
+		}
+	}
+
+	// levels of subsystems
+	SetLogLevel("", slog.LevelWarn)
+	SetLogLevel(LogMQTT, slog.LevelDebug)
+	buf.Reset()
+	gatewayLog.Info("filtered")
+	mqttLog.With("topic", "a/b").WithGroup("g").Debug("logged", "k", "v")
+	out := buf.String()
+	if strings.Contains(out, "filtered") {
+		t.Errorf("gateway info should be filtered: %s", out)
+	}
+	if !strings.Contains(out, `"subsystem":"mqtt","topic":"a/b","g":{"k":"v"}`) {
+		t.Errorf("mqtt debug should be logged: %s", out)
+	}
+}
+
+func TestKiiLoggerHandler(t *testing.T) {
+	out := captureLog(t, func() {
+		gatewayLog.With("thingID", "th.1").Warn("failed to handle command", "commandID", "cmd 1", "latency", time.Second)
+		gatewayLog.WithGroup("req").Debug("access", "status", 200)
+	})
+	expected := "[Warn] failed to handle command subsystem=gateway thingID=th.1 commandID=\"cmd 1\" latency=1s\n" +
+		"[Debug] access subsystem=gateway req.status=200\n"
+	if out != expected {
+		t.Errorf("unexpected log: %q", out)
+	}
+}
+
+func TestSlogKiiLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogKiiLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	l.Debugf("hidden %d", 1)
+	l.Warnf("shown %d", 2)
+	out := buf.String()
+	if strings.Contains(out, "hidden") || !strings.Contains(out, `level=WARN msg="shown 2"`) {
+		t.Errorf("unexpected log: %q", out)
+	}
+}
@@ -0,0 +1,272 @@
+package kii
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// StateReporter reports trait formatted states of things.  It remembers the
+// last acknowledged state per thing and alias, and uploads only aliases whose
+// state changed.  Unchanged reports are not uploaded.
+//
+//	r := &StateReporter{
+//	  Author:          &gatewayAuthor,
+//	  CoalesceWindow:  500 * time.Millisecond,
+//	  RefreshInterval: 10 * time.Minute,
+//	}
+//	r.Report(thingID, "AirConditionerAlias", state)
+type StateReporter struct {
+	// Author is used to upload states.  It should be a Gateway or EndNode.
+	Author *APIAuthor
+
+	// CoalesceWindow is the duration to merge reports of a thing into one
+	// upload.  When zero, each Report uploads synchronously.
+	CoalesceWindow time.Duration
+
+	// RefreshInterval is the interval to upload full state of a thing even
+	// if it is not changed.  When zero, full refresh is never forced.
+	RefreshInterval time.Duration
+
+	// RetryInterval is the delay to retry a failed upload.  When zero, 30
+	// seconds is used.
+	RetryInterval time.Duration
+
+	mu     sync.Mutex
+	things map[string]*reportedThing
+
+	// upload is used to replace uploading in tests.
+	upload func(thingID string, states map[string]map[string]interface{}) error
+}
+
+type reportedThing struct {
+	// uploading serializes uploads of the thing, so that an older state
+	// is never written after a newer one.
+	uploading sync.Mutex
+
+	acked       map[string]map[string]interface{}
+	pending     map[string]map[string]interface{}
+	lastRefresh time.Time
+	timer       *time.Timer
+}
+
+// Report reports state of an alias of a thing.  state must be a value which
+// is marshaled into a JSON object, like map or struct.  If CoalesceWindow is
+// zero, changed state is uploaded before Report returns.  Otherwise the
+// upload is delayed, and its error is written to Logger.
+func (r *StateReporter) Report(thingID, alias string, state interface{}) error {
+	m, err := toStateMap(state)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	t := r.thing(thingID)
+	if t.pending == nil {
+		t.pending = map[string]map[string]interface{}{}
+	}
+	t.pending[alias] = m
+	if r.CoalesceWindow <= 0 {
+		r.mu.Unlock()
+		return r.flush(thingID)
+	}
+	if t.timer == nil {
+		r.schedule(thingID, t, r.CoalesceWindow)
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// schedule flushes states of a thing after d.  r.mu must be held.
+func (r *StateReporter) schedule(thingID string, t *reportedThing, d time.Duration) {
+	t.timer = time.AfterFunc(d, func() {
+		if err := r.flush(thingID); err != nil {
+			gatewayLog.Warn("failed to upload state", "thingID", thingID, "error", err)
+		}
+	})
+}
+
+// Flush uploads all pending reports immediately.
+func (r *StateReporter) Flush() error {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.things))
+	for id := range r.things {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+	var firstErr error
+	for _, id := range ids {
+		if err := r.flush(id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Forget discards acknowledged and pending states of a thing.  Next report
+// of the thing is uploaded as a full refresh.
+func (r *StateReporter) Forget(thingID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.things[thingID]; ok {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		delete(r.things, thingID)
+	}
+}
+
+// thing returns reportedThing for thingID.  r.mu must be held.
+func (r *StateReporter) thing(thingID string) *reportedThing {
+	if r.things == nil {
+		r.things = map[string]*reportedThing{}
+	}
+	t, ok := r.things[thingID]
+	if !ok {
+		t = &reportedThing{acked: map[string]map[string]interface{}{}}
+		r.things[thingID] = t
+	}
+	return t
+}
+
+// flush uploads pending states of a thing which differ from acknowledged
+// ones.  Failed states are retried after RetryInterval.
+func (r *StateReporter) flush(thingID string) error {
+	r.mu.Lock()
+	t, ok := r.things[thingID]
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	t.uploading.Lock()
+	defer t.uploading.Unlock()
+
+	r.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	pending := t.pending
+	t.pending = nil
+	now := time.Now()
+	refresh := t.lastRefresh.IsZero() ||
+		(r.RefreshInterval > 0 && now.Sub(t.lastRefresh) >= r.RefreshInterval)
+
+	states := map[string]map[string]interface{}{}
+	if refresh {
+		for alias, s := range t.acked {
+			states[alias] = s
+		}
+	}
+	for alias, s := range pending {
+		if refresh || len(StateDelta(t.acked[alias], s)) > 0 {
+			states[alias] = s
+		}
+	}
+	r.mu.Unlock()
+
+	if len(states) == 0 {
+		return nil
+	}
+	if err := r.doUpload(thingID, states); err != nil {
+		// keep failed states as pending so that they are retried by next
+		// report, flush or retry timer.  States reported during the upload
+		// are newer, and are kept.
+		r.mu.Lock()
+		if t.pending == nil {
+			t.pending = map[string]map[string]interface{}{}
+		}
+		for alias, s := range pending {
+			if _, ok := t.pending[alias]; !ok {
+				t.pending[alias] = s
+			}
+		}
+		if t.timer == nil && r.things[thingID] == t {
+			retry := r.RetryInterval
+			if retry <= 0 {
+				retry = 30 * time.Second
+			}
+			r.schedule(thingID, t, retry)
+		}
+		r.mu.Unlock()
+		return err
+	}
+
+	r.mu.Lock()
+	for alias, s := range states {
+		t.acked[alias] = s
+	}
+	if refresh {
+		t.lastRefresh = now
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *StateReporter) doUpload(thingID string, states map[string]map[string]interface{}) error {
+	if r.upload != nil {
+		return r.upload(thingID, states)
+	}
+	if r.Author == nil {
+		return errors.New("Author must not be nil")
+	}
+	if len(states) == 1 {
+		for alias, s := range states {
+			return r.Author.UpdateTraitState(thingID, alias, s)
+		}
+	}
+	return r.Author.UpdateMultipleTraitState(thingID, states)
+}
+
+// StateDelta returns fields of next which differ from prev.  Fields removed
+// in next are included with nil value.  Values are compared after JSON
+// normalization, so 1 and 1.0 are equal.
+func StateDelta(prev, next map[string]interface{}) map[string]interface{} {
+	delta := map[string]interface{}{}
+	for k, v := range next {
+		pv, ok := prev[k]
+		if !ok || !reflect.DeepEqual(normalizeJSON(pv), normalizeJSON(v)) {
+			delta[k] = v
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			delta[k] = nil
+		}
+	}
+	return delta
+}
+
+// toStateMap converts state to JSON object representation.
+func toStateMap(state interface{}) (map[string]interface{}, error) {
+	if state == nil {
+		return nil, errors.New("state must not be nil")
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.New("state must be marshaled into JSON object")
+	}
+	return m, nil
+}
+
+// normalizeJSON converts v to the form which is decoded from JSON.
+func normalizeJSON(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, bool, string, float64:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err := json.Unmarshal(b, &n); err != nil {
+		return v
+	}
+	return n
+}
@@ -0,0 +1,191 @@
+package kii
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type uploadRecorder struct {
+	mu      sync.Mutex
+	uploads []map[string]map[string]interface{}
+	err     error
+}
+
+func (u *uploadRecorder) upload(thingID string, states map[string]map[string]interface{}) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return u.err
+	}
+	u.uploads = append(u.uploads, states)
+	return nil
+}
+
+func (u *uploadRecorder) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.uploads)
+}
+
+func TestStateReporterSuppressNoop(t *testing.T) {
+	rec := &uploadRecorder{}
+	r := &StateReporter{upload: rec.upload}
+
+	state := AirConditonerState{Power: true, Temperature: 23}
+	if err := r.Report("th.1", "ac", state); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+	if err := r.Report("th.1", "ac", state); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+	if rec.count() != 1 {
+		t.Fatalf("same state should be uploaded once: %d", rec.count())
+	}
+
+	state.Temperature = 24
+	if err := r.Report("th.1", "ac", state); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+	if rec.count() != 2 {
+		t.Fatalf("changed state should be uploaded: %d", rec.count())
+	}
+}
+
+func TestStateReporterOnlyChangedAliases(t *testing.T) {
+	rec := &uploadRecorder{}
+	r := &StateReporter{upload: rec.upload}
+
+	r.Report("th.1", "a1", map[string]interface{}{"v": 1})
+	r.Report("th.1", "a2", map[string]interface{}{"v": 1})
+	r.Report("th.1", "a2", map[string]interface{}{"v": 2})
+	last := rec.uploads[len(rec.uploads)-1]
+	if _, ok := last["a1"]; ok || len(last) != 1 {
+		t.Errorf("only changed alias should be uploaded: %#v", last)
+	}
+}
+
+func TestStateReporterCoalesce(t *testing.T) {
+	rec := &uploadRecorder{}
+	r := &StateReporter{
+		CoalesceWindow: 50 * time.Millisecond,
+		upload:         rec.upload,
+	}
+	for i := 0; i < 10; i++ {
+		r.Report("th.1", "ac", map[string]interface{}{"v": i})
+	}
+	if rec.count() != 0 {
+		t.Fatalf("reports should be delayed")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if rec.count() != 1 {
+		t.Fatalf("burst should be coalesced into one upload: %d", rec.count())
+	}
+	if v := rec.uploads[0]["ac"]["v"]; v != float64(9) {
+		t.Errorf("latest state should be uploaded: %v", v)
+	}
+}
+
+func TestStateReporterRefresh(t *testing.T) {
+	rec := &uploadRecorder{}
+	r := &StateReporter{
+		RefreshInterval: 50 * time.Millisecond,
+		upload:          rec.upload,
+	}
+	r.Report("th.1", "a1", map[string]interface{}{"v": 1})
+	r.Report("th.1", "a2", map[string]interface{}{"v": 1})
+	time.Sleep(100 * time.Millisecond)
+	r.Report("th.1", "a2", map[string]interface{}{"v": 1})
+	if rec.count() != 3 {
+		t.Fatalf("full refresh should be forced: %d", rec.count())
+	}
+	if len(rec.uploads[2]) != 2 {
+		t.Errorf("full refresh should contain all aliases: %#v", rec.uploads[2])
+	}
+}
+
+func TestStateReporterRetryAfterFailure(t *testing.T) {
+	rec := &uploadRecorder{err: errors.New("offline")}
+	r := &StateReporter{upload: rec.upload}
+	if err := r.Report("th.1", "ac", map[string]interface{}{"v": 1}); err == nil {
+		t.Fatal("should fail")
+	}
+	rec.err = nil
+	if err := r.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err)
+	}
+	if rec.count() != 1 {
+		t.Errorf("failed state should be retried: %d", rec.count())
+	}
+}
+
+func TestStateReporterRetryTimer(t *testing.T) {
+	rec := &uploadRecorder{err: errors.New("offline")}
+	r := &StateReporter{upload: rec.upload, RetryInterval: 10 * time.Millisecond}
+	if err := r.Report("th.1", "ac", map[string]interface{}{"v": 1}); err == nil {
+		t.Fatal("should fail")
+	}
+	rec.mu.Lock()
+	rec.err = nil
+	rec.mu.Unlock()
+	waitUntil(t, time.Second, func() bool { return rec.count() == 1 })
+}
+
+func TestStateReporterSerializeUploads(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		uploaded []interface{}
+	)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r := &StateReporter{}
+	r.upload = func(thingID string, states map[string]map[string]interface{}) error {
+		v := states["ac"]["v"]
+		if v == float64(1) {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		uploaded = append(uploaded, v)
+		mu.Unlock()
+		return nil
+	}
+	first := make(chan error)
+	go func() { first <- r.Report("th.1", "ac", map[string]interface{}{"v": 1}) }()
+	<-started
+	second := make(chan error)
+	go func() { second <- r.Report("th.1", "ac", map[string]interface{}{"v": 2}) }()
+	select {
+	case <-second:
+		t.Fatal("newer state should wait for the running upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(uploaded) != 2 || uploaded[1] != float64(2) {
+		t.Errorf("newer state should be written last: %v", uploaded)
+	}
+}
+
+func TestStateDelta(t *testing.T) {
+	prev := map[string]interface{}{"a": float64(1), "b": "x", "c": true}
+	next := map[string]interface{}{"a": 1, "b": "y", "d": false}
+	d := StateDelta(prev, next)
+	if len(d) != 3 {
+		t.Fatalf("unexpected delta: %#v", d)
+	}
+	if _, ok := d["a"]; ok {
+		t.Errorf("a should not be changed")
+	}
+	if v, ok := d["c"]; !ok || v != nil {
+		t.Errorf("removed c should be nil")
+	}
+}
@@ -0,0 +1,226 @@
+package kii
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by Store when the key doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is a key-value storage which is used to persist identities and
+// records of gateway.  Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns value of key.  If key doesn't exist, ErrNotFound is
+	// returned.
+	Get(key string) ([]byte, error)
+	// Put stores value with key.
+	Put(key string, value []byte) error
+	// Delete deletes key.  It is not an error when key doesn't exist.
+	Delete(key string) error
+	// Keys returns keys which have prefix in ascending order.
+	Keys(prefix string) ([]string, error)
+}
+
+// MemoryStore is a Store which holds values in memory.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string][]byte{}}
+}
+
+// Get returns value of key.
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// Put stores value with key.
+func (s *MemoryStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Delete deletes key.
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+// Keys returns keys which have prefix.
+func (s *MemoryStore) Keys(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return filterKeys(s.data, prefix), nil
+}
+
+// FileStore is a Store which persists all values in a JSON file.  The file
+// is rewritten atomically on every change, so it is suitable for small
+// number of records like identities of a gateway and its end nodes.
+type FileStore struct {
+	path string
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+var _ Store = (*FileStore)(nil)
+
+// OpenFileStore opens FileStore of path.  If the file doesn't exist, it is
+// created on the first change.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, data: map[string][]byte{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return s, nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		s.data[k] = []byte(v)
+	}
+	return s, nil
+}
+
+// Get returns value of key.
+func (s *FileStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// Put stores value with key.  value must be a valid JSON.
+func (s *FileStore) Put(key string, value []byte) error {
+	if !json.Valid(value) {
+		return errors.New("value of FileStore must be a valid JSON")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.data[key]
+	s.data[key] = append([]byte(nil), value...)
+	if err := s.save(); err != nil {
+		if existed {
+			s.data[key] = prev
+		} else {
+			delete(s.data, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete deletes key.
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	delete(s.data, key)
+	if err := s.save(); err != nil {
+		s.data[key] = prev
+		return err
+	}
+	return nil
+}
+
+// Keys returns keys which have prefix.
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return filterKeys(s.data, prefix), nil
+}
+
+// save writes all data to a temporary file and renames it.  s.mu must be
+// held.
+func (s *FileStore) save() error {
+	m := make(map[string]json.RawMessage, len(s.data))
+	for k, v := range s.data {
+		m[k] = json.RawMessage(v)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func filterKeys(data map[string][]byte, prefix string) []string {
+	var keys []string
+	for k := range data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// getJSON gets value of key from s and decodes it into v.
+func getJSON(s Store, key string, v interface{}) error {
+	b, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// putJSON encodes v and stores it with key into s.
+func putJSON(s Store, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(key, b)
+}
@@ -0,0 +1,164 @@
+package kii
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Thing represents a thing registered on Kii Cloud.  Predefined fields are
+// mapped to struct fields, and other fields are stored in Properties.
+type Thing struct {
+	ThingID         string
+	VendorThingID   string
+	ThingType       string
+	LayoutPosition  string
+	Vendor          string
+	FirmwareVersion string
+	Lot             string
+	StringField1    string
+	StringField2    string
+	StringField3    string
+	StringField4    string
+	StringField5    string
+	NumberField1    int64
+	NumberField2    int64
+	NumberField3    int64
+	NumberField4    int64
+	NumberField5    int64
+	Created         time.Time
+	Modified        time.Time
+	Disabled        bool
+	Online          bool
+	// OnlineStatusModifiedAt is time when Online is changed.
+	OnlineStatusModifiedAt time.Time
+	// Properties holds custom fields.
+	Properties map[string]interface{}
+}
+
+// thingField binds a predefined field name to a field of Thing.
+type thingField struct {
+	name     string
+	readOnly bool
+	ptr      func(t *Thing) interface{}
+}
+
+var thingFields = []thingField{
+	{"_thingID", true, func(t *Thing) interface{} { return &t.ThingID }},
+	{"_vendorThingID", true, func(t *Thing) interface{} { return &t.VendorThingID }},
+	{"_thingType", false, func(t *Thing) interface{} { return &t.ThingType }},
+	{"_layoutPosition", true, func(t *Thing) interface{} { return &t.LayoutPosition }},
+	{"_vendor", false, func(t *Thing) interface{} { return &t.Vendor }},
+	{"_firmwareVersion", false, func(t *Thing) interface{} { return &t.FirmwareVersion }},
+	{"_lot", false, func(t *Thing) interface{} { return &t.Lot }},
+	{"_stringField1", false, func(t *Thing) interface{} { return &t.StringField1 }},
+	{"_stringField2", false, func(t *Thing) interface{} { return &t.StringField2 }},
+	{"_stringField3", false, func(t *Thing) interface{} { return &t.StringField3 }},
+	{"_stringField4", false, func(t *Thing) interface{} { return &t.StringField4 }},
+	{"_stringField5", false, func(t *Thing) interface{} { return &t.StringField5 }},
+	{"_numberField1", false, func(t *Thing) interface{} { return &t.NumberField1 }},
+	{"_numberField2", false, func(t *Thing) interface{} { return &t.NumberField2 }},
+	{"_numberField3", false, func(t *Thing) interface{} { return &t.NumberField3 }},
+	{"_numberField4", false, func(t *Thing) interface{} { return &t.NumberField4 }},
+	{"_numberField5", false, func(t *Thing) interface{} { return &t.NumberField5 }},
+	{"_created", true, func(t *Thing) interface{} { return &t.Created }},
+	{"_modified", true, func(t *Thing) interface{} { return &t.Modified }},
+	{"_disabled", true, func(t *Thing) interface{} { return &t.Disabled }},
+	{"_online", true, func(t *Thing) interface{} { return &t.Online }},
+	{"_onlineStatusModifiedAt", true, func(t *Thing) interface{} { return &t.OnlineStatusModifiedAt }},
+}
+
+// UnmarshalJSON decodes JSON representation of a thing.  Timestamps are
+// decoded from milliseconds since epoch.
+func (t *Thing) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*t = Thing{}
+	for _, f := range thingFields {
+		raw, ok := m[f.name]
+		if !ok {
+			continue
+		}
+		delete(m, f.name)
+		if string(raw) == "null" {
+			continue
+		}
+		var err error
+		switch p := f.ptr(t).(type) {
+		case *time.Time:
+			var ms int64
+			if err = json.Unmarshal(raw, &ms); err == nil {
+				*p = millisToTime(ms)
+			}
+		default:
+			err = json.Unmarshal(raw, p)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", f.name, err)
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	t.Properties = make(map[string]interface{}, len(m))
+	for k, raw := range m {
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return fmt.Errorf("invalid %s: %s", k, err)
+		}
+		t.Properties[k] = v
+	}
+	return nil
+}
+
+// MarshalJSON encodes non-zero fields of a thing.  Timestamps are encoded as
+// milliseconds since epoch.
+func (t Thing) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.fieldMap(false))
+}
+
+// fieldMap returns non-zero fields of a thing.  When writableOnly is true,
+// read-only predefined fields are excluded.
+func (t *Thing) fieldMap(writableOnly bool) map[string]interface{} {
+	m := make(map[string]interface{}, len(thingFields)+len(t.Properties))
+	for k, v := range t.Properties {
+		m[k] = v
+	}
+	for _, f := range thingFields {
+		if writableOnly && f.readOnly {
+			continue
+		}
+		switch p := f.ptr(t).(type) {
+		case *string:
+			if *p != "" {
+				m[f.name] = *p
+			}
+		case *int64:
+			if *p != 0 {
+				m[f.name] = *p
+			}
+		case *bool:
+			if *p {
+				m[f.name] = *p
+			}
+		case *time.Time:
+			if !p.IsZero() {
+				m[f.name] = timeToMillis(*p)
+			}
+		}
+	}
+	return m
+}
+
+func millisToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func timeToMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -1,12 +1,16 @@
 package kii
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	dproxy "github.com/koron/go-dproxy"
 )
 
 func TestUpdateThing(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -47,6 +51,7 @@ func TestUpdateThing(t *testing.T) {
 }
 
 func TestUpdateThingFail(t *testing.T) {
+	defer useCassette(t)()
 	au := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -56,3 +61,182 @@ func TestUpdateThingFail(t *testing.T) {
 		t.Error("should fail")
 	}
 }
+
+func TestUpdateTypedThing(t *testing.T) {
+	defer useCassette(t)()
+	au, gatewayID, err := GatewayOnboard()
+	if err != nil {
+		t.Errorf("got error on onboard gateway %s", err)
+	}
+	endNodeID, err := RegisterAnEndNode(au)
+	if err != nil {
+		t.Errorf("got error when register an end node %s", err)
+	}
+
+	err = au.AddEndNode(*gatewayID, endNodeID)
+	if err != nil {
+		t.Errorf("got error when add end node %s", err)
+	}
+
+	responseObj, err := au.GenerateEndNodeToken(*gatewayID, endNodeID, &EndNodeTokenRequest{})
+	if err != nil {
+		t.Errorf("got error when GenerateEndNodeToken %s", err)
+	}
+	endNodeAuthor := APIAuthor{
+		Token: responseObj.AccessToken,
+		App:   testApp,
+	}
+	err = endNodeAuthor.UpdateTypedThing(endNodeID, &Thing{
+		StringField1: "str1",
+		Properties: map[string]interface{}{
+			"StateUploadDisabled": true,
+		},
+	})
+	if err != nil {
+		t.Errorf("failed to update thing, %s", err)
+	}
+	thing, err := endNodeAuthor.GetTypedThing(endNodeID)
+	if err != nil {
+		t.Fatalf("failed to get thing, %s", err)
+	}
+	if thing.ThingID != endNodeID || thing.ThingType != "dummyType" || thing.Created.IsZero() {
+		t.Errorf("predefined fields not decoded correctly: %+v", thing)
+	}
+	if thing.StringField1 != "str1" || thing.Properties["StateUploadDisabled"] != true {
+		t.Errorf("properties not update correctly: %+v", thing)
+	}
+
+	if err = endNodeAuthor.DeleteThing(endNodeID); err != nil {
+		t.Errorf("delete thing failed, %s", err)
+	}
+}
+
+func TestThingUnmarshalJSON(t *testing.T) {
+	var thing Thing
+	err := json.Unmarshal([]byte(`{
+		"_thingID": "th.1",
+		"_vendorThingID": "vid",
+		"_thingType": "type",
+		"_layoutPosition": "END_NODE",
+		"_firmwareVersion": "v1",
+		"_numberField1": 12,
+		"_created": 1500000000123,
+		"_disabled": true,
+		"_online": true,
+		"_onlineStatusModifiedAt": 1500000001000,
+		"myNumber": 1,
+		"myObject": {"a": "b"}
+	}`), &thing)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if thing.ThingID != "th.1" || thing.VendorThingID != "vid" || thing.ThingType != "type" ||
+		thing.LayoutPosition != ENDNODE.String() || thing.FirmwareVersion != "v1" || thing.NumberField1 != 12 {
+		t.Errorf("predefined fields not decoded: %+v", thing)
+	}
+	if !thing.Disabled || !thing.Online {
+		t.Errorf("flags not decoded: %+v", thing)
+	}
+	if !thing.Created.Equal(time.Unix(1500000000, 123000000)) {
+		t.Errorf("_created not decoded: %s", thing.Created)
+	}
+	if len(thing.Properties) != 2 || thing.Properties["myNumber"] != json.Number("1") {
+		t.Errorf("custom properties not decoded: %#v", thing.Properties)
+	}
+
+	b, err := json.Marshal(thing)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	var again Thing
+	if err := json.Unmarshal(b, &again); err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if !reflect.DeepEqual(thing, again) {
+		t.Errorf("round trip not match:\n%+v\n%+v", thing, again)
+	}
+
+	m := thing.fieldMap(true)
+	for _, k := range []string{"_thingID", "_vendorThingID", "_created", "_online", "_disabled"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("read-only %s should not be updated", k)
+		}
+	}
+	if m["_firmwareVersion"] != "v1" || m["myNumber"] != json.Number("1") {
+		t.Errorf("writable fields should be updated: %#v", m)
+	}
+}
+
+func TestDisableEnableThing(t *testing.T) {
+	defer useCassette(t)()
+	author, err := AnonymousLogin(testApp)
+	if err != nil {
+		t.Fatalf("anonymouseLogin fail:%s", err)
+	}
+	endNodeID, err := RegisterAnEndNode(author)
+	if err != nil {
+		t.Fatalf("got error when register an end node %s", err)
+	}
+
+	if err := author.DisableThing(endNodeID); err != nil {
+		t.Errorf("failed to disable thing, %s", err)
+	}
+	thing, err := author.GetTypedThing(endNodeID)
+	if err != nil || !thing.Disabled {
+		t.Errorf("thing should be disabled: %v", err)
+	}
+	if err := author.EnableThing(endNodeID); err != nil {
+		t.Errorf("failed to enable thing, %s", err)
+	}
+	thing, err = author.GetTypedThing(endNodeID)
+	if err != nil || thing.Disabled {
+		t.Errorf("thing should be enabled: %v", err)
+	}
+
+	if err = author.DeleteThing(endNodeID); err != nil {
+		t.Errorf("delete thing failed, %s", err)
+	}
+}
+
+func TestUpdateFirmwareVersionAndThingType(t *testing.T) {
+	defer useCassette(t)()
+	author, _, err := GetLoginKiiUser()
+	if err != nil {
+		t.Fatalf("fail to get login user")
+	}
+	endNodeID, err := RegisterATraitEnabledEndNode(author)
+	if err != nil {
+		t.Fatalf("got error when register an end node %s", err)
+	}
+
+	if err := author.UpdateFirmwareVersion(endNodeID, "v2"); err != nil {
+		t.Errorf("failed to update firmware version, %s", err)
+	}
+	if fv, err := author.GetFirmwareVersion(endNodeID); err != nil || fv != "v2" {
+		t.Errorf("firmware version should be updated: %q, %v", fv, err)
+	}
+	if err := author.UpdateThingType(endNodeID, "MyOtherType"); err != nil {
+		t.Errorf("failed to update thing type, %s", err)
+	}
+	if tt, err := author.GetThingType(endNodeID); err != nil || tt != "MyOtherType" {
+		t.Errorf("thing type should be updated: %q, %v", tt, err)
+	}
+
+	if err = author.DeleteThing(endNodeID); err != nil {
+		t.Errorf("delete thing failed, %s", err)
+	}
+}
+
+func TestUpdateFirmwareVersionFail(t *testing.T) {
+	defer useCassette(t)()
+	au := APIAuthor{
+		Token: "dummyToken",
+		App:   testApp,
+	}
+	if err := au.UpdateFirmwareVersion("dummyID", "v2"); err == nil {
+		t.Error("should fail")
+	}
+	if err := au.DisableThing("dummyID"); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,379 @@
+package kii
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// TraitDefinition represents definition of a trait.
+type TraitDefinition struct {
+	Trait                string                           `json:"trait"`
+	Version              int                              `json:"version"`
+	DataGroupingInterval string                           `json:"dataGroupingInterval,omitempty"`
+	States               []map[string]TraitDataDefinition `json:"states,omitempty"`
+	Actions              []map[string]TraitDataDefinition `json:"actions,omitempty"`
+}
+
+// TraitDataDefinition represents definition of a state field or an action of
+// a trait.
+type TraitDataDefinition struct {
+	Description   string      `json:"description,omitempty"`
+	PayloadSchema *JSONSchema `json:"payloadSchema"`
+	// ResultSchema is schema of "data" of action result.  It is used only
+	// for actions, and optional.
+	ResultSchema *JSONSchema `json:"resultSchema,omitempty"`
+}
+
+// State returns definition of a state field.
+func (td *TraitDefinition) State(name string) (*TraitDataDefinition, bool) {
+	return findTraitData(td.States, name)
+}
+
+// Action returns definition of an action.
+func (td *TraitDefinition) Action(name string) (*TraitDataDefinition, bool) {
+	return findTraitData(td.Actions, name)
+}
+
+func findTraitData(list []map[string]TraitDataDefinition, name string) (*TraitDataDefinition, bool) {
+	for _, m := range list {
+		if d, ok := m[name]; ok {
+			return &d, true
+		}
+	}
+	return nil, false
+}
+
+// TraitAlias represents a trait bound to an alias.
+type TraitAlias struct {
+	Trait        string `json:"trait"`
+	TraitVersion int    `json:"traitVersion"`
+}
+
+// ThingTypeDefinition represents aliases of a thingType and firmwareVersion.
+type ThingTypeDefinition struct {
+	ThingType       string                `json:"thingType"`
+	FirmwareVersion string                `json:"firmwareVersion"`
+	Aliases         map[string]TraitAlias `json:"aliases"`
+}
+
+type traitKey struct {
+	trait   string
+	version int
+}
+
+type thingTypeKey struct {
+	thingType       string
+	firmwareVersion string
+}
+
+// TraitRegistry holds trait definitions and aliases keyed by thingType and
+// firmwareVersion, and validates trait formatted payloads locally.
+type TraitRegistry struct {
+	mu         sync.RWMutex
+	traits     map[traitKey]*TraitDefinition
+	thingTypes map[thingTypeKey]*ThingTypeDefinition
+}
+
+// NewTraitRegistry creates an empty TraitRegistry.
+func NewTraitRegistry() *TraitRegistry {
+	return &TraitRegistry{
+		traits:     map[traitKey]*TraitDefinition{},
+		thingTypes: map[thingTypeKey]*ThingTypeDefinition{},
+	}
+}
+
+// AddTrait adds a trait definition.  Existing definition with same trait and
+// version is replaced.
+func (r *TraitRegistry) AddTrait(def *TraitDefinition) error {
+	if def.Trait == "" {
+		return fmt.Errorf("trait must not be empty")
+	}
+	if def.Version < 1 {
+		return fmt.Errorf("version of trait %s must be positive: %d", def.Trait, def.Version)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.traits[traitKey{def.Trait, def.Version}] = def
+	return nil
+}
+
+// AddThingType adds aliases of a thingType and firmwareVersion.  Existing
+// definition with same thingType and firmwareVersion is replaced.
+func (r *TraitRegistry) AddThingType(def *ThingTypeDefinition) error {
+	if def.ThingType == "" || def.FirmwareVersion == "" {
+		return fmt.Errorf("thingType and firmwareVersion must not be empty")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.thingTypes[thingTypeKey{def.ThingType, def.FirmwareVersion}] = def
+	return nil
+}
+
+// LoadFile loads definitions from a JSON file.  The file contains a
+// TraitDefinition, a ThingTypeDefinition or an array of them.  Objects which
+// have "trait" are treated as TraitDefinition, and objects which have
+// "thingType" are treated as ThingTypeDefinition.
+func (r *TraitRegistry) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := r.load(b); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+func (r *TraitRegistry) load(b []byte) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(b, &list); err != nil {
+		list = []json.RawMessage{b}
+	}
+	for i, raw := range list {
+		var probe map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return fmt.Errorf("definition[%d]: %s", i, err)
+		}
+		if _, ok := probe["trait"]; ok {
+			var def TraitDefinition
+			if err := json.Unmarshal(raw, &def); err != nil {
+				return fmt.Errorf("definition[%d]: %s", i, err)
+			}
+			if err := r.AddTrait(&def); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := probe["thingType"]; ok {
+			var def ThingTypeDefinition
+			if err := json.Unmarshal(raw, &def); err != nil {
+				return fmt.Errorf("definition[%d]: %s", i, err)
+			}
+			if err := r.AddThingType(&def); err != nil {
+				return err
+			}
+			continue
+		}
+		return fmt.Errorf("definition[%d]: neither trait nor thingType", i)
+	}
+	return nil
+}
+
+// Fetch loads aliases of thingType and firmwareVersion and traits bound to
+// them from the server.
+func (r *TraitRegistry) Fetch(a *APIAuthor, thingType, firmwareVersion string) error {
+	aliases, err := a.GetTraitAliases(thingType, firmwareVersion)
+	if err != nil {
+		return err
+	}
+	for _, ta := range aliases {
+		if _, ok := r.Trait(ta.Trait, ta.TraitVersion); ok {
+			continue
+		}
+		def, err := a.GetTraitDefinition(ta.Trait, ta.TraitVersion)
+		if err != nil {
+			return err
+		}
+		if err := r.AddTrait(def); err != nil {
+			return err
+		}
+	}
+	return r.AddThingType(&ThingTypeDefinition{
+		ThingType:       thingType,
+		FirmwareVersion: firmwareVersion,
+		Aliases:         aliases,
+	})
+}
+
+// Trait returns a trait definition.
+func (r *TraitRegistry) Trait(trait string, version int) (*TraitDefinition, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	def, ok := r.traits[traitKey{trait, version}]
+	return def, ok
+}
+
+// ThingType returns aliases of a thingType and firmwareVersion.
+func (r *TraitRegistry) ThingType(thingType, firmwareVersion string) (*ThingTypeDefinition, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	def, ok := r.thingTypes[thingTypeKey{thingType, firmwareVersion}]
+	return def, ok
+}
+
+// ThingTypes returns all registered ThingTypeDefinitions ordered by
+// thingType and firmwareVersion.
+func (r *TraitRegistry) ThingTypes() []*ThingTypeDefinition {
+	r.mu.RLock()
+	list := make([]*ThingTypeDefinition, 0, len(r.thingTypes))
+	for _, def := range r.thingTypes {
+		list = append(list, def)
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ThingType != list[j].ThingType {
+			return list[i].ThingType < list[j].ThingType
+		}
+		return list[i].FirmwareVersion < list[j].FirmwareVersion
+	})
+	return list
+}
+
+// TraitOfAlias returns the trait definition bound to an alias.
+func (r *TraitRegistry) TraitOfAlias(thingType, firmwareVersion, alias string) (*TraitDefinition, error) {
+	tt, ok := r.ThingType(thingType, firmwareVersion)
+	if !ok {
+		return nil, fmt.Errorf("thingType %s with firmwareVersion %s is not registered", thingType, firmwareVersion)
+	}
+	ta, ok := tt.Aliases[alias]
+	if !ok {
+		return nil, &ValidationError{Path: alias, Message: "alias is not defined"}
+	}
+	def, ok := r.Trait(ta.Trait, ta.TraitVersion)
+	if !ok {
+		return nil, fmt.Errorf("trait %s version %d is not registered", ta.Trait, ta.TraitVersion)
+	}
+	return def, nil
+}
+
+// ValidateTraitState validates a state of an alias, which is sent by
+// UpdateTraitState.
+func (r *TraitRegistry) ValidateTraitState(thingType, firmwareVersion, alias string, state interface{}) error {
+	def, err := r.TraitOfAlias(thingType, firmwareVersion, alias)
+	if err != nil {
+		return err
+	}
+	return validateTraitState(def, alias, normalizeJSON(state)).err()
+}
+
+// ValidateMultipleTraitState validates states of aliases, which is sent by
+// UpdateMultipleTraitState.
+func (r *TraitRegistry) ValidateMultipleTraitState(thingType, firmwareVersion string, states interface{}) error {
+	m, ok := normalizeJSON(states).(map[string]interface{})
+	if !ok {
+		return ValidationErrors{{Message: "states must be an object"}}
+	}
+	var errs ValidationErrors
+	for _, alias := range sortedKeys(m) {
+		def, err := r.TraitOfAlias(thingType, firmwareVersion, alias)
+		if ve, ok := err.(*ValidationError); ok {
+			errs = append(errs, ve)
+			continue
+		} else if err != nil {
+			return err
+		}
+		errs = append(errs, validateTraitState(def, alias, m[alias])...)
+	}
+	return errs.err()
+}
+
+func validateTraitState(def *TraitDefinition, path string, state interface{}) ValidationErrors {
+	m, ok := state.(map[string]interface{})
+	if !ok {
+		return ValidationErrors{{Path: path, Message: "state must be an object"}}
+	}
+	var errs ValidationErrors
+	for _, name := range sortedKeys(m) {
+		sd, ok := def.State(name)
+		if !ok {
+			errs = append(errs, &ValidationError{
+				Path:    joinPath(path, name),
+				Message: fmt.Sprintf("is not a state of trait %s", def.Trait),
+			})
+			continue
+		}
+		errs = append(errs, sd.PayloadSchema.validate(joinPath(path, name), m[name])...)
+	}
+	return errs
+}
+
+// ValidateTraitActions validates actions of trait command, which is sent by
+// PostTraitCommand.
+func (r *TraitRegistry) ValidateTraitActions(thingType, firmwareVersion string, actions []map[string]interface{}) error {
+	return r.validateTraitCommand(thingType, firmwareVersion, "actions", actions,
+		func(def *TraitDefinition, path string, name string, v interface{}) ValidationErrors {
+			ad, ok := def.Action(name)
+			if !ok {
+				return ValidationErrors{{
+					Path:    path,
+					Message: fmt.Sprintf("is not an action of trait %s", def.Trait),
+				}}
+			}
+			return ad.PayloadSchema.validate(path, v)
+		})
+}
+
+// ValidateTraitActionResults validates action results of trait command,
+// which is sent by UpdateTraitCommandResults.
+func (r *TraitRegistry) ValidateTraitActionResults(thingType, firmwareVersion string, results []map[string]interface{}) error {
+	return r.validateTraitCommand(thingType, firmwareVersion, "actionResults", results,
+		func(def *TraitDefinition, path string, name string, v interface{}) ValidationErrors {
+			ad, ok := def.Action(name)
+			if !ok {
+				return ValidationErrors{{
+					Path:    path,
+					Message: fmt.Sprintf("is not an action of trait %s", def.Trait),
+				}}
+			}
+			return actionResultSchema(ad.ResultSchema).validate(path, v)
+		})
+}
+
+// actionResultSchema returns schema of an action result.
+func actionResultSchema(data *JSONSchema) *JSONSchema {
+	props := map[string]*JSONSchema{
+		"succeeded":    {Type: JSONSchemaTypes{"boolean"}},
+		"errorMessage": {Type: JSONSchemaTypes{"string"}},
+	}
+	if data != nil {
+		props["data"] = data
+	}
+	return &JSONSchema{
+		Type:       JSONSchemaTypes{"object"},
+		Properties: props,
+		Required:   []string{"succeeded"},
+	}
+}
+
+// validateTraitCommand validates list of trait formatted actions or action
+// results: [{alias: [{name: value}, ...]}, ...].
+func (r *TraitRegistry) validateTraitCommand(thingType, firmwareVersion, root string, list []map[string]interface{},
+	validateItem func(def *TraitDefinition, path, name string, v interface{}) ValidationErrors) error {
+	if _, ok := r.ThingType(thingType, firmwareVersion); !ok {
+		return fmt.Errorf("thingType %s with firmwareVersion %s is not registered", thingType, firmwareVersion)
+	}
+	var errs ValidationErrors
+	for i, entry := range list {
+		entryPath := fmt.Sprintf("%s[%d]", root, i)
+		for _, alias := range sortedKeys(entry) {
+			aliasPath := joinPath(entryPath, alias)
+			def, err := r.TraitOfAlias(thingType, firmwareVersion, alias)
+			if _, ok := err.(*ValidationError); ok {
+				errs = append(errs, &ValidationError{Path: aliasPath, Message: "alias is not defined"})
+				continue
+			} else if err != nil {
+				return err
+			}
+			items, ok := normalizeJSON(entry[alias]).([]interface{})
+			if !ok {
+				errs = append(errs, &ValidationError{Path: aliasPath, Message: "must be an array"})
+				continue
+			}
+			for j, item := range items {
+				itemPath := fmt.Sprintf("%s[%d]", aliasPath, j)
+				m, ok := item.(map[string]interface{})
+				if !ok || len(m) != 1 {
+					errs = append(errs, &ValidationError{Path: itemPath, Message: "must be an object with single key"})
+					continue
+				}
+				for name, v := range m {
+					errs = append(errs, validateItem(def, joinPath(itemPath, name), name, v)...)
+				}
+			}
+		}
+	}
+	return errs.err()
+}
@@ -0,0 +1,187 @@
+package kii
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const airConditionerDefinitions = `[
+  {
+    "trait": "AirConditioner",
+    "version": 1,
+    "states": [
+      {"power": {"payloadSchema": {"type": "boolean"}}},
+      {"currentTemperature": {"payloadSchema": {"type": "integer", "minimum": -20, "maximum": 50}}}
+    ],
+    "actions": [
+      {"turnPower": {"payloadSchema": {"type": "boolean"}}},
+      {"setPresetTemperature": {
+        "payloadSchema": {"type": "integer", "minimum": 16, "maximum": 30},
+        "resultSchema": {"type": "object", "properties": {"applied": {"type": "integer"}}}
+      }}
+    ]
+  },
+  {
+    "thingType": "MyAirConditioner",
+    "firmwareVersion": "v1",
+    "aliases": {
+      "AirConditionerAlias": {"trait": "AirConditioner", "traitVersion": 1}
+    }
+  }
+]`
+
+func newTestTraitRegistry(t *testing.T) *TraitRegistry {
+	dir, err := ioutil.TempDir("", "kii_trait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traits.json")
+	if err := ioutil.WriteFile(path, []byte(airConditionerDefinitions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewTraitRegistry()
+	if err := r.LoadFile(path); err != nil {
+		t.Fatalf("failed to load definitions: %s", err)
+	}
+	return r
+}
+
+func TestTraitRegistryValidateState(t *testing.T) {
+	r := newTestTraitRegistry(t)
+
+	err := r.ValidateTraitState(thingType, firmwareVersion, alias, AirConditonerState{
+		Power:       true,
+		Temperature: 23,
+	})
+	if err != nil {
+		t.Errorf("valid state should pass: %s", err)
+	}
+
+	err = r.ValidateMultipleTraitState(thingType, firmwareVersion, map[string]interface{}{
+		alias: map[string]interface{}{
+			"power":              "on",
+			"currentTemperature": 80,
+			"humidity":           40,
+		},
+		"not-existing-alias": map[string]interface{}{},
+	})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("should be ValidationErrors: %#v", err)
+	}
+	expected := []string{
+		"AirConditionerAlias.currentTemperature",
+		"AirConditionerAlias.humidity",
+		"AirConditionerAlias.power",
+		"not-existing-alias",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors: %s", errs)
+	}
+	for i, e := range errs {
+		if e.Path != expected[i] {
+			t.Errorf("path of error[%d] should be %s but %s", i, expected[i], e.Path)
+		}
+	}
+}
+
+func TestTraitRegistryValidateActions(t *testing.T) {
+	r := newTestTraitRegistry(t)
+
+	actions := []map[string]interface{}{
+		{
+			alias: []map[string]interface{}{
+				{"turnPower": true},
+				{"setPresetTemperature": 40},
+				{"fly": true},
+			},
+		},
+	}
+	err := r.ValidateTraitActions(thingType, firmwareVersion, actions)
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("should have 2 errors: %v", err)
+	}
+	if errs[0].Path != "actions[0].AirConditionerAlias[1].setPresetTemperature" {
+		t.Errorf("unexpected path: %s", errs[0].Path)
+	}
+	if errs[1].Path != "actions[0].AirConditionerAlias[2].fly" {
+		t.Errorf("unexpected path: %s", errs[1].Path)
+	}
+}
+
+func TestTraitRegistryValidateActionResults(t *testing.T) {
+	r := newTestTraitRegistry(t)
+
+	results := []map[string]interface{}{
+		{
+			alias: []map[string]interface{}{
+				{"turnPower": map[string]interface{}{"succeeded": true}},
+				{"setPresetTemperature": map[string]interface{}{
+					"succeeded": true,
+					"data":      map[string]interface{}{"applied": 25},
+				}},
+			},
+		},
+	}
+	if err := r.ValidateTraitActionResults(thingType, firmwareVersion, results); err != nil {
+		t.Errorf("valid results should pass: %s", err)
+	}
+
+	results = []map[string]interface{}{
+		{
+			alias: []map[string]interface{}{
+				{"turnPower": map[string]interface{}{"errorMessage": 1}},
+			},
+		},
+	}
+	err := r.ValidateTraitActionResults(thingType, firmwareVersion, results)
+	if err == nil || !strings.Contains(err.Error(), "actionResults[0].AirConditionerAlias[0].turnPower.succeeded: is required") {
+		t.Errorf("missing succeeded should be reported: %v", err)
+	}
+}
+
+func TestTraitRegistryUnknownThingType(t *testing.T) {
+	r := newTestTraitRegistry(t)
+	err := r.ValidateTraitState("unknown", "v1", alias, map[string]interface{}{})
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	if _, ok := err.(ValidationErrors); ok {
+		t.Errorf("unknown thingType should not be a validation error")
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	var s JSONSchema
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["name"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "pattern": "^[a-z]+$", "maxLength": 5},
+			"tags": {"type": "array", "maxItems": 1, "items": {"enum": ["a", "b"]}},
+			"level": {"type": ["integer", "null"], "minimum": 0, "exclusiveMinimum": true}
+		}
+	}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(map[string]interface{}{"name": "abc", "level": nil}); err != nil {
+		t.Errorf("should pass: %s", err)
+	}
+	err := s.Validate(map[string]interface{}{
+		"name":  "ABCDEF",
+		"tags":  []string{"a", "c"},
+		"level": 0,
+		"extra": 1,
+	})
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 6 {
+		t.Errorf("should have 6 errors: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package kii
 import (
 	"fmt"
 	"testing"
-	"time"
 
 	dproxy "github.com/koron/go-dproxy"
 )
@@ -25,7 +24,7 @@ type AirConditonerState struct {
 
 func RegisterATraitEnabledEndNode(author *APIAuthor) (endNodeID string, error error) {
 
-	VendorThingID := fmt.Sprintf("dummyID%d", time.Now().UnixNano())
+	VendorThingID := uniqueID("dummyID")
 	requestObj := RegisterThingRequest{
 		VendorThingID:   VendorThingID,
 		ThingPassword:   "dummyPass",
@@ -41,6 +40,7 @@ func RegisterATraitEnabledEndNode(author *APIAuthor) (endNodeID string, error er
 }
 
 func TestOnboadWithFirmwareVersion(t *testing.T) {
+	defer useCassette(t)()
 	// get a login user
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
@@ -62,7 +62,7 @@ func TestOnboadWithFirmwareVersion(t *testing.T) {
 		t.Errorf("fail to onboard gateway by login user:%s", err)
 	}
 
-	endnodeThingID := fmt.Sprintf("dummyID%d", time.Now().UnixNano())
+	endnodeThingID := uniqueID("dummyID")
 	owgrep := OnboardEndnodeWithGatewayThingIDRequest{
 		GatewayThingID: *gwid,
 		OnboardEndnodeRequestCommon: OnboardEndnodeRequestCommon{
@@ -97,6 +97,7 @@ func TestOnboadWithFirmwareVersion(t *testing.T) {
 }
 
 func TestUpdateMultipleTraitStateSuccess(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -146,6 +147,7 @@ func TestUpdateMultipleTraitStateSuccess(t *testing.T) {
 }
 
 func TestUpdateMultipleTraitsStateFail(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -183,6 +185,7 @@ func TestUpdateMultipleTraitsStateFail(t *testing.T) {
 }
 
 func TestUpdateSingleTraitStateSuccess(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -231,6 +234,7 @@ func TestUpdateSingleTraitStateSuccess(t *testing.T) {
 }
 
 func TestUpdateSingleTraitsStateFail(t *testing.T) {
+	defer useCassette(t)()
 	au, gatewayID, err := GatewayOnboard()
 	if err != nil {
 		t.Errorf("got error on onboard gateway %s", err)
@@ -267,6 +271,7 @@ func TestUpdateSingleTraitsStateFail(t *testing.T) {
 }
 
 func TestPostTraitCommandSucceeded(t *testing.T) {
+	defer useCassette(t)()
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
 		t.Errorf("fail to get login user")
@@ -314,6 +319,7 @@ func TestPostTraitCommandSucceeded(t *testing.T) {
 }
 
 func TestPostTraitCommandFail(t *testing.T) {
+	defer useCassette(t)()
 	author := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -343,6 +349,7 @@ func TestPostTraitCommandFail(t *testing.T) {
 }
 
 func TestUpdateTraitCommandResultsSucceeded(t *testing.T) {
+	defer useCassette(t)()
 	author, userID, err := GetLoginKiiUser()
 	if err != nil {
 		t.Errorf("fail to get login user")
@@ -441,6 +448,7 @@ func TestUpdateTraitCommandResultsSucceeded(t *testing.T) {
 }
 
 func TestUpdateTraitCommandResultsFail(t *testing.T) {
+	defer useCassette(t)()
 	// endnode update Command results
 	endnodeAuthor := APIAuthor{
 		Token: "dummyToken",
@@ -6,6 +6,7 @@ import (
 )
 
 func TestQueryUserSuccess(t *testing.T) {
+	defer useCassette(t)()
 	// get admin token
 	admin, err := AdminLogin(testApp, clientID, clientSecret)
 	if err != nil {
@@ -142,6 +143,7 @@ func TestQueryUserSuccess(t *testing.T) {
 }
 
 func TestQueryUserFail(t *testing.T) {
+	defer useCassette(t)()
 	admin := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -159,6 +161,7 @@ func TestQueryUserFail(t *testing.T) {
 }
 
 func TestDeleteKiiUserSuccess(t *testing.T) {
+	defer useCassette(t)()
 	// get admin token
 	admin, err := AdminLogin(testApp, clientID, clientSecret)
 	if err != nil {
@@ -205,6 +208,7 @@ func TestDeleteKiiUserSuccess(t *testing.T) {
 }
 
 func TestDeleteKiiUserFail(t *testing.T) {
+	defer useCassette(t)()
 	admin := APIAuthor{
 		Token: "dummyToken",
 		App:   testApp,
@@ -2,8 +2,10 @@ package kii
 
 import (
 	"fmt"
+	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
+	"testing"
 	"time"
 )
 
@@ -11,25 +13,32 @@ var testApp App
 var clientID string
 var clientSecret string
 
+// envCassette switches tests using Kii Cloud to record exchanges to
+// testdata/cassettes with "record", or replay them without credentials with
+// "replay".  Record against an app without things and users of previous
+// recordings, because IDs are the same on every recording.
+const envCassette = "KIIGO_CASSETTE"
+
+var cassetteMode = os.Getenv(envCassette)
+
+// testName and testSeq make IDs of uniqueID in cassettes.
+var testName string
+var testSeq int
+
 func init() {
-	envName := "KIIGO_APP"
-	s, ok := os.LookupEnv(envName)
-	if !ok || s == "" {
-		fmt.Printf("failed to lookup environment value for %s", envName)
+	config, err := LoadConfig("")
+	if err != nil && cassetteMode == "replay" {
+		testApp = App{AppID: "replay", AppKey: "replay", Location: "replay.invalid"}
+		clientID, clientSecret = "replay", "replay"
 		return
 	}
-	ss := strings.SplitN(s, ":", 5)
-	if len(ss) != 5 {
-		fmt.Printf("invalid format of %s, it should be {SITE}:{APP_ID}:{APP_KEY}:{CLIENT_ID}:{CLIENT_SECRET}", envName)
+	if err != nil {
+		fmt.Printf("failed to load config: %s", err)
 		return
 	}
-	testApp = App{
-		Location: ss[0],
-		AppID:    ss[1],
-		AppKey:   ss[2],
-	}
-	clientID = ss[3]
-	clientSecret = ss[4]
+	testApp = config.App
+	clientID = config.ClientID
+	clientSecret = config.ClientSecret
 	// If you want to make log enabled, uncomment below line.
 	//Logger = log.New(os.Stderr, "", log.LstdFlags)
 }
@@ -63,7 +72,7 @@ func GatewayOnboard() (gateway *APIAuthor, gatewayID *string, error error) {
 
 func RegisterAnEndNode(author *APIAuthor) (endNodeID string, error error) {
 
-	VendorThingID := fmt.Sprintf("dummyID%d", time.Now().UnixNano())
+	VendorThingID := uniqueID("dummyID")
 	requestObj := RegisterThingRequest{
 		VendorThingID:  VendorThingID,
 		ThingPassword:  "dummyPass",
@@ -141,5 +150,58 @@ func OnboardAGateway(vid, password string) (gateway *APIAuthor, gatewayID *strin
 }
 
 func randString() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	return uniqueID("")
+}
+
+// uniqueID returns an ID of things, users and buckets created in Kii Cloud.
+// It is made of time, or of the test name in cassettes so that requests
+// are the same on replay.
+func uniqueID(prefix string) string {
+	testSeq++
+	if cassetteMode == "" {
+		return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s%s%d", prefix, testName, testSeq)
+}
+
+// useCassette records or replays exchanges of t with Kii Cloud by
+// envCassette.  t fails on replay when it has no cassette.  Call the
+// returned function at the end of t.
+func useCassette(t *testing.T) func() {
+	testName, testSeq = t.Name(), 0
+	var mode CassetteMode
+	switch cassetteMode {
+	case "":
+		return func() {}
+	case "record":
+		mode = CassetteRecord
+	case "replay":
+		mode = CassetteReplay
+	default:
+		t.Fatalf("%s should be record or replay: %q", envCassette, cassetteMode)
+	}
+	path := filepath.Join("testdata", "cassettes", t.Name()+".json")
+	c, err := NewCassette(path, mode)
+	if os.IsNotExist(err) {
+		t.Fatalf("no cassette %s, record it with %s=record", path, envCassette)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetHTTPClient(&http.Client{Transport: c})
+	return func() {
+		SetHTTPClient(nil)
+		if mode == CassetteReplay {
+			if u := c.Unmatched(); len(u) > 0 {
+				t.Errorf("requests not in cassette: %v", u)
+			}
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Save(); err != nil {
+			t.Errorf("failed to save cassette: %s", err)
+		}
+	}
 }